@@ -0,0 +1,88 @@
+package helpers
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Output formats picked from the Accept header, in order of preference when the client
+// weighs them equally. AVIF comes first since it is usually the smaller one.
+var negotiatedFormats = []struct {
+	mediaType string
+	format    string
+}{
+	{mediaType: "image/avif", format: "avif"},
+	{mediaType: "image/webp", format: "webp"},
+}
+
+// NegotiateFormat picks the output format from an Accept header, the enabled media type
+// with the highest q weight. Wildcards don't count since every client that sends image/*
+// would get AVIF, so anything without an explicit match falls back to WebP.
+func NegotiateFormat(accept string, enabled []string) string {
+	best, bestWeight := "webp", 0.0
+	for _, format := range negotiatedFormats {
+		if !slices.Contains(enabled, format.format) {
+			continue
+		}
+		weight := acceptWeight(accept, format.mediaType)
+		if weight > bestWeight {
+			best, bestWeight = format.format, weight
+		}
+	}
+	return best
+}
+
+// ParseFormatChain splits an f list like avif,webp,jpeg into its formats, in order of preference
+func ParseFormatChain(value string) ([]string, error) {
+	chain := []string{}
+	for _, format := range strings.Split(value, ",") {
+		format = strings.ToLower(strings.TrimSpace(format))
+		if !slices.Contains(OutputFormats, format) {
+			return nil, NewValidationError(ErrCodeInvalidFormat, "f", "f must be one of %s, or a comma separated list of them", strings.Join(OutputFormats, ", "))
+		}
+		chain = append(chain, format)
+	}
+	return chain, nil
+}
+
+// ResolveFormatChain picks the first format of the chain that the deployment encodes and the
+// Accept header lists. Every client decodes JPEG, so it needs no Accept entry, and as with
+// NegotiateFormat wildcards don't count. A chain nothing matches falls back to WebP, like a
+// negotiation without a match.
+func ResolveFormatChain(chain []string, accept string, enabled []string) string {
+	for _, format := range chain {
+		if !slices.Contains(enabled, format) {
+			continue
+		}
+		if format == "jpeg" || acceptWeight(accept, ContentType(format)) > 0 {
+			return format
+		}
+	}
+	return "webp"
+}
+
+// acceptWeight returns the q weight the Accept header gives the media type, 0 when it
+// isn't listed or was listed with an invalid weight
+func acceptWeight(accept string, mediaType string) float64 {
+	for _, mediaRange := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(mediaRange, ";")
+		if !strings.EqualFold(strings.TrimSpace(name), mediaType) {
+			continue
+		}
+		weight := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(param, "=")
+			if strings.TrimSpace(strings.ToLower(key)) != "q" {
+				continue
+			}
+			q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil || q < 0 || q > 1 {
+				return 0
+			}
+			weight = q
+		}
+		return weight
+	}
+	return 0
+}
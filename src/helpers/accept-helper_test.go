@@ -0,0 +1,79 @@
+package helpers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		name     string
+		accept   string
+		expected string
+	}{
+		{name: "Empty", accept: "", expected: "webp"},
+		{name: "Chrome", accept: "image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8", expected: "avif"},
+		{name: "WebP only", accept: "image/webp,*/*", expected: "webp"},
+		{name: "Wildcards only", accept: "image/*,*/*;q=0.8", expected: "webp"},
+		{name: "Unsupported only", accept: "image/png,image/jpeg", expected: "webp"},
+		{name: "Higher weight wins", accept: "image/avif;q=0.5,image/webp;q=0.9", expected: "webp"},
+		{name: "Equal weight prefers avif", accept: "image/webp;q=0.8, image/avif;q=0.8", expected: "avif"},
+		{name: "Refused avif", accept: "image/avif;q=0", expected: "webp"},
+		{name: "Case and spaces", accept: " Image/AVIF ; Q=0.7 ", expected: "avif"},
+		{name: "Invalid weight", accept: "image/avif;q=high,image/webp", expected: "webp"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, NegotiateFormat(tt.accept, OutputFormats))
+		})
+	}
+}
+
+func TestNegotiateFormat_Disabled(t *testing.T) {
+	assert.Equal(t, "webp", NegotiateFormat("image/avif,image/webp", []string{"webp", "jpeg"}))
+	assert.Equal(t, "webp", NegotiateFormat("image/avif", []string{"webp"}))
+}
+
+func TestParseFormatChain(t *testing.T) {
+	chain, err := ParseFormatChain("avif, WebP,jpeg")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"avif", "webp", "jpeg"}, chain)
+
+	for _, value := range []string{"avif,gif", "avif,,jpeg", "avif,"} {
+		_, err := ParseFormatChain(value)
+		var validationErr *ValidationError
+		if assert.ErrorAs(t, err, &validationErr, value) {
+			assert.Equal(t, ErrCodeInvalidFormat, validationErr.Code)
+			assert.Equal(t, "f", validationErr.Field)
+		}
+	}
+}
+
+func TestResolveFormatChain(t *testing.T) {
+	chrome := "image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8"
+	tests := []struct {
+		name     string
+		chain    []string
+		accept   string
+		enabled  []string
+		expected string
+	}{
+		{name: "First accepted", chain: []string{"avif", "webp", "jpeg"}, accept: chrome, enabled: OutputFormats, expected: "avif"},
+		{name: "Chain order beats weights", chain: []string{"webp", "avif"}, accept: "image/avif,image/webp;q=0.5", enabled: OutputFormats, expected: "webp"},
+		{name: "Skips what the client doesn't list", chain: []string{"avif", "webp", "jpeg"}, accept: "image/webp,*/*", enabled: OutputFormats, expected: "webp"},
+		{name: "JPEG needs no Accept entry", chain: []string{"avif", "webp", "jpeg"}, accept: "image/*,*/*;q=0.8", enabled: OutputFormats, expected: "jpeg"},
+		{name: "Refused weight", chain: []string{"avif", "jpeg"}, accept: "image/avif;q=0,image/webp", enabled: OutputFormats, expected: "jpeg"},
+		{name: "Skips what the deployment doesn't encode", chain: []string{"avif", "webp", "jpeg"}, accept: chrome, enabled: []string{"webp", "jpeg"}, expected: "webp"},
+		{name: "Disabled JPEG", chain: []string{"avif", "jpeg"}, accept: "image/webp", enabled: []string{"webp", "avif"}, expected: "webp"},
+		{name: "Nothing matches falls back to WebP", chain: []string{"avif", "webp"}, accept: "", enabled: OutputFormats, expected: "webp"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, ResolveFormatChain(tt.chain, tt.accept, tt.enabled))
+		})
+	}
+}
@@ -1,8 +1,14 @@
 package helpers
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
 	"net/url"
 	"slices"
@@ -17,10 +23,161 @@ type ParamsOptimize struct {
 	Width   int
 	Height  int
 	Quality int
+	Rotate  float64 // Manual rotation in degrees, applied after EXIF autorotate
+	Orient  string  // EXIF orientation handling (bake, preserve, normalize), empty is bake
+	Density int     // Rasterization DPI for vector sources (SVG), 0 uses the default
+	Dpr     float64 // Device pixel ratio multiplying w/h (1-3), folded into them by ValidateParams
+
+	// Encoder overrides, empty/0 picks a content-aware default
+	Format       string // Output format (OutputFormats), empty is webp
+	ContentAware bool   // f=auto: images classified as graphics are encoded as lossless WebP whatever the negotiated format
+	Preset       string // WebP preset (default, picture, photo, drawing, icon, text)
+	AlphaQuality int    // Alpha plane quality (1-100)
+	Optimization string // Encoder effort bundle (fast, balanced, max)
+
+	WithoutEnlargement bool   // Never scale beyond the source dimensions
+	Fit                string // How the image is sized to w/h (contain, cover, fill), empty is contain
+	Undersize          string // Contain policy for a source capped below both w and h (shrink-only, pad), empty is shrink-only
+	Gravity            string // Part of the image the ar and fit=cover crops keep (GravityModes), empty is center
+	Progressive        bool   // Progressive/interlaced output where the format supports it
+
+	// Border trimming, nil TrimColor and 0 TrimThreshold use the libvips defaults
+	Trim          bool
+	TrimColor     []float64 // Border color as RGB
+	TrimThreshold int       // Max difference from the border color (1-255)
+
+	Background []float64 // RGB fill for pixels introduced by arbitrary rotations, nil is transparent/black
+
+	AspectRatio float64 // Center crop to width/height before resizing, 0 keeps the source ratio
+
+	Pipeline []PipelineOp // Explicit operation order, replaces the implicit trim/rotate/crop/resize/sharpen steps
+
+	QualityCapped bool // Quality was lowered to MAX_QUALITY
+	Trusted       bool // Caller sent the TRUSTED_KEY, expensive encodes are not capped
+
+	Swatch bool // Output a solid image of the dominant color instead of the image
+
+	Thumbnail     bool    // House thumbnail style, expanded by ApplyThumbnail
+	Sharpen       float64 // Sharpen sigma at full downscale, scaled down with the resize factor
+	StripMetadata bool    // Drop EXIF/XMP/IPTC from the output, the ICC profile is kept
+
+	KeepMeta []string // Metadata namespaces kept in the output, the rest is stripped. nil leaves it to StripMetadata
+
+	Email bool // Email-safe bundle expanded by ApplyEmail, always encoded as an opaque JPEG
+
+	QuantTable string // JPEG quantization table preset (QuantTables), empty is the libjpeg default
+
+	UseEmbeddedThumb bool // Resize from the EXIF thumbnail of a JPEG when it covers the requested size
+	Lqip             bool // Also return a blurred few-pixel data URI of the output in X-LQIP
+
+	AutoSharpen string // Sharpen by output size bucket (SharpenLevels), replaces the Sharpen scaling
+
+	SourceFormat string `json:"-"` // Trusted hint of the source format (SourceFormatHints), skips the signature check. Output is the same, so kept out of the cache key
+	NoCache      bool   `json:"-"` // Trusted only: store=1 renders and writes again instead of returning the variant already stored, kept out of the variant key
+
+	RequestID string `json:"-"` // Correlates log lines, kept out of the cache key and ETag
 }
 
+// Output formats f may request, as libvips names them
+var OutputFormats = []string{"webp", "avif", "jpeg"}
+
+var WebpPresets = []string{"default", "picture", "photo", "drawing", "icon", "text"}
+var OptimizationLevels = []string{"fast", "balanced", "max"}
+var FitModes = []string{"contain", "cover", "fill"}
+var UndersizePolicies = []string{"shrink-only", "pad"}
+var GravityModes = []string{"center", "north", "south", "east", "west", "northeast", "northwest", "southeast", "southwest"}
+var OrientModes = []string{"bake", "preserve", "normalize"}
+var MetadataNamespaces = []string{"icc", "exif", "iptc", "xmp", "orientation"}
+
+// JPEG quantization table presets, in libvips quant_table index order. imagemagick is the
+// MozJPEG default, the non-default tables need libvips built with MozJPEG.
+var QuantTables = []string{"default", "flat", "msssim", "imagemagick", "psnr-hvs", "klein", "watson", "ahumada", "peterson"}
+
+// Formats src_fmt may hint, as libvips names them, so the decoded format can be checked against it
+var SourceFormatHints = []string{"jpeg", "png", "gif", "webp", "tiff", "heif"}
+
+// auto_sharpen levels, each scales the amount of the SHARPEN_BUCKETS mask
+var SharpenLevels = []string{"low", "medium", "high"}
+
+// Introspection modes gated by ENABLE_DEBUG_MODES, each returns source or optimizer details
+// instead of the image. info and diag are reserved so they can't ship ungated later
+var DebugModes = []string{"info", "debug", "diag", "size", "recommend", "validate", "preview_crop"}
+
+// Query params the handler reads, anything else is rejected under STRICT_PARAMS
+var KnownParams = slices.Concat([]string{
+	"url", "w", "h", "q", "rotate", "density", "aq", "preset", "optimize", "fit", "enlarge",
+	"trim", "trimthreshold", "trimcolor", "bg", "ar", "pipeline", "progressive", "thumbnail",
+	"swatch", "email", "undersize",
+	"use_embedded_thumb", "keep_meta", "lqip", "orient", "qtable", "store", "seed", "nocache",
+	"auto_sharpen", "src_fmt", "f", "keep_metadata", "dpr", "gravity",
+}, DebugModes)
+
 type ErrorResponse struct {
-	Error string `json:"error"`
+	Error ErrorDetail `json:"error"`
+}
+
+// ErrorDetail is the machine-readable error body, clients branch on Code
+type ErrorDetail struct {
+	Code    string `json:"code"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// Error codes returned in the error body
+const (
+	ErrCodeForbidden           = "FORBIDDEN"
+	ErrCodeNotFound            = "NOT_FOUND"
+	ErrCodeMissingParameter    = "MISSING_PARAMETER"
+	ErrCodeInvalidParameter    = "INVALID_PARAMETER"
+	ErrCodeUnknownParameter    = "UNKNOWN_PARAMETER"
+	ErrCodeInvalidUrl          = "INVALID_URL"
+	ErrCodeInvalidWidth        = "INVALID_WIDTH"
+	ErrCodeInvalidHeight       = "INVALID_HEIGHT"
+	ErrCodeInvalidQuality      = "INVALID_QUALITY"
+	ErrCodeInvalidRotate       = "INVALID_ROTATE"
+	ErrCodeInvalidOrient       = "INVALID_ORIENT"
+	ErrCodeInvalidDensity      = "INVALID_DENSITY"
+	ErrCodeInvalidDpr          = "INVALID_DPR"
+	ErrCodeInvalidPreset       = "INVALID_PRESET"
+	ErrCodeInvalidOptimization = "INVALID_OPTIMIZE"
+	ErrCodeInvalidAlphaQuality = "INVALID_ALPHA_QUALITY"
+	ErrCodeInvalidColor        = "INVALID_COLOR"
+	ErrCodeInvalidThreshold    = "INVALID_TRIM_THRESHOLD"
+	ErrCodeInvalidAspectRatio  = "INVALID_ASPECT_RATIO"
+	ErrCodeInvalidPipeline     = "INVALID_PIPELINE"
+	ErrCodeInvalidFit          = "INVALID_FIT"
+	ErrCodeInvalidUndersize    = "INVALID_UNDERSIZE"
+	ErrCodeInvalidGravity      = "INVALID_GRAVITY"
+	ErrCodeInvalidKeepMeta     = "INVALID_KEEP_META"
+	ErrCodeInvalidQuantTable   = "INVALID_QUANT_TABLE"
+	ErrCodeInvalidPreviewCrop  = "INVALID_PREVIEW_CROP"
+	ErrCodeInvalidAutoSharpen  = "INVALID_AUTO_SHARPEN"
+	ErrCodeInvalidSourceFormat = "INVALID_SOURCE_FORMAT"
+	ErrCodeInvalidFormat       = "INVALID_FORMAT"
+	ErrCodeInvalidSeed         = "INVALID_SEED"
+	ErrCodeTransparentSource   = "TRANSPARENT_SOURCE"
+	ErrCodeUpstream            = "UPSTREAM_ERROR"
+	ErrCodeNonImageContent     = "NON_IMAGE_CONTENT"
+	ErrCodeOriginNotAllowed    = "ORIGIN_NOT_ALLOWED"
+	ErrCodeUnsupportedMedia    = "UNSUPPORTED_MEDIA"
+	ErrCodeTimeout             = "UPSTREAM_TIMEOUT"
+	ErrCodeOverloaded          = "OVERLOADED"
+	ErrCodeInternal            = "INTERNAL_ERROR"
+)
+
+// ValidationError is a request error tied to a query parameter
+type ValidationError struct {
+	Code    string
+	Field   string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+func NewValidationError(code string, field string, format string, args ...any) *ValidationError {
+	return &ValidationError{Code: code, Field: field, Message: fmt.Sprintf(format, args...)}
 }
 
 func GetHeaders(headers map[string]string) map[string]string {
@@ -32,11 +189,60 @@ func GetHeaders(headers map[string]string) map[string]string {
 	return headerData
 }
 
-func ParseParams[T int | string](reqParams map[string]string, key string) (T, error) {
+// Media types of the libvips format names, for encoder output and passthrough sources
+var formatContentTypes = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"webp": "image/webp",
+	"avif": "image/avif",
+	"heif": "image/heif",
+	"gif":  "image/gif",
+	"tiff": "image/tiff",
+	"jxl":  "image/jxl",
+	"jp2k": "image/jp2",
+	"bmp":  "image/bmp",
+	"svg":  "image/svg+xml",
+	"pdf":  "application/pdf",
+}
+
+// ContentType returns the media type of a libvips format name, generic binary when unknown
+// (e.g. a passthrough format only the magick loader reads)
+func ContentType(format string) string {
+	if contentType, ok := formatContentTypes[strings.ToLower(format)]; ok {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// Header carrying the request ID, read from the request and echoed in the response
+const RequestIDHeader = "X-Request-Id"
+
+// Longest incoming request ID kept, anything longer is truncated
+const maxRequestIDLength = 128
+
+// RequestID returns the caller's X-Request-Id, sanitized, or a new UUID when absent.
+// Headers are expected lowercased as returned by GetHeaders.
+func RequestID(headers map[string]string) string {
+	if requestID := HeaderValue(headers[strings.ToLower(RequestIDHeader)], maxRequestIDLength); requestID != "" {
+		return requestID
+	}
+	return NewRequestID()
+}
+
+// NewRequestID generates a random (version 4) UUID
+func NewRequestID() string {
+	var uuid [16]byte
+	rand.Read(uuid[:])
+	uuid[6] = uuid[6]&0x0f | 0x40 // Version 4
+	uuid[8] = uuid[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16])
+}
+
+func ParseParams[T int | float64 | string | bool](reqParams map[string]string, key string) (T, error) {
 	var zero T
 	value, ok := reqParams[key]
 	if !ok {
-		return zero, fmt.Errorf("missing %s parameter", key)
+		return zero, NewValidationError(ErrCodeMissingParameter, key, "missing %s parameter", key)
 	}
 
 	switch any(zero).(type) {
@@ -44,7 +250,17 @@ func ParseParams[T int | string](reqParams map[string]string, key string) (T, er
 		if val, err := strconv.Atoi(value); err == nil {
 			return any(val).(T), nil
 		}
-		return zero, fmt.Errorf("invalid integer value for %s parameter", key)
+		return zero, NewValidationError(ErrCodeInvalidParameter, key, "invalid integer value for %s parameter", key)
+	case float64:
+		if val, err := strconv.ParseFloat(value, 64); err == nil && !math.IsNaN(val) && !math.IsInf(val, 0) {
+			return any(val).(T), nil
+		}
+		return zero, NewValidationError(ErrCodeInvalidParameter, key, "invalid number value for %s parameter", key)
+	case bool:
+		if val, err := strconv.ParseBool(value); err == nil {
+			return any(val).(T), nil
+		}
+		return zero, NewValidationError(ErrCodeInvalidParameter, key, "invalid boolean value for %s parameter", key)
 	default:
 		return any(value).(T), nil
 	}
@@ -55,8 +271,13 @@ func ErrResponse(err error, statusCode int) (events.APIGatewayProxyResponse, err
 	if statusCode == http.StatusForbidden {
 		cacheControl = "public, max-age=60, s-maxage=60"
 	}
+	if statusCode == http.StatusServiceUnavailable || statusCode == http.StatusInternalServerError {
+		// Shed load is transient, a retry may succeed right away, and our own failures are
+		// never shared with other clients
+		cacheControl = "no-store"
+	}
 	errorJSON, errJson := json.Marshal(ErrorResponse{
-		Error: err.Error(),
+		Error: errorDetail(err, statusCode),
 	})
 
 	if errJson != nil {
@@ -73,60 +294,588 @@ func ErrResponse(err error, statusCode int) (events.APIGatewayProxyResponse, err
 	}, nil
 }
 
+// ErrNonImageContent is returned when the origin answered with a success status but the
+// body isn't an image, like a 200 "not found" page, so misbehaving origins can be told
+// apart from failed fetches
+var ErrNonImageContent = errors.New("origin returned non-image content")
+
+// ErrUnsupportedMedia is returned for a source that looks like an image but can't be
+// decoded, e.g. a truncated file or a format libvips wasn't built with
+var ErrUnsupportedMedia = errors.New("unsupported media")
+
+// ErrOriginNotAllowed is returned by the optimizer for a source outside ALLOWED_ORIGINS or
+// ALLOWED_BUCKETS, whatever the caller checked before
+var ErrOriginNotAllowed = errors.New("origin not allowed")
+
+// Message of our own failures, their error can carry bucket names, S3 request IDs or libvips
+// internals, so it is only logged
+const internalErrorMessage = "internal error"
+
+// errorDetail uses the code and field of a ValidationError, falling back to a code derived from
+// the error or the status
+func errorDetail(err error, statusCode int) ErrorDetail {
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		return ErrorDetail{Code: validationErr.Code, Field: validationErr.Field, Message: validationErr.Message}
+	}
+	if statusCode == http.StatusInternalServerError {
+		return ErrorDetail{Code: ErrCodeInternal, Message: internalErrorMessage}
+	}
+
+	code := ErrCodeInternal
+	switch {
+	case errors.Is(err, ErrNonImageContent):
+		code = ErrCodeNonImageContent
+	case errors.Is(err, ErrOriginNotAllowed):
+		code = ErrCodeOriginNotAllowed
+	case errors.Is(err, ErrUnsupportedMedia):
+		code = ErrCodeUnsupportedMedia
+	case statusCode == http.StatusGatewayTimeout:
+		code = ErrCodeTimeout
+	case statusCode == http.StatusForbidden:
+		code = ErrCodeForbidden
+	case statusCode == http.StatusNotFound:
+		code = ErrCodeNotFound
+	case statusCode == http.StatusBadGateway:
+		code = ErrCodeUpstream
+	case statusCode == http.StatusServiceUnavailable:
+		code = ErrCodeOverloaded
+	case statusCode >= 400 && statusCode < 500:
+		code = ErrCodeInvalidParameter
+	}
+	return ErrorDetail{Code: code, Message: err.Error()}
+}
+
+// JSONResponse returns an uncached JSON response, used by the introspection modes
+func JSONResponse(body any, statusCode int) (events.APIGatewayProxyResponse, error) {
+	bodyJSON, err := json.Marshal(body)
+	if err != nil {
+		return ErrResponse(err, http.StatusInternalServerError)
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Body:       string(bodyJSON),
+		Headers: map[string]string{
+			"Content-Type":  "application/json",
+			"Cache-Control": "no-store",
+		},
+	}, nil
+}
+
+// RequestedDebugMode returns the first introspection mode switched on in the query
+// (mode=1), or an empty string
+func RequestedDebugMode(reqParams map[string]string) string {
+	for _, mode := range DebugModes {
+		if value, err := ParseParams[int](reqParams, mode); err == nil && value == 1 {
+			return mode
+		}
+	}
+	return ""
+}
+
+// UnknownParams returns the query params outside KnownParams, sorted so errors are stable
+func UnknownParams(reqParams map[string]string) []string {
+	unknown := []string{}
+	for key := range reqParams {
+		if !slices.Contains(KnownParams, key) {
+			unknown = append(unknown, key)
+		}
+	}
+	slices.Sort(unknown)
+	return unknown
+}
+
+// ValidatePresentParams rejects params sent with a value ValidateParams can't tell from
+// unset, like q=0 or dpr=0, which would otherwise be silently replaced by the default
+func ValidatePresentParams(reqParams map[string]string, params ParamsOptimize) error {
+	// Only an absent q gets DEFAULT_QUALITY
+	if _, ok := reqParams["q"]; ok && params.Quality < 1 {
+		return NewValidationError(ErrCodeInvalidQuality, "q", "quality must be between 1 and 100")
+	}
+	if _, ok := reqParams["dpr"]; ok && !validDpr(params.Dpr) {
+		return NewValidationError(ErrCodeInvalidDpr, "dpr", "dpr must be between 1 and 3")
+	}
+	return nil
+}
+
+// validDpr is written so NaN is rejected too
+func validDpr(dpr float64) bool {
+	return dpr >= 1 && dpr <= 3
+}
+
+// EffectiveDpr returns the device pixel ratio an output delivers in the CSS box of w/h, the
+// sizes before the dpr fold, and whether it fell short of the requested dpr (to 2 decimals).
+// A contain output is bounded by one axis, so its best axis counts, while cover and fill fill
+// the box, so their worst axis does. Without a box there is nothing to report.
+func EffectiveDpr(dpr float64, fit string, width int, height int, outputWidth int, outputHeight int) (float64, bool) {
+	ratios := []float64{}
+	if width > 0 {
+		ratios = append(ratios, float64(outputWidth)/float64(width))
+	}
+	if height > 0 {
+		ratios = append(ratios, float64(outputHeight)/float64(height))
+	}
+	if len(ratios) == 0 {
+		return 0, false
+	}
+	effective := slices.Max(ratios)
+	if fit == "cover" || fit == "fill" {
+		effective = slices.Min(ratios)
+	}
+	return effective, math.Round(effective*100) < math.Round(dpr*100)
+}
+
 func ValidateParams(params ParamsOptimize) (ParamsOptimize, error) {
 	appEnv := GetAppEnv()
-	imageParams := ParamsOptimize{
-		Url:     params.Url,
-		Width:   params.Width,
-		Height:  params.Height,
-		Quality: params.Quality,
+	imageParams := params
+	// 0 is an absent q (an explicit q=0 is rejected by ValidatePresentParams). Before the
+	// bundles, so the thumbnail quality floor applies to the default too
+	if imageParams.Quality == 0 {
+		imageParams.Quality = appEnv.DEFAULT_QUALITY
+	}
+	if imageParams.Email {
+		imageParams = ApplyEmail(imageParams)
+	}
+	if imageParams.Thumbnail {
+		imageParams = ApplyThumbnail(imageParams)
 	}
 
+	// The pipeline spells out every geometry step, mixing it with the implicit ones would be ambiguous
+	if len(imageParams.Pipeline) > 0 && (imageParams.Width > 0 || imageParams.Height > 0 || imageParams.Rotate != 0 ||
+		imageParams.Trim || imageParams.AspectRatio > 0 || imageParams.Thumbnail) {
+		return imageParams, NewValidationError(ErrCodeInvalidPipeline, "pipeline", "pipeline can't be combined with w, h, rotate, trim, ar or thumbnail")
+	}
 	if imageParams.Width < 0 || imageParams.Width > appEnv.MAX_WIDTH {
-		return imageParams, fmt.Errorf("width must be between 0 and %d", appEnv.MAX_WIDTH)
+		return imageParams, NewValidationError(ErrCodeInvalidWidth, "w", "width must be between 0 and %d", appEnv.MAX_WIDTH)
 	}
 	if imageParams.Height < 0 || imageParams.Height > appEnv.MAX_HEIGHT {
-		return imageParams, fmt.Errorf("height must be between 0 and %d", appEnv.MAX_HEIGHT)
+		return imageParams, NewValidationError(ErrCodeInvalidHeight, "h", "height must be between 0 and %d", appEnv.MAX_HEIGHT)
+	}
+	if imageParams.Dpr != 0 && !validDpr(imageParams.Dpr) {
+		return imageParams, NewValidationError(ErrCodeInvalidDpr, "dpr", "dpr must be between 1 and 3")
+	}
+	// 0 is an absent dpr (an explicit dpr=0 is rejected by ValidatePresentParams)
+	if imageParams.Dpr == 0 {
+		imageParams.Dpr = appEnv.DEFAULT_DPR
+	}
+	// w/h are CSS pixels under a dpr, the pixel size is clamped to the max instead of rejected.
+	// Both axes share the clamped factor so the requested ratio, and with it the cover/fill box,
+	// is kept. Folding it in lets w=800 and w=400&dpr=2 share a cache key.
+	if imageParams.Dpr != 0 {
+		factor := imageParams.Dpr
+		if imageParams.Width > 0 {
+			factor = min(factor, float64(appEnv.MAX_WIDTH)/float64(imageParams.Width))
+		}
+		if imageParams.Height > 0 {
+			factor = min(factor, float64(appEnv.MAX_HEIGHT)/float64(imageParams.Height))
+		}
+		if imageParams.Width > 0 {
+			imageParams.Width = min(int(math.Round(float64(imageParams.Width)*factor)), appEnv.MAX_WIDTH)
+		}
+		if imageParams.Height > 0 {
+			imageParams.Height = min(int(math.Round(float64(imageParams.Height)*factor)), appEnv.MAX_HEIGHT)
+		}
+		imageParams.Dpr = 0
+	}
+	// Dimension floors guard against degenerate outputs like w=1, 0 keeps the source size
+	if imageParams.Width > 0 && imageParams.Width < appEnv.MIN_WIDTH {
+		if appEnv.STRICT_VALIDATION {
+			return imageParams, NewValidationError(ErrCodeInvalidWidth, "w", "width must be at least %d", appEnv.MIN_WIDTH)
+		}
+		imageParams.Width = appEnv.MIN_WIDTH
+	}
+	if imageParams.Height > 0 && imageParams.Height < appEnv.MIN_HEIGHT {
+		if appEnv.STRICT_VALIDATION {
+			return imageParams, NewValidationError(ErrCodeInvalidHeight, "h", "height must be at least %d", appEnv.MIN_HEIGHT)
+		}
+		imageParams.Height = appEnv.MIN_HEIGHT
 	}
 	if imageParams.Quality < 0 || imageParams.Quality > 100 {
-		return imageParams, fmt.Errorf("quality must be between 0 and 100")
+		return imageParams, NewValidationError(ErrCodeInvalidQuality, "q", "quality must be between 1 and 100")
+	}
+	// Quality floor guards against clients accidentally over-compressing
+	if imageParams.Quality < appEnv.MIN_QUALITY {
+		if appEnv.STRICT_VALIDATION {
+			return imageParams, NewValidationError(ErrCodeInvalidQuality, "q", "quality must be at least %d", appEnv.MIN_QUALITY)
+		}
+		imageParams.Quality = appEnv.MIN_QUALITY
+	}
+	// Quality ceiling protects bandwidth from near-lossless q=100 requests, trusted callers may exceed it
+	if imageParams.Quality > appEnv.MAX_QUALITY && !imageParams.Trusted {
+		if appEnv.STRICT_VALIDATION {
+			return imageParams, NewValidationError(ErrCodeInvalidQuality, "q", "quality must be at most %d", appEnv.MAX_QUALITY)
+		}
+		imageParams.Quality = appEnv.MAX_QUALITY
+		imageParams.QualityCapped = true
+	}
+	if imageParams.Rotate < -360 || imageParams.Rotate > 360 {
+		return imageParams, NewValidationError(ErrCodeInvalidRotate, "rotate", "rotate must be between -360 and 360")
+	}
+	if imageParams.Orient != "" && !slices.Contains(OrientModes, imageParams.Orient) {
+		return imageParams, NewValidationError(ErrCodeInvalidOrient, "orient", "orient must be one of %s", strings.Join(OrientModes, ", "))
+	}
+	if imageParams.Density < 0 || imageParams.Density > 600 {
+		return imageParams, NewValidationError(ErrCodeInvalidDensity, "density", "density must be between 0 and 600")
+	}
+	if imageParams.Format != "" && !slices.Contains(appEnv.OUTPUT_FORMATS, imageParams.Format) {
+		return imageParams, NewValidationError(ErrCodeInvalidFormat, "f", "f must be one of %s", strings.Join(appEnv.OUTPUT_FORMATS, ", "))
+	}
+	// WebP is the default, negotiated or explicit it shares the cache key of no f at all
+	if imageParams.Format == "webp" {
+		imageParams.Format = ""
+	}
+	if imageParams.Preset != "" && !slices.Contains(WebpPresets, imageParams.Preset) {
+		return imageParams, NewValidationError(ErrCodeInvalidPreset, "preset", "preset must be one of %s", strings.Join(WebpPresets, ", "))
+	}
+	if imageParams.Optimization != "" && !slices.Contains(OptimizationLevels, imageParams.Optimization) {
+		return imageParams, NewValidationError(ErrCodeInvalidOptimization, "optimize", "optimize must be one of %s", strings.Join(OptimizationLevels, ", "))
+	}
+	// Max effort is CPU heavy, once a TRUSTED_KEY is configured only trusted callers get it
+	if imageParams.Optimization == "max" && appEnv.TRUSTED_KEY != "" && !imageParams.Trusted {
+		if appEnv.STRICT_VALIDATION {
+			return imageParams, NewValidationError(ErrCodeInvalidOptimization, "optimize", "optimize=max requires a trusted key")
+		}
+		imageParams.Optimization = "balanced"
+	}
+	if imageParams.Fit != "" && !slices.Contains(FitModes, imageParams.Fit) {
+		return imageParams, NewValidationError(ErrCodeInvalidFit, "fit", "fit must be one of %s", strings.Join(FitModes, ", "))
+	}
+	// Cover and fill size to the exact box, with a single dimension there is no box
+	if (imageParams.Fit == "cover" || imageParams.Fit == "fill") && (imageParams.Width == 0 || imageParams.Height == 0) {
+		return imageParams, NewValidationError(ErrCodeInvalidFit, "fit", "fit=%s requires both w and h", imageParams.Fit)
+	}
+	if imageParams.Undersize != "" && !slices.Contains(UndersizePolicies, imageParams.Undersize) {
+		return imageParams, NewValidationError(ErrCodeInvalidUndersize, "undersize", "undersize must be one of %s", strings.Join(UndersizePolicies, ", "))
+	}
+	// Padding letterboxes to the w/h box, which only exists in contain mode with both dimensions
+	if imageParams.Undersize == "pad" && (imageParams.Width == 0 || imageParams.Height == 0 || (imageParams.Fit != "" && imageParams.Fit != "contain")) {
+		return imageParams, NewValidationError(ErrCodeInvalidUndersize, "undersize", "undersize=pad requires both w and h with fit=contain")
+	}
+	if imageParams.Gravity != "" && !slices.Contains(GravityModes, imageParams.Gravity) {
+		return imageParams, NewValidationError(ErrCodeInvalidGravity, "gravity", "gravity must be one of %s", strings.Join(GravityModes, ", "))
+	}
+	// center is the default, normalized so both spellings share a cache key
+	if imageParams.Gravity == "center" {
+		imageParams.Gravity = ""
+	}
+	if imageParams.QuantTable != "" && !slices.Contains(QuantTables, imageParams.QuantTable) {
+		return imageParams, NewValidationError(ErrCodeInvalidQuantTable, "qtable", "qtable must be one of %s", strings.Join(QuantTables, ", "))
+	}
+	// Only trusted callers may skip the signature check, anyone else gets the full validation
+	if !imageParams.Trusted {
+		imageParams.SourceFormat = ""
+		imageParams.NoCache = false
+	}
+	if imageParams.SourceFormat != "" && !slices.Contains(SourceFormatHints, imageParams.SourceFormat) {
+		return imageParams, NewValidationError(ErrCodeInvalidSourceFormat, "src_fmt", "src_fmt must be one of %s", strings.Join(SourceFormatHints, ", "))
+	}
+	if imageParams.AutoSharpen != "" && !slices.Contains(SharpenLevels, imageParams.AutoSharpen) {
+		return imageParams, NewValidationError(ErrCodeInvalidAutoSharpen, "auto_sharpen", "auto_sharpen must be one of %s", strings.Join(SharpenLevels, ", "))
+	}
+	// A pipeline sharpens with its own sharpen operations
+	if imageParams.AutoSharpen != "" && len(imageParams.Pipeline) > 0 {
+		return imageParams, NewValidationError(ErrCodeInvalidAutoSharpen, "auto_sharpen", "auto_sharpen can't be combined with pipeline, use its sharpen operation")
+	}
+	if imageParams.AlphaQuality < 0 || imageParams.AlphaQuality > 100 {
+		return imageParams, NewValidationError(ErrCodeInvalidAlphaQuality, "aq", "alpha quality must be between 0 and 100")
+	}
+	if imageParams.TrimThreshold < 0 || imageParams.TrimThreshold > 255 {
+		return imageParams, NewValidationError(ErrCodeInvalidThreshold, "trimthreshold", "trim threshold must be between 0 and 255")
 	}
 
 	return imageParams, nil
 }
 
-func ValidateImage(params ParamsOptimize) (ParamsOptimize, error) {
+// ValidatePreviewCrop rejects the params whose crop can't be known from the source header
+// alone: trimming depends on the pixels, a pipeline crops at any step and a rotate by
+// other than a right angle grows the canvas
+func ValidatePreviewCrop(params ParamsOptimize) error {
+	if params.Trim || len(params.Pipeline) > 0 || math.Mod(params.Rotate, 90) != 0 {
+		return NewValidationError(ErrCodeInvalidPreviewCrop, "preview_crop", "preview_crop can't be combined with trim, pipeline or a rotate other than a right angle")
+	}
+	return nil
+}
+
+// ApplyThumbnail expands thumbnail=true into its components: no enlargement, a mild
+// sharpen scaled to the downscale factor, a quality floor and stripped metadata.
+// Each component is configured by the THUMBNAIL_* env vars.
+func ApplyThumbnail(params ParamsOptimize) ParamsOptimize {
+	appEnv := GetAppEnv()
+	imageParams := params
+
+	imageParams.WithoutEnlargement = true
+	imageParams.Sharpen = appEnv.THUMBNAIL_SHARPEN
+	if imageParams.Quality < appEnv.THUMBNAIL_MIN_QUALITY {
+		imageParams.Quality = appEnv.THUMBNAIL_MIN_QUALITY
+	}
+	imageParams.StripMetadata = appEnv.THUMBNAIL_STRIP_METADATA
+
+	return imageParams
+}
+
+// ApplyEmail expands email=1 into its components: a progressive JPEG flattened onto
+// the bg color (EMAIL_BACKGROUND by default) with stripped metadata, whatever else
+// was requested, since email clients handle WebP, AVIF and alpha poorly.
+func ApplyEmail(params ParamsOptimize) ParamsOptimize {
 	appEnv := GetAppEnv()
-	imageParams := ParamsOptimize{
-		Url:     params.Url,
-		Width:   params.Width,
-		Height:  params.Height,
-		Quality: params.Quality,
+	imageParams := params
+
+	imageParams.Progressive = true
+	imageParams.StripMetadata = true
+	if imageParams.Background == nil {
+		imageParams.Background = appEnv.EMAIL_BACKGROUND
 	}
 
+	return imageParams
+}
+
+func ValidateImage(params ParamsOptimize) (ParamsOptimize, error) {
+	appEnv := GetAppEnv()
+	imageParams := params
+
 	if imageParams.Width < 1 || imageParams.Width > appEnv.MAX_WIDTH {
-		return imageParams, fmt.Errorf("width must be between 1 and %d", appEnv.MAX_WIDTH)
+		return imageParams, NewValidationError(ErrCodeInvalidWidth, "w", "width must be between 1 and %d", appEnv.MAX_WIDTH)
 	}
 	if imageParams.Height < 1 || imageParams.Height > appEnv.MAX_HEIGHT {
-		return imageParams, fmt.Errorf("height must be between 1 and %d", appEnv.MAX_HEIGHT)
+		return imageParams, NewValidationError(ErrCodeInvalidHeight, "h", "height must be between 1 and %d", appEnv.MAX_HEIGHT)
 	}
 	if imageParams.Quality < 1 || imageParams.Quality > 100 {
-		return imageParams, fmt.Errorf("quality must be between 1 and 100")
+		return imageParams, NewValidationError(ErrCodeInvalidQuality, "q", "quality must be between 1 and 100")
 	}
 
 	return imageParams, nil
 }
 
+// ParseColor parses a hex color (RGB or RRGGBB, optional leading #) into RGB values
+func ParseColor(field string, value string) ([]float64, error) {
+	hex := strings.TrimPrefix(strings.TrimSpace(value), "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) != 6 {
+		return nil, NewValidationError(ErrCodeInvalidColor, field, "%s must be a hex color like ffffff", field)
+	}
+
+	color := make([]float64, 3)
+	for i := range color {
+		channel, err := strconv.ParseUint(hex[i*2:i*2+2], 16, 8)
+		if err != nil {
+			return nil, NewValidationError(ErrCodeInvalidColor, field, "%s must be a hex color like ffffff", field)
+		}
+		color[i] = float64(channel)
+	}
+	return color, nil
+}
+
+// Bounds on the aspect ratio, anything more extreme degenerates into a line of pixels
+const (
+	MinAspectRatio = 1.0 / 20
+	MaxAspectRatio = 20.0
+)
+
+// ParseAspectRatio parses a ratio like 4:3 or 1.91:1 into width/height
+func ParseAspectRatio(field string, value string) (float64, error) {
+	widthStr, heightStr, ok := strings.Cut(strings.TrimSpace(value), ":")
+	if !ok {
+		return 0, NewValidationError(ErrCodeInvalidAspectRatio, field, "%s must be a ratio like 4:3", field)
+	}
+	width, errWidth := strconv.ParseFloat(strings.TrimSpace(widthStr), 64)
+	height, errHeight := strconv.ParseFloat(strings.TrimSpace(heightStr), 64)
+	if errWidth != nil || errHeight != nil || !(width > 0) || !(height > 0) || math.IsInf(width, 0) || math.IsInf(height, 0) {
+		return 0, NewValidationError(ErrCodeInvalidAspectRatio, field, "%s must be a ratio like 4:3", field)
+	}
+
+	ratio := width / height
+	if ratio < MinAspectRatio || ratio > MaxAspectRatio {
+		return 0, NewValidationError(ErrCodeInvalidAspectRatio, field, "%s must be between 1:20 and 20:1", field)
+	}
+	return ratio, nil
+}
+
+// ParseKeepMeta parses a comma separated list of metadata namespaces to keep, returned in
+// the MetadataNamespaces order so equivalent lists share a cache key. An empty value is an
+// empty list, which strips everything.
+func ParseKeepMeta(field string, value string) ([]string, error) {
+	requested := []string{}
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if !slices.Contains(MetadataNamespaces, name) {
+			return nil, NewValidationError(ErrCodeInvalidKeepMeta, field, "%s must be a list of %s", field, strings.Join(MetadataNamespaces, ", "))
+		}
+		requested = append(requested, name)
+	}
+
+	namespaces := []string{}
+	for _, name := range MetadataNamespaces {
+		if slices.Contains(requested, name) {
+			namespaces = append(namespaces, name)
+		}
+	}
+	return namespaces, nil
+}
+
+// SeedRequest is the seed=1 body, each item holds the query params of one variant
+type SeedRequest struct {
+	Items []map[string]string `json:"items"`
+}
+
+// ParseSeedItems parses the seed=1 body into the query params of the variants to store,
+// at most maxItems of them. An item can't start a seed of its own.
+func ParseSeedItems(body string, maxItems int) ([]map[string]string, error) {
+	var request SeedRequest
+	if err := json.Unmarshal([]byte(body), &request); err != nil {
+		return nil, NewValidationError(ErrCodeInvalidSeed, "seed", `seed body must be {"items": [{"url": ..., "w": ...}, ...]}`)
+	}
+	if len(request.Items) == 0 {
+		return nil, NewValidationError(ErrCodeInvalidSeed, "seed", "seed needs at least one item")
+	}
+	if len(request.Items) > maxItems {
+		return nil, NewValidationError(ErrCodeInvalidSeed, "seed", "seed accepts at most %d items, got %d", maxItems, len(request.Items))
+	}
+	for i, item := range request.Items {
+		if _, ok := item["seed"]; ok {
+			return nil, NewValidationError(ErrCodeInvalidSeed, "seed", "seed item %d can't seed", i)
+		}
+	}
+	return request.Items, nil
+}
+
+// CacheKey serializes the normalized (validated) params, so equivalent requests share a key
+func CacheKey(params ParamsOptimize) string {
+	key, err := json.Marshal(params)
+	if err != nil {
+		return ""
+	}
+	return string(key)
+}
+
+// ETag builds a strong validator from the normalized params and the source content hash,
+// it only changes when the output could change
+func ETag(params ParamsOptimize, sourceHash string) string {
+	digest := sha256.Sum256([]byte(CacheKey(params) + "\n" + sourceHash))
+	return `"` + hex.EncodeToString(digest[:16]) + `"`
+}
+
+// VariantKey is the deterministic S3 key of a stored variant, a hash of the normalized
+// params under the prefix, so equivalent requests map to the same object
+func VariantKey(params ParamsOptimize, prefix string) string {
+	digest := sha256.Sum256([]byte(CacheKey(params)))
+	return prefix + hex.EncodeToString(digest[:])
+}
+
+// MatchesETag checks an If-None-Match header against the ETag, using the weak comparison
+// RFC 9110 requires for If-None-Match
+func MatchesETag(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// HeaderValue strips control characters so the value can't inject extra headers,
+// and truncates it to maxLen bytes (0 means no limit)
+func HeaderValue(value string, maxLen int) string {
+	value = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7F {
+			return -1
+		}
+		return r
+	}, value))
+	if maxLen > 0 && len(value) > maxLen {
+		value = strings.ToValidUTF8(value[:maxLen], "")
+	}
+	return value
+}
+
+// CacheControl builds a shared Cache-Control value for the given seconds, 0 disables caching.
+// The STALE_WHILE_REVALIDATE and STALE_IF_ERROR directives are added when configured.
+func CacheControl(seconds int) string {
+	if seconds <= 0 {
+		return "no-store"
+	}
+	appEnv := GetAppEnv()
+	maxAge := strconv.Itoa(seconds)
+	cacheControl := "public, max-age=" + maxAge + ", s-maxage=" + maxAge
+	if appEnv.STALE_WHILE_REVALIDATE > 0 {
+		cacheControl += ", stale-while-revalidate=" + strconv.Itoa(appEnv.STALE_WHILE_REVALIDATE)
+	}
+	if appEnv.STALE_IF_ERROR > 0 {
+		cacheControl += ", stale-if-error=" + strconv.Itoa(appEnv.STALE_IF_ERROR)
+	}
+	return cacheControl
+}
+
+// SizeHeaders reports the source and output sizes along with the compression ratio (source/output)
+func SizeHeaders(sourceBytes int, outputBytes int) map[string]string {
+	ratio := 0.0
+	if outputBytes > 0 {
+		ratio = float64(sourceBytes) / float64(outputBytes)
+	}
+
+	return map[string]string{
+		"X-Source-Bytes":      strconv.Itoa(sourceBytes),
+		"X-Output-Bytes":      strconv.Itoa(outputBytes),
+		"X-Compression-Ratio": strconv.FormatFloat(ratio, 'f', 2, 64),
+	}
+}
+
+// IsTrustedRequest checks the imgop-trusted-key header against TRUSTED_KEY,
+// nobody is trusted while TRUSTED_KEY is unset
+func IsTrustedRequest(reqHeaders map[string]string) bool {
+	appEnv := GetAppEnv()
+	trustedKey, ok := reqHeaders["imgop-trusted-key"]
+	if !ok || appEnv.TRUSTED_KEY == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(trustedKey), []byte(appEnv.TRUSTED_KEY)) == 1
+}
+
+// IsDataUrl checks if the url is an inline data: URL, which needs no origin check
+func IsDataUrl(urlParam string) bool {
+	return strings.HasPrefix(strings.ToLower(strings.TrimSpace(urlParam)), "data:")
+}
+
 func IsAllowedOrigin(urlParam string) bool {
 	appEnv := GetAppEnv()
 	parsedUrl, err := url.Parse(urlParam)
-	if err != nil {
+	if err != nil || IsS3Url(urlParam) {
+		// S3 sources are checked against ALLOWED_BUCKETS instead
 		return false
 	}
 
+	if appEnv.DEV_MODE {
+		// Local development, e.g. a file server on localhost, skips the allowlist
+		return (parsedUrl.Scheme == "http" || parsedUrl.Scheme == "https") && parsedUrl.Host != ""
+	}
+
 	origin := parsedUrl.Host
 	if slices.Contains(appEnv.ALLOWED_ORIGINS, origin) {
 		return true
 	}
 	return false
 }
+
+// IsS3Url checks if the url is an s3://bucket/key URI, read with the AWS SDK instead of HTTP
+func IsS3Url(urlParam string) bool {
+	return strings.HasPrefix(strings.ToLower(strings.TrimSpace(urlParam)), "s3://")
+}
+
+// IsAllowedBucket checks an s3://bucket/key URI against ALLOWED_BUCKETS
+func IsAllowedBucket(urlParam string) bool {
+	appEnv := GetAppEnv()
+	if !IsS3Url(urlParam) {
+		return false
+	}
+	parsedUrl, err := url.Parse(urlParam)
+	if err != nil || strings.TrimPrefix(parsedUrl.Path, "/") == "" {
+		return false
+	}
+	return slices.Contains(appEnv.ALLOWED_BUCKETS, parsedUrl.Host)
+}
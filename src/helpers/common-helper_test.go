@@ -0,0 +1,1613 @@
+package helpers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrResponse_CacheControl(t *testing.T) {
+	response, _ := ErrResponse(fmt.Errorf("bad"), http.StatusUnprocessableEntity)
+	assert.Equal(t, "public, max-age=259200, s-maxage=259200", response.Headers["Cache-Control"])
+	response, _ = ErrResponse(fmt.Errorf("forbidden"), http.StatusForbidden)
+	assert.Equal(t, "public, max-age=60, s-maxage=60", response.Headers["Cache-Control"])
+	response, _ = ErrResponse(fmt.Errorf("overloaded"), http.StatusServiceUnavailable)
+	assert.Equal(t, "no-store", response.Headers["Cache-Control"])
+	response, _ = ErrResponse(fmt.Errorf("boom"), http.StatusInternalServerError)
+	assert.Equal(t, "no-store", response.Headers["Cache-Control"])
+}
+
+func TestCacheControl(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		seconds  int
+		expected string
+	}{
+		{name: "One year", seconds: 31536000, expected: "public, max-age=31536000, s-maxage=31536000"},
+		{name: "Short", seconds: 30, expected: "public, max-age=30, s-maxage=30"},
+		{name: "Disabled", seconds: 0, expected: "no-store"},
+		{
+			name:     "Stale directives",
+			env:      map[string]string{"STALE_WHILE_REVALIDATE": "60", "STALE_IF_ERROR": "86400"},
+			seconds:  31536000,
+			expected: "public, max-age=31536000, s-maxage=31536000, stale-while-revalidate=60, stale-if-error=86400",
+		},
+		{
+			name:     "Stale if error only",
+			env:      map[string]string{"STALE_IF_ERROR": "3600"},
+			seconds:  30,
+			expected: "public, max-age=30, s-maxage=30, stale-if-error=3600",
+		},
+		{
+			name:     "No stale directives without caching",
+			env:      map[string]string{"STALE_WHILE_REVALIDATE": "60", "STALE_IF_ERROR": "86400"},
+			seconds:  0,
+			expected: "no-store",
+		},
+		{
+			name:     "Invalid values are omitted",
+			env:      map[string]string{"STALE_WHILE_REVALIDATE": "-1", "STALE_IF_ERROR": "soon"},
+			seconds:  30,
+			expected: "public, max-age=30, s-maxage=30",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SECRET_KEY", "test-imgop-key")
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			ResetAppEnvForTesting()
+			defer ResetAppEnvForTesting()
+
+			assert.Equal(t, tt.expected, CacheControl(tt.seconds))
+		})
+	}
+}
+
+func TestSizeHeaders(t *testing.T) {
+	tests := []struct {
+		name          string
+		sourceBytes   int
+		outputBytes   int
+		expectedRatio string
+	}{
+		{
+			name:          "smaller output",
+			sourceBytes:   102400,
+			outputBytes:   25600,
+			expectedRatio: "4.00",
+		},
+		{
+			name:          "larger output",
+			sourceBytes:   1000,
+			outputBytes:   3000,
+			expectedRatio: "0.33",
+		},
+		{
+			name:          "empty output avoids divide by zero",
+			sourceBytes:   1000,
+			outputBytes:   0,
+			expectedRatio: "0.00",
+		},
+		{
+			name:          "empty source and output",
+			sourceBytes:   0,
+			outputBytes:   0,
+			expectedRatio: "0.00",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := SizeHeaders(tt.sourceBytes, tt.outputBytes)
+			assert.Equal(t, tt.expectedRatio, headers["X-Compression-Ratio"])
+			assert.Equal(t, strconv.Itoa(tt.sourceBytes), headers["X-Source-Bytes"])
+			assert.Equal(t, strconv.Itoa(tt.outputBytes), headers["X-Output-Bytes"])
+		})
+	}
+}
+
+func TestValidateParams_Rotate(t *testing.T) {
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	ResetAppEnvForTesting()
+	defer ResetAppEnvForTesting()
+
+	tests := []struct {
+		name          string
+		rotate        float64
+		expectedError bool
+	}{
+		{name: "no rotation", rotate: 0, expectedError: false},
+		{name: "rotate 90", rotate: 90, expectedError: false},
+		{name: "rotate 180", rotate: 180, expectedError: false},
+		{name: "rotate 270", rotate: 270, expectedError: false},
+		{name: "deskew 3", rotate: 3, expectedError: false},
+		{name: "rotate 45.5", rotate: 45.5, expectedError: false},
+		{name: "rotate 360", rotate: 360, expectedError: false},
+		{name: "negative rotate", rotate: -90, expectedError: false},
+		{name: "above 360", rotate: 360.5, expectedError: true},
+		{name: "below -360", rotate: -720, expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ValidateParams(ParamsOptimize{Url: "https://test.com/a.jpg", Rotate: tt.rotate})
+			if tt.expectedError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestValidateParams_MaxQuality(t *testing.T) {
+	tests := []struct {
+		name             string
+		maxQuality       string
+		strict           string
+		quality          int
+		expectedQuality  int
+		expectedCapped   bool
+		expectedErrorMsg string
+	}{
+		{
+			name:            "default ceiling is a no-op",
+			quality:         100,
+			expectedQuality: 100,
+		},
+		{
+			name:            "clamps above ceiling",
+			maxQuality:      "85",
+			quality:         100,
+			expectedQuality: 85,
+			expectedCapped:  true,
+		},
+		{
+			name:            "keeps quality at ceiling",
+			maxQuality:      "85",
+			quality:         85,
+			expectedQuality: 85,
+		},
+		{
+			name:            "unset quality gets the default",
+			maxQuality:      "85",
+			quality:         0,
+			expectedQuality: 80,
+		},
+		{
+			name:            "default above the ceiling is clamped without capping",
+			maxQuality:      "70",
+			strict:          "true",
+			quality:         0,
+			expectedQuality: 70,
+		},
+		{
+			name:             "strict rejects above ceiling",
+			maxQuality:       "85",
+			strict:           "true",
+			quality:          90,
+			expectedErrorMsg: "quality must be at most 85",
+		},
+		{
+			name:            "invalid ceiling falls back to default",
+			maxQuality:      "0",
+			quality:         100,
+			expectedQuality: 100,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SECRET_KEY", "test-imgop-key")
+			t.Setenv("MAX_QUALITY", tt.maxQuality)
+			t.Setenv("STRICT_VALIDATION", tt.strict)
+			ResetAppEnvForTesting()
+			defer ResetAppEnvForTesting()
+
+			params, err := ValidateParams(ParamsOptimize{Url: "https://test.com/a.jpg", Quality: tt.quality})
+			if tt.expectedErrorMsg != "" {
+				assert.EqualError(t, err, tt.expectedErrorMsg)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedQuality, params.Quality)
+			assert.Equal(t, tt.expectedCapped, params.QualityCapped)
+		})
+	}
+}
+
+func TestValidateParams_DefaultQuality(t *testing.T) {
+	tests := []struct {
+		name            string
+		defaultQuality  string
+		params          ParamsOptimize
+		expectedQuality int
+	}{
+		{name: "url and w only", params: ParamsOptimize{Url: "https://test.com/a.jpg", Width: 400}, expectedQuality: 80},
+		{name: "url only", params: ParamsOptimize{Url: "https://test.com/a.jpg"}, expectedQuality: 80},
+		{name: "configured default", defaultQuality: "60", params: ParamsOptimize{Url: "https://test.com/a.jpg", Height: 300}, expectedQuality: 60},
+		{name: "q wins over the default", defaultQuality: "60", params: ParamsOptimize{Url: "https://test.com/a.jpg", Quality: 90}, expectedQuality: 90},
+		{name: "invalid default falls back to 80", defaultQuality: "0", params: ParamsOptimize{Url: "https://test.com/a.jpg"}, expectedQuality: 80},
+		{name: "thumbnail floor applies to the default", defaultQuality: "50", params: ParamsOptimize{Url: "https://test.com/a.jpg", Thumbnail: true}, expectedQuality: 70},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SECRET_KEY", "test-imgop-key")
+			t.Setenv("DEFAULT_QUALITY", tt.defaultQuality)
+			ResetAppEnvForTesting()
+			defer ResetAppEnvForTesting()
+
+			params, err := ValidateParams(tt.params)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedQuality, params.Quality)
+			assert.Equal(t, tt.params.Width, params.Width)
+			assert.Equal(t, tt.params.Height, params.Height)
+		})
+	}
+}
+
+func TestJSONResponse(t *testing.T) {
+	response, err := JSONResponse(map[string]int{"width": 200}, http.StatusOK)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.JSONEq(t, `{"width":200}`, response.Body)
+	assert.Equal(t, "application/json", response.Headers["Content-Type"])
+	assert.Equal(t, "no-store", response.Headers["Cache-Control"])
+}
+
+func TestValidateParams_MinQuality(t *testing.T) {
+	tests := []struct {
+		name             string
+		minQuality       string
+		strict           string
+		quality          int
+		expectedQuality  int
+		expectedErrorMsg string
+	}{
+		{
+			name:            "default floor keeps low quality",
+			quality:         5,
+			expectedQuality: 5,
+		},
+		{
+			name:            "clamps below floor",
+			minQuality:      "40",
+			quality:         5,
+			expectedQuality: 40,
+		},
+		{
+			name:            "keeps quality above floor",
+			minQuality:      "40",
+			quality:         80,
+			expectedQuality: 80,
+		},
+		{
+			name:            "unset quality gets the default",
+			minQuality:      "40",
+			quality:         0,
+			expectedQuality: 80,
+		},
+		{
+			name:            "default below the floor is raised",
+			minQuality:      "90",
+			strict:          "true",
+			quality:         0,
+			expectedQuality: 90,
+		},
+		{
+			name:             "strict rejects below floor",
+			minQuality:       "40",
+			strict:           "true",
+			quality:          5,
+			expectedErrorMsg: "quality must be at least 40",
+		},
+		{
+			name:            "strict accepts floor value",
+			minQuality:      "40",
+			strict:          "true",
+			quality:         40,
+			expectedQuality: 40,
+		},
+		{
+			name:            "invalid floor falls back to default",
+			minQuality:      "500",
+			quality:         5,
+			expectedQuality: 5,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SECRET_KEY", "test-imgop-key")
+			t.Setenv("MIN_QUALITY", tt.minQuality)
+			t.Setenv("STRICT_VALIDATION", tt.strict)
+			ResetAppEnvForTesting()
+			defer ResetAppEnvForTesting()
+
+			params, err := ValidateParams(ParamsOptimize{Url: "https://test.com/a.jpg", Quality: tt.quality})
+			if tt.expectedErrorMsg != "" {
+				assert.EqualError(t, err, tt.expectedErrorMsg)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedQuality, params.Quality)
+		})
+	}
+}
+
+func TestValidateParams_MinDimensions(t *testing.T) {
+	tests := []struct {
+		name             string
+		minWidth         string
+		minHeight        string
+		strict           string
+		width            int
+		height           int
+		expectedWidth    int
+		expectedHeight   int
+		expectedErrorMsg string
+	}{
+		{
+			name:           "default floor keeps tiny sizes",
+			width:          1,
+			height:         1,
+			expectedWidth:  1,
+			expectedHeight: 1,
+		},
+		{
+			name:           "clamps below floor",
+			minWidth:       "16",
+			minHeight:      "16",
+			width:          1,
+			height:         4,
+			expectedWidth:  16,
+			expectedHeight: 16,
+		},
+		{
+			name:           "keeps sizes above floor",
+			minWidth:       "16",
+			minHeight:      "16",
+			width:          400,
+			height:         300,
+			expectedWidth:  400,
+			expectedHeight: 300,
+		},
+		{
+			name:      "unset dimensions keep the source size",
+			minWidth:  "16",
+			minHeight: "16",
+		},
+		{
+			name:             "strict rejects width below floor",
+			minWidth:         "16",
+			strict:           "true",
+			width:            1,
+			expectedErrorMsg: "width must be at least 16",
+		},
+		{
+			name:             "strict rejects height below floor",
+			minHeight:        "16",
+			strict:           "true",
+			height:           1,
+			expectedErrorMsg: "height must be at least 16",
+		},
+		{
+			name:          "strict accepts floor value",
+			minWidth:      "16",
+			strict:        "true",
+			width:         16,
+			expectedWidth: 16,
+		},
+		{
+			name:          "floor above max falls back to default",
+			minWidth:      "5000",
+			width:         1,
+			expectedWidth: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SECRET_KEY", "test-imgop-key")
+			t.Setenv("MIN_WIDTH", tt.minWidth)
+			t.Setenv("MIN_HEIGHT", tt.minHeight)
+			t.Setenv("STRICT_VALIDATION", tt.strict)
+			ResetAppEnvForTesting()
+			defer ResetAppEnvForTesting()
+
+			params, err := ValidateParams(ParamsOptimize{Url: "https://test.com/a.jpg", Width: tt.width, Height: tt.height})
+			if tt.expectedErrorMsg != "" {
+				assert.EqualError(t, err, tt.expectedErrorMsg)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedWidth, params.Width)
+			assert.Equal(t, tt.expectedHeight, params.Height)
+		})
+	}
+}
+
+func TestValidateParams_Dpr(t *testing.T) {
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	ResetAppEnvForTesting()
+	defer ResetAppEnvForTesting()
+
+	tests := []struct {
+		name             string
+		params           ParamsOptimize
+		expectedWidth    int
+		expectedHeight   int
+		expectedErrorMsg string
+	}{
+		{name: "unset", params: ParamsOptimize{Width: 400, Height: 300}, expectedWidth: 400, expectedHeight: 300},
+		{name: "2x", params: ParamsOptimize{Width: 400, Height: 300, Dpr: 2}, expectedWidth: 800, expectedHeight: 600},
+		{name: "fractional rounds", params: ParamsOptimize{Width: 333, Dpr: 1.5}, expectedWidth: 500},
+		{name: "unset axis stays unset", params: ParamsOptimize{Height: 300, Dpr: 3}, expectedHeight: 900},
+		{name: "clamped to the max", params: ParamsOptimize{Width: 1000, Height: 700, Dpr: 3}, expectedWidth: 1800, expectedHeight: 1260},
+		{name: "clamped by the height", params: ParamsOptimize{Width: 500, Height: 1000, Dpr: 2.5}, expectedWidth: 900, expectedHeight: 1800},
+		{name: "below 1", params: ParamsOptimize{Width: 400, Dpr: 0.5}, expectedErrorMsg: "dpr must be between 1 and 3"},
+		{name: "above 3", params: ParamsOptimize{Width: 400, Dpr: 4}, expectedErrorMsg: "dpr must be between 1 and 3"},
+		{name: "NaN", params: ParamsOptimize{Width: 400, Dpr: math.NaN()}, expectedErrorMsg: "dpr must be between 1 and 3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, err := ValidateParams(tt.params)
+			if tt.expectedErrorMsg != "" {
+				var validationErr *ValidationError
+				if assert.ErrorAs(t, err, &validationErr) {
+					assert.Equal(t, ErrCodeInvalidDpr, validationErr.Code)
+					assert.Equal(t, tt.expectedErrorMsg, validationErr.Message)
+				}
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedWidth, params.Width)
+			assert.Equal(t, tt.expectedHeight, params.Height)
+			assert.Zero(t, params.Dpr, "dpr is folded into w/h")
+		})
+	}
+
+	// Same pixel size, same variant
+	folded, err := ValidateParams(ParamsOptimize{Url: "https://test.com/a.jpg", Width: 400, Dpr: 2})
+	assert.NoError(t, err)
+	plain, err := ValidateParams(ParamsOptimize{Url: "https://test.com/a.jpg", Width: 800})
+	assert.NoError(t, err)
+	assert.Equal(t, CacheKey(plain), CacheKey(folded))
+}
+
+func TestValidateParams_DefaultDpr(t *testing.T) {
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	t.Setenv("DEFAULT_DPR", "2")
+	ResetAppEnvForTesting()
+	defer ResetAppEnvForTesting()
+
+	tests := []struct {
+		name           string
+		params         ParamsOptimize
+		expectedWidth  int
+		expectedHeight int
+	}{
+		{name: "omitted dpr applies the default", params: ParamsOptimize{Width: 400, Height: 300}, expectedWidth: 800, expectedHeight: 600},
+		{name: "request dpr overrides it", params: ParamsOptimize{Width: 400, Height: 300, Dpr: 1}, expectedWidth: 400, expectedHeight: 300},
+		{name: "request dpr above it", params: ParamsOptimize{Width: 400, Dpr: 3}, expectedWidth: 1200},
+		{name: "clamped to the max like a request dpr", params: ParamsOptimize{Width: 1200, Height: 600}, expectedWidth: 1800, expectedHeight: 900},
+		{name: "no size keeps the source size", params: ParamsOptimize{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, err := ValidateParams(tt.params)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedWidth, params.Width)
+			assert.Equal(t, tt.expectedHeight, params.Height)
+		})
+	}
+}
+
+func TestEffectiveDpr(t *testing.T) {
+	tests := []struct {
+		name                      string
+		dpr                       float64
+		fit                       string
+		width, height             int
+		outputWidth, outputHeight int
+		expected                  float64
+		expectedCapped            bool
+	}{
+		{name: "Full dpr", dpr: 2, width: 400, outputWidth: 800, outputHeight: 533, expected: 2},
+		{name: "Capped by the source", dpr: 3, width: 800, outputWidth: 1500, outputHeight: 1000, expected: 1.875, expectedCapped: true},
+		{name: "Height only", dpr: 2, height: 300, outputWidth: 900, outputHeight: 450, expected: 1.5, expectedCapped: true},
+		{name: "Contain counts the bounding axis", dpr: 2, width: 800, height: 800, outputWidth: 1600, outputHeight: 800, expected: 2},
+		{name: "Cover counts the worst axis", dpr: 2, fit: "cover", width: 800, height: 600, outputWidth: 1500, outputHeight: 1000, expected: 1.6667, expectedCapped: true},
+		{name: "Fill counts the worst axis", dpr: 2, fit: "fill", width: 800, height: 600, outputWidth: 1600, outputHeight: 1000, expected: 1.6667, expectedCapped: true},
+		{name: "Rounding of the fold is not a cap", dpr: 1.5, width: 333, outputWidth: 500, outputHeight: 300, expected: 1.5015},
+		{name: "No box", dpr: 2, outputWidth: 1500, outputHeight: 1000, expected: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			effective, capped := EffectiveDpr(tt.dpr, tt.fit, tt.width, tt.height, tt.outputWidth, tt.outputHeight)
+			assert.InDelta(t, tt.expected, effective, 0.0001)
+			assert.Equal(t, tt.expectedCapped, capped)
+		})
+	}
+}
+
+func TestValidatePresentParams(t *testing.T) {
+	tests := []struct {
+		name             string
+		reqParams        map[string]string
+		params           ParamsOptimize
+		expectedCode     string
+		expectedErrorMsg string
+	}{
+		{name: "absent q and dpr", reqParams: map[string]string{}, params: ParamsOptimize{}},
+		{name: "valid q", reqParams: map[string]string{"q": "75"}, params: ParamsOptimize{Quality: 75}},
+		{name: "explicit q=0", reqParams: map[string]string{"q": "0"}, params: ParamsOptimize{}, expectedCode: ErrCodeInvalidQuality, expectedErrorMsg: "quality must be between 1 and 100"},
+		{name: "negative q", reqParams: map[string]string{"q": "-5"}, params: ParamsOptimize{Quality: -5}, expectedCode: ErrCodeInvalidQuality, expectedErrorMsg: "quality must be between 1 and 100"},
+		{name: "valid dpr", reqParams: map[string]string{"dpr": "2"}, params: ParamsOptimize{Dpr: 2}},
+		{name: "explicit dpr=0", reqParams: map[string]string{"dpr": "0"}, params: ParamsOptimize{}, expectedCode: ErrCodeInvalidDpr, expectedErrorMsg: "dpr must be between 1 and 3"},
+		{name: "dpr above 3", reqParams: map[string]string{"dpr": "4"}, params: ParamsOptimize{Dpr: 4}, expectedCode: ErrCodeInvalidDpr, expectedErrorMsg: "dpr must be between 1 and 3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidatePresentParams(tt.reqParams, tt.params)
+			if tt.expectedErrorMsg == "" {
+				assert.NoError(t, err)
+				return
+			}
+			var validationErr *ValidationError
+			if assert.ErrorAs(t, err, &validationErr) {
+				assert.Equal(t, tt.expectedCode, validationErr.Code)
+				assert.Equal(t, tt.expectedErrorMsg, validationErr.Message)
+			}
+		})
+	}
+}
+
+func TestValidateParams_Gravity(t *testing.T) {
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	ResetAppEnvForTesting()
+	defer ResetAppEnvForTesting()
+
+	params, err := ValidateParams(ParamsOptimize{Width: 400, Height: 100, Fit: "cover", Gravity: "southwest"})
+	assert.NoError(t, err)
+	assert.Equal(t, "southwest", params.Gravity)
+
+	params, err = ValidateParams(ParamsOptimize{Width: 400, Height: 100, Fit: "cover", Gravity: "center"})
+	assert.NoError(t, err)
+	assert.Empty(t, params.Gravity, "center is the default")
+
+	_, err = ValidateParams(ParamsOptimize{Width: 400, Height: 100, Fit: "cover", Gravity: "top"})
+	var validationErr *ValidationError
+	if assert.ErrorAs(t, err, &validationErr) {
+		assert.Equal(t, ErrCodeInvalidGravity, validationErr.Code)
+		assert.Equal(t, "gravity", validationErr.Field)
+	}
+}
+
+func TestValidateParams_Fit(t *testing.T) {
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	ResetAppEnvForTesting()
+	defer ResetAppEnvForTesting()
+
+	tests := []struct {
+		name             string
+		params           ParamsOptimize
+		expectedErrorMsg string
+	}{
+		{name: "default", params: ParamsOptimize{Width: 400}},
+		{name: "contain", params: ParamsOptimize{Width: 400, Fit: "contain"}},
+		{name: "cover", params: ParamsOptimize{Width: 400, Height: 100, Fit: "cover"}},
+		{name: "cover needs both dimensions", params: ParamsOptimize{Height: 100, Fit: "cover"}, expectedErrorMsg: "fit=cover requires both w and h"},
+		{name: "fill", params: ParamsOptimize{Width: 400, Height: 100, Fit: "fill"}},
+		{name: "fill needs both dimensions", params: ParamsOptimize{Width: 400, Fit: "fill"}, expectedErrorMsg: "fit=fill requires both w and h"},
+		{name: "unknown", params: ParamsOptimize{Width: 400, Fit: "stretch"}, expectedErrorMsg: "fit must be one of contain, cover, fill"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ValidateParams(tt.params)
+			if tt.expectedErrorMsg != "" {
+				var validationErr *ValidationError
+				if assert.ErrorAs(t, err, &validationErr) {
+					assert.Equal(t, ErrCodeInvalidFit, validationErr.Code)
+					assert.Equal(t, tt.expectedErrorMsg, validationErr.Message)
+				}
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestValidateParams_Orient(t *testing.T) {
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	ResetAppEnvForTesting()
+	defer ResetAppEnvForTesting()
+
+	for _, orient := range []string{"", "bake", "preserve", "normalize"} {
+		_, err := ValidateParams(ParamsOptimize{Width: 400, Orient: orient})
+		assert.NoError(t, err, orient)
+	}
+
+	_, err := ValidateParams(ParamsOptimize{Width: 400, Orient: "flip"})
+	var validationErr *ValidationError
+	if assert.ErrorAs(t, err, &validationErr) {
+		assert.Equal(t, ErrCodeInvalidOrient, validationErr.Code)
+		assert.Equal(t, "orient must be one of bake, preserve, normalize", validationErr.Message)
+	}
+}
+
+func TestValidateParams_QuantTable(t *testing.T) {
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	ResetAppEnvForTesting()
+	defer ResetAppEnvForTesting()
+
+	for _, quantTable := range append([]string{""}, QuantTables...) {
+		_, err := ValidateParams(ParamsOptimize{Width: 400, Email: true, QuantTable: quantTable})
+		assert.NoError(t, err, quantTable)
+	}
+
+	_, err := ValidateParams(ParamsOptimize{Width: 400, Email: true, QuantTable: "mozjpeg"})
+	var validationErr *ValidationError
+	if assert.ErrorAs(t, err, &validationErr) {
+		assert.Equal(t, ErrCodeInvalidQuantTable, validationErr.Code)
+		assert.Equal(t, "qtable", validationErr.Field)
+	}
+}
+
+func TestValidatePreviewCrop(t *testing.T) {
+	tests := []struct {
+		name        string
+		params      ParamsOptimize
+		expectError bool
+	}{
+		{name: "Aspect ratio", params: ParamsOptimize{AspectRatio: 1.5}},
+		{name: "Right angle rotate", params: ParamsOptimize{AspectRatio: 1.5, Rotate: -270}},
+		{name: "Trim", params: ParamsOptimize{AspectRatio: 1.5, Trim: true}, expectError: true},
+		{name: "Pipeline", params: ParamsOptimize{Pipeline: []PipelineOp{{Op: PipelineCrop, Value: 1.5}}}, expectError: true},
+		{name: "Arbitrary rotate", params: ParamsOptimize{AspectRatio: 1.5, Rotate: 45}, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidatePreviewCrop(tt.params)
+			if !tt.expectError {
+				assert.NoError(t, err)
+				return
+			}
+			var validationErr *ValidationError
+			if assert.ErrorAs(t, err, &validationErr) {
+				assert.Equal(t, ErrCodeInvalidPreviewCrop, validationErr.Code)
+				assert.Equal(t, "preview_crop", validationErr.Field)
+			}
+		})
+	}
+}
+
+func TestValidateParams_AutoSharpen(t *testing.T) {
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	ResetAppEnvForTesting()
+	defer ResetAppEnvForTesting()
+
+	for _, level := range append([]string{""}, SharpenLevels...) {
+		_, err := ValidateParams(ParamsOptimize{Width: 400, AutoSharpen: level})
+		assert.NoError(t, err, level)
+	}
+
+	tests := []struct {
+		name             string
+		params           ParamsOptimize
+		expectedErrorMsg string
+	}{
+		{name: "unknown level", params: ParamsOptimize{Width: 400, AutoSharpen: "max"}, expectedErrorMsg: "auto_sharpen must be one of low, medium, high"},
+		{name: "with pipeline", params: ParamsOptimize{AutoSharpen: "high", Pipeline: []PipelineOp{{Op: PipelineResize, Width: 400}}}, expectedErrorMsg: "auto_sharpen can't be combined with pipeline"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ValidateParams(tt.params)
+			var validationErr *ValidationError
+			if assert.ErrorAs(t, err, &validationErr) {
+				assert.Equal(t, ErrCodeInvalidAutoSharpen, validationErr.Code)
+				assert.Contains(t, validationErr.Error(), tt.expectedErrorMsg)
+			}
+		})
+	}
+}
+
+func TestValidateParams_Undersize(t *testing.T) {
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	ResetAppEnvForTesting()
+	defer ResetAppEnvForTesting()
+
+	tests := []struct {
+		name             string
+		params           ParamsOptimize
+		expectedErrorMsg string
+	}{
+		{name: "default", params: ParamsOptimize{Width: 400, Height: 300}},
+		{name: "shrink-only", params: ParamsOptimize{Width: 400, Undersize: "shrink-only"}},
+		{name: "pad", params: ParamsOptimize{Width: 400, Height: 300, Undersize: "pad"}},
+		{name: "pad needs both dimensions", params: ParamsOptimize{Width: 400, Undersize: "pad"}, expectedErrorMsg: "undersize=pad requires both w and h with fit=contain"},
+		{name: "pad needs contain", params: ParamsOptimize{Width: 400, Height: 300, Fit: "fill", Undersize: "pad"}, expectedErrorMsg: "undersize=pad requires both w and h with fit=contain"},
+		{name: "pad with cover", params: ParamsOptimize{Width: 400, Height: 300, Fit: "cover", Undersize: "pad"}, expectedErrorMsg: "undersize=pad requires both w and h with fit=contain"},
+		{name: "unknown", params: ParamsOptimize{Width: 400, Height: 300, Undersize: "grow"}, expectedErrorMsg: "undersize must be one of shrink-only, pad"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ValidateParams(tt.params)
+			if tt.expectedErrorMsg != "" {
+				var validationErr *ValidationError
+				if assert.ErrorAs(t, err, &validationErr) {
+					assert.Equal(t, ErrCodeInvalidUndersize, validationErr.Code)
+					assert.Equal(t, tt.expectedErrorMsg, validationErr.Message)
+				}
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestValidateParams_Optimization(t *testing.T) {
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	ResetAppEnvForTesting()
+	defer ResetAppEnvForTesting()
+
+	for _, level := range []string{"", "fast", "balanced", "max"} {
+		_, err := ValidateParams(ParamsOptimize{Url: "https://test.com/a.jpg", Optimization: level})
+		assert.NoError(t, err, "level %q should be valid", level)
+	}
+
+	_, err := ValidateParams(ParamsOptimize{Url: "https://test.com/a.jpg", Optimization: "ultra"})
+	assert.EqualError(t, err, "optimize must be one of fast, balanced, max")
+}
+
+func TestParseParams_Bool(t *testing.T) {
+	params := map[string]string{"yes": "true", "one": "1", "no": "false", "bad": "maybe"}
+
+	value, err := ParseParams[bool](params, "yes")
+	assert.NoError(t, err)
+	assert.True(t, value)
+
+	value, err = ParseParams[bool](params, "one")
+	assert.NoError(t, err)
+	assert.True(t, value)
+
+	value, err = ParseParams[bool](params, "no")
+	assert.NoError(t, err)
+	assert.False(t, value)
+
+	_, err = ParseParams[bool](params, "bad")
+	assert.EqualError(t, err, "invalid boolean value for bad parameter")
+
+	_, err = ParseParams[bool](params, "missing")
+	assert.EqualError(t, err, "missing missing parameter")
+}
+
+func TestIsDataUrl(t *testing.T) {
+	assert.True(t, IsDataUrl("data:image/png;base64,AAAA"))
+	assert.True(t, IsDataUrl("DATA:image/png;base64,AAAA"))
+	assert.False(t, IsDataUrl("https://test.com/data:image.png"))
+	assert.False(t, IsDataUrl(""))
+}
+
+func TestIsAllowedBucket(t *testing.T) {
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	t.Setenv("ALLOWED_ORIGINS", "private-assets")
+	t.Setenv("ALLOWED_BUCKETS", "private-assets, media")
+	ResetAppEnvForTesting()
+	defer ResetAppEnvForTesting()
+
+	tests := []struct {
+		name          string
+		url           string
+		allowedBucket bool
+		allowedOrigin bool
+	}{
+		{name: "Listed bucket", url: "s3://private-assets/photos/a.jpg", allowedBucket: true},
+		{name: "Second bucket", url: "S3://media/a.jpg", allowedBucket: true},
+		{name: "Unlisted bucket", url: "s3://other/a.jpg"},
+		{name: "Missing key", url: "s3://media/"},
+		{name: "HTTP url is not a bucket", url: "https://media/a.jpg"},
+		{name: "HTTP url on an origin", url: "https://private-assets/a.jpg", allowedOrigin: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.allowedBucket, IsAllowedBucket(tt.url))
+			assert.Equal(t, tt.allowedOrigin, IsAllowedOrigin(tt.url))
+		})
+	}
+}
+
+func TestRequestedDebugMode(t *testing.T) {
+	tests := []struct {
+		name     string
+		params   map[string]string
+		expected string
+	}{
+		{name: "No mode", params: map[string]string{"w": "100"}, expected: ""},
+		{name: "Debug", params: map[string]string{"debug": "1"}, expected: "debug"},
+		{name: "Size", params: map[string]string{"size": "1"}, expected: "size"},
+		{name: "Info", params: map[string]string{"info": "1"}, expected: "info"},
+		{name: "Diag", params: map[string]string{"diag": "1"}, expected: "diag"},
+		{name: "Recommend", params: map[string]string{"recommend": "1"}, expected: "recommend"},
+		{name: "Validate", params: map[string]string{"validate": "1"}, expected: "validate"},
+		{name: "Preview crop", params: map[string]string{"preview_crop": "1"}, expected: "preview_crop"},
+		{name: "Switched off", params: map[string]string{"debug": "0", "size": "0"}, expected: ""},
+		{name: "Not a number", params: map[string]string{"debug": "true"}, expected: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, RequestedDebugMode(tt.params))
+		})
+	}
+}
+
+func TestUnknownParams(t *testing.T) {
+	tests := []struct {
+		name     string
+		params   map[string]string
+		expected []string
+	}{
+		{name: "Known params", params: map[string]string{"url": "https://test.com/a.jpg", "w": "800", "q": "80", "debug": "1"}, expected: []string{}},
+		{name: "Typo", params: map[string]string{"url": "https://test.com/a.jpg", "widht": "800"}, expected: []string{"widht"}},
+		{name: "Sorted", params: map[string]string{"hieght": "1", "widht": "1", "w": "1"}, expected: []string{"hieght", "widht"}},
+		{name: "Case sensitive", params: map[string]string{"W": "800"}, expected: []string{"W"}},
+		{name: "No params", params: nil, expected: []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, UnknownParams(tt.params))
+		})
+	}
+}
+
+func TestIsAllowedOrigin_DevMode(t *testing.T) {
+	tests := []struct {
+		name     string
+		devMode  string
+		url      string
+		expected bool
+	}{
+		{name: "Listed origin", url: "https://yoursite.com/a.jpg", expected: true},
+		{name: "Localhost blocked by default", url: "http://localhost:8080/a.jpg", expected: false},
+		{name: "Localhost in dev mode", devMode: "true", url: "http://localhost:8080/a.jpg", expected: true},
+		{name: "Any host in dev mode", devMode: "true", url: "https://other.com/a.jpg", expected: true},
+		{name: "Non http scheme in dev mode", devMode: "true", url: "file:///etc/passwd", expected: false},
+		{name: "S3 in dev mode", devMode: "true", url: "s3://bucket/a.jpg", expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SECRET_KEY", "test-imgop-key")
+			t.Setenv("ALLOWED_ORIGINS", "yoursite.com")
+			t.Setenv("DEV_MODE", tt.devMode)
+			ResetAppEnvForTesting()
+			defer ResetAppEnvForTesting()
+
+			assert.Equal(t, tt.expected, IsAllowedOrigin(tt.url))
+		})
+	}
+}
+
+func TestErrResponse(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		statusCode int
+		expected   string
+	}{
+		{
+			name:       "Validation error",
+			err:        NewValidationError(ErrCodeInvalidQuality, "q", "quality must be between 1 and 100"),
+			statusCode: http.StatusUnprocessableEntity,
+			expected:   `{"error":{"code":"INVALID_QUALITY","field":"q","message":"quality must be between 1 and 100"}}`,
+		},
+		{
+			name:       "Wrapped validation error",
+			err:        fmt.Errorf("bad request: %w", NewValidationError(ErrCodeMissingParameter, "url", "missing url parameter")),
+			statusCode: http.StatusUnprocessableEntity,
+			expected:   `{"error":{"code":"MISSING_PARAMETER","field":"url","message":"missing url parameter"}}`,
+		},
+		{
+			name:       "Forbidden",
+			err:        fmt.Errorf("Forbidden, secret key is incorrect"),
+			statusCode: http.StatusForbidden,
+			expected:   `{"error":{"code":"FORBIDDEN","message":"Forbidden, secret key is incorrect"}}`,
+		},
+		{
+			name:       "Not found",
+			err:        fmt.Errorf("not found"),
+			statusCode: http.StatusNotFound,
+			expected:   `{"error":{"code":"NOT_FOUND","message":"not found"}}`,
+		},
+		{
+			name:       "Upstream",
+			err:        fmt.Errorf("unexpected origin status: 500"),
+			statusCode: http.StatusBadGateway,
+			expected:   `{"error":{"code":"UPSTREAM_ERROR","message":"unexpected origin status: 500"}}`,
+		},
+		{
+			name:       "Non-image content",
+			err:        fmt.Errorf("%w: invalid content type: text/html", ErrNonImageContent),
+			statusCode: http.StatusBadGateway,
+			expected:   `{"error":{"code":"NON_IMAGE_CONTENT","message":"origin returned non-image content: invalid content type: text/html"}}`,
+		},
+		{
+			name:       "Origin not allowed",
+			err:        fmt.Errorf("%w: evil.com", ErrOriginNotAllowed),
+			statusCode: http.StatusForbidden,
+			expected:   `{"error":{"code":"ORIGIN_NOT_ALLOWED","message":"origin not allowed: evil.com"}}`,
+		},
+		{
+			name:       "Unsupported media",
+			err:        fmt.Errorf("%w: %w", ErrUnsupportedMedia, fmt.Errorf("VipsForeignLoad: buffer is not in a known format")),
+			statusCode: http.StatusUnsupportedMediaType,
+			expected:   `{"error":{"code":"UNSUPPORTED_MEDIA","message":"unsupported media: VipsForeignLoad: buffer is not in a known format"}}`,
+		},
+		{
+			name:       "Upstream timeout",
+			err:        fmt.Errorf("context deadline exceeded"),
+			statusCode: http.StatusGatewayTimeout,
+			expected:   `{"error":{"code":"UPSTREAM_TIMEOUT","message":"context deadline exceeded"}}`,
+		},
+		{
+			name:       "Overloaded",
+			err:        fmt.Errorf("too many requests in flight"),
+			statusCode: http.StatusServiceUnavailable,
+			expected:   `{"error":{"code":"OVERLOADED","message":"too many requests in flight"}}`,
+		},
+		{
+			name:       "Internal hides the error",
+			err:        fmt.Errorf("failed to store variant: AccessDenied: bucket variants, request id 4442587FB7D0A2F9"),
+			statusCode: http.StatusInternalServerError,
+			expected:   `{"error":{"code":"INTERNAL_ERROR","message":"internal error"}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := ErrResponse(tt.err, tt.statusCode)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.statusCode, response.StatusCode)
+			assert.JSONEq(t, tt.expected, response.Body)
+			assert.Equal(t, "application/json", response.Headers["Content-Type"])
+		})
+	}
+}
+
+func TestValidateParams_ErrorCodes(t *testing.T) {
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	ResetAppEnvForTesting()
+	defer ResetAppEnvForTesting()
+
+	tests := []struct {
+		name   string
+		params ParamsOptimize
+		code   string
+		field  string
+	}{
+		{name: "Width", params: ParamsOptimize{Width: -1}, code: ErrCodeInvalidWidth, field: "w"},
+		{name: "Height", params: ParamsOptimize{Height: 99999}, code: ErrCodeInvalidHeight, field: "h"},
+		{name: "Quality", params: ParamsOptimize{Quality: 101}, code: ErrCodeInvalidQuality, field: "q"},
+		{name: "Rotate", params: ParamsOptimize{Rotate: 400}, code: ErrCodeInvalidRotate, field: "rotate"},
+		{name: "Density", params: ParamsOptimize{Density: 601}, code: ErrCodeInvalidDensity, field: "density"},
+		{name: "Preset", params: ParamsOptimize{Preset: "poster"}, code: ErrCodeInvalidPreset, field: "preset"},
+		{name: "Optimize", params: ParamsOptimize{Optimization: "ultra"}, code: ErrCodeInvalidOptimization, field: "optimize"},
+		{name: "Alpha quality", params: ParamsOptimize{AlphaQuality: 101}, code: ErrCodeInvalidAlphaQuality, field: "aq"},
+		{name: "Trim threshold", params: ParamsOptimize{TrimThreshold: 256}, code: ErrCodeInvalidThreshold, field: "trimthreshold"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ValidateParams(tt.params)
+			var validationErr *ValidationError
+			if assert.ErrorAs(t, err, &validationErr) {
+				assert.Equal(t, tt.code, validationErr.Code)
+				assert.Equal(t, tt.field, validationErr.Field)
+			}
+		})
+	}
+}
+
+func TestParseParams_Float(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		expected float64
+		wantErr  bool
+	}{
+		{name: "Integer", value: "90", expected: 90},
+		{name: "Fraction", value: "-3.5", expected: -3.5},
+		{name: "Not a number", value: "abc", wantErr: true},
+		{name: "NaN", value: "NaN", wantErr: true},
+		{name: "Infinity", value: "Inf", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, err := ParseParams[float64](map[string]string{"rotate": tt.value}, "rotate")
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, value)
+		})
+	}
+}
+
+func TestParseParams_ErrorCodes(t *testing.T) {
+	_, err := ParseParams[int](map[string]string{}, "w")
+	var validationErr *ValidationError
+	if assert.ErrorAs(t, err, &validationErr) {
+		assert.Equal(t, ErrCodeMissingParameter, validationErr.Code)
+		assert.Equal(t, "w", validationErr.Field)
+	}
+
+	_, err = ParseParams[int](map[string]string{"w": "abc"}, "w")
+	if assert.ErrorAs(t, err, &validationErr) {
+		assert.Equal(t, ErrCodeInvalidParameter, validationErr.Code)
+		assert.Equal(t, "w", validationErr.Field)
+	}
+}
+
+func TestParseColor(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		expected []float64
+		wantErr  bool
+	}{
+		{name: "Six digits", value: "f0ebde", expected: []float64{240, 235, 222}},
+		{name: "Leading hash", value: "#FFFFFF", expected: []float64{255, 255, 255}},
+		{name: "Three digits", value: "fa0", expected: []float64{255, 170, 0}},
+		{name: "Wrong length", value: "ffff", wantErr: true},
+		{name: "Not hex", value: "gggggg", wantErr: true},
+		{name: "Empty", value: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			color, err := ParseColor("trimcolor", tt.value)
+			if tt.wantErr {
+				var validationErr *ValidationError
+				if assert.ErrorAs(t, err, &validationErr) {
+					assert.Equal(t, ErrCodeInvalidColor, validationErr.Code)
+					assert.Equal(t, "trimcolor", validationErr.Field)
+				}
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, color)
+		})
+	}
+}
+
+func TestParseAspectRatio(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		expected float64
+		wantErr  bool
+	}{
+		{name: "Integers", value: "4:3", expected: 4.0 / 3},
+		{name: "Decimals", value: "1.91:1", expected: 1.91},
+		{name: "Portrait", value: "9:16", expected: 9.0 / 16},
+		{name: "Spaces", value: " 1 : 1 ", expected: 1},
+		{name: "No separator", value: "4x3", wantErr: true},
+		{name: "Zero", value: "4:0", wantErr: true},
+		{name: "Negative", value: "-4:3", wantErr: true},
+		{name: "Not a number", value: "a:b", wantErr: true},
+		{name: "Too wide", value: "21:1", wantErr: true},
+		{name: "Too tall", value: "1:21", wantErr: true},
+		{name: "Empty", value: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ratio, err := ParseAspectRatio("ar", tt.value)
+			if tt.wantErr {
+				var validationErr *ValidationError
+				if assert.ErrorAs(t, err, &validationErr) {
+					assert.Equal(t, ErrCodeInvalidAspectRatio, validationErr.Code)
+					assert.Equal(t, "ar", validationErr.Field)
+				}
+				return
+			}
+			assert.NoError(t, err)
+			assert.InDelta(t, tt.expected, ratio, 0.0001)
+		})
+	}
+}
+
+func TestParseKeepMeta(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		expected []string
+		wantErr  bool
+	}{
+		{name: "Single", value: "icc", expected: []string{"icc"}},
+		{name: "Canonical order", value: "orientation,xmp,exif", expected: []string{"exif", "xmp", "orientation"}},
+		{name: "Case and spaces", value: " EXIF , Iptc ", expected: []string{"exif", "iptc"}},
+		{name: "Duplicates", value: "icc,icc", expected: []string{"icc"}},
+		{name: "Empty strips everything", value: "", expected: []string{}},
+		{name: "Unknown namespace", value: "exif,gps", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			namespaces, err := ParseKeepMeta("keep_meta", tt.value)
+			if tt.wantErr {
+				var validationErr *ValidationError
+				if assert.ErrorAs(t, err, &validationErr) {
+					assert.Equal(t, ErrCodeInvalidKeepMeta, validationErr.Code)
+					assert.Equal(t, "keep_meta", validationErr.Field)
+				}
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, namespaces)
+		})
+	}
+}
+
+func TestApplyThumbnail(t *testing.T) {
+	tests := []struct {
+		name            string
+		env             map[string]string
+		quality         int
+		expectedQuality int
+		expectedSharpen float64
+		expectedStrip   bool
+	}{
+		{
+			name:            "Defaults raise quality to the floor",
+			quality:         40,
+			expectedQuality: 70,
+			expectedSharpen: 1.0,
+			expectedStrip:   true,
+		},
+		{
+			name:            "Unset quality gets the default above the floor",
+			quality:         0,
+			expectedQuality: 80,
+			expectedSharpen: 1.0,
+			expectedStrip:   true,
+		},
+		{
+			name:            "Quality above the floor is kept",
+			quality:         90,
+			expectedQuality: 90,
+			expectedSharpen: 1.0,
+			expectedStrip:   true,
+		},
+		{
+			name:            "Configured components",
+			env:             map[string]string{"THUMBNAIL_SHARPEN": "0.5", "THUMBNAIL_MIN_QUALITY": "60", "THUMBNAIL_STRIP_METADATA": "false"},
+			quality:         50,
+			expectedQuality: 60,
+			expectedSharpen: 0.5,
+			expectedStrip:   false,
+		},
+		{
+			name:            "Sharpen disabled",
+			env:             map[string]string{"THUMBNAIL_SHARPEN": "0"},
+			quality:         80,
+			expectedQuality: 80,
+			expectedSharpen: 0,
+			expectedStrip:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SECRET_KEY", "test-imgop-key")
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			ResetAppEnvForTesting()
+			defer ResetAppEnvForTesting()
+
+			params, err := ValidateParams(ParamsOptimize{Url: "https://test.com/a.jpg", Width: 200, Quality: tt.quality, Thumbnail: true})
+			assert.NoError(t, err)
+			assert.True(t, params.WithoutEnlargement)
+			assert.Equal(t, tt.expectedQuality, params.Quality)
+			assert.Equal(t, tt.expectedSharpen, params.Sharpen)
+			assert.Equal(t, tt.expectedStrip, params.StripMetadata)
+		})
+	}
+}
+
+func TestApplyEmail(t *testing.T) {
+	tests := []struct {
+		name               string
+		env                map[string]string
+		background         []float64
+		expectedBackground []float64
+	}{
+		{name: "Defaults to white", expectedBackground: []float64{255, 255, 255}},
+		{name: "Configured background", env: map[string]string{"EMAIL_BACKGROUND": "#f0f0f0"}, expectedBackground: []float64{240, 240, 240}},
+		{name: "Invalid background falls back to white", env: map[string]string{"EMAIL_BACKGROUND": "white"}, expectedBackground: []float64{255, 255, 255}},
+		{name: "bg param wins", env: map[string]string{"EMAIL_BACKGROUND": "f0f0f0"}, background: []float64{0, 0, 0}, expectedBackground: []float64{0, 0, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SECRET_KEY", "test-imgop-key")
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			ResetAppEnvForTesting()
+			defer ResetAppEnvForTesting()
+
+			params, err := ValidateParams(ParamsOptimize{Url: "https://test.com/a.jpg", Width: 200, Quality: 80, Background: tt.background, Email: true})
+			assert.NoError(t, err)
+			assert.True(t, params.Progressive)
+			assert.True(t, params.StripMetadata)
+			assert.Equal(t, tt.expectedBackground, params.Background)
+		})
+	}
+}
+
+func TestContentType(t *testing.T) {
+	tests := []struct {
+		format   string
+		expected string
+	}{
+		{format: "webp", expected: "image/webp"},
+		{format: "jpeg", expected: "image/jpeg"},
+		{format: "png", expected: "image/png"},
+		{format: "avif", expected: "image/avif"},
+		{format: "heif", expected: "image/heif"},
+		{format: "gif", expected: "image/gif"},
+		{format: "tiff", expected: "image/tiff"},
+		{format: "jp2k", expected: "image/jp2"},
+		{format: "svg", expected: "image/svg+xml"},
+		{format: "JPEG", expected: "image/jpeg"},
+		{format: "magick", expected: "application/octet-stream"},
+		{format: "", expected: "application/octet-stream"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			assert.Equal(t, tt.expected, ContentType(tt.format))
+		})
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	assert.Equal(t, "edge-123", RequestID(map[string]string{"x-request-id": "edge-123"}))
+	assert.NotContains(t, RequestID(map[string]string{"x-request-id": "edge-123\r\nX-Injected: 1"}), "\n")
+	assert.Len(t, RequestID(map[string]string{"x-request-id": strings.Repeat("a", 500)}), 128)
+
+	uuidPattern := `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`
+	generated := RequestID(map[string]string{})
+	assert.Regexp(t, uuidPattern, generated)
+	assert.Regexp(t, uuidPattern, RequestID(map[string]string{"x-request-id": "  "}))
+	assert.NotEqual(t, generated, NewRequestID())
+}
+
+func TestCacheKey_IgnoresRequestID(t *testing.T) {
+	params := ParamsOptimize{Url: "https://test.com/a.jpg", Width: 200, Quality: 80}
+	withID := params
+	withID.RequestID = "edge-123"
+	assert.Equal(t, CacheKey(params), CacheKey(withID))
+}
+
+func TestParseSeedItems(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected []map[string]string
+		wantErr  bool
+	}{
+		{name: "Items", body: `{"items":[{"url":"https://test.com/a.jpg","w":"400"},{"url":"https://test.com/b.jpg"}]}`,
+			expected: []map[string]string{{"url": "https://test.com/a.jpg", "w": "400"}, {"url": "https://test.com/b.jpg"}}},
+		{name: "At the cap", body: `{"items":[{"url":"a"},{"url":"b"},{"url":"c"}]}`,
+			expected: []map[string]string{{"url": "a"}, {"url": "b"}, {"url": "c"}}},
+		{name: "Over the cap", body: `{"items":[{"url":"a"},{"url":"b"},{"url":"c"},{"url":"d"}]}`, wantErr: true},
+		{name: "Empty", body: `{"items":[]}`, wantErr: true},
+		{name: "No body", body: "", wantErr: true},
+		{name: "Not JSON", body: "url=a", wantErr: true},
+		{name: "Non-string params", body: `{"items":[{"url":"a","w":400}]}`, wantErr: true},
+		{name: "Nested seed", body: `{"items":[{"url":"a","seed":"1"}]}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items, err := ParseSeedItems(tt.body, 3)
+			if tt.wantErr {
+				var validationErr *ValidationError
+				if assert.ErrorAs(t, err, &validationErr) {
+					assert.Equal(t, ErrCodeInvalidSeed, validationErr.Code)
+					assert.Equal(t, "seed", validationErr.Field)
+				}
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, items)
+		})
+	}
+}
+
+func TestVariantKey(t *testing.T) {
+	params := ParamsOptimize{Url: "https://test.com/a.jpg", Width: 200, Quality: 80}
+	withID := params
+	withID.RequestID = "edge-123"
+	resized := params
+	resized.Width = 300
+
+	key := VariantKey(params, "variants/")
+	assert.Regexp(t, `^variants/[0-9a-f]{64}$`, key)
+	assert.Equal(t, key, VariantKey(withID, "variants/"), "the request id is not part of the key")
+	assert.NotEqual(t, key, VariantKey(resized, "variants/"))
+}
+
+func TestETag(t *testing.T) {
+	params := ParamsOptimize{Url: "https://test.com/a.jpg", Width: 200, Quality: 80}
+	sourceHash := "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	etag := ETag(params, sourceHash)
+
+	assert.Regexp(t, `^"[0-9a-f]{32}"$`, etag, "strong validator")
+	assert.Equal(t, etag, ETag(params, sourceHash), "identical requests share the ETag")
+
+	assert.NotEqual(t, etag, ETag(params, "60303ae22b998861bce3b28f33eec1be758a213c86c93c076dbe9f558c11c752"), "source change")
+	changes := []ParamsOptimize{
+		{Url: "https://test.com/b.jpg", Width: 200, Quality: 80},
+		{Url: "https://test.com/a.jpg", Width: 201, Quality: 80},
+		{Url: "https://test.com/a.jpg", Width: 200, Quality: 81},
+		{Url: "https://test.com/a.jpg", Width: 200, Quality: 80, Rotate: 90},
+		{Url: "https://test.com/a.jpg", Width: 200, Quality: 80, Background: []float64{255, 255, 255}},
+	}
+	for _, changed := range changes {
+		assert.NotEqual(t, etag, ETag(changed, sourceHash), "param change %+v", changed)
+	}
+}
+
+func TestMatchesETag(t *testing.T) {
+	etag := `"abc123"`
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		expected    bool
+	}{
+		{name: "Exact", ifNoneMatch: `"abc123"`, expected: true},
+		{name: "Weak", ifNoneMatch: `W/"abc123"`, expected: true},
+		{name: "List", ifNoneMatch: `"old", "abc123"`, expected: true},
+		{name: "Wildcard", ifNoneMatch: `*`, expected: true},
+		{name: "Different", ifNoneMatch: `"old"`, expected: false},
+		{name: "Unquoted", ifNoneMatch: `abc123`, expected: false},
+		{name: "Empty", ifNoneMatch: ``, expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, MatchesETag(tt.ifNoneMatch, etag))
+		})
+	}
+}
+
+func TestHeaderValue(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		maxLen   int
+		expected string
+	}{
+		{name: "Plain", value: "truncated file", maxLen: 0, expected: "truncated file"},
+		{name: "Header injection", value: "bad\r\nSet-Cookie: x=1", maxLen: 0, expected: "badSet-Cookie: x=1"},
+		{name: "Trimmed", value: "  spaced \t", maxLen: 0, expected: "spaced"},
+		{name: "Truncated", value: "abcdef", maxLen: 3, expected: "abc"},
+		{name: "Truncated mid rune", value: "aé", maxLen: 2, expected: "a"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, HeaderValue(tt.value, tt.maxLen))
+		})
+	}
+}
+
+func TestIsTrustedRequest(t *testing.T) {
+	tests := []struct {
+		name       string
+		trustedKey string
+		headers    map[string]string
+		expected   bool
+	}{
+		{name: "Matching key", trustedKey: "internal", headers: map[string]string{"imgop-trusted-key": "internal"}, expected: true},
+		{name: "Wrong key", trustedKey: "internal", headers: map[string]string{"imgop-trusted-key": "guess"}, expected: false},
+		{name: "No header", trustedKey: "internal", headers: map[string]string{}, expected: false},
+		{name: "Unset trusted key", trustedKey: "", headers: map[string]string{"imgop-trusted-key": ""}, expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SECRET_KEY", "test-imgop-key")
+			t.Setenv("TRUSTED_KEY", tt.trustedKey)
+			ResetAppEnvForTesting()
+			defer ResetAppEnvForTesting()
+
+			assert.Equal(t, tt.expected, IsTrustedRequest(tt.headers))
+		})
+	}
+}
+
+func TestValidateParams_SourceFormatHint(t *testing.T) {
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	ResetAppEnvForTesting()
+	defer ResetAppEnvForTesting()
+
+	params, err := ValidateParams(ParamsOptimize{Width: 400, SourceFormat: "jpeg"})
+	assert.NoError(t, err)
+	assert.Empty(t, params.SourceFormat, "untrusted callers always get the signature check")
+
+	params, err = ValidateParams(ParamsOptimize{Width: 400, SourceFormat: "bogus"})
+	assert.NoError(t, err, "an untrusted hint is ignored, not validated")
+	assert.Empty(t, params.SourceFormat)
+
+	params, err = ValidateParams(ParamsOptimize{Width: 400, SourceFormat: "jpeg", Trusted: true})
+	assert.NoError(t, err)
+	assert.Equal(t, "jpeg", params.SourceFormat)
+
+	_, err = ValidateParams(ParamsOptimize{Width: 400, SourceFormat: "svg", Trusted: true})
+	var validationErr *ValidationError
+	if assert.ErrorAs(t, err, &validationErr) {
+		assert.Equal(t, ErrCodeInvalidSourceFormat, validationErr.Code)
+		assert.Equal(t, "src_fmt", validationErr.Field)
+	}
+
+	hinted := ParamsOptimize{Width: 400, SourceFormat: "jpeg", Trusted: true}
+	unhinted := ParamsOptimize{Width: 400, Trusted: true}
+	assert.Equal(t, CacheKey(unhinted), CacheKey(hinted), "the hint doesn't change the output")
+}
+
+func TestValidateParams_NoCache(t *testing.T) {
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	ResetAppEnvForTesting()
+	defer ResetAppEnvForTesting()
+
+	params, err := ValidateParams(ParamsOptimize{Width: 400, NoCache: true})
+	assert.NoError(t, err)
+	assert.False(t, params.NoCache, "untrusted callers always get the stored variant")
+
+	params, err = ValidateParams(ParamsOptimize{Width: 400, NoCache: true, Trusted: true})
+	assert.NoError(t, err)
+	assert.True(t, params.NoCache)
+
+	fresh := ParamsOptimize{Width: 400, NoCache: true, Trusted: true}
+	cached := ParamsOptimize{Width: 400, Trusted: true}
+	assert.Equal(t, VariantKey(cached, "variants/"), VariantKey(fresh, "variants/"), "a fresh render replaces the same variant")
+}
+
+func TestValidateParams_Format(t *testing.T) {
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	t.Setenv("OUTPUT_FORMATS", "webp,avif,jpeg")
+	ResetAppEnvForTesting()
+	defer ResetAppEnvForTesting()
+
+	params, err := ValidateParams(ParamsOptimize{Width: 400, Format: "avif"})
+	assert.NoError(t, err)
+	assert.Equal(t, "avif", params.Format)
+
+	params, err = ValidateParams(ParamsOptimize{Width: 400, Format: "webp"})
+	assert.NoError(t, err)
+	assert.Empty(t, params.Format, "webp is the default")
+
+	params, err = ValidateParams(ParamsOptimize{Width: 400, Format: "jpeg"})
+	assert.NoError(t, err)
+	assert.Equal(t, "jpeg", params.Format)
+
+	_, err = ValidateParams(ParamsOptimize{Width: 400, Format: "gif"})
+	var validationErr *ValidationError
+	if assert.ErrorAs(t, err, &validationErr) {
+		assert.Equal(t, ErrCodeInvalidFormat, validationErr.Code)
+		assert.Equal(t, "f", validationErr.Field)
+	}
+
+	webp, _ := ValidateParams(ParamsOptimize{Width: 400, Format: "webp"})
+	unset, _ := ValidateParams(ParamsOptimize{Width: 400})
+	avif, _ := ValidateParams(ParamsOptimize{Width: 400, Format: "avif"})
+	assert.Equal(t, CacheKey(unset), CacheKey(webp))
+	assert.NotEqual(t, CacheKey(webp), CacheKey(avif))
+}
+
+func TestValidateParams_DisabledFormat(t *testing.T) {
+	// AVIF is left out by default
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	ResetAppEnvForTesting()
+	defer ResetAppEnvForTesting()
+
+	_, err := ValidateParams(ParamsOptimize{Width: 400, Format: "avif"})
+	var validationErr *ValidationError
+	if assert.ErrorAs(t, err, &validationErr) {
+		assert.Equal(t, ErrCodeInvalidFormat, validationErr.Code)
+		assert.Equal(t, "f must be one of webp, jpeg", validationErr.Message)
+	}
+
+	params, err := ValidateParams(ParamsOptimize{Width: 400, Format: "jpeg"})
+	assert.NoError(t, err)
+	assert.Equal(t, "jpeg", params.Format)
+}
+
+func TestValidateParams_TrustedEncodes(t *testing.T) {
+	tests := []struct {
+		name                 string
+		trustedKey           string
+		strict               string
+		trusted              bool
+		expectedOptimization string
+		expectedQuality      int
+		expectedErrorMsg     string
+	}{
+		{
+			name:                 "untrusted is capped",
+			trustedKey:           "internal",
+			expectedOptimization: "balanced",
+			expectedQuality:      85,
+		},
+		{
+			name:                 "trusted is not capped",
+			trustedKey:           "internal",
+			trusted:              true,
+			expectedOptimization: "max",
+			expectedQuality:      100,
+		},
+		{
+			name:             "strict rejects untrusted expensive encodes",
+			trustedKey:       "internal",
+			strict:           "true",
+			expectedErrorMsg: "quality must be at most 85",
+		},
+		{
+			name:                 "no trusted key keeps max effort available",
+			expectedOptimization: "max",
+			expectedQuality:      85,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SECRET_KEY", "test-imgop-key")
+			t.Setenv("TRUSTED_KEY", tt.trustedKey)
+			t.Setenv("MAX_QUALITY", "85")
+			t.Setenv("STRICT_VALIDATION", tt.strict)
+			ResetAppEnvForTesting()
+			defer ResetAppEnvForTesting()
+
+			params, err := ValidateParams(ParamsOptimize{
+				Url:          "https://test.com/a.jpg",
+				Quality:      100,
+				Optimization: "max",
+				Trusted:      tt.trusted,
+			})
+			if tt.expectedErrorMsg != "" {
+				assert.EqualError(t, err, tt.expectedErrorMsg)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedOptimization, params.Optimization)
+			assert.Equal(t, tt.expectedQuality, params.Quality)
+		})
+	}
+}
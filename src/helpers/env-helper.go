@@ -1,8 +1,11 @@
 package helpers
 
 import (
+	"encoding/json"
 	"log"
+	"net/http"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -11,12 +14,140 @@ import (
 // Singelton Env
 type AppEnv struct {
 	ALLOWED_ORIGINS []string
+	// Buckets s3:// sources may be read from with the Lambda role
+	ALLOWED_BUCKETS []string
 	SECRET_KEY      string
 	MAX_WIDTH       int
 	MAX_HEIGHT      int
-	FETCH_TIMEOUT   int
+	// Smallest width/height a request may ask for, guards against degenerate outputs
+	MIN_WIDTH     int
+	MIN_HEIGHT    int
+	FETCH_TIMEOUT int
+	// Connection phase timeouts in seconds, bounded by FETCH_TIMEOUT
+	CONNECT_TIMEOUT       int
+	TLS_HANDSHAKE_TIMEOUT int
+	// Second key for trusted internal callers, allows expensive encodes when set
+	TRUSTED_KEY string
+	// Per-origin fetch headers keyed by host, e.g. partner CDN credentials.
+	// Values are secrets and must never be logged.
+	ORIGIN_HEADERS map[string]map[string]string
+	// Max source size in bytes, 0 means unlimited
+	MAX_DOWNLOAD_BYTES int64
+	// TIFF sources declaring more bytes are decoded as they download instead of buffered, 0 disables
+	STREAM_DECODE_BYTES int64
+	// Per-origin fetch limit overrides keyed by host
+	ORIGIN_LIMITS map[string]OriginLimits
+	// Outbound fetches per second to a single origin host, 0 means unlimited
+	ORIGIN_RATE_LIMIT float64
+	// Images optimized at once, 0 means unlimited
+	MAX_CONCURRENCY int
+	// Requests waiting for a slot once MAX_CONCURRENCY is reached, the rest are shed with 503
+	MAX_QUEUE int
+	// Origin and S3 fetches in flight at once, further fetches wait within their deadline. 0 means unlimited
+	MAX_OUTBOUND_FETCHES int
+	// Local development only: any http(s) origin is allowed, including localhost. Never enable in production.
+	DEV_MODE bool
+	// Allows the introspection modes (helpers.DebugModes), off by default
+	ENABLE_DEBUG_MODES bool
+	// Reject out-of-policy params instead of clamping them
+	STRICT_VALIDATION bool
+	// Reject query params outside helpers.KnownParams instead of ignoring them
+	STRICT_PARAMS bool
+	// Lowest quality a request may ask for
+	MIN_QUALITY int
+	// Highest quality a request may ask for
+	MAX_QUALITY int
+	// Quality of requests without q, within MIN_QUALITY-MAX_QUALITY
+	DEFAULT_QUALITY int
+	// Device pixel ratio of requests without dpr (1-3), e.g. 2 for deployments serving retina clients only
+	DEFAULT_DPR float64
+	// Origin response headers copied onto our response
+	FORWARD_HEADERS []string
+	// Output formats (OutputFormats) the deployment encodes, WebP is always one of them
+	OUTPUT_FORMATS []string
+	// Source formats (libvips names, e.g. tiff) returned untouched instead of re-encoded
+	PASSTHROUGH_FORMATS []string
+	// Fail sources carrying HTML or script markup instead of re-encoding them
+	REJECT_POLYGLOTS bool
+	// Image served, resized, when the source can't be fetched or decoded, empty disables
+	PLACEHOLDER_URL string
+	// Origin statuses treated as success, empty accepts any 2xx
+	ACCEPTED_STATUSES []int
+	// 206 handling: "complete" fetches the remaining ranges, "reject" fails the request
+	PARTIAL_CONTENT string
+	// Cache time in seconds for fallback responses served when the source couldn't be optimized, 0 disables caching
+	FALLBACK_CACHE_TTL int
+	// Seconds a CDN may serve a stale response while revalidating, or when the origin errors, 0 omits the directive
+	STALE_WHILE_REVALIDATE int
+	STALE_IF_ERROR         int
+	// Max/min axis scale ratio of a fit=fill resize before it is flagged as distorted
+	ASPECT_DISTORTION_THRESHOLD float64
+	// Components of the thumbnail=true bundle
+	THUMBNAIL_SHARPEN        float64 // Sharpen sigma at full downscale, 0 disables
+	THUMBNAIL_MIN_QUALITY    int
+	THUMBNAIL_STRIP_METADATA bool
+
+	// Flatten color of the email=1 bundle, as RGB
+	EMAIL_BACKGROUND []float64
+
+	// WebP encoder effort (0-6) of the default balanced optimize level
+	DEFAULT_EFFORT int
+
+	// f=jpeg of an image with transparency and no bg: "preserve" encodes WebP instead, "error" fails the request
+	ALPHA_POLICY string
+
+	// f=auto encodes an image as lossless WebP when at least AUTO_LOSSLESS_FLAT_RATIO of its
+	// neighbouring pixels are within AUTO_LOSSLESS_TOLERANCE of each other and at least
+	// AUTO_LOSSLESS_EDGE_RATIO of them are across a sharp edge, as in screenshots and text
+	AUTO_LOSSLESS_FLAT_RATIO float64
+	AUTO_LOSSLESS_TOLERANCE  int
+	AUTO_LOSSLESS_EDGE_RATIO float64
+
+	// Smallest source accepted, tracking pixels and empty bodies below them fail instead of
+	// being encoded
+	MIN_SOURCE_WIDTH  int
+	MIN_SOURCE_HEIGHT int
+	MIN_SOURCE_BYTES  int64
+
+	// Bucket store=1 writes variants to, empty disables the mode
+	VARIANTS_BUCKET string
+	// Key prefix of the stored variants
+	VARIANTS_PREFIX string
+	// Public URL of the bucket (e.g. the CDN in front of it), returned with the key appended
+	VARIANTS_BASE_URL string
+	// Variants a seed=1 batch stores at once, and the most items a batch may list
+	SEED_CONCURRENCY int
+	SEED_MAX_ITEMS   int
+
+	// Unsharp masks of auto_sharpen by output size, sorted with the catch-all bucket last
+	SHARPEN_BUCKETS []SharpenBucket
+}
+
+// OriginLimits overrides the global fetch limits for a single origin, zero values fall back to the globals
+type OriginLimits struct {
+	FetchTimeout     int     `json:"fetch_timeout"`
+	MaxDownloadBytes int64   `json:"max_download_bytes"`
+	RateLimit        float64 `json:"rate_limit"`
+}
+
+// SharpenBucket is the auto_sharpen unsharp mask of the outputs whose longest side is at
+// most MaxSize, 0 matches any size
+type SharpenBucket struct {
+	MaxSize int     `json:"max_size"`
+	Sigma   float64 `json:"sigma"`
+	Amount  float64 `json:"amount"` // Sharpening of the jagged areas, libvips m2
 }
 
+// Small outputs lose the most detail to the downscale, so they get the strongest mask
+var defaultSharpenBuckets = []SharpenBucket{
+	{MaxSize: 200, Sigma: 1.0, Amount: 3.0},
+	{MaxSize: 800, Sigma: 0.7, Amount: 2.0},
+	{MaxSize: 0, Sigma: 0.5, Amount: 1.0},
+}
+
+// Formats encoded when OUTPUT_FORMATS is unset, the ones every libvips build can encode
+var defaultOutputFormats = []string{"webp", "jpeg"}
+
 var appEnv *AppEnv
 var once sync.Once
 
@@ -40,6 +171,14 @@ func GetAppEnv() *AppEnv {
 			}
 		}
 
+		allowedBuckets := []string{}
+		for _, bucket := range strings.Split(os.Getenv("ALLOWED_BUCKETS"), ",") {
+			bucket = strings.TrimSpace(bucket)
+			if bucket != "" {
+				allowedBuckets = append(allowedBuckets, bucket)
+			}
+		}
+
 		secretKey := os.Getenv("SECRET_KEY")
 		if secretKey == "" {
 			log.Fatal("SECRET_KEY is not set")
@@ -58,6 +197,40 @@ func GetAppEnv() *AppEnv {
 			}
 		}
 
+		// Floors above the max dimensions would reject every sized request, they fall back to 1
+		minWidth := 1
+		if minWidthStr := os.Getenv("MIN_WIDTH"); minWidthStr != "" {
+			if mw, err := strconv.Atoi(minWidthStr); err == nil && mw > 0 && mw <= maxWidth {
+				minWidth = mw
+			}
+		}
+		minHeight := 1
+		if minHeightStr := os.Getenv("MIN_HEIGHT"); minHeightStr != "" {
+			if mh, err := strconv.Atoi(minHeightStr); err == nil && mh > 0 && mh <= maxHeight {
+				minHeight = mh
+			}
+		}
+
+		// Source floors default to anything decodable
+		minSourceWidth := 1
+		if minSourceWidthStr := os.Getenv("MIN_SOURCE_WIDTH"); minSourceWidthStr != "" {
+			if msw, err := strconv.Atoi(minSourceWidthStr); err == nil && msw > 0 {
+				minSourceWidth = msw
+			}
+		}
+		minSourceHeight := 1
+		if minSourceHeightStr := os.Getenv("MIN_SOURCE_HEIGHT"); minSourceHeightStr != "" {
+			if msh, err := strconv.Atoi(minSourceHeightStr); err == nil && msh > 0 {
+				minSourceHeight = msh
+			}
+		}
+		minSourceBytes := int64(0)
+		if minSourceBytesStr := os.Getenv("MIN_SOURCE_BYTES"); minSourceBytesStr != "" {
+			if msb, err := strconv.ParseInt(minSourceBytesStr, 10, 64); err == nil && msb > 0 {
+				minSourceBytes = msb
+			}
+		}
+
 		fetchTimeout := 5
 		if fetchTimeoutStr := os.Getenv("FETCH_TIMEOUT"); fetchTimeoutStr != "" {
 			if ft, err := strconv.Atoi(fetchTimeoutStr); err == nil && ft > 0 {
@@ -65,13 +238,408 @@ func GetAppEnv() *AppEnv {
 			}
 		}
 
+		connectTimeout := 2
+		if connectTimeoutStr := os.Getenv("CONNECT_TIMEOUT"); connectTimeoutStr != "" {
+			if ct, err := strconv.Atoi(connectTimeoutStr); err == nil && ct > 0 {
+				connectTimeout = ct
+			}
+		}
+		tlsHandshakeTimeout := 3
+		if tlsHandshakeTimeoutStr := os.Getenv("TLS_HANDSHAKE_TIMEOUT"); tlsHandshakeTimeoutStr != "" {
+			if tt, err := strconv.Atoi(tlsHandshakeTimeoutStr); err == nil && tt > 0 {
+				tlsHandshakeTimeout = tt
+			}
+		}
+
+		originHeaders := map[string]map[string]string{}
+		if originHeadersStr := os.Getenv("ORIGIN_HEADERS"); originHeadersStr != "" {
+			parsedHeaders := map[string]map[string]string{}
+			if err := json.Unmarshal([]byte(originHeadersStr), &parsedHeaders); err != nil {
+				// Do not include the raw value, it may contain credentials
+				log.Fatal("ORIGIN_HEADERS is not valid JSON")
+			}
+			for host, headers := range parsedHeaders {
+				host = strings.ToLower(strings.TrimSpace(host))
+				if host != "" && len(headers) > 0 {
+					originHeaders[host] = headers
+				}
+			}
+		}
+
+		maxDownloadBytes := int64(0)
+		if maxDownloadBytesStr := os.Getenv("MAX_DOWNLOAD_BYTES"); maxDownloadBytesStr != "" {
+			if mdb, err := strconv.ParseInt(maxDownloadBytesStr, 10, 64); err == nil && mdb > 0 {
+				maxDownloadBytes = mdb
+			}
+		}
+
+		streamDecodeBytes := int64(100 * 1024 * 1024)
+		if streamDecodeBytesStr := os.Getenv("STREAM_DECODE_BYTES"); streamDecodeBytesStr != "" {
+			if sdb, err := strconv.ParseInt(streamDecodeBytesStr, 10, 64); err == nil && sdb >= 0 {
+				streamDecodeBytes = sdb
+			}
+		}
+
+		originRateLimit := 0.0
+		if originRateLimitStr := os.Getenv("ORIGIN_RATE_LIMIT"); originRateLimitStr != "" {
+			if orl, err := strconv.ParseFloat(originRateLimitStr, 64); err == nil && orl >= 0 && orl <= 10000 {
+				originRateLimit = orl
+			}
+		}
+
+		originLimits := map[string]OriginLimits{}
+		if originLimitsStr := os.Getenv("ORIGIN_LIMITS"); originLimitsStr != "" {
+			parsedLimits := map[string]OriginLimits{}
+			if err := json.Unmarshal([]byte(originLimitsStr), &parsedLimits); err != nil {
+				log.Fatal("ORIGIN_LIMITS is not valid JSON: ", err)
+			}
+			for host, limits := range parsedLimits {
+				host = strings.ToLower(strings.TrimSpace(host))
+				if host != "" {
+					originLimits[host] = limits
+				}
+			}
+		}
+
+		maxConcurrency := 0
+		if maxConcurrencyStr := os.Getenv("MAX_CONCURRENCY"); maxConcurrencyStr != "" {
+			if mc, err := strconv.Atoi(maxConcurrencyStr); err == nil && mc > 0 {
+				maxConcurrency = mc
+			}
+		}
+		maxQueue := 0
+		if maxQueueStr := os.Getenv("MAX_QUEUE"); maxQueueStr != "" {
+			if mq, err := strconv.Atoi(maxQueueStr); err == nil && mq > 0 {
+				maxQueue = mq
+			}
+		}
+
+		maxOutboundFetches := 0
+		if maxOutboundFetchesStr := os.Getenv("MAX_OUTBOUND_FETCHES"); maxOutboundFetchesStr != "" {
+			if mof, err := strconv.Atoi(maxOutboundFetchesStr); err == nil && mof > 0 {
+				maxOutboundFetches = mof
+			}
+		}
+
+		devMode, _ := strconv.ParseBool(os.Getenv("DEV_MODE"))
+		if devMode {
+			log.Println("WARNING: DEV_MODE is enabled, the allowed origins check is off. Never enable it in production.")
+		}
+
+		enableDebugModes, _ := strconv.ParseBool(os.Getenv("ENABLE_DEBUG_MODES"))
+		strictValidation, _ := strconv.ParseBool(os.Getenv("STRICT_VALIDATION"))
+		strictParams, _ := strconv.ParseBool(os.Getenv("STRICT_PARAMS"))
+
+		minQuality := 1
+		if minQualityStr := os.Getenv("MIN_QUALITY"); minQualityStr != "" {
+			if mq, err := strconv.Atoi(minQualityStr); err == nil && mq > 0 && mq <= 100 {
+				minQuality = mq
+			}
+		}
+
+		maxQuality := 100
+		if maxQualityStr := os.Getenv("MAX_QUALITY"); maxQualityStr != "" {
+			if mq, err := strconv.Atoi(maxQualityStr); err == nil && mq > 0 && mq <= 100 {
+				maxQuality = mq
+			}
+		}
+
+		defaultQuality := 80
+		if defaultQualityStr := os.Getenv("DEFAULT_QUALITY"); defaultQualityStr != "" {
+			if dq, err := strconv.Atoi(defaultQualityStr); err == nil && dq > 0 && dq <= 100 {
+				defaultQuality = dq
+			}
+		}
+		// Requests without q must never fall outside the policy, even under STRICT_VALIDATION
+		defaultQuality = min(max(defaultQuality, minQuality), maxQuality)
+
+		defaultDpr := 1.0
+		if defaultDprStr := os.Getenv("DEFAULT_DPR"); defaultDprStr != "" {
+			if dd, err := strconv.ParseFloat(defaultDprStr, 64); err == nil && validDpr(dd) {
+				defaultDpr = dd
+			}
+		}
+
+		forwardHeaders := []string{}
+		for _, header := range strings.Split(os.Getenv("FORWARD_HEADERS"), ",") {
+			header = strings.TrimSpace(header)
+			if header != "" {
+				forwardHeaders = append(forwardHeaders, http.CanonicalHeaderKey(header))
+			}
+		}
+
+		// AVIF needs libheif with an AV1 encoder in the libvips build, so it is only negotiated
+		// or accepted once the deployment opts in. WebP is the default output
+		outputFormats := defaultOutputFormats
+		if outputFormatsStr := os.Getenv("OUTPUT_FORMATS"); outputFormatsStr != "" {
+			outputFormats = []string{"webp"}
+			for _, format := range strings.Split(outputFormatsStr, ",") {
+				format = strings.ToLower(strings.TrimSpace(format))
+				if slices.Contains(OutputFormats, format) && !slices.Contains(outputFormats, format) {
+					outputFormats = append(outputFormats, format)
+				}
+			}
+		}
+
+		passthroughFormats := []string{}
+		for _, format := range strings.Split(os.Getenv("PASSTHROUGH_FORMATS"), ",") {
+			format = strings.ToLower(strings.TrimSpace(format))
+			if format != "" {
+				passthroughFormats = append(passthroughFormats, format)
+			}
+		}
+
+		sharpenBuckets := defaultSharpenBuckets
+		if sharpenBucketsStr := os.Getenv("SHARPEN_BUCKETS"); sharpenBucketsStr != "" {
+			parsedBuckets := []SharpenBucket{}
+			if err := json.Unmarshal([]byte(sharpenBucketsStr), &parsedBuckets); err != nil {
+				log.Fatal("SHARPEN_BUCKETS is not valid JSON: ", err)
+			}
+			for _, bucket := range parsedBuckets {
+				if bucket.MaxSize < 0 || !(bucket.Sigma > 0 && bucket.Sigma <= 10) || !(bucket.Amount > 0 && bucket.Amount <= 10) {
+					log.Fatal("SHARPEN_BUCKETS needs a max_size of at least 0, and a sigma and amount above 0 and at most 10")
+				}
+			}
+			// The catch-all bucket (max_size 0) sorts last
+			slices.SortFunc(parsedBuckets, func(a, b SharpenBucket) int {
+				if a.MaxSize == 0 || b.MaxSize == 0 {
+					return b.MaxSize - a.MaxSize
+				}
+				return a.MaxSize - b.MaxSize
+			})
+			sharpenBuckets = parsedBuckets
+		}
+
+		variantsBucket := strings.TrimSpace(os.Getenv("VARIANTS_BUCKET"))
+		variantsBaseUrl := strings.TrimSuffix(strings.TrimSpace(os.Getenv("VARIANTS_BASE_URL")), "/")
+		if variantsBaseUrl == "" && variantsBucket != "" {
+			variantsBaseUrl = "https://" + variantsBucket + ".s3.amazonaws.com"
+		}
+
+		seedConcurrency := 4
+		if seedConcurrencyStr := os.Getenv("SEED_CONCURRENCY"); seedConcurrencyStr != "" {
+			if sc, err := strconv.Atoi(seedConcurrencyStr); err == nil && sc > 0 {
+				seedConcurrency = sc
+			}
+		}
+		seedMaxItems := 100
+		if seedMaxItemsStr := os.Getenv("SEED_MAX_ITEMS"); seedMaxItemsStr != "" {
+			if smi, err := strconv.Atoi(seedMaxItemsStr); err == nil && smi > 0 {
+				seedMaxItems = smi
+			}
+		}
+
+		rejectPolyglots, _ := strconv.ParseBool(os.Getenv("REJECT_POLYGLOTS"))
+
+		acceptedStatuses := []int{}
+		for _, status := range strings.Split(os.Getenv("ACCEPTED_STATUSES"), ",") {
+			status = strings.TrimSpace(status)
+			if status == "" {
+				continue
+			}
+			code, err := strconv.Atoi(status)
+			if err != nil || code < 200 || code > 299 {
+				log.Fatal("ACCEPTED_STATUSES must be a comma separated list of 2xx codes")
+			}
+			acceptedStatuses = append(acceptedStatuses, code)
+		}
+
+		partialContent := "complete"
+		if partialContentStr := strings.ToLower(strings.TrimSpace(os.Getenv("PARTIAL_CONTENT"))); partialContentStr == "reject" {
+			partialContent = partialContentStr
+		}
+
+		fallbackCacheTTL := 30
+		if fallbackCacheTTLStr := os.Getenv("FALLBACK_CACHE_TTL"); fallbackCacheTTLStr != "" {
+			if fc, err := strconv.Atoi(fallbackCacheTTLStr); err == nil && fc >= 0 {
+				fallbackCacheTTL = fc
+			}
+		}
+		staleWhileRevalidate := 0
+		if staleWhileRevalidateStr := os.Getenv("STALE_WHILE_REVALIDATE"); staleWhileRevalidateStr != "" {
+			if swr, err := strconv.Atoi(staleWhileRevalidateStr); err == nil && swr >= 0 {
+				staleWhileRevalidate = swr
+			}
+		}
+		staleIfError := 0
+		if staleIfErrorStr := os.Getenv("STALE_IF_ERROR"); staleIfErrorStr != "" {
+			if sie, err := strconv.Atoi(staleIfErrorStr); err == nil && sie >= 0 {
+				staleIfError = sie
+			}
+		}
+
+		aspectDistortionThreshold := 1.2
+		if aspectDistortionThresholdStr := os.Getenv("ASPECT_DISTORTION_THRESHOLD"); aspectDistortionThresholdStr != "" {
+			if ad, err := strconv.ParseFloat(aspectDistortionThresholdStr, 64); err == nil && ad >= 1 {
+				aspectDistortionThreshold = ad
+			}
+		}
+
+		thumbnailSharpen := 1.0
+		if thumbnailSharpenStr := os.Getenv("THUMBNAIL_SHARPEN"); thumbnailSharpenStr != "" {
+			if ts, err := strconv.ParseFloat(thumbnailSharpenStr, 64); err == nil && ts >= 0 && ts <= 10 {
+				thumbnailSharpen = ts
+			}
+		}
+		thumbnailMinQuality := 70
+		if thumbnailMinQualityStr := os.Getenv("THUMBNAIL_MIN_QUALITY"); thumbnailMinQualityStr != "" {
+			if tq, err := strconv.Atoi(thumbnailMinQualityStr); err == nil && tq > 0 && tq <= 100 {
+				thumbnailMinQuality = tq
+			}
+		}
+		thumbnailStripMetadata := true
+		if thumbnailStripMetadataStr := os.Getenv("THUMBNAIL_STRIP_METADATA"); thumbnailStripMetadataStr != "" {
+			if sm, err := strconv.ParseBool(thumbnailStripMetadataStr); err == nil {
+				thumbnailStripMetadata = sm
+			}
+		}
+
+		defaultEffort := 4
+		if defaultEffortStr := os.Getenv("DEFAULT_EFFORT"); defaultEffortStr != "" {
+			if de, err := strconv.Atoi(defaultEffortStr); err == nil && de >= 0 && de <= 6 {
+				defaultEffort = de
+			}
+		}
+
+		alphaPolicy := "preserve"
+		if alphaPolicyStr := strings.ToLower(strings.TrimSpace(os.Getenv("ALPHA_POLICY"))); alphaPolicyStr == "error" {
+			alphaPolicy = alphaPolicyStr
+		}
+
+		autoLosslessFlatRatio := 0.7
+		if autoLosslessFlatRatioStr := os.Getenv("AUTO_LOSSLESS_FLAT_RATIO"); autoLosslessFlatRatioStr != "" {
+			if fr, err := strconv.ParseFloat(autoLosslessFlatRatioStr, 64); err == nil && fr >= 0 && fr <= 1 {
+				autoLosslessFlatRatio = fr
+			}
+		}
+		autoLosslessTolerance := 2
+		if autoLosslessToleranceStr := os.Getenv("AUTO_LOSSLESS_TOLERANCE"); autoLosslessToleranceStr != "" {
+			if lt, err := strconv.Atoi(autoLosslessToleranceStr); err == nil && lt >= 0 && lt <= 255 {
+				autoLosslessTolerance = lt
+			}
+		}
+		autoLosslessEdgeRatio := 0.01
+		if autoLosslessEdgeRatioStr := os.Getenv("AUTO_LOSSLESS_EDGE_RATIO"); autoLosslessEdgeRatioStr != "" {
+			if er, err := strconv.ParseFloat(autoLosslessEdgeRatioStr, 64); err == nil && er >= 0 && er <= 1 {
+				autoLosslessEdgeRatio = er
+			}
+		}
+
+		emailBackground := []float64{255, 255, 255}
+		if emailBackgroundStr := os.Getenv("EMAIL_BACKGROUND"); emailBackgroundStr != "" {
+			if color, err := ParseColor("EMAIL_BACKGROUND", emailBackgroundStr); err == nil {
+				emailBackground = color
+			}
+		}
+
 		appEnv = &AppEnv{
 			ALLOWED_ORIGINS: allowedOrigins,
+			ALLOWED_BUCKETS: allowedBuckets,
 			SECRET_KEY:      os.Getenv("SECRET_KEY"),
+			TRUSTED_KEY:     os.Getenv("TRUSTED_KEY"),
 			MAX_WIDTH:       maxWidth,
 			MAX_HEIGHT:      maxHeight,
+			MIN_WIDTH:       minWidth,
+			MIN_HEIGHT:      minHeight,
 			FETCH_TIMEOUT:   fetchTimeout,
+			ORIGIN_HEADERS:  originHeaders,
+
+			MIN_SOURCE_WIDTH:  minSourceWidth,
+			MIN_SOURCE_HEIGHT: minSourceHeight,
+			MIN_SOURCE_BYTES:  minSourceBytes,
+
+			VARIANTS_BUCKET:   variantsBucket,
+			VARIANTS_PREFIX:   strings.TrimPrefix(strings.TrimSpace(os.Getenv("VARIANTS_PREFIX")), "/"),
+			VARIANTS_BASE_URL: variantsBaseUrl,
+			SEED_CONCURRENCY:  seedConcurrency,
+			SEED_MAX_ITEMS:    seedMaxItems,
+
+			SHARPEN_BUCKETS: sharpenBuckets,
+
+			CONNECT_TIMEOUT:       connectTimeout,
+			TLS_HANDSHAKE_TIMEOUT: tlsHandshakeTimeout,
+
+			MAX_DOWNLOAD_BYTES: maxDownloadBytes,
+			ORIGIN_LIMITS:      originLimits,
+			ORIGIN_RATE_LIMIT:  originRateLimit,
+			MAX_CONCURRENCY:    maxConcurrency,
+			MAX_QUEUE:          maxQueue,
+
+			MAX_OUTBOUND_FETCHES: maxOutboundFetches,
+
+			STREAM_DECODE_BYTES: streamDecodeBytes,
+
+			DEV_MODE:           devMode,
+			ENABLE_DEBUG_MODES: enableDebugModes,
+			STRICT_VALIDATION:  strictValidation,
+			STRICT_PARAMS:      strictParams,
+			MIN_QUALITY:        minQuality,
+			MAX_QUALITY:        maxQuality,
+			FORWARD_HEADERS:    forwardHeaders,
+
+			DEFAULT_QUALITY: defaultQuality,
+			DEFAULT_DPR:     defaultDpr,
+
+			OUTPUT_FORMATS:      outputFormats,
+			PASSTHROUGH_FORMATS: passthroughFormats,
+			PLACEHOLDER_URL:     strings.TrimSpace(os.Getenv("PLACEHOLDER_URL")),
+			REJECT_POLYGLOTS:    rejectPolyglots,
+
+			ACCEPTED_STATUSES: acceptedStatuses,
+			PARTIAL_CONTENT:   partialContent,
+
+			FALLBACK_CACHE_TTL:     fallbackCacheTTL,
+			STALE_WHILE_REVALIDATE: staleWhileRevalidate,
+			STALE_IF_ERROR:         staleIfError,
+
+			ASPECT_DISTORTION_THRESHOLD: aspectDistortionThreshold,
+
+			THUMBNAIL_SHARPEN:        thumbnailSharpen,
+			THUMBNAIL_MIN_QUALITY:    thumbnailMinQuality,
+			THUMBNAIL_STRIP_METADATA: thumbnailStripMetadata,
+
+			EMAIL_BACKGROUND: emailBackground,
+
+			DEFAULT_EFFORT: defaultEffort,
+
+			ALPHA_POLICY: alphaPolicy,
+
+			AUTO_LOSSLESS_FLAT_RATIO: autoLosslessFlatRatio,
+			AUTO_LOSSLESS_TOLERANCE:  autoLosslessTolerance,
+			AUTO_LOSSLESS_EDGE_RATIO: autoLosslessEdgeRatio,
 		}
 	})
 	return appEnv
 }
+
+// IsAcceptedStatus reports whether an origin status counts as success
+func (env *AppEnv) IsAcceptedStatus(statusCode int) bool {
+	if len(env.ACCEPTED_STATUSES) == 0 {
+		return statusCode >= 200 && statusCode <= 299
+	}
+	return slices.Contains(env.ACCEPTED_STATUSES, statusCode)
+}
+
+// FetchTimeoutFor returns the fetch timeout in seconds for the host, falling back to FETCH_TIMEOUT
+func (env *AppEnv) FetchTimeoutFor(host string) int {
+	if limits, ok := env.ORIGIN_LIMITS[strings.ToLower(host)]; ok && limits.FetchTimeout > 0 {
+		return limits.FetchTimeout
+	}
+	return env.FETCH_TIMEOUT
+}
+
+// OriginRateLimitFor returns the fetches per second allowed to the host, falling back to ORIGIN_RATE_LIMIT
+func (env *AppEnv) OriginRateLimitFor(host string) float64 {
+	if limits, ok := env.ORIGIN_LIMITS[strings.ToLower(host)]; ok && limits.RateLimit > 0 {
+		return limits.RateLimit
+	}
+	return env.ORIGIN_RATE_LIMIT
+}
+
+// MaxDownloadBytesFor returns the max source size for the host, falling back to MAX_DOWNLOAD_BYTES
+func (env *AppEnv) MaxDownloadBytesFor(host string) int64 {
+	if limits, ok := env.ORIGIN_LIMITS[strings.ToLower(host)]; ok && limits.MaxDownloadBytes > 0 {
+		return limits.MaxDownloadBytes
+	}
+	return env.MAX_DOWNLOAD_BYTES
+}
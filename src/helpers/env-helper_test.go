@@ -0,0 +1,409 @@
+package helpers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetAppEnv_OriginLimits(t *testing.T) {
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	t.Setenv("FETCH_TIMEOUT", "5")
+	t.Setenv("MAX_DOWNLOAD_BYTES", "1000")
+	t.Setenv("ORIGIN_LIMITS", `{"Fast.Internal.com":{"fetch_timeout":30,"max_download_bytes":50000},"slow.com":{"fetch_timeout":2}}`)
+	ResetAppEnvForTesting()
+	defer ResetAppEnvForTesting()
+
+	appEnv := GetAppEnv()
+
+	tests := []struct {
+		name                     string
+		host                     string
+		expectedTimeout          int
+		expectedMaxDownloadBytes int64
+	}{
+		{
+			name:                     "full override",
+			host:                     "fast.internal.com",
+			expectedTimeout:          30,
+			expectedMaxDownloadBytes: 50000,
+		},
+		{
+			name:                     "host lookup is case insensitive",
+			host:                     "FAST.internal.com",
+			expectedTimeout:          30,
+			expectedMaxDownloadBytes: 50000,
+		},
+		{
+			name:                     "partial override falls back for missing values",
+			host:                     "slow.com",
+			expectedTimeout:          2,
+			expectedMaxDownloadBytes: 1000,
+		},
+		{
+			name:                     "no override uses globals",
+			host:                     "other.com",
+			expectedTimeout:          5,
+			expectedMaxDownloadBytes: 1000,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expectedTimeout, appEnv.FetchTimeoutFor(tt.host))
+			assert.Equal(t, tt.expectedMaxDownloadBytes, appEnv.MaxDownloadBytesFor(tt.host))
+		})
+	}
+}
+
+func TestGetAppEnv_ConnectionTimeouts(t *testing.T) {
+	tests := []struct {
+		name               string
+		connectTimeout     string
+		tlsTimeout         string
+		expectedConnect    int
+		expectedTLSTimeout int
+	}{
+		{name: "defaults", expectedConnect: 2, expectedTLSTimeout: 3},
+		{name: "configured", connectTimeout: "1", tlsTimeout: "4", expectedConnect: 1, expectedTLSTimeout: 4},
+		{name: "invalid values keep defaults", connectTimeout: "-1", tlsTimeout: "abc", expectedConnect: 2, expectedTLSTimeout: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SECRET_KEY", "test-imgop-key")
+			t.Setenv("CONNECT_TIMEOUT", tt.connectTimeout)
+			t.Setenv("TLS_HANDSHAKE_TIMEOUT", tt.tlsTimeout)
+			ResetAppEnvForTesting()
+			defer ResetAppEnvForTesting()
+
+			appEnv := GetAppEnv()
+			assert.Equal(t, tt.expectedConnect, appEnv.CONNECT_TIMEOUT)
+			assert.Equal(t, tt.expectedTLSTimeout, appEnv.TLS_HANDSHAKE_TIMEOUT)
+		})
+	}
+}
+
+func TestAppEnv_IsAcceptedStatus(t *testing.T) {
+	tests := []struct {
+		name             string
+		acceptedStatuses string
+		status           int
+		expected         bool
+	}{
+		{name: "default accepts 200", status: 200, expected: true},
+		{name: "default accepts 203", status: 203, expected: true},
+		{name: "default accepts 206", status: 206, expected: true},
+		{name: "default rejects 304", status: 304, expected: false},
+		{name: "default rejects 404", status: 404, expected: false},
+		{name: "list accepts listed", acceptedStatuses: "200, 203", status: 203, expected: true},
+		{name: "list rejects unlisted", acceptedStatuses: "200,203", status: 206, expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SECRET_KEY", "test-imgop-key")
+			t.Setenv("ACCEPTED_STATUSES", tt.acceptedStatuses)
+			ResetAppEnvForTesting()
+			defer ResetAppEnvForTesting()
+
+			assert.Equal(t, tt.expected, GetAppEnv().IsAcceptedStatus(tt.status))
+		})
+	}
+}
+
+func TestGetAppEnv_FallbackCacheTTL(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		expected int
+	}{
+		{name: "default", expected: 30},
+		{name: "configured", value: "5", expected: 5},
+		{name: "zero disables caching", value: "0", expected: 0},
+		{name: "invalid keeps default", value: "-1", expected: 30},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SECRET_KEY", "test-imgop-key")
+			t.Setenv("FALLBACK_CACHE_TTL", tt.value)
+			ResetAppEnvForTesting()
+			defer ResetAppEnvForTesting()
+
+			assert.Equal(t, tt.expected, GetAppEnv().FALLBACK_CACHE_TTL)
+		})
+	}
+}
+
+func TestGetAppEnv_AspectDistortionThreshold(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		expected float64
+	}{
+		{name: "default", expected: 1.2},
+		{name: "configured", value: "1.5", expected: 1.5},
+		{name: "below 1 keeps default", value: "0.5", expected: 1.2},
+		{name: "invalid keeps default", value: "abc", expected: 1.2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SECRET_KEY", "test-imgop-key")
+			t.Setenv("ASPECT_DISTORTION_THRESHOLD", tt.value)
+			ResetAppEnvForTesting()
+			defer ResetAppEnvForTesting()
+
+			assert.Equal(t, tt.expected, GetAppEnv().ASPECT_DISTORTION_THRESHOLD)
+		})
+	}
+}
+
+func TestGetAppEnv_DefaultEffort(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		expected int
+	}{
+		{name: "default", expected: 4},
+		{name: "configured", value: "2", expected: 2},
+		{name: "zero is a valid effort", value: "0", expected: 0},
+		{name: "above 6 keeps default", value: "7", expected: 4},
+		{name: "negative keeps default", value: "-1", expected: 4},
+		{name: "invalid keeps default", value: "abc", expected: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SECRET_KEY", "test-imgop-key")
+			t.Setenv("DEFAULT_EFFORT", tt.value)
+			ResetAppEnvForTesting()
+			defer ResetAppEnvForTesting()
+
+			assert.Equal(t, tt.expected, GetAppEnv().DEFAULT_EFFORT)
+		})
+	}
+}
+
+func TestGetAppEnv_AlphaPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		expected string
+	}{
+		{name: "default", expected: "preserve"},
+		{name: "error", value: "error", expected: "error"},
+		{name: "case insensitive", value: " Error ", expected: "error"},
+		{name: "invalid keeps default", value: "flatten", expected: "preserve"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SECRET_KEY", "test-imgop-key")
+			t.Setenv("ALPHA_POLICY", tt.value)
+			ResetAppEnvForTesting()
+			defer ResetAppEnvForTesting()
+
+			assert.Equal(t, tt.expected, GetAppEnv().ALPHA_POLICY)
+		})
+	}
+}
+
+func TestGetAppEnv_OutputFormats(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		expected []string
+	}{
+		{name: "default leaves avif out", expected: []string{"webp", "jpeg"}},
+		{name: "avif opted in", value: "webp,avif,jpeg", expected: OutputFormats},
+		{name: "without jpeg", value: "webp,avif", expected: []string{"webp", "avif"}},
+		{name: "webp is always enabled", value: " AVIF ", expected: []string{"webp", "avif"}},
+		{name: "unknown formats are ignored", value: "gif,jpeg,jpeg", expected: []string{"webp", "jpeg"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SECRET_KEY", "test-imgop-key")
+			t.Setenv("OUTPUT_FORMATS", tt.value)
+			ResetAppEnvForTesting()
+			defer ResetAppEnvForTesting()
+
+			assert.Equal(t, tt.expected, GetAppEnv().OUTPUT_FORMATS)
+		})
+	}
+}
+
+func TestGetAppEnv_DefaultDpr(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		expected float64
+	}{
+		{name: "default", expected: 1},
+		{name: "retina", value: "2", expected: 2},
+		{name: "fractional", value: "1.5", expected: 1.5},
+		{name: "below 1 keeps default", value: "0.5", expected: 1},
+		{name: "above 3 keeps default", value: "4", expected: 1},
+		{name: "NaN keeps default", value: "NaN", expected: 1},
+		{name: "invalid keeps default", value: "retina", expected: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SECRET_KEY", "test-imgop-key")
+			t.Setenv("DEFAULT_DPR", tt.value)
+			ResetAppEnvForTesting()
+			defer ResetAppEnvForTesting()
+
+			assert.Equal(t, tt.expected, GetAppEnv().DEFAULT_DPR)
+		})
+	}
+}
+
+func TestGetAppEnv_AutoLossless(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		t.Setenv("SECRET_KEY", "test-imgop-key")
+		ResetAppEnvForTesting()
+		defer ResetAppEnvForTesting()
+
+		appEnv := GetAppEnv()
+		assert.Equal(t, 0.7, appEnv.AUTO_LOSSLESS_FLAT_RATIO)
+		assert.Equal(t, 2, appEnv.AUTO_LOSSLESS_TOLERANCE)
+		assert.Equal(t, 0.01, appEnv.AUTO_LOSSLESS_EDGE_RATIO)
+	})
+
+	t.Run("configured", func(t *testing.T) {
+		t.Setenv("SECRET_KEY", "test-imgop-key")
+		t.Setenv("AUTO_LOSSLESS_FLAT_RATIO", "0.5")
+		t.Setenv("AUTO_LOSSLESS_TOLERANCE", "0")
+		t.Setenv("AUTO_LOSSLESS_EDGE_RATIO", "0.05")
+		ResetAppEnvForTesting()
+		defer ResetAppEnvForTesting()
+
+		appEnv := GetAppEnv()
+		assert.Equal(t, 0.5, appEnv.AUTO_LOSSLESS_FLAT_RATIO)
+		assert.Equal(t, 0, appEnv.AUTO_LOSSLESS_TOLERANCE)
+		assert.Equal(t, 0.05, appEnv.AUTO_LOSSLESS_EDGE_RATIO)
+	})
+
+	t.Run("out of range keeps defaults", func(t *testing.T) {
+		t.Setenv("SECRET_KEY", "test-imgop-key")
+		t.Setenv("AUTO_LOSSLESS_FLAT_RATIO", "1.5")
+		t.Setenv("AUTO_LOSSLESS_TOLERANCE", "256")
+		t.Setenv("AUTO_LOSSLESS_EDGE_RATIO", "-0.1")
+		ResetAppEnvForTesting()
+		defer ResetAppEnvForTesting()
+
+		appEnv := GetAppEnv()
+		assert.Equal(t, 0.7, appEnv.AUTO_LOSSLESS_FLAT_RATIO)
+		assert.Equal(t, 2, appEnv.AUTO_LOSSLESS_TOLERANCE)
+		assert.Equal(t, 0.01, appEnv.AUTO_LOSSLESS_EDGE_RATIO)
+	})
+}
+
+func TestGetAppEnv_MinSource(t *testing.T) {
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	ResetAppEnvForTesting()
+	defer ResetAppEnvForTesting()
+
+	appEnv := GetAppEnv()
+	assert.Equal(t, 1, appEnv.MIN_SOURCE_WIDTH)
+	assert.Equal(t, 1, appEnv.MIN_SOURCE_HEIGHT)
+	assert.Equal(t, int64(0), appEnv.MIN_SOURCE_BYTES)
+
+	t.Setenv("MIN_SOURCE_WIDTH", "16")
+	t.Setenv("MIN_SOURCE_HEIGHT", "0")
+	t.Setenv("MIN_SOURCE_BYTES", "1024")
+	ResetAppEnvForTesting()
+
+	appEnv = GetAppEnv()
+	assert.Equal(t, 16, appEnv.MIN_SOURCE_WIDTH)
+	assert.Equal(t, 1, appEnv.MIN_SOURCE_HEIGHT, "0 keeps the default")
+	assert.Equal(t, int64(1024), appEnv.MIN_SOURCE_BYTES)
+}
+
+func TestGetAppEnv_Seed(t *testing.T) {
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	ResetAppEnvForTesting()
+	defer ResetAppEnvForTesting()
+
+	appEnv := GetAppEnv()
+	assert.Equal(t, 4, appEnv.SEED_CONCURRENCY)
+	assert.Equal(t, 100, appEnv.SEED_MAX_ITEMS)
+
+	t.Setenv("SEED_CONCURRENCY", "8")
+	t.Setenv("SEED_MAX_ITEMS", "-1")
+	ResetAppEnvForTesting()
+
+	appEnv = GetAppEnv()
+	assert.Equal(t, 8, appEnv.SEED_CONCURRENCY)
+	assert.Equal(t, 100, appEnv.SEED_MAX_ITEMS, "invalid keeps the default")
+}
+
+func TestGetAppEnv_SharpenBuckets(t *testing.T) {
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	ResetAppEnvForTesting()
+	defer ResetAppEnvForTesting()
+
+	assert.Equal(t, defaultSharpenBuckets, GetAppEnv().SHARPEN_BUCKETS)
+
+	t.Setenv("SHARPEN_BUCKETS", `[{"max_size":0,"sigma":0.4,"amount":1},{"max_size":600,"sigma":0.8,"amount":2},{"max_size":100,"sigma":1.5,"amount":4}]`)
+	ResetAppEnvForTesting()
+
+	assert.Equal(t, []SharpenBucket{
+		{MaxSize: 100, Sigma: 1.5, Amount: 4},
+		{MaxSize: 600, Sigma: 0.8, Amount: 2},
+		{MaxSize: 0, Sigma: 0.4, Amount: 1},
+	}, GetAppEnv().SHARPEN_BUCKETS, "sorted by size with the catch-all last")
+}
+
+func TestGetAppEnv_PassthroughFormats(t *testing.T) {
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	t.Setenv("PASSTHROUGH_FORMATS", " TIFF, jp2k,,")
+	ResetAppEnvForTesting()
+	defer ResetAppEnvForTesting()
+
+	assert.Equal(t, []string{"tiff", "jp2k"}, GetAppEnv().PASSTHROUGH_FORMATS)
+}
+
+func TestGetAppEnv_EnableDebugModes(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		expected bool
+	}{
+		{name: "disabled by default", expected: false},
+		{name: "enabled", value: "true", expected: true},
+		{name: "invalid keeps disabled", value: "yes", expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SECRET_KEY", "test-imgop-key")
+			t.Setenv("ENABLE_DEBUG_MODES", tt.value)
+			ResetAppEnvForTesting()
+			defer ResetAppEnvForTesting()
+
+			assert.Equal(t, tt.expected, GetAppEnv().ENABLE_DEBUG_MODES)
+		})
+	}
+}
+
+func TestAppEnv_OriginRateLimitFor(t *testing.T) {
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	t.Setenv("ORIGIN_RATE_LIMIT", "10")
+	t.Setenv("ORIGIN_LIMITS", `{"Fragile.com":{"rate_limit":0.5},"slow.com":{"fetch_timeout":2}}`)
+	ResetAppEnvForTesting()
+	defer ResetAppEnvForTesting()
+
+	appEnv := GetAppEnv()
+	assert.Equal(t, 0.5, appEnv.OriginRateLimitFor("fragile.com"))
+	assert.Equal(t, 10.0, appEnv.OriginRateLimitFor("slow.com"))
+	assert.Equal(t, 10.0, appEnv.OriginRateLimitFor("other.com"))
+
+	t.Setenv("ORIGIN_RATE_LIMIT", "-1")
+	ResetAppEnvForTesting()
+	assert.Equal(t, 0.0, GetAppEnv().ORIGIN_RATE_LIMIT, "invalid keeps unlimited")
+}
@@ -0,0 +1,101 @@
+package helpers
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Upper bound on the operations of a pipeline, each one is a full pass over the image
+const MaxPipelineOps = 8
+
+// Pipeline operations, applied in the order given instead of the implicit order
+const (
+	PipelineTrim    = "trim"    // trim[:threshold]
+	PipelineRotate  = "rotate"  // rotate:degrees
+	PipelineCrop    = "crop"    // crop:W:H, center crop to an aspect ratio
+	PipelineResize  = "resize"  // resize:WxH, either side may be left out
+	PipelineSharpen = "sharpen" // sharpen:sigma
+)
+
+// PipelineOp is a single parsed operation, only the fields of its kind are set
+type PipelineOp struct {
+	Op     string  `json:"op"`
+	Width  int     `json:"width,omitempty"`  // resize box
+	Height int     `json:"height,omitempty"` // resize box
+	Value  float64 `json:"value,omitempty"`  // trim threshold, rotate degrees, crop ratio or sharpen sigma
+}
+
+// ParsePipeline parses a comma separated list of operations with their arguments after
+// a colon, e.g. trim,crop:4:3,rotate:90,resize:800x,sharpen:1.5
+func ParsePipeline(field string, value string) ([]PipelineOp, error) {
+	appEnv := GetAppEnv()
+	steps := strings.Split(value, ",")
+	if len(steps) > MaxPipelineOps {
+		return nil, NewValidationError(ErrCodeInvalidPipeline, field, "%s can have at most %d operations", field, MaxPipelineOps)
+	}
+
+	ops := make([]PipelineOp, 0, len(steps))
+	for _, step := range steps {
+		name, arg, hasArg := strings.Cut(strings.TrimSpace(step), ":")
+		op := PipelineOp{Op: strings.ToLower(name)}
+		switch op.Op {
+		case PipelineTrim:
+			if hasArg {
+				threshold, err := strconv.Atoi(arg)
+				if err != nil || threshold < 1 || threshold > 255 {
+					return nil, NewValidationError(ErrCodeInvalidPipeline, field, "%s trim threshold must be between 1 and 255", field)
+				}
+				op.Value = float64(threshold)
+			}
+		case PipelineRotate:
+			degrees, err := strconv.ParseFloat(arg, 64)
+			if err != nil || !(degrees >= -360 && degrees <= 360) {
+				return nil, NewValidationError(ErrCodeInvalidPipeline, field, "%s rotate must be between -360 and 360", field)
+			}
+			op.Value = degrees
+		case PipelineCrop:
+			ratio, err := ParseAspectRatio(field, arg)
+			if err != nil {
+				return nil, NewValidationError(ErrCodeInvalidPipeline, field, "%s crop must be a ratio like crop:4:3", field)
+			}
+			op.Value = ratio
+		case PipelineResize:
+			width, height, ok := parseResizeBox(arg)
+			if !ok {
+				return nil, NewValidationError(ErrCodeInvalidPipeline, field, "%s resize must be a box like resize:800x600, resize:800x or resize:x600", field)
+			}
+			if width > appEnv.MAX_WIDTH || height > appEnv.MAX_HEIGHT {
+				return nil, NewValidationError(ErrCodeInvalidPipeline, field, "%s resize must be within %dx%d", field, appEnv.MAX_WIDTH, appEnv.MAX_HEIGHT)
+			}
+			op.Width, op.Height = width, height
+		case PipelineSharpen:
+			sigma, err := strconv.ParseFloat(arg, 64)
+			if err != nil || !(sigma > 0 && sigma <= 10) {
+				return nil, NewValidationError(ErrCodeInvalidPipeline, field, "%s sharpen sigma must be above 0 and at most 10", field)
+			}
+			op.Value = sigma
+		default:
+			return nil, NewValidationError(ErrCodeInvalidPipeline, field, "%s operation must be one of trim, rotate, crop, resize, sharpen", field)
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+// parseResizeBox parses WxH where either side may be left out, a bare number is the width
+func parseResizeBox(value string) (int, int, bool) {
+	widthStr, heightStr, _ := strings.Cut(strings.ToLower(value), "x")
+	width, height := 0, 0
+	var err error
+	if widthStr != "" {
+		if width, err = strconv.Atoi(widthStr); err != nil || width < 1 {
+			return 0, 0, false
+		}
+	}
+	if heightStr != "" {
+		if height, err = strconv.Atoi(heightStr); err != nil || height < 1 {
+			return 0, 0, false
+		}
+	}
+	return width, height, width+height > 0
+}
@@ -0,0 +1,103 @@
+package helpers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePipeline(t *testing.T) {
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	ResetAppEnvForTesting()
+	defer ResetAppEnvForTesting()
+
+	tests := []struct {
+		name     string
+		value    string
+		expected []PipelineOp
+		wantErr  bool
+	}{
+		{
+			name:  "Crop rotate resize sharpen",
+			value: "crop:4:3,rotate:90,resize:800x,sharpen:1.5",
+			expected: []PipelineOp{
+				{Op: PipelineCrop, Value: 4.0 / 3},
+				{Op: PipelineRotate, Value: 90},
+				{Op: PipelineResize, Width: 800},
+				{Op: PipelineSharpen, Value: 1.5},
+			},
+		},
+		{
+			name:  "Trim with and without threshold",
+			value: "trim, TRIM:30 ,resize:x600",
+			expected: []PipelineOp{
+				{Op: PipelineTrim},
+				{Op: PipelineTrim, Value: 30},
+				{Op: PipelineResize, Height: 600},
+			},
+		},
+		{name: "Resize box", value: "resize:400x300", expected: []PipelineOp{{Op: PipelineResize, Width: 400, Height: 300}}},
+		{name: "Resize bare width", value: "resize:400", expected: []PipelineOp{{Op: PipelineResize, Width: 400}}},
+		{name: "Unknown operation", value: "resize:400,blur:3", wantErr: true},
+		{name: "Empty operation", value: "resize:400,", wantErr: true},
+		{name: "Empty", value: "", wantErr: true},
+		{name: "Too many operations", value: "trim,trim,trim,trim,trim,trim,trim,trim,trim", wantErr: true},
+		{name: "Rotate missing degrees", value: "rotate", wantErr: true},
+		{name: "Rotate out of range", value: "rotate:400", wantErr: true},
+		{name: "Crop bad ratio", value: "crop:4x3", wantErr: true},
+		{name: "Resize empty box", value: "resize:x", wantErr: true},
+		{name: "Resize above max", value: "resize:5000", wantErr: true},
+		{name: "Sharpen zero", value: "sharpen:0", wantErr: true},
+		{name: "Trim threshold out of range", value: "trim:300", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ops, err := ParsePipeline("pipeline", tt.value)
+			if tt.wantErr {
+				var validationErr *ValidationError
+				if assert.ErrorAs(t, err, &validationErr) {
+					assert.Equal(t, ErrCodeInvalidPipeline, validationErr.Code)
+					assert.Equal(t, "pipeline", validationErr.Field)
+				}
+				return
+			}
+			assert.NoError(t, err)
+			assert.Len(t, ops, len(tt.expected))
+			for i := range tt.expected {
+				assert.Equal(t, tt.expected[i].Op, ops[i].Op)
+				assert.Equal(t, tt.expected[i].Width, ops[i].Width)
+				assert.Equal(t, tt.expected[i].Height, ops[i].Height)
+				assert.InDelta(t, tt.expected[i].Value, ops[i].Value, 0.0001)
+			}
+		})
+	}
+}
+
+func TestValidateParams_PipelineConflicts(t *testing.T) {
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	ResetAppEnvForTesting()
+	defer ResetAppEnvForTesting()
+
+	pipeline := []PipelineOp{{Op: PipelineResize, Width: 400}}
+	conflicts := []ParamsOptimize{
+		{Width: 400},
+		{Height: 300},
+		{Rotate: 90},
+		{Trim: true},
+		{AspectRatio: 1},
+		{Thumbnail: true},
+	}
+	for _, params := range conflicts {
+		params.Pipeline = pipeline
+		_, err := ValidateParams(params)
+		var validationErr *ValidationError
+		if assert.ErrorAs(t, err, &validationErr, "params %+v", params) {
+			assert.Equal(t, ErrCodeInvalidPipeline, validationErr.Code)
+		}
+	}
+
+	// Modifiers of the operations are fine
+	_, err := ValidateParams(ParamsOptimize{Pipeline: pipeline, Quality: 80, WithoutEnlargement: true, TrimColor: []float64{255, 255, 255}})
+	assert.NoError(t, err)
+}
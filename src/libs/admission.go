@@ -0,0 +1,69 @@
+package libs
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrOverloaded is returned when both the processing slots and the wait queue are full
+var ErrOverloaded = errors.New("too many images in flight, retry later")
+
+// AdmissionControl bounds how many images are optimized at once and how many requests
+// may wait for a slot. Requests beyond both are shed immediately instead of queueing
+// until the Lambda times out.
+type AdmissionControl struct {
+	slots    chan struct{}
+	maxQueue int
+
+	mu      sync.Mutex
+	waiting int
+}
+
+// NewAdmissionControl allows concurrency images at once with up to maxQueue waiting,
+// a concurrency of 0 admits everything
+func NewAdmissionControl(concurrency int, maxQueue int) *AdmissionControl {
+	admission := &AdmissionControl{maxQueue: maxQueue}
+	if concurrency > 0 {
+		admission.slots = make(chan struct{}, concurrency)
+	}
+	return admission
+}
+
+// Acquire waits for a processing slot, failing with ErrOverloaded right away when the
+// queue is full or once the context ends. The returned release frees the slot.
+func (a *AdmissionControl) Acquire(ctx context.Context) (func(), error) {
+	if a.slots == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case a.slots <- struct{}{}:
+		return a.release, nil
+	default:
+	}
+
+	a.mu.Lock()
+	if a.waiting >= a.maxQueue {
+		a.mu.Unlock()
+		return nil, ErrOverloaded
+	}
+	a.waiting++
+	a.mu.Unlock()
+	defer func() {
+		a.mu.Lock()
+		a.waiting--
+		a.mu.Unlock()
+	}()
+
+	select {
+	case a.slots <- struct{}{}:
+		return a.release, nil
+	case <-ctx.Done():
+		return nil, ErrOverloaded
+	}
+}
+
+func (a *AdmissionControl) release() {
+	<-a.slots
+}
@@ -0,0 +1,73 @@
+package libs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdmissionControl_Unlimited(t *testing.T) {
+	admission := NewAdmissionControl(0, 0)
+	for i := 0; i < 100; i++ {
+		_, err := admission.Acquire(context.Background())
+		require.NoError(t, err)
+	}
+}
+
+func TestAdmissionControl_ShedsBeyondQueue(t *testing.T) {
+	admission := NewAdmissionControl(2, 1)
+
+	// Fill both slots
+	release1, err := admission.Acquire(context.Background())
+	require.NoError(t, err)
+	_, err = admission.Acquire(context.Background())
+	require.NoError(t, err)
+
+	// One request may wait in the queue
+	queued := make(chan error, 1)
+	go func() {
+		release, err := admission.Acquire(context.Background())
+		if err == nil {
+			release()
+		}
+		queued <- err
+	}()
+	require.Eventually(t, func() bool {
+		admission.mu.Lock()
+		defer admission.mu.Unlock()
+		return admission.waiting == 1
+	}, time.Second, time.Millisecond)
+
+	// Anything beyond slots and queue is shed without waiting
+	start := time.Now()
+	_, err = admission.Acquire(context.Background())
+	assert.ErrorIs(t, err, ErrOverloaded)
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+
+	// Freeing a slot admits the queued request
+	release1()
+	select {
+	case err := <-queued:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("queued request was not admitted")
+	}
+}
+
+func TestAdmissionControl_QueueTimeout(t *testing.T) {
+	admission := NewAdmissionControl(1, 1)
+	_, err := admission.Acquire(context.Background())
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = admission.Acquire(ctx)
+	assert.ErrorIs(t, err, ErrOverloaded)
+
+	admission.mu.Lock()
+	defer admission.mu.Unlock()
+	assert.Zero(t, admission.waiting, "timed out request must leave the queue")
+}
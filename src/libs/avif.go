@@ -0,0 +1,73 @@
+package libs
+
+import (
+	"errors"
+	"imgop/src/helpers"
+	"sync"
+
+	"github.com/cshum/vipsgen/vips"
+)
+
+// ErrAvifUnavailable is returned by the AVIF encode when libvips was built without libheif
+// or libheif without an AV1 encoder
+var ErrAvifUnavailable = errors.New("libvips has no AVIF encoder")
+
+// avifSupported checks once whether libvips can save AVIF, it's replaced in tests to
+// simulate a build without the encoder
+var avifSupported = sync.OnceValue(func() bool {
+	return vips.HasOperation("heifsave_buffer")
+})
+
+// EncoderAvailable reports whether the libvips build can encode the output format
+func EncoderAvailable(format string) bool {
+	if format == "avif" {
+		return avifSupported()
+	}
+	return true
+}
+
+// SetAvifSupportedForTesting overrides the AVIF encoder check and returns a func restoring it
+// This should only be called in tests
+func SetAvifSupportedForTesting(supported bool) func() {
+	previous := avifSupported
+	avifSupported = func() bool { return supported }
+	return func() { avifSupported = previous }
+}
+
+// AV1 encoder effort (0-9) of each optimize level, AV1 is far slower than WebP at the same
+// effort so balanced stays at the libvips default
+var avifEfforts = map[string]int{
+	"fast":     2,
+	"balanced": 4,
+	"max":      7,
+}
+
+// avifEncoderSettings describes the f=avif output. The WebP presets and alpha quality have
+// no AV1 counterpart, alpha is always encoded at the image quality.
+func avifEncoderSettings(params helpers.ParamsOptimize) EncoderSettings {
+	effort, ok := avifEfforts[params.Optimization]
+	if !ok {
+		effort = avifEfforts["balanced"]
+	}
+	return EncoderSettings{
+		Format:        "avif",
+		Quality:       params.Quality,
+		Effort:        effort,
+		StripMetadata: params.StripMetadata,
+		KeepMetadata:  params.KeepMeta,
+	}
+}
+
+// encodeAvif encodes an 8-bit AVIF, libvips saves AVIF through heifsave with AV1 compression
+func encodeAvif(image *vips.Image, encoder EncoderSettings) ([]byte, error) {
+	if !avifSupported() {
+		return nil, ErrAvifUnavailable
+	}
+	return image.HeifsaveBuffer(&vips.HeifsaveBufferOptions{
+		Q:           encoder.Quality,
+		Bitdepth:    8,
+		Compression: vips.HeifCompressionAv1,
+		Effort:      encoder.Effort,
+		Keep:        metadataKeep(encoder.StripMetadata, encoder.KeepMetadata),
+	})
+}
@@ -0,0 +1,93 @@
+package libs
+
+import (
+	"context"
+	"imgop/src/helpers"
+	"testing"
+
+	"github.com/cshum/vipsgen/vips"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAvifEncoderSettings(t *testing.T) {
+	tests := []struct {
+		name     string
+		params   helpers.ParamsOptimize
+		expected EncoderSettings
+	}{
+		{name: "Default", params: helpers.ParamsOptimize{Quality: 60},
+			expected: EncoderSettings{Format: "avif", Quality: 60, Effort: 4}},
+		{name: "Fast", params: helpers.ParamsOptimize{Quality: 60, Optimization: "fast"},
+			expected: EncoderSettings{Format: "avif", Quality: 60, Effort: 2}},
+		{name: "Max", params: helpers.ParamsOptimize{Quality: 60, Optimization: "max"},
+			expected: EncoderSettings{Format: "avif", Quality: 60, Effort: 7}},
+		{name: "WebP options are ignored", params: helpers.ParamsOptimize{Quality: 60, Preset: "drawing", AlphaQuality: 50},
+			expected: EncoderSettings{Format: "avif", Quality: 60, Effort: 4}},
+		{name: "Metadata", params: helpers.ParamsOptimize{Quality: 60, StripMetadata: true, KeepMeta: []string{"icc"}},
+			expected: EncoderSettings{Format: "avif", Quality: 60, Effort: 4, StripMetadata: true, KeepMetadata: []string{"icc"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, avifEncoderSettings(tt.params))
+		})
+	}
+}
+
+func TestProcess_Avif(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	result, err := NewImageOptimizer().Process(context.Background(), newJpeg(t, 400, 200), helpers.ParamsOptimize{
+		Width:       100,
+		Quality:     60,
+		Format:      "avif",
+		Progressive: true,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "avif", result.Encoder.Format)
+	assert.True(t, result.ProgressiveIgnored)
+
+	// libvips reads AVIF with the heif loader
+	output, err := vips.NewImageFromBuffer(result.Image, nil)
+	require.NoError(t, err)
+	defer output.Close()
+	assert.Equal(t, vips.ImageTypeHeif, output.Format())
+	assert.Equal(t, 100, output.Width())
+	assert.Equal(t, 50, output.Height())
+}
+
+func TestProcess_AvifUnavailable(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+	defer SetAvifSupportedForTesting(false)()
+
+	assert.False(t, EncoderAvailable("avif"))
+	assert.True(t, EncoderAvailable("webp"))
+
+	result, err := NewImageOptimizer().Process(context.Background(), newJpeg(t, 400, 200), helpers.ParamsOptimize{
+		Width:   100,
+		Quality: 60,
+		Format:  "avif",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "webp", result.Encoder.Format)
+	assert.Equal(t, "avif", result.FormatFallback)
+
+	output, err := vips.NewImageFromBuffer(result.Image, nil)
+	require.NoError(t, err)
+	defer output.Close()
+	assert.Equal(t, vips.ImageTypeWebp, output.Format())
+	assert.Equal(t, 100, output.Width())
+}
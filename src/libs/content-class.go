@@ -0,0 +1,89 @@
+package libs
+
+import (
+	"imgop/src/helpers"
+
+	"github.com/cshum/vipsgen/vips"
+)
+
+// Longest side of the sample the content class is computed from. Nearest neighbour keeps
+// flat areas exact and edges sharp, where a smoothing kernel would blur both.
+const contentSampleSize = 256
+
+// Grey level difference of two neighbouring pixels across a sharp edge, e.g. text on its
+// background. Photo detail rarely jumps this far from one pixel to the next.
+const sharpEdgeContrast = 64
+
+// classifyPixels tells graphics (screenshots, text, flat art) from photos by their pixels
+// and the AUTO_LOSSLESS_* thresholds, where classifyContent only has the source header.
+// The image itself is left untouched, but its pixels are read again, so the source must
+// not have been loaded with sequential access.
+func classifyPixels(image *vips.Image, appEnv *helpers.AppEnv) (string, error) {
+	sample, err := image.Copy(nil)
+	if err != nil {
+		return "", err
+	}
+	defer sample.Close()
+
+	if sample.HasAlpha() {
+		if err := sample.Flatten(&vips.FlattenOptions{Background: []float64{255, 255, 255}}); err != nil {
+			return "", err
+		}
+	}
+	if err := sample.Colourspace(vips.InterpretationBW, nil); err != nil {
+		return "", err
+	}
+	if err := sample.Cast(vips.BandFormatUchar, nil); err != nil {
+		return "", err
+	}
+	scale := float64(contentSampleSize) / float64(max(sample.Width(), sample.Height()))
+	if scale < 1.0 {
+		if err := sample.Resize(scale, &vips.ResizeOptions{Kernel: vips.KernelNearest}); err != nil {
+			return "", err
+		}
+	}
+
+	pixels, err := sample.RawsaveBuffer(nil)
+	if err != nil {
+		return "", err
+	}
+	flat, edges := neighbourStats(pixels, sample.Width(), sample.Height(), appEnv.AUTO_LOSSLESS_TOLERANCE)
+	if flat >= appEnv.AUTO_LOSSLESS_FLAT_RATIO && edges >= appEnv.AUTO_LOSSLESS_EDGE_RATIO {
+		return ContentGraphic, nil
+	}
+	return ContentPhoto, nil
+}
+
+// neighbourStats returns the fractions of horizontally and vertically neighbouring pixels of
+// a grey image that are within tolerance of each other, and that are across a sharp edge
+func neighbourStats(pixels []byte, width int, height int, tolerance int) (float64, float64) {
+	if width <= 0 || height <= 0 || len(pixels) < width*height {
+		return 0, 0
+	}
+
+	pairs, flat, edges := 0, 0, 0
+	compare := func(a byte, b byte) {
+		diff := abs(int(a) - int(b))
+		pairs++
+		if diff <= tolerance {
+			flat++
+		} else if diff >= sharpEdgeContrast {
+			edges++
+		}
+	}
+	for y := range height {
+		for x := range width {
+			pixel := pixels[y*width+x]
+			if x+1 < width {
+				compare(pixel, pixels[y*width+x+1])
+			}
+			if y+1 < height {
+				compare(pixel, pixels[(y+1)*width+x])
+			}
+		}
+	}
+	if pairs == 0 {
+		return 0, 0
+	}
+	return float64(flat) / float64(pairs), float64(edges) / float64(pairs)
+}
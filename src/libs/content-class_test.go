@@ -0,0 +1,173 @@
+package libs
+
+import (
+	"context"
+	"imgop/src/helpers"
+	"testing"
+
+	"github.com/cshum/vipsgen/vips"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNeighbourStats(t *testing.T) {
+	tests := []struct {
+		name          string
+		pixels        []byte
+		width, height int
+		tolerance     int
+		expectedFlat  float64
+		expectedEdges float64
+	}{
+		{name: "Flat", pixels: []byte{9, 9, 9, 9}, width: 2, height: 2, expectedFlat: 1},
+		{name: "Black and white columns", pixels: []byte{0, 255, 0, 255}, width: 2, height: 2, expectedFlat: 0.5, expectedEdges: 0.5},
+		{name: "Within tolerance", pixels: []byte{100, 102, 101, 100}, width: 2, height: 2, tolerance: 2, expectedFlat: 1},
+		{name: "Soft gradient is neither", pixels: []byte{0, 20, 40, 60}, width: 4, height: 1},
+		{name: "Short buffer", pixels: []byte{0}, width: 2, height: 2},
+		{name: "Single pixel", pixels: []byte{0}, width: 1, height: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flat, edges := neighbourStats(tt.pixels, tt.width, tt.height, tt.tolerance)
+			assert.InDelta(t, tt.expectedFlat, flat, 0.0001)
+			assert.InDelta(t, tt.expectedEdges, edges, 0.0001)
+		})
+	}
+}
+
+// newScreenshotPng returns a white RGB PNG with lines of black glyph-like bars, the flat
+// areas and sharp edges of text in a screenshot
+func newScreenshotPng(t *testing.T) []byte {
+	t.Helper()
+	width, height := 320, 200
+	pixels := make([]byte, width*height*3)
+	for i := range pixels {
+		pixels[i] = 255
+	}
+	for line := range 8 {
+		for y := 20 + line*20; y < 28+line*20; y++ {
+			for x := 10; x < 310; x++ {
+				if x%5 < 3 {
+					offset := (y*width + x) * 3
+					pixels[offset], pixels[offset+1], pixels[offset+2] = 0, 0, 0
+				}
+			}
+		}
+	}
+
+	image, err := vips.NewImageFromMemory(pixels, width, height, 3)
+	require.NoError(t, err)
+	defer image.Close()
+	data, err := image.PngsaveBuffer(nil)
+	require.NoError(t, err)
+	return data
+}
+
+// newNoisePng returns a grey PNG of gaussian noise, no two neighbours alike as in photo detail
+func newNoisePng(t *testing.T) []byte {
+	t.Helper()
+	image, err := vips.NewGaussnoise(320, 200, &vips.GaussnoiseOptions{Mean: 128, Sigma: 30})
+	require.NoError(t, err)
+	defer image.Close()
+	require.NoError(t, image.Cast(vips.BandFormatUchar, nil))
+	data, err := image.PngsaveBuffer(nil)
+	require.NoError(t, err)
+	return data
+}
+
+func TestClassifyPixels(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	tests := []struct {
+		name      string
+		data      []byte
+		flatRatio string
+		expected  string
+	}{
+		{name: "Screenshot", data: newScreenshotPng(t), expected: ContentGraphic},
+		{name: "Noise", data: newNoisePng(t), expected: ContentPhoto},
+		{name: "Flat without edges", data: newJpeg(t, 320, 200), expected: ContentPhoto},
+		{name: "Stricter flat ratio", data: newScreenshotPng(t), flatRatio: "0.99", expected: ContentPhoto},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SECRET_KEY", "test-imgop-key")
+			t.Setenv("AUTO_LOSSLESS_FLAT_RATIO", tt.flatRatio)
+			helpers.ResetAppEnvForTesting()
+			defer helpers.ResetAppEnvForTesting()
+
+			image, err := vips.NewImageFromBuffer(tt.data, nil)
+			require.NoError(t, err)
+			defer image.Close()
+			width, height := image.Width(), image.Height()
+
+			contentClass, err := classifyPixels(image, helpers.GetAppEnv())
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, contentClass)
+			assert.Equal(t, width, image.Width(), "the image itself is left untouched")
+			assert.Equal(t, height, image.Height())
+		})
+	}
+}
+
+func TestProcess_ContentAware(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	tests := []struct {
+		name             string
+		data             []byte
+		format           string
+		expectedFormat   string
+		expectedLossless bool
+		expectedClass    string
+	}{
+		{name: "Screenshot gets lossless WebP over AVIF", data: newScreenshotPng(t), format: "avif",
+			expectedFormat: "webp", expectedLossless: true, expectedClass: ContentGraphic},
+		{name: "Screenshot gets lossless WebP", data: newScreenshotPng(t),
+			expectedFormat: "webp", expectedLossless: true, expectedClass: ContentGraphic},
+		{name: "Photo keeps the negotiated AVIF", data: newNoisePng(t), format: "avif",
+			expectedFormat: "avif", expectedClass: ContentPhoto},
+		{name: "Photo keeps lossy WebP", data: newNoisePng(t),
+			expectedFormat: "webp", expectedClass: ContentPhoto},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := NewImageOptimizer().Process(context.Background(), tt.data, helpers.ParamsOptimize{
+				Quality:      60,
+				Format:       tt.format,
+				ContentAware: true,
+			})
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedFormat, result.Encoder.Format)
+			assert.Equal(t, tt.expectedLossless, result.Encoder.Lossless)
+			assert.Equal(t, tt.expectedClass, result.ContentClass)
+			assert.False(t, result.SequentialAccess, "the classifier reads the pixels a second time")
+
+			if tt.expectedLossless {
+				// Every pixel of the screenshot survives the encode
+				output, err := vips.NewImageFromBuffer(result.Image, nil)
+				require.NoError(t, err)
+				defer output.Close()
+				source, err := vips.NewImageFromBuffer(tt.data, nil)
+				require.NoError(t, err)
+				defer source.Close()
+				require.NoError(t, output.Subtract(source))
+				require.NoError(t, output.Abs())
+				maxDiff, err := output.Max(nil)
+				require.NoError(t, err)
+				assert.Zero(t, maxDiff)
+			}
+		})
+	}
+}
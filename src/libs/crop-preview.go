@@ -0,0 +1,74 @@
+package libs
+
+import (
+	"imgop/src/helpers"
+	"math"
+
+	"github.com/cshum/vipsgen/vips"
+)
+
+// CropBox is an area of the source, in pixels as displayed
+type CropBox struct {
+	Left   int `json:"left"`
+	Top    int `json:"top"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// CropPreview is the crop Optimize would apply to the source, without the cropped pixels
+type CropPreview struct {
+	Width   int     `json:"width"`  // Source width as displayed, after EXIF orientation and rotate
+	Height  int     `json:"height"` // Source height as displayed, after EXIF orientation and rotate
+	Gravity string  `json:"gravity"`
+	Cropped bool    `json:"cropped"` // False when the box is the whole image
+	Crop    CropBox `json:"crop"`
+}
+
+// PreviewCrop reads the source dimensions from its header and returns the crop box the
+// ar param and fit=cover would cut, so the focal region can be checked before publishing
+func (imgop *ImageOptimizerHandler) PreviewCrop(params helpers.ParamsOptimize) (CropPreview, error) {
+	var preview CropPreview
+	err := imgop.withSourceHeader(params, func(image *vips.Image, bytesRead int) {
+		width, height := image.Width(), image.Height()
+		if image.Orientation() >= 5 {
+			// EXIF orientations 5-8 are displayed rotated by 90 degrees
+			width, height = height, width
+		}
+		preview = previewCrop(params, width, height)
+	})
+	return preview, err
+}
+
+// previewCrop computes the crop box of a width x height source, rotated by params.Rotate
+// first like in Optimize. Only right angles are expected, others can't be previewed.
+func previewCrop(params helpers.ParamsOptimize, width int, height int) CropPreview {
+	if math.Mod(math.Abs(params.Rotate), 180) == 90 {
+		width, height = height, width
+	}
+
+	preview := CropPreview{
+		Width:   width,
+		Height:  height,
+		Gravity: "center",
+		Crop:    CropBox{Width: width, Height: height},
+	}
+	if params.Gravity != "" {
+		preview.Gravity = params.Gravity
+	}
+	if params.AspectRatio > 0 {
+		_, _, cropWidth, cropHeight := aspectCrop(width, height, params.AspectRatio)
+		left, top, cropWidth, cropHeight := gravityCrop(width, height, cropWidth, cropHeight, params.Gravity)
+		preview.Crop = CropBox{Left: left, Top: top, Width: cropWidth, Height: cropHeight}
+	}
+	if params.Fit == "cover" {
+		// The box cut after resizing, scaled back to source pixels within the ar crop
+		crop := preview.Crop
+		scale, _ := computeCoverScale(params, crop.Width, crop.Height)
+		boxWidth := int(math.Round(float64(params.Width) / scale))
+		boxHeight := int(math.Round(float64(params.Height) / scale))
+		left, top, cropWidth, cropHeight := gravityCrop(crop.Width, crop.Height, boxWidth, boxHeight, params.Gravity)
+		preview.Crop = CropBox{Left: crop.Left + left, Top: crop.Top + top, Width: cropWidth, Height: cropHeight}
+	}
+	preview.Cropped = preview.Crop.Width != width || preview.Crop.Height != height
+	return preview
+}
@@ -0,0 +1,138 @@
+package libs
+
+import (
+	"cmp"
+	"imgop/src/helpers"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreviewCrop(t *testing.T) {
+	tests := []struct {
+		name            string
+		params          helpers.ParamsOptimize
+		expectedWidth   int
+		expectedHeight  int
+		expectedCropped bool
+		expectedBox     CropBox
+	}{
+		{name: "No ratio keeps the whole image", params: helpers.ParamsOptimize{Width: 800},
+			expectedWidth: 2500, expectedHeight: 1667, expectedBox: CropBox{Width: 2500, Height: 1667}},
+		{name: "Square crops the width around the centre", params: helpers.ParamsOptimize{AspectRatio: 1},
+			expectedWidth: 2500, expectedHeight: 1667, expectedCropped: true, expectedBox: CropBox{Left: 416, Width: 1667, Height: 1667}},
+		{name: "Wide crops the height around the centre", params: helpers.ParamsOptimize{AspectRatio: 16.0 / 9},
+			expectedWidth: 2500, expectedHeight: 1667, expectedCropped: true, expectedBox: CropBox{Top: 130, Width: 2500, Height: 1406}},
+		{name: "Source ratio crops nothing", params: helpers.ParamsOptimize{AspectRatio: 2500.0 / 1667},
+			expectedWidth: 2500, expectedHeight: 1667, expectedBox: CropBox{Width: 2500, Height: 1667}},
+		{name: "Right angle rotate crops the rotated image", params: helpers.ParamsOptimize{AspectRatio: 1, Rotate: -90},
+			expectedWidth: 1667, expectedHeight: 2500, expectedCropped: true, expectedBox: CropBox{Top: 416, Width: 1667, Height: 1667}},
+		{name: "Half turn keeps the orientation", params: helpers.ParamsOptimize{AspectRatio: 1, Rotate: 180},
+			expectedWidth: 2500, expectedHeight: 1667, expectedCropped: true, expectedBox: CropBox{Left: 416, Width: 1667, Height: 1667}},
+		{name: "Cover square crops the width", params: helpers.ParamsOptimize{Width: 400, Height: 400, Fit: "cover"},
+			expectedWidth: 2500, expectedHeight: 1667, expectedCropped: true, expectedBox: CropBox{Left: 416, Width: 1667, Height: 1667}},
+		{name: "Cover wide crops the height", params: helpers.ParamsOptimize{Width: 800, Height: 200, Fit: "cover"},
+			expectedWidth: 2500, expectedHeight: 1667, expectedCropped: true, expectedBox: CropBox{Top: 521, Width: 2500, Height: 625}},
+		{name: "Cover within the ratio crop", params: helpers.ParamsOptimize{Width: 400, Height: 200, Fit: "cover", AspectRatio: 1},
+			expectedWidth: 2500, expectedHeight: 1667, expectedCropped: true, expectedBox: CropBox{Left: 416, Top: 416, Width: 1667, Height: 834}},
+		{name: "Capped cover clips the box to the source", params: helpers.ParamsOptimize{Width: 4000, Height: 1000, Fit: "cover", WithoutEnlargement: true},
+			expectedWidth: 2500, expectedHeight: 1667, expectedCropped: true, expectedBox: CropBox{Top: 333, Width: 2500, Height: 1000}},
+		{name: "Enlarged cover upscales the box into the source", params: helpers.ParamsOptimize{Width: 4000, Height: 1000, Fit: "cover"},
+			expectedWidth: 2500, expectedHeight: 1667, expectedCropped: true, expectedBox: CropBox{Top: 521, Width: 2500, Height: 625}},
+		{name: "Cover north keeps the top", params: helpers.ParamsOptimize{Width: 800, Height: 200, Fit: "cover", Gravity: "north"},
+			expectedWidth: 2500, expectedHeight: 1667, expectedCropped: true, expectedBox: CropBox{Top: 0, Width: 2500, Height: 625}},
+		{name: "Cover south keeps the bottom", params: helpers.ParamsOptimize{Width: 800, Height: 200, Fit: "cover", Gravity: "south"},
+			expectedWidth: 2500, expectedHeight: 1667, expectedCropped: true, expectedBox: CropBox{Top: 1042, Width: 2500, Height: 625}},
+		{name: "Cover southeast pins the cropped axis", params: helpers.ParamsOptimize{Width: 400, Height: 400, Fit: "cover", Gravity: "southeast"},
+			expectedWidth: 2500, expectedHeight: 1667, expectedCropped: true, expectedBox: CropBox{Left: 833, Width: 1667, Height: 1667}},
+		{name: "Ratio west", params: helpers.ParamsOptimize{AspectRatio: 1, Gravity: "west"},
+			expectedWidth: 2500, expectedHeight: 1667, expectedCropped: true, expectedBox: CropBox{Left: 0, Width: 1667, Height: 1667}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			preview := previewCrop(tt.params, 2500, 1667)
+			assert.Equal(t, tt.expectedWidth, preview.Width)
+			assert.Equal(t, tt.expectedHeight, preview.Height)
+			assert.Equal(t, cmp.Or(tt.params.Gravity, "center"), preview.Gravity)
+			assert.Equal(t, tt.expectedCropped, preview.Cropped)
+			assert.Equal(t, tt.expectedBox, preview.Crop)
+		})
+	}
+}
+
+func TestOptimizer_PreviewCrop(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	tests := []struct {
+		name        string
+		data        []byte
+		expectedBox CropBox
+	}{
+		{name: "Upright", data: loadTestImage(t), expectedBox: CropBox{Left: 416, Width: 1667, Height: 1667}},
+		{name: "EXIF rotated", data: withExifOrientation(t, loadTestImage(t), 6), expectedBox: CropBox{Top: 416, Width: 1667, Height: 1667}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "image/jpeg")
+				w.WriteHeader(http.StatusOK)
+				w.Write(tt.data)
+			}))
+			defer server.Close()
+
+			preview, err := NewImageOptimizer().PreviewCrop(helpers.ParamsOptimize{Url: server.URL, AspectRatio: 1})
+			require.NoError(t, err)
+			assert.True(t, preview.Cropped)
+			assert.Equal(t, tt.expectedBox, preview.Crop)
+		})
+	}
+}
+
+func TestOptimizer_PreviewCrop_Gravity(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	testImage := loadTestImage(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.WriteHeader(http.StatusOK)
+		w.Write(testImage)
+	}))
+	defer server.Close()
+
+	// The 2500x1667 test image covering an 800x200 box keeps a 2500x625 band
+	tests := []struct {
+		gravity     string
+		expectedTop int
+	}{
+		{gravity: "north", expectedTop: 0},
+		{gravity: "south", expectedTop: 1042},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.gravity, func(t *testing.T) {
+			preview, err := NewImageOptimizer().PreviewCrop(helpers.ParamsOptimize{
+				Url: server.URL, Width: 800, Height: 200, Fit: "cover", Gravity: tt.gravity,
+			})
+			require.NoError(t, err)
+			assert.Equal(t, tt.gravity, preview.Gravity)
+			assert.Equal(t, CropBox{Top: tt.expectedTop, Width: 2500, Height: 625}, preview.Crop)
+		})
+	}
+}
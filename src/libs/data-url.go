@@ -0,0 +1,53 @@
+package libs
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// dataUrlResponse decodes an inline data: URL (RFC 2397) into a synthetic origin
+// response, so it goes through the same size, content-type and signature checks
+// as a fetched image without any network access.
+func dataUrlResponse(dataUrl *url.URL) (*http.Response, error) {
+	mediaType, encoded, found := strings.Cut(dataUrl.Opaque, ",")
+	if !found {
+		return nil, fmt.Errorf("invalid data url: missing data separator")
+	}
+
+	isBase64 := false
+	if before, ok := strings.CutSuffix(mediaType, ";base64"); ok {
+		mediaType = before
+		isBase64 = true
+	}
+	if !isImageContentType(mediaType) {
+		return nil, fmt.Errorf("invalid data url media type: %s", mediaType)
+	}
+
+	var data []byte
+	var err error
+	if isBase64 {
+		// '+' may have been decoded to a space along the query string
+		encoded = strings.ReplaceAll(encoded, " ", "+")
+		data, err = base64.StdEncoding.DecodeString(encoded)
+	} else {
+		var decoded string
+		decoded, err = url.PathUnescape(encoded)
+		data = []byte(decoded)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid data url encoding: %w", err)
+	}
+
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Type": []string{mediaType}, "Content-Length": []string{strconv.Itoa(len(data))}},
+		Body:          io.NopCloser(bytes.NewReader(data)),
+		ContentLength: int64(len(data)),
+	}, nil
+}
@@ -0,0 +1,135 @@
+package libs
+
+import (
+	"encoding/base64"
+	"imgop/src/helpers"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/cshum/vipsgen/vips"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDataUrlResponse(t *testing.T) {
+	jpegHeader := []byte{0xFF, 0xD8, 0xFF, 0xE0, 0x00, 0x10, 0x4A, 0x46, 0x49, 0x46, 0x00, 0x01, 0xFB, 0xFF}
+	encodedJpeg := base64.StdEncoding.EncodeToString(jpegHeader)
+
+	tests := []struct {
+		name                string
+		dataUrl             string
+		expectedContentType string
+		expectedData        []byte
+		errorContains       string
+	}{
+		{
+			name:                "base64 jpeg",
+			dataUrl:             "data:image/jpeg;base64," + encodedJpeg,
+			expectedContentType: "image/jpeg",
+			expectedData:        jpegHeader,
+		},
+		{
+			name:                "base64 with plus decoded to space",
+			dataUrl:             "data:image/jpeg;base64," + "/9j/4AAQSkZJRgAB" + " /8=",
+			expectedContentType: "image/jpeg",
+			expectedData:        jpegHeader,
+		},
+		{
+			name:                "percent encoded svg",
+			dataUrl:             "data:image/svg+xml,%3Csvg%20xmlns%3D%22http%3A%2F%2Fwww.w3.org%2F2000%2Fsvg%22%3E%3C%2Fsvg%3E",
+			expectedContentType: "image/svg+xml",
+			expectedData:        []byte(`<svg xmlns="http://www.w3.org/2000/svg"></svg>`),
+		},
+		{
+			name:          "non image media type",
+			dataUrl:       "data:text/html;base64," + base64.StdEncoding.EncodeToString([]byte("<html></html>")),
+			errorContains: "invalid data url media type",
+		},
+		{
+			name:          "missing media type",
+			dataUrl:       "data:;base64," + encodedJpeg,
+			errorContains: "invalid data url media type",
+		},
+		{
+			name:          "missing separator",
+			dataUrl:       "data:image/jpeg;base64" + encodedJpeg,
+			errorContains: "missing data separator",
+		},
+		{
+			name:          "invalid base64",
+			dataUrl:       "data:image/jpeg;base64,!!!not-base64!!!",
+			errorContains: "invalid data url encoding",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dataUrl, err := url.Parse(tt.dataUrl)
+			require.NoError(t, err)
+
+			resp, err := dataUrlResponse(dataUrl)
+			if tt.errorContains != "" {
+				assert.ErrorContains(t, err, tt.errorContains)
+				return
+			}
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, tt.expectedContentType, resp.Header.Get("Content-Type"))
+			assert.Equal(t, int64(len(tt.expectedData)), resp.ContentLength)
+			data, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedData, data)
+		})
+	}
+}
+
+func TestOptimize_DataUrlSizeLimit(t *testing.T) {
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	t.Setenv("MAX_DOWNLOAD_BYTES", "8")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	// The download cap applies to the decoded data, rejected before decoding
+	jpegHeader := []byte{0xFF, 0xD8, 0xFF, 0xE0, 0x00, 0x10, 0x4A, 0x46, 0x49, 0x46, 0x00, 0x01}
+	result, err := NewImageOptimizer().Optimize(helpers.ParamsOptimize{
+		Url: "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(jpegHeader),
+	})
+	assert.Error(t, err)
+	assert.Empty(t, result.Image)
+}
+
+func TestOptimize_DataUrl(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	os.Setenv("SECRET_KEY", "test-imgop-key")
+	defer func() {
+		os.Unsetenv("SECRET_KEY")
+		helpers.ResetAppEnvForTesting()
+	}()
+	helpers.ResetAppEnvForTesting()
+
+	smallImage, err := vips.NewBlack(40, 20, &vips.BlackOptions{Bands: 3})
+	require.NoError(t, err)
+	defer smallImage.Close()
+	smallPng, err := smallImage.PngsaveBuffer(nil)
+	require.NoError(t, err)
+
+	result, err := NewImageOptimizer().Optimize(helpers.ParamsOptimize{
+		Url:     "data:image/png;base64," + base64.StdEncoding.EncodeToString(smallPng),
+		Width:   20,
+		Quality: 80,
+	})
+	require.NoError(t, err)
+	require.Greater(t, len(result.Image), 0)
+	assert.Equal(t, len(smallPng), result.SourceBytes)
+	assert.Equal(t, "png", result.SourceFormat)
+	assert.Equal(t, 20, result.Width)
+	assert.Equal(t, 10, result.Height)
+}
@@ -0,0 +1,32 @@
+package libs
+
+import (
+	"errors"
+	"fmt"
+	"imgop/src/helpers"
+)
+
+// ErrDegenerateSource is returned for an empty source, or one below the MIN_SOURCE_* floors
+var ErrDegenerateSource = errors.New("degenerate source")
+
+// checkSourceBytes rejects a source of size bytes below MIN_SOURCE_BYTES, an empty source
+// always is. A negative size is unknown and passes.
+func checkSourceBytes(size int64, appEnv *helpers.AppEnv) error {
+	if size == 0 {
+		return fmt.Errorf("%w: source is empty", ErrDegenerateSource)
+	}
+	if size > 0 && size < appEnv.MIN_SOURCE_BYTES {
+		return fmt.Errorf("%w: source is %d bytes, below the %d bytes minimum", ErrDegenerateSource, size, appEnv.MIN_SOURCE_BYTES)
+	}
+	return nil
+}
+
+// checkSourceDimensions rejects a decoded source smaller than MIN_SOURCE_WIDTH x MIN_SOURCE_HEIGHT,
+// like a 1x1 tracking pixel
+func checkSourceDimensions(width int, height int, appEnv *helpers.AppEnv) error {
+	if width < appEnv.MIN_SOURCE_WIDTH || height < appEnv.MIN_SOURCE_HEIGHT {
+		return fmt.Errorf("%w: source is %dx%d, below the %dx%d minimum", ErrDegenerateSource,
+			width, height, appEnv.MIN_SOURCE_WIDTH, appEnv.MIN_SOURCE_HEIGHT)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package libs
+
+import (
+	"imgop/src/helpers"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckSourceBytes(t *testing.T) {
+	permissive := &helpers.AppEnv{}
+	assert.ErrorIs(t, checkSourceBytes(0, permissive), ErrDegenerateSource, "an empty source is always degenerate")
+	assert.NoError(t, checkSourceBytes(1, permissive))
+	assert.NoError(t, checkSourceBytes(-1, permissive), "an unknown size passes")
+
+	floor := &helpers.AppEnv{MIN_SOURCE_BYTES: 100}
+	assert.ErrorContains(t, checkSourceBytes(43, floor), "source is 43 bytes, below the 100 bytes minimum")
+	assert.NoError(t, checkSourceBytes(100, floor))
+	assert.NoError(t, checkSourceBytes(-1, floor))
+}
+
+func TestCheckSourceDimensions(t *testing.T) {
+	permissive := &helpers.AppEnv{MIN_SOURCE_WIDTH: 1, MIN_SOURCE_HEIGHT: 1}
+	assert.NoError(t, checkSourceDimensions(1, 1, permissive))
+
+	floor := &helpers.AppEnv{MIN_SOURCE_WIDTH: 2, MIN_SOURCE_HEIGHT: 2}
+	assert.ErrorContains(t, checkSourceDimensions(1, 1, floor), "source is 1x1, below the 2x2 minimum")
+	assert.ErrorIs(t, checkSourceDimensions(640, 1, floor), ErrDegenerateSource)
+	assert.NoError(t, checkSourceDimensions(2, 2, floor))
+}
+
+func TestOptimize_DegenerateSource(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	pixel := newJpeg(t, 1, 1)
+	tests := []struct {
+		name          string
+		data          []byte
+		minWidth      string
+		minBytes      string
+		expectedImage bool
+	}{
+		{name: "1x1 passes by default", data: pixel, expectedImage: true},
+		{name: "1x1 below the dimension floor", data: pixel, minWidth: "2"},
+		{name: "1x1 below the byte floor", data: pixel, minBytes: "100000"},
+		{name: "0-byte source", data: []byte{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "image/jpeg")
+				w.WriteHeader(http.StatusOK)
+				w.Write(tt.data)
+			}))
+			defer server.Close()
+
+			t.Setenv("SECRET_KEY", "test-imgop-key")
+			t.Setenv("MIN_SOURCE_WIDTH", tt.minWidth)
+			t.Setenv("MIN_SOURCE_BYTES", tt.minBytes)
+			helpers.ResetAppEnvForTesting()
+			defer helpers.ResetAppEnvForTesting()
+
+			result, err := NewImageOptimizer().Optimize(helpers.ParamsOptimize{Url: server.URL, Width: 100, Quality: 80})
+			if tt.expectedImage {
+				require.NoError(t, err)
+				require.Greater(t, len(result.Image), 0)
+			} else {
+				assert.ErrorIs(t, err, ErrDegenerateSource)
+				assert.Empty(t, result.Image)
+			}
+		})
+	}
+}
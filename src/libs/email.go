@@ -0,0 +1,43 @@
+package libs
+
+import (
+	"imgop/src/helpers"
+	"slices"
+
+	"github.com/cshum/vipsgen/vips"
+)
+
+// emailEncoderSettings describes the email=1 output: a progressive JPEG without metadata
+// besides the ICC profile, unless keep_meta says otherwise. Email clients have no use for the WebP presets or effort.
+func emailEncoderSettings(params helpers.ParamsOptimize) EncoderSettings {
+	return EncoderSettings{
+		Format:        "jpeg",
+		Quality:       params.Quality,
+		StripMetadata: true,
+		Progressive:   true,
+		KeepMetadata:  params.KeepMeta,
+		QuantTable:    params.QuantTable,
+	}
+}
+
+// encodeEmail flattens any alpha onto the background and encodes the email-safe JPEG
+func encodeEmail(image *vips.Image, params helpers.ParamsOptimize) ([]byte, error) {
+	if image.HasAlpha() {
+		if err := image.Flatten(&vips.FlattenOptions{Background: params.Background}); err != nil {
+			return nil, err
+		}
+	}
+	return image.JpegsaveBuffer(&vips.JpegsaveBufferOptions{
+		Q:              params.Quality,
+		OptimizeCoding: true,
+		Interlace:      true,
+		Keep:           metadataKeep(true, params.KeepMeta),
+		QuantTable:     quantTableIndex(params.QuantTable),
+	})
+}
+
+// quantTableIndex maps a qtable preset onto the libvips quant_table index, 0 (the libjpeg
+// default) when none was requested
+func quantTableIndex(name string) int {
+	return max(slices.Index(helpers.QuantTables, name), 0)
+}
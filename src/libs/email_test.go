@@ -0,0 +1,103 @@
+package libs
+
+import (
+	"bytes"
+	"imgop/src/helpers"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cshum/vipsgen/vips"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmailEncoderSettings(t *testing.T) {
+	encoder := emailEncoderSettings(helpers.ParamsOptimize{Quality: 85, Preset: "drawing", Optimization: "max"})
+	assert.Equal(t, EncoderSettings{Format: "jpeg", Quality: 85, StripMetadata: true, Progressive: true}, encoder)
+
+	encoder = emailEncoderSettings(helpers.ParamsOptimize{Quality: 85, QuantTable: "imagemagick"})
+	assert.Equal(t, "imagemagick", encoder.QuantTable)
+}
+
+func TestOptimize_Email(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	t.Setenv("PASSTHROUGH_FORMATS", "png")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	// Fully transparent PNG, flattening it must give the background color
+	alphaImage, err := vips.NewBlack(64, 64, &vips.BlackOptions{Bands: 4})
+	require.NoError(t, err)
+	defer alphaImage.Close()
+	alphaPng, err := alphaImage.PngsaveBuffer(nil)
+	require.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.WriteHeader(http.StatusOK)
+		w.Write(alphaPng)
+	}))
+	defer server.Close()
+
+	params, err := helpers.ValidateParams(helpers.ParamsOptimize{Url: server.URL, Width: 32, Quality: 80, Email: true})
+	require.NoError(t, err)
+	result, err := NewImageOptimizer().Optimize(params)
+	require.NoError(t, err)
+	require.Greater(t, len(result.Image), 0)
+	assert.False(t, result.Passthrough, "email overrides passthrough")
+	assert.Equal(t, "jpeg", result.Encoder.Format)
+	assert.True(t, result.Encoder.Progressive)
+	assert.False(t, result.ProgressiveIgnored)
+	// SOF2 marks a progressive JPEG
+	assert.True(t, bytes.Contains(result.Image, []byte{0xFF, 0xC2}))
+
+	output, err := vips.NewImageFromBuffer(result.Image, nil)
+	require.NoError(t, err)
+	defer output.Close()
+	assert.Equal(t, vips.ImageTypeJpeg, output.Format())
+	assert.False(t, output.HasAlpha())
+	assert.Equal(t, 3, output.Bands())
+	average, err := output.Avg()
+	require.NoError(t, err)
+	assert.InDelta(t, 255, average, 1, "flattened onto white")
+}
+
+func TestQuantTableIndex(t *testing.T) {
+	assert.Equal(t, 0, quantTableIndex(""))
+	assert.Equal(t, 0, quantTableIndex("default"))
+	assert.Equal(t, 3, quantTableIndex("imagemagick"))
+	assert.Equal(t, 8, quantTableIndex("peterson"))
+}
+
+func TestEncodeEmail_QuantTable(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	encode := func(quantTable string) []byte {
+		image, err := vips.NewImageFromBuffer(loadTestImage(t), nil)
+		require.NoError(t, err)
+		defer image.Close()
+		output, err := encodeEmail(image, helpers.ParamsOptimize{Quality: 80, QuantTable: quantTable})
+		require.NoError(t, err)
+		return output
+	}
+
+	standard := encode("")
+	assert.Equal(t, standard, encode("default"), "default is the libjpeg table")
+	flat := encode("flat")
+	if bytes.Equal(standard, flat) {
+		t.Skip("libvips built without MozJPEG ignores quant_table")
+	}
+	assert.NotEqual(t, len(standard), len(flat))
+	assert.NotEqual(t, len(standard), len(encode("imagemagick")))
+}
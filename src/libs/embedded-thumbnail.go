@@ -0,0 +1,77 @@
+package libs
+
+import (
+	"imgop/src/helpers"
+	"math"
+
+	"github.com/cshum/vipsgen/vips"
+)
+
+// libvips exposes the EXIF thumbnail of a JPEG under this blob field
+const exifThumbnailField = "jpeg-thumbnail-data"
+
+// Camera thumbnails are sometimes letterboxed to a fixed ratio, those are never used
+const maxThumbnailRatioDiff = 0.01
+
+// embeddedThumbnail decodes the EXIF thumbnail of a JPEG source when it covers the
+// requested size without enlarging, carrying over the source orientation since the
+// thumbnail is stored like the main image. It returns false when there is none or it
+// is too small, the full image is used then.
+func embeddedThumbnail(image *vips.Image, params helpers.ParamsOptimize) (*vips.Image, bool) {
+	if image.Format() != vips.ImageTypeJpeg || !image.HasField(exifThumbnailField) {
+		return nil, false
+	}
+	// Explicit pipelines resize to their own boxes, and no size means the full image
+	if len(params.Pipeline) > 0 || (params.Width == 0 && params.Height == 0) {
+		return nil, false
+	}
+
+	data, err := image.GetBlob(exifThumbnailField)
+	if err != nil || !isImageFileSignature(data) {
+		return nil, false
+	}
+	thumbnail, err := vips.NewImageFromBuffer(data, &vips.LoadOptions{FailOnError: true})
+	if err != nil {
+		return nil, false
+	}
+
+	orientation := image.Orientation()
+	if !thumbnailCovers(params, image.Width(), image.Height(), thumbnail.Width(), thumbnail.Height(), orientation) {
+		thumbnail.Close()
+		return nil, false
+	}
+	if orientation > 1 {
+		if err := thumbnail.SetOrientation(orientation); err != nil {
+			thumbnail.Close()
+			return nil, false
+		}
+	}
+	return thumbnail, true
+}
+
+// thumbnailCovers reports whether a thumbnail with the same ratio as the source is large
+// enough for the requested box, both sizes are as stored before the EXIF orientation
+func thumbnailCovers(params helpers.ParamsOptimize, sourceWidth int, sourceHeight int, width int, height int, orientation int) bool {
+	sourceRatio := float64(sourceWidth) / float64(sourceHeight)
+	if math.Abs(float64(width)/float64(height)-sourceRatio)/sourceRatio > maxThumbnailRatioDiff {
+		return false
+	}
+
+	if orientation >= 5 {
+		// EXIF orientations 5-8 are displayed rotated by 90 degrees
+		width, height = height, width
+	}
+	if params.AspectRatio > 0 {
+		_, _, width, height = aspectCrop(width, height, params.AspectRatio)
+	}
+	if params.Fit == "cover" {
+		scale, _ := computeCoverScale(params, width, height)
+		return scale <= 1.0
+	}
+	if params.Fit == "fill" {
+		scaleX, scaleY, _ := computeFillScale(params, width, height)
+		return scaleX <= 1.0 && scaleY <= 1.0
+	}
+	scale, _ := computeScale(params, width, height)
+	return scale <= 1.0
+}
@@ -0,0 +1,145 @@
+package libs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"imgop/src/helpers"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cshum/vipsgen/vips"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withExifThumbnail inserts an APP1 EXIF segment right after the JPEG SOI, with an
+// orientation in IFD0 and the thumbnail JPEG referenced from IFD1
+func withExifThumbnail(t *testing.T, jpeg []byte, thumbnail []byte, orientation uint16) []byte {
+	t.Helper()
+	le := binary.LittleEndian
+	entry := func(buf *bytes.Buffer, tag uint16, kind uint16, value uint32) {
+		binary.Write(buf, le, tag)
+		binary.Write(buf, le, kind)
+		binary.Write(buf, le, uint32(1))
+		binary.Write(buf, le, value)
+	}
+
+	const ifd0Offset, ifd1Offset = 8, 8 + 18
+	const thumbnailOffset = ifd1Offset + 30
+	tiff := &bytes.Buffer{}
+	tiff.WriteString("II")
+	binary.Write(tiff, le, uint16(42))
+	binary.Write(tiff, le, uint32(ifd0Offset))
+	// IFD0: orientation (SHORT), then the offset of IFD1
+	binary.Write(tiff, le, uint16(1))
+	entry(tiff, 0x0112, 3, uint32(orientation))
+	binary.Write(tiff, le, uint32(ifd1Offset))
+	// IFD1: thumbnail offset and length (LONG), no further IFD
+	binary.Write(tiff, le, uint16(2))
+	entry(tiff, 0x0201, 4, thumbnailOffset)
+	entry(tiff, 0x0202, 4, uint32(len(thumbnail)))
+	binary.Write(tiff, le, uint32(0))
+	tiff.Write(thumbnail)
+
+	payload := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	require.Less(t, len(payload)+2, 1<<16, "thumbnail too large for an APP1 segment")
+
+	out := &bytes.Buffer{}
+	out.Write(jpeg[:2]) // SOI
+	out.Write([]byte{0xFF, 0xE1})
+	binary.Write(out, binary.BigEndian, uint16(len(payload)+2))
+	out.Write(payload)
+	out.Write(jpeg[2:])
+	return out.Bytes()
+}
+
+func newJpeg(t *testing.T, width int, height int) []byte {
+	t.Helper()
+	image, err := vips.NewBlack(width, height, &vips.BlackOptions{Bands: 3})
+	require.NoError(t, err)
+	defer image.Close()
+	jpeg, err := image.JpegsaveBuffer(nil)
+	require.NoError(t, err)
+	return jpeg
+}
+
+func TestThumbnailCovers(t *testing.T) {
+	tests := []struct {
+		name        string
+		params      helpers.ParamsOptimize
+		width       int
+		height      int
+		orientation int
+		expected    bool
+	}{
+		{name: "Smaller box", params: helpers.ParamsOptimize{Width: 100}, width: 160, height: 120, expected: true},
+		{name: "Same size", params: helpers.ParamsOptimize{Width: 160, Height: 120}, width: 160, height: 120, expected: true},
+		{name: "Larger box", params: helpers.ParamsOptimize{Width: 400}, width: 160, height: 120, expected: false},
+		{name: "Letterboxed thumbnail", params: helpers.ParamsOptimize{Width: 100}, width: 160, height: 160, expected: false},
+		{name: "Rotated source", params: helpers.ParamsOptimize{Height: 150}, width: 160, height: 120, orientation: 6, expected: true},
+		{name: "Rotated source too small", params: helpers.ParamsOptimize{Width: 150}, width: 160, height: 120, orientation: 6, expected: false},
+		{name: "Fill", params: helpers.ParamsOptimize{Width: 160, Height: 60, Fit: "fill"}, width: 160, height: 120, expected: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, thumbnailCovers(tt.params, 1600, 1200, tt.width, tt.height, tt.orientation))
+		})
+	}
+}
+
+func TestOptimize_EmbeddedThumbnail(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	plainJpeg := newJpeg(t, 1600, 1200)
+	thumbJpeg := withExifThumbnail(t, plainJpeg, newJpeg(t, 160, 120), 1)
+	rotatedJpeg := withExifThumbnail(t, plainJpeg, newJpeg(t, 160, 120), 6)
+
+	sources := map[string][]byte{"/plain.jpg": plainJpeg, "/thumb.jpg": thumbJpeg, "/rotated.jpg": rotatedJpeg}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.WriteHeader(http.StatusOK)
+		w.Write(sources[r.URL.Path])
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name           string
+		path           string
+		width          int
+		useThumb       bool
+		expectedThumb  bool
+		expectedWidth  int
+		expectedHeight int
+	}{
+		{name: "Thumbnail covers the size", path: "/thumb.jpg", width: 100, useThumb: true, expectedThumb: true, expectedWidth: 100, expectedHeight: 75},
+		{name: "Thumbnail too small", path: "/thumb.jpg", width: 400, useThumb: true, expectedWidth: 400, expectedHeight: 300},
+		{name: "No thumbnail", path: "/plain.jpg", width: 100, useThumb: true, expectedWidth: 100, expectedHeight: 75},
+		{name: "Not requested", path: "/thumb.jpg", width: 100, expectedWidth: 100, expectedHeight: 75},
+		{name: "Source orientation applies", path: "/rotated.jpg", width: 90, useThumb: true, expectedThumb: true, expectedWidth: 90, expectedHeight: 120},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := NewImageOptimizer().Optimize(helpers.ParamsOptimize{
+				Url:              server.URL + tt.path,
+				Width:            tt.width,
+				Quality:          80,
+				UseEmbeddedThumb: tt.useThumb,
+			})
+			require.NoError(t, err)
+			require.Greater(t, len(result.Image), 0)
+
+			assert.Equal(t, tt.expectedThumb, result.EmbeddedThumbnail)
+			assert.Equal(t, tt.expectedWidth, result.Width)
+			assert.Equal(t, tt.expectedHeight, result.Height)
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package libs
+
+import (
+	"context"
+	"errors"
+	"imgop/src/helpers"
+	"io"
+	"sync"
+)
+
+// ErrFetchSlotTimeout is returned when no outbound fetch slot freed up within the deadline
+var ErrFetchSlotTimeout = errors.New("too many outbound fetches in flight")
+
+// FetchLimiter bounds the outbound fetches in flight, so a warm container handling a big
+// batch doesn't exhaust its connections and file descriptors. A slot is held until the
+// response body is closed.
+type FetchLimiter struct {
+	slots chan struct{}
+}
+
+// NewFetchLimiter allows limit fetches at once, a limit of 0 allows everything
+func NewFetchLimiter(limit int) *FetchLimiter {
+	limiter := &FetchLimiter{}
+	if limit > 0 {
+		limiter.slots = make(chan struct{}, limit)
+	}
+	return limiter
+}
+
+// Acquire waits for a fetch slot, failing with ErrFetchSlotTimeout once the context ends.
+// The returned release frees the slot.
+func (l *FetchLimiter) Acquire(ctx context.Context) (func(), error) {
+	if l.slots == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return l.release, nil
+	case <-ctx.Done():
+		return nil, ErrFetchSlotTimeout
+	}
+}
+
+func (l *FetchLimiter) release() {
+	<-l.slots
+}
+
+// fetchLimiter returns the limiter shared by all requests of the handler, sized by
+// MAX_OUTBOUND_FETCHES on first use
+func (imgop *ImageOptimizerHandler) fetchLimiter() *FetchLimiter {
+	imgop.fetchSlotsOnce.Do(func() {
+		imgop.fetchSlots = NewFetchLimiter(helpers.GetAppEnv().MAX_OUTBOUND_FETCHES)
+	})
+	return imgop.fetchSlots
+}
+
+// releasingBody frees the fetch slot once the response body is closed
+type releasingBody struct {
+	io.ReadCloser
+	releaseOnce sync.Once
+	release     func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.releaseOnce.Do(b.release)
+	return err
+}
@@ -0,0 +1,130 @@
+package libs
+
+import (
+	"context"
+	"imgop/src/helpers"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetchLimiter_Unlimited(t *testing.T) {
+	limiter := NewFetchLimiter(0)
+	for i := 0; i < 100; i++ {
+		_, err := limiter.Acquire(context.Background())
+		require.NoError(t, err)
+	}
+}
+
+func TestFetchLimiter_QueuesBeyondLimit(t *testing.T) {
+	limiter := NewFetchLimiter(2)
+
+	release1, err := limiter.Acquire(context.Background())
+	require.NoError(t, err)
+	_, err = limiter.Acquire(context.Background())
+	require.NoError(t, err)
+
+	// A third fetch waits for a slot instead of failing
+	queued := make(chan error, 1)
+	go func() {
+		release, err := limiter.Acquire(context.Background())
+		if err == nil {
+			release()
+		}
+		queued <- err
+	}()
+	select {
+	case <-queued:
+		t.Fatal("fetch beyond the limit was not queued")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release1()
+	select {
+	case err := <-queued:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("queued fetch was not admitted")
+	}
+}
+
+func TestFetchLimiter_Deadline(t *testing.T) {
+	limiter := NewFetchLimiter(1)
+	_, err := limiter.Acquire(context.Background())
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = limiter.Acquire(ctx)
+	assert.ErrorIs(t, err, ErrFetchSlotTimeout)
+}
+
+func TestOpenOrigin_MaxOutboundFetches(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte{0xFF, 0xD8, 0xFF})
+	}))
+	defer server.Close()
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	t.Setenv("MAX_OUTBOUND_FETCHES", "2")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	imgop := NewImageOptimizer()
+	imageUrl, err := url.Parse(server.URL + "/a.jpg")
+	require.NoError(t, err)
+
+	// Both slots are held until the bodies are closed
+	first, err := imgop.openOrigin(context.Background(), http.MethodGet, imageUrl)
+	require.NoError(t, err)
+	second, err := imgop.openOrigin(context.Background(), http.MethodGet, imageUrl)
+	require.NoError(t, err)
+	defer second.Body.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = imgop.openOrigin(ctx, http.MethodGet, imageUrl)
+	assert.ErrorIs(t, err, ErrFetchSlotTimeout)
+	assert.Equal(t, int32(2), requests.Load(), "the fetch beyond the bound is never sent")
+
+	// A queued fetch goes out once a body is closed
+	queued := make(chan error, 1)
+	go func() {
+		resp, err := imgop.openOrigin(context.Background(), http.MethodGet, imageUrl)
+		if err == nil {
+			resp.Body.Close()
+		}
+		queued <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	first.Body.Close()
+	first.Body.Close() // Closing twice frees a single slot
+	select {
+	case err := <-queued:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("queued fetch was not sent")
+	}
+	assert.Equal(t, int32(3), requests.Load())
+
+	// Data URLs are never fetched, so they don't need a slot
+	dataUrl, err := url.Parse("data:image/jpeg;base64,/9j/")
+	require.NoError(t, err)
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = imgop.fetchLimiter().Acquire(ctx)
+	require.NoError(t, err)
+	resp, err := imgop.openOrigin(ctx, http.MethodGet, dataUrl)
+	require.NoError(t, err)
+	resp.Body.Close()
+}
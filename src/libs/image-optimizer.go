@@ -3,81 +3,834 @@ package libs
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"imgop/src/helpers"
 	"io"
+	"log/slog"
 	"math"
+	"net"
 	"net/http"
 	"net/url"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cshum/vipsgen/vips"
 )
 
-type ImageOptimizerHandler struct{}
+type ImageOptimizerHandler struct {
+	client     *http.Client
+	clientOnce sync.Once
+
+	s3     s3ObjectAPI
+	s3Err  error
+	s3Once sync.Once
+
+	placeholder   *cachedSource
+	placeholderMu sync.Mutex
+
+	originLimiter *OriginRateLimiter
+
+	fetchSlots     *FetchLimiter
+	fetchSlotsOnce sync.Once
+}
+
+// OptimizeResult holds the encoded image along with metadata about the decisions made
+type OptimizeResult struct {
+	Image          []byte          `json:"-"`
+	SourceBytes    int             `json:"source_bytes"`
+	SourceHash     string          `json:"source_hash"` // SHA-256 of the source bytes
+	SourceFormat   string          `json:"source_format"`
+	OriginalWidth  int             `json:"original_width"`
+	OriginalHeight int             `json:"original_height"`
+	Fit            string          `json:"fit"`
+	Scale          float64         `json:"scale"`
+	Width          int             `json:"width"`
+	Height         int             `json:"height"`
+	EnlargeCapped  bool            `json:"enlarge_capped"`
+	Encoder        EncoderSettings `json:"encoder"`
+	// Vertical scale of a fit=fill resize, Scale is then the horizontal one
+	VerticalScale float64 `json:"vertical_scale,omitempty"`
+	// Max/min axis scale ratio of a fit=fill resize, flagged above ASPECT_DISTORTION_THRESHOLD
+	AspectDistortion float64 `json:"aspect_distortion,omitempty"`
+	AspectDistorted  bool    `json:"aspect_distorted,omitempty"`
+	// Source colorspace converted to sRGB before processing, empty when already RGB/grey
+	ConvertedColorspace string `json:"converted_colorspace,omitempty"`
+	// Progressive output was requested but the format doesn't support it
+	ProgressiveIgnored bool `json:"progressive_ignored,omitempty"`
+	// Requested format that couldn't be encoded, the image is WebP instead
+	FormatFallback string `json:"format_fallback,omitempty"`
+	// Dominant color as #rrggbb, only computed for swatches
+	DominantColor string `json:"dominant_color,omitempty"`
+	// Sharpen sigma applied after the resize, 0 when not sharpened
+	Sharpen float64 `json:"sharpen"`
+	// Sharpen amount (libvips m2) of auto_sharpen, 0 is the libvips default
+	SharpenAmount float64 `json:"sharpen_amount,omitempty"`
+	// Explicit operations applied in order, instead of the implicit steps
+	Pipeline []helpers.PipelineOp `json:"pipeline,omitempty"`
+	// Whether the source was decoded top to bottom, letting libvips discard decoded lines
+	SequentialAccess bool `json:"sequential_access"`
+	// Source bytes returned untouched because the format is in PASSTHROUGH_FORMATS
+	Passthrough bool `json:"passthrough,omitempty"`
+	// A PASSTHROUGH_FORMATS source was re-encoded instead, it carried HTML or script markup
+	PolyglotReencoded bool `json:"polyglot_reencoded,omitempty"`
+	// The source failed and this is the PLACEHOLDER_URL image instead
+	Fallback bool `json:"fallback,omitempty"`
+	// Resized from the EXIF thumbnail instead of the full image, see use_embedded_thumb
+	EmbeddedThumbnail bool `json:"embedded_thumbnail,omitempty"`
+	// f=jpeg was encoded as WebP instead to keep the image transparency, see ALPHA_POLICY
+	AlphaPreserved bool `json:"alpha_preserved,omitempty"`
+	// Content class of f=auto (graphic, photo), graphics are encoded as lossless WebP
+	ContentClass string `json:"content_class,omitempty"`
+	// Few-pixel WebP data URI of the output, only computed for lqip=1
+	Lqip string `json:"lqip,omitempty"`
+	// Origin response headers selected by FORWARD_HEADERS
+	ForwardedHeaders map[string]string `json:"forwarded_headers,omitempty"`
+	// libvips warnings emitted while processing, e.g. truncated data
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// Headers that describe the connection or the original body, never forwarded from the origin
+var unforwardableHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade",
+	"Content-Length", "Content-Type", "Content-Encoding", "Set-Cookie",
+}
+
+// EncoderSettings describes the options the output was encoded with
+type EncoderSettings struct {
+	Format         string `json:"format"`
+	Quality        int    `json:"quality"`
+	Effort         int    `json:"effort"`
+	SmartSubsample bool   `json:"smart_subsample"`
+	Preset         string `json:"preset"`
+	AlphaQuality   int    `json:"alpha_quality,omitempty"`
+	MinSize        bool   `json:"min_size"`
+	StripMetadata  bool   `json:"strip_metadata"`
+	Progressive    bool   `json:"progressive"`
+	// Metadata namespaces kept by keep_meta, overriding StripMetadata
+	KeepMetadata []string `json:"keep_metadata,omitempty"`
+	// JPEG quantization table preset, only set for JPEG output
+	QuantTable string `json:"quant_table,omitempty"`
+	// Lossless WebP, picked by f=auto for graphics
+	Lossless bool `json:"lossless,omitempty"`
+}
+
+// Formats whose encoders support progressive/interlaced output (JPEG progressive, PNG interlace)
+var progressiveFormats = []string{"jpeg", "png"}
+
+var webpPresets = map[string]vips.WebpPreset{
+	"default": vips.WebpPresetDefault,
+	"picture": vips.WebpPresetPicture,
+	"photo":   vips.WebpPresetPhoto,
+	"drawing": vips.WebpPresetDrawing,
+	"icon":    vips.WebpPresetIcon,
+	"text":    vips.WebpPresetText,
+}
 
 func NewImageOptimizer() *ImageOptimizerHandler {
-	return &ImageOptimizerHandler{}
+	return &ImageOptimizerHandler{originLimiter: NewOriginRateLimiter()}
 }
 
-func (imgop *ImageOptimizerHandler) Optimize(params helpers.ParamsOptimize) []byte {
+// Optimize fetches, transforms and encodes the image. When the origin fails to deliver a
+// usable source and PLACEHOLDER_URL is set, the placeholder is optimized with the same
+// params instead, and if the placeholder fails too the error of the requested image is
+// returned. A source outside the allowlist and our own failures are never replaced.
+func (imgop *ImageOptimizerHandler) Optimize(params helpers.ParamsOptimize) (OptimizeResult, error) {
+	appEnv := helpers.GetAppEnv()
+	result, err := imgop.optimize(params)
+	if err == nil || appEnv.PLACEHOLDER_URL == "" || params.Url == appEnv.PLACEHOLDER_URL {
+		return result, err
+	}
+	if errors.Is(err, helpers.ErrOriginNotAllowed) || !IsSourceError(err) {
+		return result, err
+	}
+
+	placeholderParams := params
+	placeholderParams.Url = appEnv.PLACEHOLDER_URL
+	placeholder, placeholderErr := imgop.optimize(placeholderParams)
+	if placeholderErr != nil {
+		return OptimizeResult{}, err
+	}
+	placeholder.Fallback = true
+	// The placeholder origin's headers say nothing about the requested image
+	placeholder.ForwardedHeaders = nil
+	return placeholder, nil
+}
+
+// optimize collects the libvips warnings of one source and logs why it failed
+func (imgop *ImageOptimizerHandler) optimize(params helpers.ParamsOptimize) (OptimizeResult, error) {
+	// Attribute libvips warnings to this request, error paths only log them
+	vipsWarnings.begin(params.Url, params.RequestID)
+	defer vipsWarnings.end()
+
+	result, err := imgop.fetchAndProcess(params)
+	// Non-image content is logged with the origin status instead
+	if err != nil && !errors.Is(err, helpers.ErrNonImageContent) {
+		NewError(err)
+	}
+	return result, err
+}
+
+func (imgop *ImageOptimizerHandler) fetchAndProcess(params helpers.ParamsOptimize) (OptimizeResult, error) {
 	appEnv := helpers.GetAppEnv()
 	// Validate if it is a proper url using simple reges
 	imageUrl, err := url.Parse(params.Url)
 	if err != nil {
-		return []byte{}
+		return OptimizeResult{}, err
 	}
 
-	// Get timeout from environment variable, default to 5 seconds
-	timeout := time.Duration(appEnv.FETCH_TIMEOUT) * time.Second
+	// Get timeout from environment variable (or the origin override), default to 5 seconds
+	timeout := time.Duration(appEnv.FetchTimeoutFor(imageUrl.Host)) * time.Second
 
 	// Create context with timeout
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
-	// Create HTTP request with context
-	req, err := http.NewRequestWithContext(ctx, "GET", imageUrl.String(), nil)
-	if err != nil {
-		return []byte{}
-	}
-
 	// Execute request with timeout
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := imgop.openSource(ctx, http.MethodGet, imageUrl)
 	if err != nil {
-		return []byte{}
+		return OptimizeResult{}, err
 	}
 	defer resp.Body.Close()
 
-	// Check HTTP status code
-	if resp.StatusCode != http.StatusOK {
-		return []byte{}
+	// Check HTTP status code against the accepted success statuses
+	if !appEnv.IsAcceptedStatus(resp.StatusCode) {
+		return OptimizeResult{}, originStatusError(resp.StatusCode)
+	}
+
+	maxDownloadBytes := appEnv.MaxDownloadBytesFor(imageUrl.Host)
+	if resp.StatusCode == http.StatusPartialContent {
+		if appEnv.PARTIAL_CONTENT != "complete" {
+			return OptimizeResult{}, fmt.Errorf("%w: partial content rejected", ErrSourceUnavailable)
+		}
+		resp, err = completePartialContent(ctx, imgop.httpClient(), imageUrl, resp, maxDownloadBytes)
+		if err != nil {
+			return OptimizeResult{}, sourceUnavailable(err)
+		}
+	}
+
+	// Reject sources that declare a size above the limit before reading them, the counting
+	// reader below still enforces it for chunked responses without a Content-Length
+	if maxDownloadBytes > 0 && resp.ContentLength > maxDownloadBytes {
+		return OptimizeResult{}, fmt.Errorf("%w: source exceeds %d bytes", ErrSourceTooLarge, maxDownloadBytes)
+	}
+
+	// Fail empty and tiny sources with a clear error instead of encoding a degenerate image
+	if err := checkSourceBytes(resp.ContentLength, appEnv); err != nil {
+		return OptimizeResult{}, err
 	}
 
 	// Validate that the response is an image and get validated body reader
-	validatedBody, err := validateImageFile(resp)
+	validatedBody, err := validateHintedImageFile(resp, params.SourceFormat)
 	if err != nil {
-		return []byte{}
+		logInvalidSource(err, resp)
+		return OptimizeResult{}, err
 	}
 	defer validatedBody.Close()
 
-	// Create source from validated image body
-	source := vips.NewSource(validatedBody)
-	defer source.Close() // source needs to remain available during image lifetime
+	// Count source bytes as vips consumes the body, failing once the limit is exceeded
+	countedBody := &countingReader{reader: validatedBody, limit: maxDownloadBytes}
+	// Hash the source as it is read, it identifies the content for the ETag
+	sourceHash := sha256.New()
+	hashedBody := io.TeeReader(countedBody, sourceHash)
+
+	var result OptimizeResult
+	if isSvgContentType(resp.Header.Get("Content-Type")) {
+		// SVGs are sanitized and rasterized without loading external resources
+		var image *vips.Image
+		if image, err = loadSvg(hashedBody, params.Density); err == nil {
+			result, err = processImage(image, nil, false, params)
+		}
+	} else if streamDecode(resp.Header.Get("Content-Type"), resp.ContentLength, params) {
+		// Huge TIFFs are decoded while they download instead of being buffered first
+		source := vips.NewSource(io.NopCloser(hashedBody))
+		defer source.Close()
+		var image *vips.Image
+		if image, err = loadImageStream(source, params); err == nil {
+			result, err = processImage(image, nil, true, params)
+		}
+	} else {
+		// Buffer the compressed source (bounded by the download limit) so it can be
+		// decoded again with random access when sequential access isn't enough
+		var sourceData []byte
+		if sourceData, err = io.ReadAll(hashedBody); err != nil && !errors.Is(err, ErrSourceTooLarge) {
+			// The body failed mid-download
+			err = sourceUnavailable(err)
+		} else if err == nil {
+			result, err = imgop.Process(ctx, sourceData, params)
+		}
+	}
+	if err != nil {
+		return OptimizeResult{}, err
+	}
+
+	result.SourceBytes = countedBody.count
+	result.SourceHash = hex.EncodeToString(sourceHash.Sum(nil))
+	result.ForwardedHeaders = forwardHeaders(resp.Header, appEnv.FORWARD_HEADERS)
+	result.Warnings = vipsWarnings.end()
+	return result, nil
+}
 
+// Process transforms and encodes a source that is already in memory, everything Optimize
+// does once the source is fetched. The same bytes and params always give the same output,
+// so it can be called directly with fixture bytes. SVGs are recognized by their signature
+// and sanitized like fetched ones. Origin headers and libvips warnings are left to Optimize.
+func (imgop *ImageOptimizerHandler) Process(ctx context.Context, src []byte, params helpers.ParamsOptimize) (OptimizeResult, error) {
+	if err := ctx.Err(); err != nil {
+		return OptimizeResult{}, err
+	}
+	appEnv := helpers.GetAppEnv()
+	// Chunked responses only know their size once read
+	if err := checkSourceBytes(int64(len(src)), appEnv); err != nil {
+		return OptimizeResult{}, err
+	}
+
+	var result OptimizeResult
+	if isSvgSignature(src) {
+		image, err := loadSvg(bytes.NewReader(src), params.Density)
+		if err != nil {
+			return OptimizeResult{}, err
+		}
+		if result, err = processImage(image, nil, false, params); err != nil {
+			return OptimizeResult{}, err
+		}
+	} else {
+		if appEnv.REJECT_POLYGLOTS && containsMarkup(src) {
+			return OptimizeResult{}, ErrPolyglotSource
+		}
+		image, sequentialAccess, err := loadImage(src, params)
+		if err != nil {
+			return OptimizeResult{}, err
+		}
+		if result, err = processImage(image, src, sequentialAccess, params); err != nil {
+			return OptimizeResult{}, err
+		}
+	}
+
+	sourceHash := sha256.Sum256(src)
+	result.SourceBytes = len(src)
+	result.SourceHash = hex.EncodeToString(sourceHash[:])
+	return result, nil
+}
+
+// processImage transforms and encodes the decoded source. sourceData is the compressed
+// source when it was buffered, which lets passthrough formats be returned as is. It owns
+// the image and closes it, the operations below replace the pixels in place so only the
+// last image (a swatch or embedded thumbnail may have replaced the source) is left open.
+func processImage(image *vips.Image, sourceData []byte, sequentialAccess bool, params helpers.ParamsOptimize) (OptimizeResult, error) {
+	// Native memory isn't collected by the GC, a warm Lambda would keep every decode
+	defer func() { image.Close() }()
+	appEnv := helpers.GetAppEnv()
+	sourceFormat := string(image.Format())
+	if params.SourceFormat != "" && sourceFormat != params.SourceFormat {
+		// The signature wasn't checked, so the hint has to hold
+		return OptimizeResult{}, decodeError(fmt.Errorf("source is %s, not the hinted %s", sourceFormat, params.SourceFormat))
+	}
+	if err := checkSourceDimensions(image.Width(), image.Height(), appEnv); err != nil {
+		return OptimizeResult{}, err
+	}
+
+	passthrough := sourceData != nil && !params.Email && slices.Contains(appEnv.PASSTHROUGH_FORMATS, sourceFormat)
+	polyglotReencoded := false
+	if passthrough && containsMarkup(sourceData) {
+		// Browsers may sniff the markup of an untouched polyglot and run it, re-encoding drops it
+		passthrough, polyglotReencoded = false, true
+	}
+	if passthrough {
+		// Long-tail formats are returned as is with their header metadata, instead of
+		// attempting a transform that might fail
+		return OptimizeResult{
+			Image:          sourceData,
+			SourceFormat:   sourceFormat,
+			OriginalWidth:  image.Width(),
+			OriginalHeight: image.Height(),
+			Fit:            "none",
+			Scale:          1.0,
+			Width:          image.Width(),
+			Height:         image.Height(),
+			Encoder:        EncoderSettings{Format: sourceFormat},
+			Passthrough:    true,
+		}, nil
+	}
+
+	embeddedThumbnailUsed := false
+	if params.UseEmbeddedThumb {
+		if thumbnail, ok := embeddedThumbnail(image, params); ok {
+			// A fraction of the pixels to decode, and still large enough for the output
+			image.Close()
+			image, embeddedThumbnailUsed = thumbnail, true
+		}
+	}
+
+	if params.Orient == "preserve" && image.Orientation() >= 5 {
+		// The box is as displayed, while the pixels stay stored rotated by 90 degrees
+		params = transposeBox(params)
+	}
+	if err := normalizeOrientation(image, params.Orient, params.Rotate, params.Background); err != nil {
+		return OptimizeResult{}, err
+	}
+
+	// CMYK and other non-RGB sources can make resize fail, convert them first
+	convertedColorspace, err := convertToSrgb(image)
+	if err != nil {
+		return OptimizeResult{}, err
+	}
+
+	originalWidth := image.Width()
+	originalHeight := image.Height()
+
+	dominantColorHex := ""
+	if params.Swatch {
+		// Replace the image with a solid swatch of its dominant color
+		dominantColor, err := findDominantColor(image)
+		if err != nil {
+			return OptimizeResult{}, err
+		}
+		image.Close()
+		swatchWidth, swatchHeight := swatchSize(params)
+		image, err = newSwatch(swatchWidth, swatchHeight, dominantColor)
+		if err != nil {
+			return OptimizeResult{}, err
+		}
+		dominantColorHex = hexColor(dominantColor)
+	}
+
+	var geometry pipelineResult
+	if len(params.Pipeline) > 0 {
+		geometry, err = applyPipeline(image, params)
+	} else {
+		geometry, err = applyImplicitSteps(image, params)
+	}
+	if err != nil {
+		return OptimizeResult{}, fmt.Errorf("processing failed for %s source: %w", sourceFormat, err)
+	}
+
+	fit := "contain"
+	distortion := 0.0
+	if params.Fit == "cover" {
+		fit = "cover"
+	} else if params.Fit == "fill" {
+		fit = "fill"
+		distortion = aspectDistortion(geometry.Scale, geometry.VerticalScale)
+	}
+
+	format := params.Format
+	alphaPreserved := false
+	if format == "jpeg" && !params.Email {
+		if format, err = jpegOutputFormat(image, params.Background, sequentialAccess); err != nil {
+			return OptimizeResult{}, err
+		}
+		alphaPreserved = format != "jpeg"
+	}
+	contentClass := ""
+	if params.ContentAware && !params.Email {
+		// Lossy AVIF or WebP smears text and sharp edges, graphics are kept lossless
+		if contentClass, err = classifyPixels(image, appEnv); err != nil {
+			return OptimizeResult{}, err
+		}
+		if contentClass == ContentGraphic {
+			format = "webp"
+		}
+	}
+
+	var encoder EncoderSettings
+	var imageByte []byte
+	progressiveIgnored := false
+	formatFallback := ""
+	if params.Email {
+		// The email bundle overrides the format, whatever else was requested
+		encoder = emailEncoderSettings(params)
+		imageByte, err = encodeEmail(image, params)
+	} else if format == "jpeg" {
+		encoder = jpegEncoderSettings(params)
+		encoder.Progressive, progressiveIgnored = progressiveSettings(params.Progressive, encoder.Format)
+		imageByte, err = encodeJpeg(image, encoder, params.Background)
+	} else if format == "avif" {
+		encoder = avifEncoderSettings(params)
+		encoder.Progressive, progressiveIgnored = progressiveSettings(params.Progressive, encoder.Format)
+		if imageByte, err = encodeAvif(image, encoder); err != nil {
+			// WebP is always enabled, a missing or failing AV1 encoder costs the format, not the image
+			NewError(fmt.Errorf("avif encode failed, falling back to webp: %w", err))
+			formatFallback = "avif"
+			encoder = webpEncoderSettings(params, image.HasAlpha(), appEnv.DEFAULT_EFFORT)
+			encoder.Progressive, progressiveIgnored = progressiveSettings(params.Progressive, encoder.Format)
+			imageByte, err = encodeWebp(image, encoder)
+		}
+	} else {
+		encoder = webpEncoderSettings(params, image.HasAlpha(), appEnv.DEFAULT_EFFORT)
+		encoder.Progressive, progressiveIgnored = progressiveSettings(params.Progressive, encoder.Format)
+		encoder.Lossless = contentClass == ContentGraphic
+		imageByte, err = encodeWebp(image, encoder)
+	}
+
+	if err != nil {
+		return OptimizeResult{}, err
+	}
+
+	lqip := ""
+	if params.Lqip {
+		// Only an extra to the image, which is still returned without it
+		if lqip, err = encodeLqip(image); err != nil {
+			NewError(fmt.Errorf("lqip failed: %w", err))
+		}
+	}
+
+	return OptimizeResult{
+		Image:          imageByte,
+		SourceFormat:   sourceFormat,
+		OriginalWidth:  originalWidth,
+		OriginalHeight: originalHeight,
+		Fit:            fit,
+		Scale:          geometry.Scale,
+		Width:          image.Width(),
+		Height:         image.Height(),
+		EnlargeCapped:  geometry.EnlargeCapped,
+		Encoder:        encoder,
+		AlphaPreserved: alphaPreserved,
+		ContentClass:   contentClass,
+
+		DominantColor:    dominantColorHex,
+		Sharpen:          geometry.Sharpen,
+		SharpenAmount:    geometry.SharpenAmount,
+		VerticalScale:    geometry.VerticalScale,
+		AspectDistortion: distortion,
+		AspectDistorted:  distortion > appEnv.ASPECT_DISTORTION_THRESHOLD,
+		Pipeline:         params.Pipeline,
+		SequentialAccess: sequentialAccess,
+
+		ProgressiveIgnored:  progressiveIgnored,
+		FormatFallback:      formatFallback,
+		ConvertedColorspace: convertedColorspace,
+
+		EmbeddedThumbnail: embeddedThumbnailUsed,
+		PolyglotReencoded: polyglotReencoded,
+		Lqip:              lqip,
+	}, nil
+}
+
+// applyImplicitSteps trims, crops to the aspect ratio, resizes and sharpens, in that order
+func applyImplicitSteps(image *vips.Image, params helpers.ParamsOptimize) (pipelineResult, error) {
+	if params.Trim {
+		if err := trimBorders(image, params.TrimColor, params.TrimThreshold); err != nil {
+			return pipelineResult{}, err
+		}
+	}
+
+	if params.AspectRatio > 0 {
+		_, _, width, height := aspectCrop(image.Width(), image.Height(), params.AspectRatio)
+		left, top, width, height := gravityCrop(image.Width(), image.Height(), width, height, params.Gravity)
+		if err := image.ExtractArea(left, top, width, height); err != nil {
+			return pipelineResult{}, err
+		}
+	}
+
+	result := pipelineResult{}
+	if params.Fit == "cover" {
+		// Scale to cover the whole box, then cut the overflow of the other axis
+		result.Scale, result.EnlargeCapped = computeCoverScale(params, image.Width(), image.Height())
+		if err := image.Resize(result.Scale, nil); err != nil {
+			return pipelineResult{}, fmt.Errorf("resize failed: %w", err)
+		}
+		left, top, width, height := gravityCrop(image.Width(), image.Height(), params.Width, params.Height, params.Gravity)
+		if err := image.ExtractArea(left, top, width, height); err != nil {
+			return pipelineResult{}, fmt.Errorf("cover crop failed: %w", err)
+		}
+		// A capped cover is meant to stay below the box
+		if !result.EnlargeCapped {
+			if err := snapToBox(image, params.Width, params.Height); err != nil {
+				return pipelineResult{}, fmt.Errorf("exact size correction failed: %w", err)
+			}
+		}
+	} else if params.Fit == "fill" {
+		// Independent axis scales stretch the image to the exact box
+		result.Scale, result.VerticalScale, result.EnlargeCapped = computeFillScale(params, image.Width(), image.Height())
+		if err := image.Resize(result.Scale, &vips.ResizeOptions{Vscale: result.VerticalScale}); err != nil {
+			return pipelineResult{}, fmt.Errorf("resize failed: %w", err)
+		}
+		if !result.EnlargeCapped {
+			if err := snapToBox(image, params.Width, params.Height); err != nil {
+				return pipelineResult{}, fmt.Errorf("exact size correction failed: %w", err)
+			}
+		}
+	} else {
+		result.Scale, result.EnlargeCapped = computeScale(params, image.Width(), image.Height())
+		if err := image.Resize(result.Scale, nil); err != nil {
+			return pipelineResult{}, fmt.Errorf("resize failed: %w", err)
+		}
+		// Capped in contain mode means the source is below both w and h
+		if result.EnlargeCapped && params.Undersize == "pad" {
+			if err := padToBox(image, params.Width, params.Height, params.Background); err != nil {
+				return pipelineResult{}, fmt.Errorf("pad failed: %w", err)
+			}
+		}
+	}
+
+	// Sharpen by the least downscaled axis
+	downscale := max(result.Scale, result.VerticalScale)
+	if params.AutoSharpen != "" {
+		if downscale < 1.0 {
+			result.Sharpen, result.SharpenAmount = autoSharpen(helpers.GetAppEnv().SHARPEN_BUCKETS, params.AutoSharpen, image.Width(), image.Height())
+		}
+	} else {
+		result.Sharpen = sharpenSigma(params.Sharpen, downscale)
+	}
+	if result.Sharpen > 0 {
+		// A 0 amount keeps the libvips default
+		if err := image.Sharpen(&vips.SharpenOptions{Sigma: result.Sharpen, M2: result.SharpenAmount}); err != nil {
+			return pipelineResult{}, err
+		}
+	}
+
+	return result, nil
+}
+
+// loadImage decodes the source, using sequential access when the pipeline only streams
+// top to bottom so libvips can discard decoded lines instead of holding the whole image
+// in memory. Rotations (manual or EXIF), trimming, explicit pipelines, LQIPs, f=auto,
+// upscaling and the alpha scan of f=jpeg need random access, in which case the source is
+// decoded again with the default access.
+func loadImage(data []byte, params helpers.ParamsOptimize) (*vips.Image, bool, error) {
+	if params.Rotate == 0 && !params.Trim && len(params.Pipeline) == 0 && !params.Lqip && !params.ContentAware {
+		image, err := vips.NewImageFromBuffer(data, &vips.LoadOptions{
+			FailOnError: true, // Fail on first error
+			Access:      vips.AccessSequential,
+		})
+		if err != nil {
+			return nil, false, decodeError(err)
+		}
+		if canUseSequentialAccess(params, image.Orientation(), image.Width(), image.Height()) && !needsAlphaScan(image, params) {
+			return image, true, nil
+		}
+		image.Close()
+	}
+
+	image, err := vips.NewImageFromBuffer(data, &vips.LoadOptions{
+		FailOnError: true, // Fail on first error
+	})
+	if err != nil {
+		return nil, false, decodeError(err)
+	}
+	return image, false, nil
+}
+
+// decodeError marks a source libvips couldn't decode, so it can be told apart from a
+// failed fetch
+func decodeError(err error) error {
+	return fmt.Errorf("%w: %w", helpers.ErrUnsupportedMedia, err)
+}
+
+// ErrSourceUnavailable marks a source that couldn't be fetched: the request failed or the
+// origin answered with an unaccepted status
+var ErrSourceUnavailable = errors.New("source unavailable")
+
+// sourceUnavailable marks a failed fetch so it can be told apart from our own failures,
+// a source outside the allowlist keeps its own error
+func sourceUnavailable(err error) error {
+	if errors.Is(err, helpers.ErrOriginNotAllowed) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrSourceUnavailable, err)
+}
+
+// originStatusError is the error of an origin response with an unaccepted status
+func originStatusError(statusCode int) error {
+	return fmt.Errorf("%w: unexpected origin status: %d", ErrSourceUnavailable, statusCode)
+}
+
+// IsSourceError reports whether the optimize failed on the origin side: the source couldn't
+// be fetched in time or at all, or what the origin sent isn't a usable image. Anything else
+// failed in our own transform or encode.
+func IsSourceError(err error) bool {
+	return errors.Is(err, ErrSourceUnavailable) || IsTimeout(err) ||
+		errors.Is(err, helpers.ErrNonImageContent) || errors.Is(err, helpers.ErrUnsupportedMedia) ||
+		errors.Is(err, ErrSourceTooLarge) || errors.Is(err, ErrDegenerateSource) || errors.Is(err, ErrPolyglotSource)
+}
+
+// IsTimeout reports whether the optimize failed because the origin didn't answer within
+// the fetch timeout, as opposed to answering with something unusable
+func IsTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// loadImageStream decodes the source as it is read. The source can't be read a second
+// time, so an image that would need random access is rejected instead of decoded again.
+func loadImageStream(source *vips.Source, params helpers.ParamsOptimize) (*vips.Image, error) {
 	image, err := vips.NewImageFromSource(source, &vips.LoadOptions{
 		FailOnError: true, // Fail on first error
+		Access:      vips.AccessSequential,
+	})
+	if err != nil {
+		return nil, decodeError(err)
+	}
+	if !canUseSequentialAccess(params, image.Orientation(), image.Width(), image.Height()) {
+		image.Close()
+		return nil, decodeError(fmt.Errorf("streamed source only supports downscaling an upright image"))
+	}
+	return image, nil
+}
+
+// streamDecode reports whether the source is a TIFF above STREAM_DECODE_BYTES and the
+// params are known to allow a single sequential read, the orientation is checked once
+// the header is loaded
+func streamDecode(contentType string, contentLength int64, params helpers.ParamsOptimize) bool {
+	appEnv := helpers.GetAppEnv()
+	if appEnv.STREAM_DECODE_BYTES <= 0 || contentLength <= appEnv.STREAM_DECODE_BYTES {
+		return false
+	}
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	if !strings.EqualFold(strings.TrimSpace(mediaType), "image/tiff") {
+		return false
+	}
+	return params.Rotate == 0 && !params.Trim && len(params.Pipeline) == 0 && !params.Lqip && !params.ContentAware
+}
+
+// canUseSequentialAccess reports whether the pipeline is a pure downscale of an
+// upright image, the only case where reading the source once top to bottom is safe
+func canUseSequentialAccess(params helpers.ParamsOptimize, orientation int, width int, height int) bool {
+	// The LQIP and the f=auto classifier read the output pixels a second time
+	if params.Rotate != 0 || params.Trim || len(params.Pipeline) > 0 || params.Lqip || params.ContentAware || orientation > 1 {
+		return false
+	}
+	if params.AspectRatio > 0 {
+		_, _, width, height = aspectCrop(width, height, params.AspectRatio)
+	}
+	if params.Fit == "cover" {
+		scale, _ := computeCoverScale(params, width, height)
+		return scale <= 1.0
+	}
+	if params.Fit == "fill" {
+		scaleX, scaleY, _ := computeFillScale(params, width, height)
+		return scaleX <= 1.0 && scaleY <= 1.0
+	}
+	scale, _ := computeScale(params, width, height)
+	return scale <= 1.0
+}
+
+// padToBox letterboxes the image centered in the width x height box, on the bg color or
+// transparent when there is none
+func padToBox(image *vips.Image, width int, height int, background []float64) error {
+	if background == nil {
+		if !image.HasAlpha() {
+			if err := image.Addalpha(); err != nil {
+				return err
+			}
+		}
+		background = []float64{0, 0, 0, 0}
+	} else if image.HasAlpha() {
+		// The padding of an image with alpha is opaque bg color
+		background = append(slices.Clone(background), 255)
+	}
+	return image.Gravity(vips.CompassDirectionCentre, width, height, &vips.GravityOptions{
+		Extend:     vips.ExtendBackground,
+		Background: background,
 	})
+}
+
+// snapToBox makes the image exactly width x height when the resize rounded it a pixel off,
+// cropping the extra row/column or repeating the edge for the missing one. An axis further
+// off than that wasn't rounded and is left alone.
+func snapToBox(image *vips.Image, width int, height int) error {
+	targetWidth, targetHeight := image.Width(), image.Height()
+	if abs(targetWidth-width) == 1 {
+		targetWidth = width
+	}
+	if abs(targetHeight-height) == 1 {
+		targetHeight = height
+	}
+	if targetWidth < image.Width() || targetHeight < image.Height() {
+		if err := image.ExtractArea(0, 0, min(targetWidth, image.Width()), min(targetHeight, image.Height())); err != nil {
+			return err
+		}
+	}
+	if targetWidth > image.Width() || targetHeight > image.Height() {
+		return image.Embed(0, 0, targetWidth, targetHeight, &vips.EmbedOptions{Extend: vips.ExtendCopy})
+	}
+	return nil
+}
+
+func abs(value int) int {
+	if value < 0 {
+		return -value
+	}
+	return value
+}
+
+// aspectCrop returns the centered area of the image with the requested width/height ratio,
+// cropping whichever dimension is in excess so the resolution is otherwise kept
+func aspectCrop(width int, height int, ratio float64) (int, int, int, int) {
+	cropWidth, cropHeight := width, height
+	if float64(width)/float64(height) > ratio {
+		cropWidth = max(int(math.Round(float64(height)*ratio)), 1)
+	} else {
+		cropHeight = max(int(math.Round(float64(width)/ratio)), 1)
+	}
+	return (width - cropWidth) / 2, (height - cropHeight) / 2, cropWidth, cropHeight
+}
+
+// gravityCrop returns the cropWidth x cropHeight area of the image on the gravity side,
+// clipped to the image when it is smaller in either dimension. The compass direction
+// pins the crop to that edge or corner, the axes it doesn't name stay centered.
+func gravityCrop(width int, height int, cropWidth int, cropHeight int, gravity string) (int, int, int, int) {
+	cropWidth, cropHeight = min(cropWidth, width), min(cropHeight, height)
+	left, top := (width-cropWidth)/2, (height-cropHeight)/2
+	switch {
+	case strings.HasSuffix(gravity, "west"):
+		left = 0
+	case strings.HasSuffix(gravity, "east"):
+		left = width - cropWidth
+	}
+	switch {
+	case strings.HasPrefix(gravity, "north"):
+		top = 0
+	case strings.HasPrefix(gravity, "south"):
+		top = height - cropHeight
+	}
+	return left, top, cropWidth, cropHeight
+}
 
+// trimBorders crops away the borders matching the background color within the threshold,
+// which handles off-white or textured scan borders. A nil color or 0 threshold keeps the
+// libvips default, and an image that is entirely border is left untouched.
+func trimBorders(image *vips.Image, color []float64, threshold int) error {
+	left, top, width, height, err := image.FindTrim(&vips.FindTrimOptions{
+		Threshold:  float64(threshold),
+		Background: color,
+	})
 	if err != nil {
-		NewError(err)
-		return []byte{}
+		return err
+	}
+	if width == 0 || height == 0 {
+		return nil
 	}
+	return image.ExtractArea(left, top, width, height)
+}
 
-	originalWidth := image.Width()
-	originalHeight := image.Height()
+// forwardHeaders picks the named origin headers, skipping hop-by-hop/body headers
+// and stripping control characters so values can't inject extra headers
+func forwardHeaders(originHeaders http.Header, names []string) map[string]string {
+	forwarded := map[string]string{}
+	for _, name := range names {
+		name = http.CanonicalHeaderKey(name)
+		if slices.Contains(unforwardableHeaders, name) {
+			continue
+		}
+		value := helpers.HeaderValue(originHeaders.Get(name), 0)
+		if value != "" {
+			forwarded[name] = value
+		}
+	}
+	return forwarded
+}
 
+// computeScale returns the resize scale for the requested box and whether it
+// was capped at the source size because enlargement is disabled
+func computeScale(params helpers.ParamsOptimize, originalWidth int, originalHeight int) (float64, bool) {
 	var scale float64 = 1.0 // Default left as it is
 
 	switch {
@@ -96,25 +849,535 @@ func (imgop *ImageOptimizerHandler) Optimize(params helpers.ParamsOptimize) []by
 		scale = math.Min(scaleW, scaleH)
 	}
 
-	image.Resize(scale, nil)
-	imageByte, err := image.WebpsaveBuffer(&vips.WebpsaveBufferOptions{
-		Q:              params.Quality, // Quality factor (0-100)
-		Effort:         4,              // Compression effort (0-6)
+	if params.WithoutEnlargement && scale > 1.0 {
+		return 1.0, true
+	}
+	return scale, false
+}
+
+// computeCoverScale returns the uniform scale at which the image covers the whole box, the
+// larger of the two axis scales, capped at 1 when enlargement is disabled
+func computeCoverScale(params helpers.ParamsOptimize, originalWidth int, originalHeight int) (float64, bool) {
+	scaleW := float64(params.Width) / float64(originalWidth)
+	scaleH := float64(params.Height) / float64(originalHeight)
+	scale := math.Max(scaleW, scaleH)
+
+	if params.WithoutEnlargement && scale > 1.0 {
+		return 1.0, true
+	}
+	return scale, false
+}
+
+// computeFillScale returns the horizontal and vertical scales stretching the image to the
+// exact box, each capped at 1 when enlargement is disabled, and whether either was capped
+func computeFillScale(params helpers.ParamsOptimize, originalWidth int, originalHeight int) (float64, float64, bool) {
+	scaleX := float64(params.Width) / float64(originalWidth)
+	scaleY := float64(params.Height) / float64(originalHeight)
+
+	enlargeCapped := false
+	if params.WithoutEnlargement && scaleX > 1.0 {
+		scaleX, enlargeCapped = 1.0, true
+	}
+	if params.WithoutEnlargement && scaleY > 1.0 {
+		scaleY, enlargeCapped = 1.0, true
+	}
+	return scaleX, scaleY, enlargeCapped
+}
+
+// aspectDistortion is how much more one axis was scaled than the other, 1 for a uniform scale
+func aspectDistortion(scaleX float64, scaleY float64) float64 {
+	if scaleY == 0 || scaleX == scaleY {
+		return 1.0
+	}
+	return max(scaleX, scaleY) / min(scaleX, scaleY)
+}
+
+// progressiveSettings returns whether progressive output applies to the format, and
+// whether a progressive request is ignored because the format can't do it
+func progressiveSettings(requested bool, format string) (bool, bool) {
+	if !requested {
+		return false, false
+	}
+	if slices.Contains(progressiveFormats, format) {
+		return true, false
+	}
+	return false, true
+}
+
+// sharpenSigma scales the sharpen sigma with how much the image was downscaled,
+// so heavy reductions get the full amount and near-original sizes barely any.
+// Images that aren't downscaled are never sharpened.
+func sharpenSigma(sigma float64, scale float64) float64 {
+	if sigma <= 0 || scale >= 1.0 {
+		return 0
+	}
+	return sigma * (1.0 - scale)
+}
+
+// Amount multiplier of each auto_sharpen level
+var sharpenLevelAmounts = map[string]float64{
+	"low":    0.5,
+	"medium": 1.0,
+	"high":   1.5,
+}
+
+// autoSharpen returns the sigma and amount of the first bucket the output fits in by its
+// longest side, the amount scaled by the level. Outputs larger than every bucket without
+// a catch-all aren't sharpened.
+func autoSharpen(buckets []helpers.SharpenBucket, level string, width int, height int) (float64, float64) {
+	size := max(width, height)
+	for _, bucket := range buckets {
+		if bucket.MaxSize == 0 || size <= bucket.MaxSize {
+			return bucket.Sigma, bucket.Amount * sharpenLevelAmounts[level]
+		}
+	}
+	return 0, 0
+}
+
+// encodeWebp encodes the WebP output, lossless for graphics
+func encodeWebp(image *vips.Image, encoder EncoderSettings) ([]byte, error) {
+	return image.WebpsaveBuffer(&vips.WebpsaveBufferOptions{
+		Q:              encoder.Quality,
+		Lossless:       encoder.Lossless,
+		Effort:         encoder.Effort,
+		SmartSubsample: encoder.SmartSubsample,
+		Preset:         webpPresets[encoder.Preset],
+		AlphaQ:         encoder.AlphaQuality,
+		MinSize:        encoder.MinSize,
+		Keep:           metadataKeep(encoder.StripMetadata, encoder.KeepMetadata),
+	})
+}
+
+// webpEncoderSettings picks the WebP encoder options. Images with an alpha channel are
+// usually UI graphics, so they default to the drawing preset with a lossless-grade alpha
+// plane, while opaque images default to the photo preset. Explicit params always win.
+//
+// The optimize level bundles the latency vs size knobs:
+//   - fast: effort 1, plain chroma subsampling
+//   - balanced (default): defaultEffort (DEFAULT_EFFORT, 4 unless configured), smart subsampling
+//   - max: effort 6, smart subsampling, min_size
+func webpEncoderSettings(params helpers.ParamsOptimize, hasAlpha bool, defaultEffort int) EncoderSettings {
+	encoder := EncoderSettings{
+		Format:         "webp",
+		Quality:        params.Quality, // Quality factor (0-100)
+		Effort:         defaultEffort,  // Compression effort (0-6)
 		SmartSubsample: true,           // Better chroma subsampling
+		Preset:         "photo",
+	}
+	switch params.Optimization {
+	case "fast":
+		encoder.Effort = 1
+		encoder.SmartSubsample = false
+	case "max":
+		encoder.Effort = 6
+		encoder.MinSize = true
+	}
+	if hasAlpha {
+		encoder.Preset = "drawing"
+		encoder.AlphaQuality = 100
+	}
+
+	if params.Preset != "" {
+		encoder.Preset = params.Preset
+	}
+	if params.AlphaQuality > 0 {
+		encoder.AlphaQuality = params.AlphaQuality
+	}
+	encoder.StripMetadata = params.StripMetadata
+	encoder.KeepMetadata = params.KeepMeta
+
+	return encoder
+}
+
+// Encoder keep flags of the keep_meta namespaces, orientation has none since the pixels
+// are rotated upright before encoding and the tag is removed
+var metadataKeepFlags = map[string]vips.Keep{
+	"icc":  vips.KeepIcc,
+	"exif": vips.KeepExif,
+	"iptc": vips.KeepIptc,
+	"xmp":  vips.KeepXmp,
+}
+
+// metadataKeep returns the encoder keep flags. An explicit keep_meta list wins, otherwise
+// stripping keeps only the ICC profile and the default keeps everything.
+func metadataKeep(stripMetadata bool, keepMeta []string) vips.Keep {
+	if keepMeta == nil {
+		if stripMetadata {
+			return vips.KeepIcc
+		}
+		return vips.Keep(0) // libvips default, keeps all metadata
+	}
+
+	// KeepNone is 0, which vipsgen leaves unset (keep all), other is none of the namespaces
+	keep := vips.KeepOther
+	for _, namespace := range keepMeta {
+		keep |= metadataKeepFlags[namespace]
+	}
+	return keep
+}
+
+// SourceSize issues a HEAD request for the source and returns its size in bytes
+// without downloading or decoding it. Returns -1 when the origin doesn't report a size.
+func (imgop *ImageOptimizerHandler) SourceSize(params helpers.ParamsOptimize) (int64, error) {
+	appEnv := helpers.GetAppEnv()
+	imageUrl, err := url.Parse(params.Url)
+	if err != nil {
+		return 0, err
+	}
+
+	timeout := time.Duration(appEnv.FetchTimeoutFor(imageUrl.Host)) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	resp, err := imgop.openSource(ctx, http.MethodHead, imageUrl)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if !appEnv.IsAcceptedStatus(resp.StatusCode) {
+		return 0, originStatusError(resp.StatusCode)
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if !isImageContentType(contentType) {
+		return 0, fmt.Errorf("%w: invalid content type: %s", helpers.ErrNonImageContent, contentType)
+	}
+
+	return resp.ContentLength, nil
+}
+
+// httpClient returns the origin client shared by all requests of the handler, so
+// connections are reused across invocations of a warm Lambda
+func (imgop *ImageOptimizerHandler) httpClient() *http.Client {
+	imgop.clientOnce.Do(func() {
+		appEnv := helpers.GetAppEnv()
+		checkRedirect := originHeadersRedirectPolicy(appEnv.ORIGIN_HEADERS)
+		if !appEnv.DEV_MODE {
+			checkRedirect = allowedOriginsRedirectPolicy(appEnv.ALLOWED_ORIGINS, checkRedirect)
+		}
+		imgop.client = &http.Client{
+			Transport: newOriginTransport(
+				time.Duration(appEnv.CONNECT_TIMEOUT)*time.Second,
+				time.Duration(appEnv.TLS_HANDSHAKE_TIMEOUT)*time.Second,
+			),
+			CheckRedirect: checkRedirect,
+		}
 	})
+	return imgop.client
+}
+
+// Idle keep-alive connections kept per origin host, most fetches go to a handful of hosts
+const originMaxIdleConnsPerHost = 16
+
+// newOriginTransport bounds the connect and TLS handshake phases separately, so an
+// unreachable origin fails fast instead of eating the whole fetch timeout. HTTP/2 is
+// negotiated over TLS when the origin supports it, so concurrent fetches from one host
+// share a connection, and HTTP/1.1 origins keep more idle connections than the default 2.
+func newOriginTransport(connectTimeout time.Duration, tlsHandshakeTimeout time.Duration) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = tlsHandshakeTimeout
+	// A custom dialer disables the automatic HTTP/2 upgrade unless forced
+	transport.ForceAttemptHTTP2 = true
+	transport.MaxIdleConnsPerHost = originMaxIdleConnsPerHost
+	transport.IdleConnTimeout = 90 * time.Second
+	return transport
+}
 
+// openSource serves PLACEHOLDER_URL from memory, reads s3:// sources with the AWS SDK
+// and fetches everything else
+func (imgop *ImageOptimizerHandler) openSource(ctx context.Context, method string, imageUrl *url.URL) (*http.Response, error) {
+	if placeholderUrl := helpers.GetAppEnv().PLACEHOLDER_URL; placeholderUrl != "" && imageUrl.String() == placeholderUrl {
+		resp, err := imgop.placeholderResponse(ctx, method, imageUrl)
+		if err != nil {
+			return nil, sourceUnavailable(err)
+		}
+		return resp, nil
+	}
+	if err := checkAllowedSource(imageUrl); err != nil {
+		return nil, err
+	}
+	resp, err := imgop.openOrigin(ctx, method, imageUrl)
 	if err != nil {
-		NewError(err)
-		return []byte{}
+		return nil, sourceUnavailable(err)
+	}
+	return resp, nil
+}
+
+// checkAllowedSource rejects sources outside ALLOWED_ORIGINS (ALLOWED_BUCKETS for s3://),
+// so the optimizer is never an open proxy even when called without the handler's checks.
+// data: URLs are never fetched and the PLACEHOLDER_URL is set by the deployment itself.
+func checkAllowedSource(imageUrl *url.URL) error {
+	source := imageUrl.String()
+	switch {
+	case imageUrl.Scheme == "data":
+		return nil
+	case helpers.IsS3Url(source):
+		if !helpers.IsAllowedBucket(source) {
+			return fmt.Errorf("%w: bucket %s", helpers.ErrOriginNotAllowed, imageUrl.Host)
+		}
+	case !helpers.IsAllowedOrigin(source):
+		return fmt.Errorf("%w: %s", helpers.ErrOriginNotAllowed, imageUrl.Host)
+	}
+	return nil
+}
+
+// openOrigin requests the source from S3 or its origin, bypassing the placeholder cache.
+// Outbound fetches hold a MAX_OUTBOUND_FETCHES slot until the body is closed.
+func (imgop *ImageOptimizerHandler) openOrigin(ctx context.Context, method string, imageUrl *url.URL) (*http.Response, error) {
+	if imageUrl.Scheme == "data" {
+		return fetchSource(ctx, imgop.httpClient(), method, imageUrl)
+	}
+
+	release, err := imgop.fetchLimiter().Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := imgop.fetchOrigin(ctx, method, imageUrl)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// fetchOrigin reads the object from S3, or fetches the source within the origin rate limit
+func (imgop *ImageOptimizerHandler) fetchOrigin(ctx context.Context, method string, imageUrl *url.URL) (*http.Response, error) {
+	if imageUrl.Scheme == "s3" {
+		client, err := imgop.s3Client()
+		if err != nil {
+			return nil, err
+		}
+		return s3ObjectResponse(ctx, client, method, imageUrl)
+	}
+	rate := helpers.GetAppEnv().OriginRateLimitFor(imageUrl.Host)
+	if err := imgop.originLimiter.Wait(ctx, strings.ToLower(imageUrl.Host), rate); err != nil {
+		return nil, err
+	}
+	return fetchSource(ctx, imgop.httpClient(), method, imageUrl)
+}
+
+// fetchSource requests the source image with the per-origin headers applied.
+// data: URLs are decoded in place instead of being fetched.
+func fetchSource(ctx context.Context, client *http.Client, method string, imageUrl *url.URL) (*http.Response, error) {
+	appEnv := helpers.GetAppEnv()
+	if imageUrl.Scheme == "data" {
+		return dataUrlResponse(imageUrl)
+	}
+
+	// Create HTTP request with context
+	req, err := http.NewRequestWithContext(ctx, method, imageUrl.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	applyOriginHeaders(req, appEnv.ORIGIN_HEADERS)
+	if length, ok := ctx.Value(sourceRangeKey{}).(int64); ok {
+		req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", length-1))
+	}
+
+	return client.Do(req)
+}
+
+// ErrSourceTooLarge is returned once a source is read past its download limit
+var ErrSourceTooLarge = errors.New("source too large")
+
+// countingReader counts the bytes read from the underlying reader, failing the read once
+// more than limit bytes were read (0 means unlimited). It is the authoritative size
+// check, since chunked responses declare no Content-Length: reads are capped so at most
+// one byte past the limit is ever pulled from the origin.
+type countingReader struct {
+	reader io.ReadCloser
+	count  int
+	limit  int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	if c.limit > 0 {
+		if remaining := c.limit - int64(c.count) + 1; int64(len(p)) > remaining {
+			p = p[:max(remaining, 0)]
+		}
+	}
+	n, err := c.reader.Read(p)
+	c.count += n
+	if c.limit > 0 && int64(c.count) > c.limit {
+		return n, fmt.Errorf("%w: source exceeds %d bytes", ErrSourceTooLarge, c.limit)
+	}
+	return n, err
+}
+
+func (c *countingReader) Close() error {
+	return c.reader.Close()
+}
+
+// applyOriginHeaders sets the configured fetch headers for the request host, if any.
+// Header values are credentials, so they are never logged.
+func applyOriginHeaders(req *http.Request, originHeaders map[string]map[string]string) {
+	headers, ok := originHeaders[strings.ToLower(req.URL.Host)]
+	if !ok {
+		return
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+}
+
+// allowedOriginsRedirectPolicy re-validates every redirect hop against the allowlist, otherwise
+// an allowed origin redirecting elsewhere would let any host through. Allowed hops continue
+// with the next policy.
+func allowedOriginsRedirectPolicy(allowedOrigins []string, next func(req *http.Request, via []*http.Request) error) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if !slices.Contains(allowedOrigins, req.URL.Host) {
+			return fmt.Errorf("%w: redirect to %s is not an allowed origin", helpers.ErrOriginNotAllowed, req.URL.Host)
+		}
+		return next(req, via)
+	}
+}
+
+// originHeadersRedirectPolicy keeps per-origin headers scoped to their host across redirects.
+// net/http copies custom headers onto the redirected request, so they are dropped here
+// and only re-applied when the new host has its own configuration.
+func originHeadersRedirectPolicy(originHeaders map[string]map[string]string) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return fmt.Errorf("stopped after 10 redirects")
+		}
+		for _, headers := range originHeaders {
+			for name := range headers {
+				req.Header.Del(name)
+			}
+		}
+		applyOriginHeaders(req, originHeaders)
+		return nil
+	}
+}
+
+// Colorspaces that are converted to sRGB after load, named for the debug trace
+var nonSrgbColorspaces = []struct {
+	interpretation vips.Interpretation
+	name           string
+}{
+	{vips.InterpretationCmyk, "cmyk"},
+	{vips.InterpretationLab, "lab"},
+	{vips.InterpretationLabq, "labq"},
+	{vips.InterpretationLabs, "labs"},
+	{vips.InterpretationLch, "lch"},
+	{vips.InterpretationCmc, "cmc"},
+	{vips.InterpretationXyz, "xyz"},
+	{vips.InterpretationYxy, "yxy"},
+	{vips.InterpretationHsv, "hsv"},
+	{vips.InterpretationScrgb, "scrgb"},
+}
+
+// convertToSrgb converts CMYK and other non-RGB colorspaces to sRGB (using the embedded
+// profile when there is one) and returns the name of the converted colorspace
+func convertToSrgb(image *vips.Image) (string, error) {
+	interpretation := image.Interpretation()
+	for _, colorspace := range nonSrgbColorspaces {
+		if colorspace.interpretation != interpretation {
+			continue
+		}
+		if err := image.Colourspace(vips.InterpretationSrgb, nil); err != nil {
+			return "", fmt.Errorf("unsupported %s colorspace, conversion to srgb failed: %w", colorspace.name, err)
+		}
+		return colorspace.name, nil
+	}
+	return "", nil
+}
+
+// normalizeOrientation handles the EXIF orientation per the orient mode, then applies the
+// manual rotation. bake (the default) autorotates and strips the tag, so the result never
+// depends on the input EXIF. preserve leaves the pixels and tag as stored for downstream
+// to rotate, and normalize autorotates but keeps a neutral tag. The background
+// (transparent/black by default) fills the corners of arbitrary angles.
+func normalizeOrientation(image *vips.Image, orient string, rotate float64, background []float64) error {
+	switch orient {
+	case "preserve":
+	case "normalize":
+		if err := image.Autorot(); err != nil {
+			return err
+		}
+		if err := image.SetOrientation(1); err != nil {
+			return err
+		}
+	default:
+		if err := image.Autorot(); err != nil {
+			return err
+		}
+		if err := image.RemoveOrientation(); err != nil {
+			return err
+		}
 	}
+	return rotateImage(image, rotate, background)
+}
 
-	return imageByte
+// transposeBox swaps the requested width and height, and inverts the aspect ratio, for
+// pixels stored rotated by 90 degrees from how they are displayed
+func transposeBox(params helpers.ParamsOptimize) helpers.ParamsOptimize {
+	params.Width, params.Height = params.Height, params.Width
+	if params.AspectRatio > 0 {
+		params.AspectRatio = 1 / params.AspectRatio
+	}
+	return params
 }
 
+// rotateImage rotates by the angle in degrees. Right angles use the lossless rot, any other
+// angle rotates by interpolation and fills the introduced corners with the background.
+func rotateImage(image *vips.Image, rotate float64, background []float64) error {
+	angle := math.Mod(rotate, 360)
+	if angle < 0 {
+		angle += 360
+	}
+	switch angle {
+	case 0:
+		return nil
+	case 90:
+		return image.Rot(vips.AngleD90)
+	case 180:
+		return image.Rot(vips.AngleD180)
+	case 270:
+		return image.Rot(vips.AngleD270)
+	}
+
+	if background != nil && image.HasAlpha() {
+		// Opaque fill for the alpha band too
+		background = append(slices.Clone(background), 255)
+	}
+	return image.Rotate(angle, &vips.RotateOptions{Background: background})
+}
+
+// NewError logs a failure of the request in flight, with its ID for correlation
 func NewError(err error) {
 	if err != nil {
-		fmt.Println(err)
+		slog.Error("optimize failed", "error", err.Error(), "request_id", vipsWarnings.currentRequestID())
+	}
+}
+
+// logInvalidSource logs a non-image origin response with the status and content type the
+// origin sent, to tell a misbehaving origin from a broken image. Other failures are
+// logged by optimize like any error.
+func logInvalidSource(err error, resp *http.Response) {
+	if !errors.Is(err, helpers.ErrNonImageContent) {
+		return
 	}
+	slog.Warn("origin returned non-image content", "error", err.Error(), "status", resp.StatusCode,
+		"content_type", helpers.HeaderValue(resp.Header.Get("Content-Type"), 256),
+		"request_id", vipsWarnings.currentRequestID())
+}
+
+// validateHintedImageFile skips the signature peek when a trusted caller hinted the source
+// format, only the Content-Type is checked. The decoded format is compared to the hint.
+func validateHintedImageFile(resp *http.Response, formatHint string) (io.ReadCloser, error) {
+	if formatHint == "" {
+		return validateImageFile(resp)
+	}
+	if contentType := resp.Header.Get("Content-Type"); !isImageContentType(contentType) {
+		return nil, fmt.Errorf("%w: invalid content type: %s", helpers.ErrNonImageContent, contentType)
+	}
+	return resp.Body, nil
 }
 
 // validateImageFile validates that the HTTP response contains a valid image file.
@@ -124,7 +1387,7 @@ func validateImageFile(resp *http.Response) (io.ReadCloser, error) {
 	// Validate Content-Type header
 	contentType := resp.Header.Get("Content-Type")
 	if !isImageContentType(contentType) {
-		return nil, fmt.Errorf("invalid content type: %s", contentType)
+		return nil, fmt.Errorf("%w: invalid content type: %s", helpers.ErrNonImageContent, contentType)
 	}
 
 	// Read first bytes to verify image file signature (magic numbers)
@@ -134,9 +1397,10 @@ func validateImageFile(resp *http.Response) (io.ReadCloser, error) {
 		return nil, fmt.Errorf("failed to read image file: %w", err)
 	}
 
-	// Verify file signature matches known image formats
-	if !isImageFileSignature(peekBuffer[:n]) {
-		return nil, fmt.Errorf("invalid image file signature")
+	// Verify file signature matches known image formats, SVG is only accepted when declared as such
+	isSvg := isSvgContentType(contentType) && isSvgSignature(peekBuffer[:n])
+	if !isImageFileSignature(peekBuffer[:n]) && !isSvg {
+		return nil, fmt.Errorf("%w: invalid image file signature", helpers.ErrNonImageContent)
 	}
 
 	// Reconstruct the body with peeked bytes + remaining body
@@ -163,42 +1427,44 @@ func isImageContentType(contentType string) bool {
 
 // isImageFileSignature checks if the first bytes match known image file signatures (magic numbers)
 func isImageFileSignature(data []byte) bool {
-	if len(data) < 4 {
-		return false
-	}
+	return len(data) >= 4 && sourceSignatureFormat(data) != ""
+}
 
+// sourceSignatureFormat returns the format matching the file signature (magic numbers) of
+// the first bytes, empty when none matches
+func sourceSignatureFormat(data []byte) string {
 	// JPEG: FF D8 FF
 	if len(data) >= 3 && data[0] == 0xFF && data[1] == 0xD8 && data[2] == 0xFF {
-		return true
+		return "jpeg"
 	}
 
 	// PNG: 89 50 4E 47
 	if len(data) >= 4 && data[0] == 0x89 && data[1] == 0x50 && data[2] == 0x4E && data[3] == 0x47 {
-		return true
+		return "png"
 	}
 
 	// GIF: 47 49 46 38 (GIF8)
 	if len(data) >= 4 && data[0] == 0x47 && data[1] == 0x49 && data[2] == 0x46 && data[3] == 0x38 {
-		return true
+		return "gif"
 	}
 
 	// WebP: Check for "RIFF" (4 bytes) followed by "WEBP" (at offset 8)
 	if len(data) >= 12 &&
 		data[0] == 0x52 && data[1] == 0x49 && data[2] == 0x46 && data[3] == 0x46 && // RIFF
 		data[8] == 0x57 && data[9] == 0x45 && data[10] == 0x42 && data[11] == 0x50 { // WEBP
-		return true
+		return "webp"
 	}
 
 	// BMP: 42 4D
 	if len(data) >= 2 && data[0] == 0x42 && data[1] == 0x4D {
-		return true
+		return "bmp"
 	}
 
 	// TIFF: 49 49 2A 00 (little-endian) or 4D 4D 00 2A (big-endian)
 	if len(data) >= 4 {
 		if (data[0] == 0x49 && data[1] == 0x49 && data[2] == 0x2A && data[3] == 0x00) ||
 			(data[0] == 0x4D && data[1] == 0x4D && data[2] == 0x00 && data[3] == 0x2A) {
-			return true
+			return "tiff"
 		}
 	}
 
@@ -208,10 +1474,10 @@ func isImageFileSignature(data []byte) bool {
 		if len(data) >= 12 {
 			brand := string(data[8:12])
 			if strings.Contains(brand, "heic") || strings.Contains(brand, "heif") || strings.Contains(brand, "mif1") {
-				return true
+				return "heif"
 			}
 		}
 	}
 
-	return false
+	return ""
 }
@@ -2,13 +2,29 @@ package libs
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"imgop/src/helpers"
 	"io"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/cshum/vipsgen/vips"
 	"github.com/stretchr/testify/assert"
@@ -314,6 +330,35 @@ func TestValidateImageFile(t *testing.T) {
 	}
 }
 
+func TestValidateImageFile_NonImageContent(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A "not found" page served with a success status
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("<!doctype html><html><body>Not found</body></html>"))
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	_, err = validateImageFile(resp)
+	assert.ErrorIs(t, err, helpers.ErrNonImageContent)
+	assert.ErrorContains(t, err, "invalid content type: text/html; charset=utf-8")
+
+	response, _ := helpers.ErrResponse(err, http.StatusBadGateway)
+	assert.Contains(t, response.Body, `"code":"NON_IMAGE_CONTENT"`)
+
+	// Read failures are not the origin's content
+	_, err = validateImageFile(&http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"image/jpeg"}},
+		Body:       &errorReader{},
+	})
+	assert.NotErrorIs(t, err, helpers.ErrNonImageContent)
+}
+
 func TestValidateImageFile_ReadError(t *testing.T) {
 	// Create a response with a body that will error on read
 	body := &errorReader{}
@@ -356,6 +401,57 @@ func TestValidateImageFile_ReconstructedBody(t *testing.T) {
 	assert.Equal(t, testData, readData, "reconstructed body should contain all original data")
 }
 
+func TestValidateHintedImageFile(t *testing.T) {
+	// Not a known signature, only a hinted source gets past the check
+	body := []byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0A, 0x0B, 0x0C}
+	newResponse := func(contentType string) *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{contentType}},
+			Body:       io.NopCloser(bytes.NewReader(body)),
+		}
+	}
+
+	_, err := validateHintedImageFile(newResponse("image/jpeg"), "")
+	assert.ErrorContains(t, err, "invalid image file signature", "without a hint the signature is checked")
+
+	validatedBody, err := validateHintedImageFile(newResponse("image/jpeg"), "jpeg")
+	require.NoError(t, err)
+	readData, err := io.ReadAll(validatedBody)
+	require.NoError(t, err)
+	assert.Equal(t, body, readData, "the body is passed through unpeeked")
+
+	_, err = validateHintedImageFile(newResponse("text/html"), "jpeg")
+	assert.ErrorContains(t, err, "invalid content type", "the content type is still checked")
+}
+
+func TestOptimize_SourceFormatHint(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	testImageData := loadTestImage(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.WriteHeader(http.StatusOK)
+		w.Write(testImageData)
+	}))
+	defer server.Close()
+
+	result, err := NewImageOptimizer().Optimize(helpers.ParamsOptimize{Url: server.URL, Width: 100, Quality: 80, SourceFormat: "jpeg"})
+	require.NoError(t, err)
+	require.Greater(t, len(result.Image), 0)
+	assert.Equal(t, "jpeg", result.SourceFormat)
+
+	result, err = NewImageOptimizer().Optimize(helpers.ParamsOptimize{Url: server.URL, Width: 100, Quality: 80, SourceFormat: "png"})
+	assert.ErrorIs(t, err, helpers.ErrUnsupportedMedia)
+	assert.Empty(t, result.Image, "a wrong hint fails once the source is decoded")
+}
+
 // errorReader is a reader that always returns an error
 type errorReader struct{}
 
@@ -367,6 +463,17 @@ func (e *errorReader) Close() error {
 	return nil
 }
 
+func TestCountingReader(t *testing.T) {
+	data := []byte{0xFF, 0xD8, 0xFF, 0xE0, 0x00, 0x10}
+	counted := &countingReader{reader: io.NopCloser(bytes.NewReader(data))}
+
+	readData, err := io.ReadAll(counted)
+	require.NoError(t, err)
+	assert.Equal(t, data, readData)
+	assert.Equal(t, len(data), counted.count)
+	assert.NoError(t, counted.Close())
+}
+
 func TestNewError(t *testing.T) {
 	// This function just prints errors, so we just verify it doesn't panic
 	assert.NotPanics(t, func() {
@@ -482,23 +589,16 @@ func TestIsImageContentType_EdgeCases(t *testing.T) {
 	}
 }
 
-func TestOptimize_WithTestImage(t *testing.T) {
-	// Skip if vips is not available (e.g., in CI without libvips installed)
-	if testing.Short() {
-		t.Skip("Skipping integration test in short mode")
-	}
-
-	// Set up test environment variables
-	os.Setenv("SECRET_KEY", "test-imgop-key")
-	os.Setenv("FETCH_TIMEOUT", "5")
-	defer func() {
-		os.Unsetenv("SECRET_KEY")
-		os.Unsetenv("FETCH_TIMEOUT")
-		helpers.ResetAppEnvForTesting()
-	}()
+// TestMain runs the package with DEV_MODE, the httptest origins listen on random local
+// ports that can't be allowlisted up front. Tests of the allowlist turn it back off.
+func TestMain(m *testing.M) {
+	os.Setenv("DEV_MODE", "true")
+	os.Exit(m.Run())
+}
 
-	// Reset env helper to pick up test environment
-	helpers.ResetAppEnvForTesting()
+// loadTestImage reads static/test-image.jpg, skipping the test when it can't be found
+func loadTestImage(t *testing.T) []byte {
+	t.Helper()
 
 	// Get the test image path - try multiple possible locations
 	testImagePath := ""
@@ -541,6 +641,29 @@ func TestOptimize_WithTestImage(t *testing.T) {
 	require.NoError(t, err, "test image file should exist")
 	assert.Greater(t, len(testImageData), 0, "test image should have content")
 
+	return testImageData
+}
+
+func TestOptimize_WithTestImage(t *testing.T) {
+	// Skip if vips is not available (e.g., in CI without libvips installed)
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	// Set up test environment variables
+	os.Setenv("SECRET_KEY", "test-imgop-key")
+	os.Setenv("FETCH_TIMEOUT", "5")
+	defer func() {
+		os.Unsetenv("SECRET_KEY")
+		os.Unsetenv("FETCH_TIMEOUT")
+		helpers.ResetAppEnvForTesting()
+	}()
+
+	// Reset env helper to pick up test environment
+	helpers.ResetAppEnvForTesting()
+
+	testImageData := loadTestImage(t)
+
 	// Create a test HTTP server that serves the test image
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "image/jpeg")
@@ -613,10 +736,15 @@ func TestOptimize_WithTestImage(t *testing.T) {
 			}
 
 			// Optimize the image
-			result := optimizer.Optimize(params)
+			optimized, err := optimizer.Optimize(params)
+			require.NoError(t, err)
+			result := optimized.Image
 
 			// Verify result is not empty
 			assert.Greater(t, len(result), 0, "optimized image should not be empty")
+			assert.Equal(t, len(testImageData), optimized.SourceBytes, "source bytes should match the fixture size")
+			sourceHash := sha256.Sum256(testImageData)
+			assert.Equal(t, hex.EncodeToString(sourceHash[:]), optimized.SourceHash, "source hash should match the fixture")
 
 			// Try to load the result as a WebP image using vips to verify it's valid
 			source := vips.NewSource(io.NopCloser(bytes.NewReader(result)))
@@ -678,3 +806,2552 @@ func TestOptimize_WithTestImage(t *testing.T) {
 		})
 	}
 }
+
+func TestApplyOriginHeaders(t *testing.T) {
+	originHeaders := map[string]map[string]string{
+		"cdn.partner.com": {"Authorization": "Bearer partner-token"},
+	}
+
+	tests := []struct {
+		name     string
+		url      string
+		expected string
+	}{
+		{
+			name:     "matching host",
+			url:      "https://cdn.partner.com/image.jpg",
+			expected: "Bearer partner-token",
+		},
+		{
+			name:     "matching host with different case",
+			url:      "https://CDN.Partner.com/image.jpg",
+			expected: "Bearer partner-token",
+		},
+		{
+			name:     "non matching host",
+			url:      "https://other.com/image.jpg",
+			expected: "",
+		},
+		{
+			name:     "suffix spoof host",
+			url:      "https://cdn.partner.com.evil.com/image.jpg",
+			expected: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", tt.url, nil)
+			require.NoError(t, err)
+
+			applyOriginHeaders(req, originHeaders)
+			assert.Equal(t, tt.expected, req.Header.Get("Authorization"))
+		})
+	}
+}
+
+func TestOriginHeadersRedirectPolicy(t *testing.T) {
+	// Other host must never receive the partner credentials
+	var otherAuth, otherKey string
+	otherServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		otherAuth = r.Header.Get("Authorization")
+		otherKey = r.Header.Get("X-Api-Key")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer otherServer.Close()
+
+	var partnerAuth string
+	partnerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		partnerAuth = r.Header.Get("Authorization")
+		http.Redirect(w, r, otherServer.URL, http.StatusFound)
+	}))
+	defer partnerServer.Close()
+
+	partnerHost := strings.TrimPrefix(partnerServer.URL, "http://")
+	originHeaders := map[string]map[string]string{
+		partnerHost: {
+			"Authorization": "Bearer partner-token",
+			"X-Api-Key":     "partner-key",
+		},
+	}
+
+	req, err := http.NewRequest("GET", partnerServer.URL, nil)
+	require.NoError(t, err)
+	applyOriginHeaders(req, originHeaders)
+
+	client := &http.Client{CheckRedirect: originHeadersRedirectPolicy(originHeaders)}
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, "Bearer partner-token", partnerAuth)
+	assert.Empty(t, otherAuth, "authorization must not leak to another host")
+	assert.Empty(t, otherKey, "custom headers must not leak to another host")
+}
+
+// withExifOrientation returns a copy of a JPEG with the EXIF orientation tag (0x0112) set
+func withExifOrientation(t *testing.T, data []byte, orientation int) []byte {
+	t.Helper()
+
+	out := append([]byte{}, data...)
+	// APP1 Exif segment is expected right after SOI, TIFF header starts after "Exif\0\0"
+	require.True(t, len(out) > 12 && out[2] == 0xFF && out[3] == 0xE1, "fixture should start with an EXIF segment")
+	require.Equal(t, "Exif", string(out[6:10]))
+	tiff := out[12:]
+
+	var order binary.ByteOrder = binary.BigEndian
+	if string(tiff[:2]) == "II" {
+		order = binary.LittleEndian
+	}
+	ifd := int(order.Uint32(tiff[4:8]))
+	entries := int(order.Uint16(tiff[ifd : ifd+2]))
+	for i := 0; i < entries; i++ {
+		entry := tiff[ifd+2+i*12 : ifd+14+i*12]
+		if order.Uint16(entry[0:2]) == 0x0112 {
+			order.PutUint16(entry[8:10], uint16(orientation))
+			return out
+		}
+	}
+
+	t.Fatal("fixture has no EXIF orientation tag")
+	return nil
+}
+
+func TestAllowedOriginsRedirectPolicy(t *testing.T) {
+	var otherHits int
+	otherServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		otherHits++
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer otherServer.Close()
+
+	allowedTarget := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer allowedTarget.Close()
+
+	redirectServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := otherServer.URL
+		if r.URL.Path == "/allowed" {
+			target = allowedTarget.URL
+		}
+		http.Redirect(w, r, target, http.StatusFound)
+	}))
+	defer redirectServer.Close()
+
+	allowedOrigins := []string{
+		strings.TrimPrefix(redirectServer.URL, "http://"),
+		strings.TrimPrefix(allowedTarget.URL, "http://"),
+	}
+	client := &http.Client{CheckRedirect: allowedOriginsRedirectPolicy(allowedOrigins, originHeadersRedirectPolicy(nil))}
+
+	resp, err := client.Get(redirectServer.URL + "/allowed")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	_, err = client.Get(redirectServer.URL + "/elsewhere")
+	assert.ErrorContains(t, err, "is not an allowed origin")
+	assert.Zero(t, otherHits, "the disallowed host must never be requested")
+}
+
+func TestCheckAllowedSource(t *testing.T) {
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	t.Setenv("ALLOWED_ORIGINS", "tarkams.com")
+	t.Setenv("ALLOWED_BUCKETS", "private-assets")
+	t.Setenv("DEV_MODE", "false")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	tests := []struct {
+		name    string
+		url     string
+		allowed bool
+	}{
+		{name: "Allowed host", url: "https://tarkams.com/a.jpg", allowed: true},
+		{name: "Disallowed host", url: "https://example.com/a.jpg", allowed: false},
+		{name: "Suffix spoof", url: "https://evil-tarkams.com/a.jpg", allowed: false},
+		{name: "Subdomain", url: "https://cdn.tarkams.com/a.jpg", allowed: false},
+		{name: "Allowed host on another port", url: "https://tarkams.com:8443/a.jpg", allowed: false},
+		{name: "Allowed bucket", url: "s3://private-assets/a.jpg", allowed: true},
+		{name: "Disallowed bucket", url: "s3://other-assets/a.jpg", allowed: false},
+		{name: "Data URL", url: "data:image/png;base64,iVBORw0KGgo=", allowed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			imageUrl, err := url.Parse(tt.url)
+			require.NoError(t, err)
+			err = checkAllowedSource(imageUrl)
+			if tt.allowed {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, helpers.ErrOriginNotAllowed)
+			}
+		})
+	}
+}
+
+func TestSourceSize_DisallowedOrigin(t *testing.T) {
+	var hits int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	t.Setenv("ALLOWED_ORIGINS", "tarkams.com")
+	t.Setenv("DEV_MODE", "false")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	_, err := NewImageOptimizer().SourceSize(helpers.ParamsOptimize{Url: server.URL})
+	assert.ErrorIs(t, err, helpers.ErrOriginNotAllowed)
+	assert.Zero(t, hits, "a disallowed origin must never be requested")
+}
+
+func TestSourceSize_RedirectToDisallowedOrigin(t *testing.T) {
+	otherServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer otherServer.Close()
+
+	redirectServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, otherServer.URL, http.StatusFound)
+	}))
+	defer redirectServer.Close()
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	t.Setenv("ALLOWED_ORIGINS", strings.TrimPrefix(redirectServer.URL, "http://"))
+	t.Setenv("DEV_MODE", "false")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	_, err := NewImageOptimizer().SourceSize(helpers.ParamsOptimize{Url: redirectServer.URL})
+	assert.ErrorContains(t, err, "is not an allowed origin")
+}
+
+func TestOptimize_Orientation(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	os.Setenv("SECRET_KEY", "test-imgop-key")
+	defer func() {
+		os.Unsetenv("SECRET_KEY")
+		helpers.ResetAppEnvForTesting()
+	}()
+	helpers.ResetAppEnvForTesting()
+
+	// test-image.jpg is landscape (2500x1667) with orientation 1
+	testImageData := loadTestImage(t)
+	optimizer := NewImageOptimizer()
+
+	tests := []struct {
+		name              string
+		orientation       int
+		rotate            float64
+		expectedLandscape bool
+	}{
+		{
+			name:              "no exif rotation, no manual rotation",
+			orientation:       1,
+			rotate:            0,
+			expectedLandscape: true,
+		},
+		{
+			name:              "no exif rotation, manual 90",
+			orientation:       1,
+			rotate:            90,
+			expectedLandscape: false,
+		},
+		{
+			name:              "exif rotated 90 CW, no manual rotation",
+			orientation:       6,
+			rotate:            0,
+			expectedLandscape: false,
+		},
+		{
+			name:              "exif rotated 90 CW, manual 90",
+			orientation:       6,
+			rotate:            90,
+			expectedLandscape: true,
+		},
+		{
+			name:              "exif rotated 270 CW, manual 270",
+			orientation:       8,
+			rotate:            270,
+			expectedLandscape: true,
+		},
+		{
+			name:              "exif rotated 180, manual 180",
+			orientation:       3,
+			rotate:            180,
+			expectedLandscape: true,
+		},
+		{
+			name:              "no exif rotation, manual -90",
+			orientation:       1,
+			rotate:            -90,
+			expectedLandscape: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fixture := withExifOrientation(t, testImageData, tt.orientation)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "image/jpeg")
+				w.WriteHeader(http.StatusOK)
+				w.Write(fixture)
+			}))
+			defer server.Close()
+
+			result, err := optimizer.Optimize(helpers.ParamsOptimize{
+				Url:     server.URL,
+				Width:   300,
+				Quality: 80,
+				Rotate:  tt.rotate,
+			})
+			require.NoError(t, err)
+			require.Greater(t, len(result.Image), 0, "optimized image should not be empty")
+
+			image, err := vips.NewImageFromBuffer(result.Image, nil)
+			require.NoError(t, err)
+			defer image.Close()
+
+			assert.Equal(t, 300, image.Width())
+			assert.Equal(t, tt.expectedLandscape, image.Width() > image.Height())
+			assert.LessOrEqual(t, image.Orientation(), 1, "orientation tag should be stripped")
+		})
+	}
+}
+
+func TestOptimize_OrientModes(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	// test-image.jpg is stored landscape (2500x1667), tagged as displayed rotated 90 CW
+	fixture := withExifOrientation(t, loadTestImage(t), 6)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.WriteHeader(http.StatusOK)
+		w.Write(fixture)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name                string
+		orient              string
+		expectedWidth       int
+		expectedHeight      int
+		expectedOrientation int
+	}{
+		{name: "Default bakes", expectedWidth: 300, expectedHeight: 450, expectedOrientation: 0},
+		{name: "Bake", orient: "bake", expectedWidth: 300, expectedHeight: 450, expectedOrientation: 0},
+		// The box is as displayed, so the stored landscape pixels are 450 wide
+		{name: "Preserve", orient: "preserve", expectedWidth: 450, expectedHeight: 300, expectedOrientation: 6},
+		{name: "Normalize", orient: "normalize", expectedWidth: 300, expectedHeight: 450, expectedOrientation: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := NewImageOptimizer().Optimize(helpers.ParamsOptimize{
+				Url:     server.URL,
+				Width:   300,
+				Quality: 80,
+				Orient:  tt.orient,
+			})
+			require.NoError(t, err)
+			require.Greater(t, len(result.Image), 0)
+
+			image, err := vips.NewImageFromBuffer(result.Image, nil)
+			require.NoError(t, err)
+			defer image.Close()
+
+			assert.InDelta(t, tt.expectedWidth, image.Width(), 1)
+			assert.InDelta(t, tt.expectedHeight, image.Height(), 1)
+			if tt.expectedOrientation == 0 {
+				assert.LessOrEqual(t, image.Orientation(), 1, "orientation tag should be stripped")
+			} else {
+				assert.Equal(t, tt.expectedOrientation, image.Orientation())
+			}
+		})
+	}
+}
+
+func TestTransposeBox(t *testing.T) {
+	params := transposeBox(helpers.ParamsOptimize{Width: 300, Height: 200, AspectRatio: 2})
+	assert.Equal(t, 200, params.Width)
+	assert.Equal(t, 300, params.Height)
+	assert.Equal(t, 0.5, params.AspectRatio)
+
+	params = transposeBox(helpers.ParamsOptimize{Width: 300})
+	assert.Equal(t, 0, params.Width)
+	assert.Equal(t, 300, params.Height)
+	assert.Zero(t, params.AspectRatio)
+}
+
+func TestSourceSize(t *testing.T) {
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	tests := []struct {
+		name          string
+		contentType   string
+		statusCode    int
+		expectedSize  int64
+		expectedError bool
+	}{
+		{
+			name:         "image source",
+			contentType:  "image/jpeg",
+			statusCode:   http.StatusOK,
+			expectedSize: 1234,
+		},
+		{
+			name:          "non image source",
+			contentType:   "text/html",
+			statusCode:    http.StatusOK,
+			expectedError: true,
+		},
+		{
+			name:          "missing source",
+			contentType:   "image/jpeg",
+			statusCode:    http.StatusNotFound,
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var methods []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				methods = append(methods, r.Method)
+				w.Header().Set("Content-Type", tt.contentType)
+				w.Header().Set("Content-Length", "1234")
+				w.WriteHeader(tt.statusCode)
+			}))
+			defer server.Close()
+
+			size, err := NewImageOptimizer().SourceSize(helpers.ParamsOptimize{Url: server.URL})
+			assert.Equal(t, []string{http.MethodHead}, methods, "only a HEAD request should reach the origin")
+			if tt.expectedError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedSize, size)
+		})
+	}
+}
+
+func TestCountingReader_Limit(t *testing.T) {
+	data := make([]byte, 100)
+
+	counted := &countingReader{reader: io.NopCloser(bytes.NewReader(data)), limit: 50}
+	_, err := io.ReadAll(counted)
+	assert.ErrorIs(t, err, ErrSourceTooLarge)
+	assert.Contains(t, err.Error(), "source exceeds 50 bytes")
+	assert.Equal(t, 51, counted.count, "reads stop one byte past the limit")
+
+	counted = &countingReader{reader: io.NopCloser(bytes.NewReader(data)), limit: 100}
+	readData, err := io.ReadAll(counted)
+	assert.NoError(t, err)
+	assert.Equal(t, data, readData)
+}
+
+// newUnsizedImageServer streams the body in flushed chunks, so the response has no Content-Length
+func newUnsizedImageServer(body []byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.WriteHeader(http.StatusOK)
+		for chunk := range slices.Chunk(body, 4096) {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+		}
+	}))
+}
+
+func TestCountingReader_ChunkedResponse(t *testing.T) {
+	server := newUnsizedImageServer(make([]byte, 1<<20))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, int64(-1), resp.ContentLength)
+	require.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+
+	counted := &countingReader{reader: resp.Body, limit: 10000}
+	_, err = io.ReadAll(counted)
+	assert.ErrorIs(t, err, ErrSourceTooLarge)
+	assert.Equal(t, 10001, counted.count)
+}
+
+func TestOptimize_ChunkedOversizedSource(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	source := loadTestImage(t)
+	server := newUnsizedImageServer(source)
+	defer server.Close()
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	t.Setenv("MAX_DOWNLOAD_BYTES", strconv.Itoa(len(source)/2))
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	result, err := NewImageOptimizer().Optimize(helpers.ParamsOptimize{Url: server.URL, Width: 100, Quality: 80})
+	assert.Error(t, err)
+	assert.Empty(t, result.Image, "the cap applies without a Content-Length")
+
+	t.Setenv("MAX_DOWNLOAD_BYTES", strconv.Itoa(len(source)))
+	helpers.ResetAppEnvForTesting()
+	result, err = NewImageOptimizer().Optimize(helpers.ParamsOptimize{Url: server.URL, Width: 100, Quality: 80})
+	require.NoError(t, err)
+	assert.NotEmpty(t, result.Image, "a chunked source within the cap is optimized")
+}
+
+func TestOptimize_OriginFetchTimeout(t *testing.T) {
+	slowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer slowServer.Close()
+
+	slowHost := strings.TrimPrefix(slowServer.URL, "http://")
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	t.Setenv("FETCH_TIMEOUT", "10")
+	t.Setenv("ORIGIN_LIMITS", `{"`+slowHost+`":{"fetch_timeout":1}}`)
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	start := time.Now()
+	result, err := NewImageOptimizer().Optimize(helpers.ParamsOptimize{Url: slowServer.URL})
+	elapsed := time.Since(start)
+
+	assert.True(t, IsTimeout(err), "got %v", err)
+	assert.Empty(t, result.Image)
+	assert.Less(t, elapsed, 3*time.Second, "origin override should cut the fetch at 1 second")
+}
+
+func TestIsTimeout(t *testing.T) {
+	assert.True(t, IsTimeout(&url.Error{Op: "Get", URL: "https://example.com/a.jpg", Err: context.DeadlineExceeded}))
+	assert.True(t, IsTimeout(&net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}))
+	assert.False(t, IsTimeout(helpers.ErrNonImageContent))
+	assert.False(t, IsTimeout(nil))
+}
+
+func TestIsSourceError(t *testing.T) {
+	assert.True(t, IsSourceError(originStatusError(http.StatusNotFound)))
+	assert.True(t, IsSourceError(sourceUnavailable(&url.Error{Op: "Get", URL: "https://example.com/a.jpg", Err: io.ErrUnexpectedEOF})))
+	assert.True(t, IsSourceError(&url.Error{Op: "Get", URL: "https://example.com/a.jpg", Err: context.DeadlineExceeded}))
+	assert.True(t, IsSourceError(fmt.Errorf("%w: invalid image file signature", helpers.ErrNonImageContent)))
+	assert.True(t, IsSourceError(decodeError(errors.New("VipsJpeg: premature end of JPEG file"))))
+	assert.True(t, IsSourceError(fmt.Errorf("%w: source is empty", ErrDegenerateSource)))
+	assert.False(t, IsSourceError(errors.New("cover crop failed: extract_area: bad extract area")), "our own failures are not the origin's")
+	assert.False(t, IsSourceError(nil))
+
+	notAllowed := fmt.Errorf("%w: evil.com", helpers.ErrOriginNotAllowed)
+	assert.Same(t, notAllowed, sourceUnavailable(notAllowed), "a refused origin keeps its own error")
+}
+
+func TestOptimize_MissingSourceIsUnavailable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	_, err := NewImageOptimizer().Optimize(helpers.ParamsOptimize{Url: server.URL + "/missing.jpg", Width: 100, Quality: 80})
+	assert.ErrorIs(t, err, ErrSourceUnavailable)
+	assert.ErrorContains(t, err, "unexpected origin status: 404")
+}
+
+func TestOptimize_SlowTLSHandshake(t *testing.T) {
+	// Accepts connections but never answers the TLS handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	t.Setenv("FETCH_TIMEOUT", "10")
+	t.Setenv("TLS_HANDSHAKE_TIMEOUT", "1")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	start := time.Now()
+	result, err := NewImageOptimizer().Optimize(helpers.ParamsOptimize{Url: "https://" + listener.Addr().String() + "/image.jpg"})
+	elapsed := time.Since(start)
+
+	assert.True(t, IsTimeout(err), "got %v", err)
+	assert.Empty(t, result.Image)
+	assert.Less(t, elapsed, 3*time.Second, "handshake timeout should fail before the fetch timeout")
+}
+
+func TestNewOriginTransport(t *testing.T) {
+	transport := newOriginTransport(2*time.Second, 3*time.Second)
+	assert.Equal(t, 3*time.Second, transport.TLSHandshakeTimeout)
+	assert.NotNil(t, transport.DialContext)
+	assert.NotNil(t, transport.Proxy, "default transport settings should be kept")
+	assert.True(t, transport.ForceAttemptHTTP2)
+	assert.Equal(t, originMaxIdleConnsPerHost, transport.MaxIdleConnsPerHost)
+}
+
+func TestNewOriginTransport_HTTP2(t *testing.T) {
+	var mu sync.Mutex
+	protocols := []string{}
+	connections := 0
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		protocols = append(protocols, r.Proto)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write([]byte{0xFF, 0xD8, 0xFF, 0xE0})
+	}))
+	server.EnableHTTP2 = true
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			connections++
+			mu.Unlock()
+		}
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	transport := newOriginTransport(2*time.Second, 3*time.Second)
+	// Trust the stub's self-signed certificate
+	transport.TLSClientConfig = server.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	client := &http.Client{Transport: transport}
+	fetch := func() {
+		resp, err := client.Get(server.URL + "/a.jpg")
+		if assert.NoError(t, err) {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}
+
+	// The first fetch negotiates HTTP/2, the concurrent ones then share its connection
+	fetch()
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fetch()
+		}()
+	}
+	wg.Wait()
+
+	for _, protocol := range protocols {
+		assert.Equal(t, "HTTP/2.0", protocol)
+	}
+	assert.Len(t, protocols, 9)
+	assert.Equal(t, 1, connections, "concurrent fetches are multiplexed on one connection")
+}
+
+func TestOptimize_NativeMemoryIsReleased(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	source := newJpeg(t, 1000, 800)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(source)
+	}))
+	defer server.Close()
+
+	optimizer := NewImageOptimizer()
+	optimize := func() {
+		_, err := optimizer.Optimize(helpers.ParamsOptimize{Url: server.URL, Width: 400, Quality: 80, Lqip: true})
+		require.NoError(t, err)
+	}
+
+	// Warm up the libvips operation cache before taking the baseline
+	for range 3 {
+		optimize()
+	}
+	var baseline vips.MemoryStats
+	vips.ReadVipsMemStats(&baseline)
+
+	for range 20 {
+		optimize()
+	}
+	var stats vips.MemoryStats
+	vips.ReadVipsMemStats(&stats)
+
+	// A leaked 1000x800 decode alone is 2.4 MB
+	assert.Less(t, stats.Mem-baseline.Mem, int64(1<<20), "tracked memory grew from %d to %d bytes", baseline.Mem, stats.Mem)
+	assert.LessOrEqual(t, stats.Files, baseline.Files)
+}
+
+func TestOptimize_ReusesOriginConnection(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	source := newJpeg(t, 200, 100)
+	var mu sync.Mutex
+	connections := 0
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(source)
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			connections++
+			mu.Unlock()
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	// Like a warm Lambda, one handler serves the invocations one after the other
+	optimizer := NewImageOptimizer()
+	for range 3 {
+		_, err := optimizer.Optimize(helpers.ParamsOptimize{Url: server.URL, Width: 100, Quality: 80})
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, 1, connections, "keep-alive connection is reused across fetches")
+}
+
+// BenchmarkFetchSource_SameHost measures repeated fetches from one HTTP/2 origin, the
+// connection and TLS handshake are only paid once
+func BenchmarkFetchSource_SameHost(b *testing.B) {
+	b.Setenv("SECRET_KEY", "test-imgop-key")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write([]byte{0xFF, 0xD8, 0xFF, 0xE0})
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	transport := newOriginTransport(2*time.Second, 3*time.Second)
+	transport.TLSClientConfig = server.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	client := &http.Client{Transport: transport}
+	imageUrl, err := url.Parse(server.URL + "/a.jpg")
+	require.NoError(b, err)
+
+	b.ReportAllocs()
+	for b.Loop() {
+		resp, err := fetchSource(context.Background(), client, http.MethodGet, imageUrl)
+		require.NoError(b, err)
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+}
+
+func TestOptimize_OriginMaxDownloadBytes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Content-Length", "2048")
+		w.WriteHeader(http.StatusOK)
+		w.Write(append([]byte{0xFF, 0xD8, 0xFF, 0xE0}, make([]byte, 2044)...))
+	}))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	t.Setenv("ORIGIN_LIMITS", `{"`+host+`":{"max_download_bytes":1024}}`)
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	// Rejected on Content-Length before the body reaches the decoder
+	result, err := NewImageOptimizer().Optimize(helpers.ParamsOptimize{Url: server.URL})
+	assert.Error(t, err)
+	assert.Empty(t, result.Image)
+}
+
+func TestOptimizeResult_DebugJSON(t *testing.T) {
+	result := OptimizeResult{
+		Image:          []byte{0x52, 0x49, 0x46, 0x46},
+		SourceBytes:    1000,
+		SourceFormat:   "jpeg",
+		OriginalWidth:  2500,
+		OriginalHeight: 1667,
+		Fit:            "contain",
+		Scale:          0.08,
+		Width:          200,
+		Height:         133,
+		Encoder:        EncoderSettings{Format: "webp", Quality: 80, Effort: 4, SmartSubsample: true},
+	}
+
+	data, err := json.Marshal(result)
+	require.NoError(t, err)
+
+	var decoded map[string]any
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	assert.NotContains(t, decoded, "Image", "debug output must not carry the image bytes")
+	assert.Equal(t, "jpeg", decoded["source_format"])
+	assert.Equal(t, 0.08, decoded["scale"])
+	assert.Equal(t, "webp", decoded["encoder"].(map[string]any)["format"])
+}
+
+func TestOptimize_DecisionTrace(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	os.Setenv("SECRET_KEY", "test-imgop-key")
+	defer func() {
+		os.Unsetenv("SECRET_KEY")
+		helpers.ResetAppEnvForTesting()
+	}()
+	helpers.ResetAppEnvForTesting()
+
+	testImageData := loadTestImage(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.WriteHeader(http.StatusOK)
+		w.Write(testImageData)
+	}))
+	defer server.Close()
+
+	result, err := NewImageOptimizer().Optimize(helpers.ParamsOptimize{
+		Url:     server.URL,
+		Width:   500,
+		Quality: 75,
+	})
+	require.NoError(t, err)
+	require.Greater(t, len(result.Image), 0)
+
+	assert.Equal(t, "jpeg", result.SourceFormat)
+	assert.Equal(t, 2500, result.OriginalWidth)
+	assert.Equal(t, 1667, result.OriginalHeight)
+	assert.Equal(t, "contain", result.Fit)
+	assert.InDelta(t, 0.2, result.Scale, 0.0001)
+	assert.Equal(t, 500, result.Width)
+	assert.Equal(t, EncoderSettings{Format: "webp", Quality: 75, Effort: 4, SmartSubsample: true, Preset: "photo"}, result.Encoder)
+}
+
+func TestWebpEncoderSettings(t *testing.T) {
+	tests := []struct {
+		name                 string
+		params               helpers.ParamsOptimize
+		hasAlpha             bool
+		expectedPreset       string
+		expectedAlphaQuality int
+	}{
+		{
+			name:                 "opaque photo",
+			params:               helpers.ParamsOptimize{Quality: 80},
+			hasAlpha:             false,
+			expectedPreset:       "photo",
+			expectedAlphaQuality: 0,
+		},
+		{
+			name:                 "alpha graphic",
+			params:               helpers.ParamsOptimize{Quality: 80},
+			hasAlpha:             true,
+			expectedPreset:       "drawing",
+			expectedAlphaQuality: 100,
+		},
+		{
+			name:                 "explicit preset overrides alpha default",
+			params:               helpers.ParamsOptimize{Quality: 80, Preset: "icon"},
+			hasAlpha:             true,
+			expectedPreset:       "icon",
+			expectedAlphaQuality: 100,
+		},
+		{
+			name:                 "explicit alpha quality overrides alpha default",
+			params:               helpers.ParamsOptimize{Quality: 80, AlphaQuality: 60},
+			hasAlpha:             true,
+			expectedPreset:       "drawing",
+			expectedAlphaQuality: 60,
+		},
+		{
+			name:                 "explicit preset on opaque image",
+			params:               helpers.ParamsOptimize{Quality: 80, Preset: "picture"},
+			hasAlpha:             false,
+			expectedPreset:       "picture",
+			expectedAlphaQuality: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoder := webpEncoderSettings(tt.params, tt.hasAlpha, 4)
+			assert.Equal(t, tt.expectedPreset, encoder.Preset)
+			assert.Equal(t, tt.expectedAlphaQuality, encoder.AlphaQuality)
+			assert.Equal(t, tt.params.Quality, encoder.Quality)
+			assert.Contains(t, webpPresets, encoder.Preset)
+		})
+	}
+}
+
+func TestOptimize_AlphaAwareEncoder(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	os.Setenv("SECRET_KEY", "test-imgop-key")
+	defer func() {
+		os.Unsetenv("SECRET_KEY")
+		helpers.ResetAppEnvForTesting()
+	}()
+	helpers.ResetAppEnvForTesting()
+
+	// 4-band PNG has an alpha channel
+	alphaImage, err := vips.NewBlack(64, 64, &vips.BlackOptions{Bands: 4})
+	require.NoError(t, err)
+	defer alphaImage.Close()
+	alphaPng, err := alphaImage.PngsaveBuffer(nil)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name           string
+		data           []byte
+		contentType    string
+		expectedPreset string
+	}{
+		{
+			name:           "alpha png",
+			data:           alphaPng,
+			contentType:    "image/png",
+			expectedPreset: "drawing",
+		},
+		{
+			name:           "opaque jpeg",
+			data:           loadTestImage(t),
+			contentType:    "image/jpeg",
+			expectedPreset: "photo",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.WriteHeader(http.StatusOK)
+				w.Write(tt.data)
+			}))
+			defer server.Close()
+
+			result, err := NewImageOptimizer().Optimize(helpers.ParamsOptimize{Url: server.URL, Width: 32, Quality: 80})
+			require.NoError(t, err)
+			require.Greater(t, len(result.Image), 0)
+			assert.Equal(t, tt.expectedPreset, result.Encoder.Preset)
+		})
+	}
+}
+
+func TestWebpEncoderSettings_OptimizationLevels(t *testing.T) {
+	tests := []struct {
+		level                  string
+		expectedEffort         int
+		expectedSmartSubsample bool
+		expectedMinSize        bool
+	}{
+		{level: "", expectedEffort: 4, expectedSmartSubsample: true, expectedMinSize: false},
+		{level: "fast", expectedEffort: 1, expectedSmartSubsample: false, expectedMinSize: false},
+		{level: "balanced", expectedEffort: 4, expectedSmartSubsample: true, expectedMinSize: false},
+		{level: "max", expectedEffort: 6, expectedSmartSubsample: true, expectedMinSize: true},
+	}
+
+	for _, tt := range tests {
+		t.Run("level "+tt.level, func(t *testing.T) {
+			encoder := webpEncoderSettings(helpers.ParamsOptimize{Quality: 80, Optimization: tt.level}, false, 4)
+			assert.Equal(t, tt.expectedEffort, encoder.Effort)
+			assert.Equal(t, tt.expectedSmartSubsample, encoder.SmartSubsample)
+			assert.Equal(t, tt.expectedMinSize, encoder.MinSize)
+			assert.Equal(t, 80, encoder.Quality, "optimize level should not change quality")
+		})
+	}
+}
+
+func TestWebpEncoderSettings_DefaultEffort(t *testing.T) {
+	tests := []struct {
+		level          string
+		expectedEffort int
+	}{
+		{level: "", expectedEffort: 2},
+		{level: "balanced", expectedEffort: 2},
+		{level: "fast", expectedEffort: 1},
+		{level: "max", expectedEffort: 6},
+	}
+
+	for _, tt := range tests {
+		t.Run("level "+tt.level, func(t *testing.T) {
+			encoder := webpEncoderSettings(helpers.ParamsOptimize{Quality: 80, Optimization: tt.level}, false, 2)
+			assert.Equal(t, tt.expectedEffort, encoder.Effort, "the default effort only applies to the balanced level")
+		})
+	}
+}
+
+func TestOptimize_DefaultEffort(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	t.Setenv("DEFAULT_EFFORT", "2")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	testImageData := loadTestImage(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.WriteHeader(http.StatusOK)
+		w.Write(testImageData)
+	}))
+	defer server.Close()
+
+	result, err := NewImageOptimizer().Optimize(helpers.ParamsOptimize{Url: server.URL, Width: 200, Quality: 80})
+	require.NoError(t, err)
+	require.Greater(t, len(result.Image), 0)
+	assert.Equal(t, 2, result.Encoder.Effort, "effort is omitted, so the deployment default applies")
+
+	result, err = NewImageOptimizer().Optimize(helpers.ParamsOptimize{Url: server.URL, Width: 200, Quality: 80, Optimization: "max"})
+	require.NoError(t, err)
+	require.Greater(t, len(result.Image), 0)
+	assert.Equal(t, 6, result.Encoder.Effort, "an explicit optimize level wins")
+}
+
+func TestComputeScale(t *testing.T) {
+	tests := []struct {
+		name           string
+		params         helpers.ParamsOptimize
+		expectedScale  float64
+		expectedCapped bool
+		originalWidth  int
+		originalHeight int
+	}{
+		{
+			name:           "width only downscale",
+			params:         helpers.ParamsOptimize{Width: 400},
+			originalWidth:  800,
+			originalHeight: 600,
+			expectedScale:  0.5,
+		},
+		{
+			name:           "height only downscale",
+			params:         helpers.ParamsOptimize{Height: 150},
+			originalWidth:  800,
+			originalHeight: 600,
+			expectedScale:  0.25,
+		},
+		{
+			name:           "contain picks the smaller scale",
+			params:         helpers.ParamsOptimize{Width: 400, Height: 400},
+			originalWidth:  800,
+			originalHeight: 600,
+			expectedScale:  0.5,
+		},
+		{
+			name:           "no dimensions keeps size",
+			params:         helpers.ParamsOptimize{},
+			originalWidth:  800,
+			originalHeight: 600,
+			expectedScale:  1.0,
+		},
+		{
+			name:           "enlargement allowed",
+			params:         helpers.ParamsOptimize{Width: 1600},
+			originalWidth:  800,
+			originalHeight: 600,
+			expectedScale:  2.0,
+		},
+		{
+			name:           "enlargement capped at source size",
+			params:         helpers.ParamsOptimize{Width: 1600, WithoutEnlargement: true},
+			originalWidth:  800,
+			originalHeight: 600,
+			expectedScale:  1.0,
+			expectedCapped: true,
+		},
+		{
+			name:           "downscale is not capped",
+			params:         helpers.ParamsOptimize{Width: 400, WithoutEnlargement: true},
+			originalWidth:  800,
+			originalHeight: 600,
+			expectedScale:  0.5,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scale, capped := computeScale(tt.params, tt.originalWidth, tt.originalHeight)
+			assert.InDelta(t, tt.expectedScale, scale, 0.0001)
+			assert.Equal(t, tt.expectedCapped, capped)
+		})
+	}
+}
+
+func TestComputeFillScale(t *testing.T) {
+	tests := []struct {
+		name           string
+		params         helpers.ParamsOptimize
+		expectedScaleX float64
+		expectedScaleY float64
+		expectedCapped bool
+	}{
+		{
+			name:           "square to wide",
+			params:         helpers.ParamsOptimize{Width: 400, Height: 100},
+			expectedScaleX: 1.0,
+			expectedScaleY: 0.25,
+		},
+		{
+			name:           "upscale allowed",
+			params:         helpers.ParamsOptimize{Width: 800, Height: 200},
+			expectedScaleX: 2.0,
+			expectedScaleY: 0.5,
+		},
+		{
+			name:           "upscale capped per axis",
+			params:         helpers.ParamsOptimize{Width: 800, Height: 200, WithoutEnlargement: true},
+			expectedScaleX: 1.0,
+			expectedScaleY: 0.5,
+			expectedCapped: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scaleX, scaleY, capped := computeFillScale(tt.params, 400, 400)
+			assert.InDelta(t, tt.expectedScaleX, scaleX, 0.0001)
+			assert.InDelta(t, tt.expectedScaleY, scaleY, 0.0001)
+			assert.Equal(t, tt.expectedCapped, capped)
+		})
+	}
+}
+
+func TestComputeCoverScale(t *testing.T) {
+	tests := []struct {
+		name           string
+		params         helpers.ParamsOptimize
+		expectedScale  float64
+		expectedCapped bool
+	}{
+		{name: "landscape to square picks the larger scale", params: helpers.ParamsOptimize{Width: 300, Height: 300}, expectedScale: 0.5},
+		{name: "landscape to wide", params: helpers.ParamsOptimize{Width: 600, Height: 150}, expectedScale: 0.75},
+		{name: "upscale allowed", params: helpers.ParamsOptimize{Width: 400, Height: 900}, expectedScale: 1.5},
+		{name: "upscale capped", params: helpers.ParamsOptimize{Width: 400, Height: 900, WithoutEnlargement: true}, expectedScale: 1.0, expectedCapped: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scale, capped := computeCoverScale(tt.params, 800, 600)
+			assert.InDelta(t, tt.expectedScale, scale, 0.0001)
+			assert.Equal(t, tt.expectedCapped, capped)
+		})
+	}
+}
+
+func TestAspectDistortion(t *testing.T) {
+	assert.InDelta(t, 1.0, aspectDistortion(0.5, 0.5), 0.0001)
+	assert.InDelta(t, 4.0, aspectDistortion(1.0, 0.25), 0.0001)
+	assert.InDelta(t, 4.0, aspectDistortion(0.25, 1.0), 0.0001)
+	assert.InDelta(t, 1.0, aspectDistortion(0.5, 0), 0.0001)
+}
+
+func TestOptimize_FitFill(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	square, err := vips.NewBlack(400, 400, &vips.BlackOptions{Bands: 3})
+	require.NoError(t, err)
+	defer square.Close()
+	squareJpeg, err := square.JpegsaveBuffer(nil)
+	require.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.WriteHeader(http.StatusOK)
+		w.Write(squareJpeg)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name               string
+		width              int
+		height             int
+		expectedDistortion float64
+		expectedDistorted  bool
+	}{
+		{name: "Square to wide", width: 400, height: 100, expectedDistortion: 4.0, expectedDistorted: true},
+		{name: "Slight stretch", width: 400, height: 380, expectedDistortion: 400.0 / 380, expectedDistorted: false},
+		{name: "Uniform", width: 200, height: 200, expectedDistortion: 1.0, expectedDistorted: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := NewImageOptimizer().Optimize(helpers.ParamsOptimize{
+				Url:     server.URL,
+				Width:   tt.width,
+				Height:  tt.height,
+				Quality: 80,
+				Fit:     "fill",
+			})
+			require.NoError(t, err)
+			require.Greater(t, len(result.Image), 0)
+
+			assert.Equal(t, "fill", result.Fit)
+			assert.Equal(t, tt.width, result.Width)
+			assert.Equal(t, tt.height, result.Height)
+			assert.InDelta(t, tt.expectedDistortion, result.AspectDistortion, 0.0001)
+			assert.Equal(t, tt.expectedDistorted, result.AspectDistorted)
+		})
+	}
+}
+
+func TestOptimize_FitModes(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	testImage := loadTestImage(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.WriteHeader(http.StatusOK)
+		w.Write(testImage)
+	}))
+	defer server.Close()
+
+	// The 2500x1667 test image into a 400x400 box
+	tests := []struct {
+		name               string
+		fit                string
+		withoutEnlargement bool
+		width, height      int
+		expectedWidth      int
+		expectedHeight     int
+	}{
+		{name: "Contain", fit: "contain", width: 400, height: 400, expectedWidth: 400, expectedHeight: 267},
+		{name: "Default is contain", width: 400, height: 400, expectedWidth: 400, expectedHeight: 267},
+		{name: "Cover", fit: "cover", width: 400, height: 400, expectedWidth: 400, expectedHeight: 400},
+		{name: "Cover wide", fit: "cover", width: 600, height: 100, expectedWidth: 600, expectedHeight: 100},
+		{name: "Cover without enlargement", fit: "cover", withoutEnlargement: true, width: 4000, height: 1000, expectedWidth: 2500, expectedHeight: 1000},
+		// Upscaled 1.8x to 4499x3000, then the width overflow is cropped
+		{name: "Cover upscales a smaller source", fit: "cover", width: 3000, height: 3000, expectedWidth: 3000, expectedHeight: 3000},
+		{name: "Fill", fit: "fill", width: 400, height: 400, expectedWidth: 400, expectedHeight: 400},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := NewImageOptimizer().Optimize(helpers.ParamsOptimize{
+				Url:                server.URL,
+				Width:              tt.width,
+				Height:             tt.height,
+				Quality:            80,
+				Fit:                tt.fit,
+				WithoutEnlargement: tt.withoutEnlargement,
+			})
+			require.NoError(t, err)
+
+			output, err := vips.NewImageFromBuffer(result.Image, nil)
+			require.NoError(t, err)
+			defer output.Close()
+			assert.Equal(t, tt.expectedWidth, output.Width())
+			assert.Equal(t, tt.expectedHeight, output.Height())
+			assert.Equal(t, tt.expectedWidth, result.Width)
+			assert.Equal(t, tt.expectedHeight, result.Height)
+		})
+	}
+}
+
+func TestSnapToBox(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	tests := []struct {
+		name                          string
+		width, height                 int
+		boxWidth, boxHeight           int
+		expectedWidth, expectedHeight int
+	}{
+		{name: "Exact is untouched", width: 300, height: 200, boxWidth: 300, boxHeight: 200, expectedWidth: 300, expectedHeight: 200},
+		{name: "One pixel over is cropped", width: 301, height: 201, boxWidth: 300, boxHeight: 200, expectedWidth: 300, expectedHeight: 200},
+		{name: "One pixel short is extended", width: 299, height: 199, boxWidth: 300, boxHeight: 200, expectedWidth: 300, expectedHeight: 200},
+		{name: "Mixed axes", width: 301, height: 199, boxWidth: 300, boxHeight: 200, expectedWidth: 300, expectedHeight: 200},
+		{name: "Further off isn't rounding", width: 250, height: 202, boxWidth: 300, boxHeight: 200, expectedWidth: 250, expectedHeight: 202},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			image, err := vips.NewBlack(tt.width, tt.height, &vips.BlackOptions{Bands: 3})
+			require.NoError(t, err)
+			defer image.Close()
+
+			require.NoError(t, snapToBox(image, tt.boxWidth, tt.boxHeight))
+			assert.Equal(t, tt.expectedWidth, image.Width())
+			assert.Equal(t, tt.expectedHeight, image.Height())
+		})
+	}
+}
+
+func TestOptimize_ExactSize(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	// Odd source sizes whose scales don't land on whole pixels
+	tests := []struct {
+		name                string
+		sourceWidth         int
+		sourceHeight        int
+		fit                 string
+		boxWidth, boxHeight int
+	}{
+		{name: "Cover downscale", sourceWidth: 1001, sourceHeight: 667, fit: "cover", boxWidth: 300, boxHeight: 199},
+		{name: "Cover third", sourceWidth: 1000, sourceHeight: 997, fit: "cover", boxWidth: 333, boxHeight: 333},
+		{name: "Cover upscale", sourceWidth: 99, sourceHeight: 67, fit: "cover", boxWidth: 401, boxHeight: 271},
+		{name: "Fill", sourceWidth: 997, sourceHeight: 501, fit: "fill", boxWidth: 333, boxHeight: 167},
+		{name: "Fill upscale", sourceWidth: 61, sourceHeight: 43, fit: "fill", boxWidth: 250, boxHeight: 97},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source, err := vips.NewBlack(tt.sourceWidth, tt.sourceHeight, &vips.BlackOptions{Bands: 3})
+			require.NoError(t, err)
+			defer source.Close()
+			sourcePng, err := source.PngsaveBuffer(nil)
+			require.NoError(t, err)
+
+			result, err := NewImageOptimizer().Process(t.Context(), sourcePng, helpers.ParamsOptimize{
+				Width:   tt.boxWidth,
+				Height:  tt.boxHeight,
+				Quality: 80,
+				Fit:     tt.fit,
+			})
+			require.NoError(t, err)
+
+			output, err := vips.NewImageFromBuffer(result.Image, nil)
+			require.NoError(t, err)
+			defer output.Close()
+			assert.Equal(t, tt.boxWidth, output.Width())
+			assert.Equal(t, tt.boxHeight, output.Height())
+		})
+	}
+}
+
+func TestOptimize_PassthroughFormats(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	source, err := vips.NewBlack(120, 80, &vips.BlackOptions{Bands: 3})
+	require.NoError(t, err)
+	defer source.Close()
+	sourceTiff, err := source.TiffsaveBuffer(nil)
+	require.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/tiff")
+		w.WriteHeader(http.StatusOK)
+		w.Write(sourceTiff)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name               string
+		passthroughFormats string
+		expectedFormat     string
+		passthrough        bool
+	}{
+		{name: "In the passthrough set", passthroughFormats: "jp2k,tiff", expectedFormat: "tiff", passthrough: true},
+		{name: "Not in the passthrough set", passthroughFormats: "jp2k", expectedFormat: "webp", passthrough: false},
+		{name: "Passthrough disabled", expectedFormat: "webp", passthrough: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SECRET_KEY", "test-imgop-key")
+			t.Setenv("PASSTHROUGH_FORMATS", tt.passthroughFormats)
+			helpers.ResetAppEnvForTesting()
+			defer helpers.ResetAppEnvForTesting()
+
+			result, err := NewImageOptimizer().Optimize(helpers.ParamsOptimize{
+				Url:     server.URL,
+				Width:   60,
+				Quality: 80,
+			})
+			require.NoError(t, err)
+			require.Greater(t, len(result.Image), 0)
+
+			assert.Equal(t, tt.passthrough, result.Passthrough)
+			assert.Equal(t, tt.expectedFormat, result.Encoder.Format)
+			assert.Equal(t, "tiff", result.SourceFormat)
+			assert.Equal(t, 120, result.OriginalWidth)
+			assert.Equal(t, 80, result.OriginalHeight)
+			if tt.passthrough {
+				assert.Equal(t, sourceTiff, result.Image)
+				assert.Equal(t, 120, result.Width)
+			} else {
+				assert.Equal(t, 60, result.Width)
+			}
+		})
+	}
+}
+
+func TestOptimize_EnlargeCapped(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	os.Setenv("SECRET_KEY", "test-imgop-key")
+	defer func() {
+		os.Unsetenv("SECRET_KEY")
+		helpers.ResetAppEnvForTesting()
+	}()
+	helpers.ResetAppEnvForTesting()
+
+	smallImage, err := vips.NewBlack(100, 80, &vips.BlackOptions{Bands: 3})
+	require.NoError(t, err)
+	defer smallImage.Close()
+	smallJpeg, err := smallImage.JpegsaveBuffer(nil)
+	require.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.WriteHeader(http.StatusOK)
+		w.Write(smallJpeg)
+	}))
+	defer server.Close()
+
+	result, err := NewImageOptimizer().Optimize(helpers.ParamsOptimize{
+		Url:                server.URL,
+		Width:              400,
+		Quality:            80,
+		WithoutEnlargement: true,
+	})
+	require.NoError(t, err)
+	require.Greater(t, len(result.Image), 0)
+
+	assert.True(t, result.EnlargeCapped)
+	assert.Equal(t, 100, result.Width)
+	assert.Equal(t, 80, result.Height)
+	assert.Equal(t, 100, result.OriginalWidth)
+	assert.Equal(t, 80, result.OriginalHeight)
+}
+
+func TestOptimize_Upscale(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	source, err := vips.NewBlack(800, 600, &vips.BlackOptions{Bands: 3})
+	require.NoError(t, err)
+	defer source.Close()
+	sourceJpeg, err := source.JpegsaveBuffer(nil)
+	require.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.WriteHeader(http.StatusOK)
+		w.Write(sourceJpeg)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name               string
+		withoutEnlargement bool
+		expectedWidth      int
+		expectedHeight     int
+	}{
+		{name: "Disabled returns the source size", withoutEnlargement: true, expectedWidth: 800, expectedHeight: 600},
+		{name: "Allowed upscales", withoutEnlargement: false, expectedWidth: 2000, expectedHeight: 1500},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := NewImageOptimizer().Optimize(helpers.ParamsOptimize{
+				Url:                server.URL,
+				Width:              2000,
+				Quality:            80,
+				WithoutEnlargement: tt.withoutEnlargement,
+			})
+			require.NoError(t, err)
+
+			output, err := vips.NewImageFromBuffer(result.Image, nil)
+			require.NoError(t, err)
+			defer output.Close()
+			assert.Equal(t, tt.expectedWidth, output.Width())
+			assert.Equal(t, tt.expectedHeight, output.Height())
+			assert.Equal(t, tt.withoutEnlargement, result.EnlargeCapped)
+		})
+	}
+}
+
+func TestOptimize_CoverEnlarge(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	// A flat grey source, so any padding instead of image would show in the corners
+	source, err := vips.NewBlack(1200, 800, &vips.BlackOptions{Bands: 3})
+	require.NoError(t, err)
+	defer source.Close()
+	require.NoError(t, source.Linear([]float64{1}, []float64{200}, nil))
+	require.NoError(t, source.Cast(vips.BandFormatUchar, nil))
+	sourcePng, err := source.PngsaveBuffer(nil)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name               string
+		withoutEnlargement bool
+		expectedWidth      int
+		expectedHeight     int
+	}{
+		{name: "Enlarge upscales then crops to the box", withoutEnlargement: false, expectedWidth: 1600, expectedHeight: 900},
+		{name: "No enlarge clips the box to the source", withoutEnlargement: true, expectedWidth: 1200, expectedHeight: 800},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := NewImageOptimizer().Process(t.Context(), sourcePng, helpers.ParamsOptimize{
+				Width:              1600,
+				Height:             900,
+				Quality:            80,
+				Fit:                "cover",
+				WithoutEnlargement: tt.withoutEnlargement,
+			})
+			require.NoError(t, err)
+			assert.Equal(t, tt.withoutEnlargement, result.EnlargeCapped)
+
+			output, err := vips.NewImageFromBuffer(result.Image, nil)
+			require.NoError(t, err)
+			defer output.Close()
+			assert.Equal(t, tt.expectedWidth, output.Width())
+			assert.Equal(t, tt.expectedHeight, output.Height())
+
+			// Every corner is source pixels, the box is filled edge to edge
+			for _, point := range [][2]int{{0, 0}, {output.Width() - 1, 0}, {0, output.Height() - 1}, {output.Width() - 1, output.Height() - 1}} {
+				pixel, err := output.Getpoint(point[0], point[1], nil)
+				require.NoError(t, err)
+				assert.InDelta(t, 200, pixel[0], 8, "corner %v", point)
+			}
+		})
+	}
+}
+
+// The dpr multiplies w/h, MAX_WIDTH/MAX_HEIGHT clamp the product keeping its ratio, the
+// MIN_WIDTH/MIN_HEIGHT floors raise it, and without enlargement the source size caps the resize
+func TestOptimize_DprInteraction(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	source, err := vips.NewBlack(1500, 1000, &vips.BlackOptions{Bands: 3})
+	require.NoError(t, err)
+	defer source.Close()
+	sourcePng, err := source.PngsaveBuffer(nil)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name              string
+		minWidth          string
+		params            helpers.ParamsOptimize
+		expectedWidth     int
+		expectedHeight    int
+		expectedCapped    bool
+		expectedEffective float64
+		expectedDprCapped bool
+	}{
+		{name: "Within the max and the source", params: helpers.ParamsOptimize{Width: 400, Dpr: 2, WithoutEnlargement: true},
+			expectedWidth: 800, expectedHeight: 533, expectedEffective: 2},
+		{name: "Source caps the dpr", params: helpers.ParamsOptimize{Width: 800, Dpr: 3, WithoutEnlargement: true},
+			expectedWidth: 1500, expectedHeight: 1000, expectedCapped: true, expectedEffective: 1.875, expectedDprCapped: true},
+		{name: "Max caps the dpr before the source", params: helpers.ParamsOptimize{Width: 800, Dpr: 3},
+			expectedWidth: 1800, expectedHeight: 1200, expectedEffective: 2.25, expectedDprCapped: true},
+		{name: "Enlarge within the max", params: helpers.ParamsOptimize{Width: 800, Dpr: 2},
+			expectedWidth: 1600, expectedHeight: 1067, expectedEffective: 2},
+		{name: "Cover capped by the source", params: helpers.ParamsOptimize{Width: 800, Height: 600, Dpr: 3, Fit: "cover", WithoutEnlargement: true},
+			expectedWidth: 1500, expectedHeight: 1000, expectedCapped: true, expectedEffective: 1.6667, expectedDprCapped: true},
+		{name: "Cover capped by the max", params: helpers.ParamsOptimize{Width: 800, Height: 600, Dpr: 3, Fit: "cover"},
+			expectedWidth: 1800, expectedHeight: 1350, expectedEffective: 2.25, expectedDprCapped: true},
+		{name: "Floor raises the dpr product", minWidth: "100", params: helpers.ParamsOptimize{Width: 40, Dpr: 2, WithoutEnlargement: true},
+			expectedWidth: 100, expectedHeight: 67, expectedEffective: 2.5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SECRET_KEY", "test-imgop-key")
+			t.Setenv("MIN_WIDTH", tt.minWidth)
+			helpers.ResetAppEnvForTesting()
+			defer helpers.ResetAppEnvForTesting()
+
+			params, err := helpers.ValidateParams(tt.params)
+			require.NoError(t, err)
+			result, err := NewImageOptimizer().Process(t.Context(), sourcePng, params)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedWidth, result.Width)
+			assert.Equal(t, tt.expectedHeight, result.Height)
+			assert.Equal(t, tt.expectedCapped, result.EnlargeCapped)
+
+			effective, dprCapped := helpers.EffectiveDpr(tt.params.Dpr, tt.params.Fit, tt.params.Width, tt.params.Height, result.Width, result.Height)
+			assert.InDelta(t, tt.expectedEffective, effective, 0.0001)
+			assert.Equal(t, tt.expectedDprCapped, dprCapped)
+		})
+	}
+}
+
+func TestOptimize_Undersize(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	smallImage, err := vips.NewBlack(100, 80, &vips.BlackOptions{Bands: 3})
+	require.NoError(t, err)
+	defer smallImage.Close()
+	smallJpeg, err := smallImage.JpegsaveBuffer(nil)
+	require.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.WriteHeader(http.StatusOK)
+		w.Write(smallJpeg)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name           string
+		undersize      string
+		background     []float64
+		expectedWidth  int
+		expectedHeight int
+		expectedAlpha  bool
+	}{
+		{name: "Default keeps the source size", expectedWidth: 100, expectedHeight: 80},
+		{name: "Shrink-only keeps the source size", undersize: "shrink-only", expectedWidth: 100, expectedHeight: 80},
+		{name: "Pad letterboxes transparent", undersize: "pad", expectedWidth: 400, expectedHeight: 300, expectedAlpha: true},
+		{name: "Pad letterboxes on the bg color", undersize: "pad", background: []float64{255, 255, 255}, expectedWidth: 400, expectedHeight: 300},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := NewImageOptimizer().Optimize(helpers.ParamsOptimize{
+				Url:                server.URL,
+				Width:              400,
+				Height:             300,
+				Quality:            80,
+				WithoutEnlargement: true,
+				Undersize:          tt.undersize,
+				Background:         tt.background,
+			})
+			require.NoError(t, err)
+			require.Greater(t, len(result.Image), 0)
+
+			assert.True(t, result.EnlargeCapped)
+			assert.Equal(t, tt.expectedWidth, result.Width)
+			assert.Equal(t, tt.expectedHeight, result.Height)
+
+			output, err := vips.NewImageFromBuffer(result.Image, nil)
+			require.NoError(t, err)
+			defer output.Close()
+			assert.Equal(t, tt.expectedAlpha, output.HasAlpha())
+		})
+	}
+}
+
+// withXmp inserts an APP1 XMP segment right after the JPEG SOI
+func withXmp(jpeg []byte, xmp string) []byte {
+	payload := append([]byte("http://ns.adobe.com/xap/1.0/\x00"), xmp...)
+	segment := []byte{0xFF, 0xE1, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}
+	return slices.Concat(jpeg[:2], segment, payload, jpeg[2:])
+}
+
+func TestMetadataKeep(t *testing.T) {
+	assert.Equal(t, vips.Keep(0), metadataKeep(false, nil), "default keeps everything")
+	assert.Equal(t, vips.KeepIcc, metadataKeep(true, nil))
+	assert.Equal(t, vips.KeepOther, metadataKeep(false, []string{}), "empty list keeps none of the namespaces")
+	assert.Equal(t, vips.KeepOther, metadataKeep(false, []string{"orientation"}))
+	assert.Equal(t, vips.KeepOther|vips.KeepExif|vips.KeepXmp, metadataKeep(true, []string{"exif", "xmp"}), "keep_meta wins over stripping")
+}
+
+func TestOptimize_KeepMeta(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	xmp := `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#"/></x:xmpmeta>`
+	source := withXmp(withExifThumbnail(t, newJpeg(t, 200, 100), newJpeg(t, 20, 10), 1), xmp)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.WriteHeader(http.StatusOK)
+		w.Write(source)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name          string
+		stripMetadata bool
+		keepMeta      []string
+		expectedExif  bool
+		expectedXmp   bool
+	}{
+		{name: "Unstripped keeps everything", expectedExif: true, expectedXmp: true},
+		{name: "Stripped", stripMetadata: true},
+		{name: "Exif only", keepMeta: []string{"exif"}, expectedExif: true},
+		{name: "Exif over stripping", stripMetadata: true, keepMeta: []string{"exif"}, expectedExif: true},
+		{name: "Xmp only", keepMeta: []string{"xmp"}, expectedXmp: true},
+		{name: "Orientation only", keepMeta: []string{"orientation"}},
+		{name: "Nothing", keepMeta: []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := NewImageOptimizer().Optimize(helpers.ParamsOptimize{
+				Url:           server.URL,
+				Width:         100,
+				Quality:       80,
+				StripMetadata: tt.stripMetadata,
+				KeepMeta:      tt.keepMeta,
+			})
+			require.NoError(t, err)
+			require.Greater(t, len(result.Image), 0)
+			assert.Equal(t, tt.keepMeta, result.Encoder.KeepMetadata)
+
+			output, err := vips.NewImageFromBuffer(result.Image, nil)
+			require.NoError(t, err)
+			defer output.Close()
+			assert.Equal(t, tt.expectedExif, output.HasField("exif-data"))
+			assert.Equal(t, tt.expectedXmp, output.HasField("xmp-data"))
+		})
+	}
+}
+
+func TestForwardHeaders(t *testing.T) {
+	originHeaders := http.Header{}
+	originHeaders.Set("Last-Modified", "Wed, 21 Oct 2015 07:28:00 GMT")
+	originHeaders.Set("X-Asset-Version", "42")
+	originHeaders.Set("X-Not-Selected", "secret")
+	originHeaders.Set("Connection", "keep-alive")
+	originHeaders.Set("Set-Cookie", "session=abc")
+	originHeaders.Set("Content-Length", "1234")
+	originHeaders["X-Injected"] = []string{"value\r\nSet-Cookie: evil=1"}
+
+	forwarded := forwardHeaders(originHeaders, []string{
+		"last-modified", "X-Asset-Version", "Connection", "Set-Cookie", "Content-Length", "X-Injected", "X-Missing",
+	})
+
+	assert.Equal(t, map[string]string{
+		"Last-Modified":   "Wed, 21 Oct 2015 07:28:00 GMT",
+		"X-Asset-Version": "42",
+		"X-Injected":      "valueSet-Cookie: evil=1",
+	}, forwarded)
+}
+
+func TestForwardHeaders_NoneConfigured(t *testing.T) {
+	originHeaders := http.Header{}
+	originHeaders.Set("Last-Modified", "Wed, 21 Oct 2015 07:28:00 GMT")
+
+	assert.Empty(t, forwardHeaders(originHeaders, []string{}))
+}
+
+func TestCanUseSequentialAccess(t *testing.T) {
+	tests := []struct {
+		name        string
+		params      helpers.ParamsOptimize
+		orientation int
+		expected    bool
+	}{
+		{name: "Downscale", params: helpers.ParamsOptimize{Width: 500}, orientation: 1, expected: true},
+		{name: "No resize", params: helpers.ParamsOptimize{}, orientation: 0, expected: true},
+		{name: "Upscale", params: helpers.ParamsOptimize{Width: 4000}, orientation: 1, expected: false},
+		{name: "Capped upscale", params: helpers.ParamsOptimize{Width: 4000, WithoutEnlargement: true}, orientation: 1, expected: true},
+		{name: "Manual rotate", params: helpers.ParamsOptimize{Width: 500, Rotate: 90}, orientation: 1, expected: false},
+		{name: "EXIF rotated", params: helpers.ParamsOptimize{Width: 500}, orientation: 6, expected: false},
+		{name: "Trim", params: helpers.ParamsOptimize{Width: 500, Trim: true}, orientation: 1, expected: false},
+		{name: "Aspect crop downscale", params: helpers.ParamsOptimize{Width: 1000, AspectRatio: 1}, orientation: 1, expected: true},
+		{name: "Pipeline", params: helpers.ParamsOptimize{Pipeline: []helpers.PipelineOp{{Op: helpers.PipelineResize, Width: 500}}}, orientation: 1, expected: false},
+		{name: "Fill downscale", params: helpers.ParamsOptimize{Width: 1000, Height: 200, Fit: "fill"}, orientation: 1, expected: true},
+		{name: "Fill stretch", params: helpers.ParamsOptimize{Width: 1000, Height: 2000, Fit: "fill"}, orientation: 1, expected: false},
+		{name: "Cover downscale", params: helpers.ParamsOptimize{Width: 1000, Height: 1000, Fit: "cover"}, orientation: 1, expected: true},
+		{name: "Cover upscale", params: helpers.ParamsOptimize{Width: 2000, Height: 2000, Fit: "cover"}, orientation: 1, expected: false},
+		{name: "Aspect crop upscale", params: helpers.ParamsOptimize{Width: 2000, AspectRatio: 1}, orientation: 1, expected: false},
+		{name: "Lqip", params: helpers.ParamsOptimize{Width: 500, Lqip: true}, orientation: 1, expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, canUseSequentialAccess(tt.params, tt.orientation, 2500, 1667))
+		})
+	}
+}
+
+func TestAspectCrop(t *testing.T) {
+	tests := []struct {
+		name                             string
+		width, height                    int
+		ratio                            float64
+		left, top, cropWidth, cropHeight int
+	}{
+		{name: "Landscape to square", width: 800, height: 600, ratio: 1, left: 100, top: 0, cropWidth: 600, cropHeight: 600},
+		{name: "Landscape to 4:3", width: 1920, height: 1080, ratio: 4.0 / 3, left: 240, top: 0, cropWidth: 1440, cropHeight: 1080},
+		{name: "Square to 16:9", width: 1000, height: 1000, ratio: 16.0 / 9, left: 0, top: 218, cropWidth: 1000, cropHeight: 563},
+		{name: "Portrait to 3:4", width: 600, height: 1000, ratio: 3.0 / 4, left: 0, top: 100, cropWidth: 600, cropHeight: 800},
+		{name: "Already matching", width: 800, height: 600, ratio: 4.0 / 3, left: 0, top: 0, cropWidth: 800, cropHeight: 600},
+		{name: "Never below a pixel", width: 1, height: 1, ratio: 20, left: 0, top: 0, cropWidth: 1, cropHeight: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			left, top, cropWidth, cropHeight := aspectCrop(tt.width, tt.height, tt.ratio)
+			assert.Equal(t, tt.left, left)
+			assert.Equal(t, tt.top, top)
+			assert.Equal(t, tt.cropWidth, cropWidth)
+			assert.Equal(t, tt.cropHeight, cropHeight)
+		})
+	}
+}
+
+func TestGravityCrop(t *testing.T) {
+	// A 400x200 crop of an 800x600 image
+	tests := []struct {
+		gravity   string
+		left, top int
+	}{
+		{gravity: "", left: 200, top: 200},
+		{gravity: "north", left: 200, top: 0},
+		{gravity: "south", left: 200, top: 400},
+		{gravity: "east", left: 400, top: 200},
+		{gravity: "west", left: 0, top: 200},
+		{gravity: "northeast", left: 400, top: 0},
+		{gravity: "northwest", left: 0, top: 0},
+		{gravity: "southeast", left: 400, top: 400},
+		{gravity: "southwest", left: 0, top: 400},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.gravity, func(t *testing.T) {
+			left, top, cropWidth, cropHeight := gravityCrop(800, 600, 400, 200, tt.gravity)
+			assert.Equal(t, tt.left, left)
+			assert.Equal(t, tt.top, top)
+			assert.Equal(t, 400, cropWidth)
+			assert.Equal(t, 200, cropHeight)
+		})
+	}
+
+	// Clipped to the image, the clipped axis has nothing to move along
+	left, top, cropWidth, cropHeight := gravityCrop(800, 600, 1000, 200, "southeast")
+	assert.Equal(t, []int{0, 400, 800, 200}, []int{left, top, cropWidth, cropHeight})
+}
+
+func TestOptimize_CoverGravity(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	// White top half, black bottom half
+	source, err := vips.NewBlack(400, 400, &vips.BlackOptions{Bands: 3})
+	require.NoError(t, err)
+	defer source.Close()
+	require.NoError(t, source.DrawRect([]float64{255, 255, 255}, 0, 0, 400, 200, &vips.DrawRectOptions{Fill: true}))
+	sourcePng, err := source.PngsaveBuffer(nil)
+	require.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(sourcePng)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		gravity     string
+		expectedAvg float64
+	}{
+		{gravity: "north", expectedAvg: 255},
+		{gravity: "south", expectedAvg: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.gravity, func(t *testing.T) {
+			result, err := NewImageOptimizer().Optimize(helpers.ParamsOptimize{
+				Url:     server.URL,
+				Width:   400,
+				Height:  100,
+				Quality: 100,
+				Fit:     "cover",
+				Gravity: tt.gravity,
+			})
+			require.NoError(t, err)
+
+			output, err := vips.NewImageFromBuffer(result.Image, nil)
+			require.NoError(t, err)
+			defer output.Close()
+			assert.Equal(t, 400, output.Width())
+			assert.Equal(t, 100, output.Height())
+			avg, err := output.Avg()
+			require.NoError(t, err)
+			assert.InDelta(t, tt.expectedAvg, avg, 8, "the crop keeps the %s band", tt.gravity)
+		})
+	}
+}
+
+func TestOptimize_AspectRatio(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	source, err := vips.NewBlack(800, 600, &vips.BlackOptions{Bands: 3})
+	require.NoError(t, err)
+	defer source.Close()
+	sourceJpeg, err := source.JpegsaveBuffer(nil)
+	require.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.WriteHeader(http.StatusOK)
+		w.Write(sourceJpeg)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name           string
+		params         helpers.ParamsOptimize
+		expectedWidth  int
+		expectedHeight int
+	}{
+		{name: "Crop only keeps resolution", params: helpers.ParamsOptimize{AspectRatio: 1}, expectedWidth: 600, expectedHeight: 600},
+		{name: "Crop then resize", params: helpers.ParamsOptimize{AspectRatio: 16.0 / 9, Width: 400}, expectedWidth: 400, expectedHeight: 225},
+		{name: "No ratio", params: helpers.ParamsOptimize{}, expectedWidth: 800, expectedHeight: 600},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.params.Url = server.URL
+			tt.params.Quality = 80
+			result, err := NewImageOptimizer().Optimize(tt.params)
+			require.NoError(t, err)
+			require.Greater(t, len(result.Image), 0)
+
+			assert.Equal(t, 800, result.OriginalWidth)
+			assert.Equal(t, 600, result.OriginalHeight)
+			assert.Equal(t, tt.expectedWidth, result.Width)
+			assert.Equal(t, tt.expectedHeight, result.Height)
+		})
+	}
+}
+
+func TestOptimize_TrimColoredBorder(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	// Dark 100x80 photo on an off-white 200x150 scan border
+	scan, err := vips.NewBlack(100, 80, &vips.BlackOptions{Bands: 3})
+	require.NoError(t, err)
+	defer scan.Close()
+	require.NoError(t, scan.Embed(50, 35, 200, 150, &vips.EmbedOptions{
+		Extend:     vips.ExtendBackground,
+		Background: []float64{240, 235, 222},
+	}))
+	scanJpeg, err := scan.JpegsaveBuffer(&vips.JpegsaveBufferOptions{Q: 95})
+	require.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.WriteHeader(http.StatusOK)
+		w.Write(scanJpeg)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		params  helpers.ParamsOptimize
+		trimmed bool
+	}{
+		{
+			name:    "Matching color",
+			params:  helpers.ParamsOptimize{Trim: true, TrimColor: []float64{240, 235, 222}, TrimThreshold: 20},
+			trimmed: true,
+		},
+		{
+			name:    "Different color",
+			params:  helpers.ParamsOptimize{Trim: true, TrimColor: []float64{0, 128, 255}, TrimThreshold: 5},
+			trimmed: false,
+		},
+		{
+			name:    "Trim disabled",
+			params:  helpers.ParamsOptimize{},
+			trimmed: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.params.Url = server.URL
+			tt.params.Quality = 80
+			result, err := NewImageOptimizer().Optimize(tt.params)
+			require.NoError(t, err)
+			require.Greater(t, len(result.Image), 0)
+
+			assert.Equal(t, 200, result.OriginalWidth)
+			if tt.trimmed {
+				assert.InDelta(t, 100, result.Width, 2)
+				assert.InDelta(t, 80, result.Height, 2)
+			} else {
+				assert.Equal(t, 200, result.Width)
+				assert.Equal(t, 150, result.Height)
+			}
+		})
+	}
+}
+
+func TestOptimize_ArbitraryRotate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	source, err := vips.NewBlack(400, 200, &vips.BlackOptions{Bands: 3})
+	require.NoError(t, err)
+	defer source.Close()
+	sourceJpeg, err := source.JpegsaveBuffer(nil)
+	require.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.WriteHeader(http.StatusOK)
+		w.Write(sourceJpeg)
+	}))
+	defer server.Close()
+
+	result, err := NewImageOptimizer().Optimize(helpers.ParamsOptimize{
+		Url:        server.URL,
+		Width:      200,
+		Quality:    90,
+		Rotate:     30,
+		Background: []float64{255, 255, 255},
+	})
+	require.NoError(t, err)
+	require.Greater(t, len(result.Image), 0)
+
+	// 400x200 rotated by 30 degrees has a bounding box of ~446x373, resized to fit the width
+	rotatedWidth := 400*math.Cos(math.Pi/6) + 200*math.Sin(math.Pi/6)
+	rotatedHeight := 400*math.Sin(math.Pi/6) + 200*math.Cos(math.Pi/6)
+	assert.InDelta(t, rotatedWidth, result.OriginalWidth, 2)
+	assert.InDelta(t, rotatedHeight, result.OriginalHeight, 2)
+	assert.Equal(t, 200, result.Width)
+	assert.InDelta(t, 200*rotatedHeight/rotatedWidth, result.Height, 2)
+
+	image, err := vips.NewImageFromBuffer(result.Image, nil)
+	require.NoError(t, err)
+	defer image.Close()
+
+	// Introduced corner is filled with the background, the center keeps the source
+	corner, err := image.Getpoint(0, 0, nil)
+	require.NoError(t, err)
+	assert.Greater(t, corner[0], 200.0)
+	center, err := image.Getpoint(image.Width()/2, image.Height()/2, nil)
+	require.NoError(t, err)
+	assert.Less(t, center[0], 50.0)
+}
+
+func TestProgressiveSettings(t *testing.T) {
+	tests := []struct {
+		name            string
+		requested       bool
+		format          string
+		expectedApplied bool
+		expectedIgnored bool
+	}{
+		{name: "Not requested", requested: false, format: "webp", expectedApplied: false, expectedIgnored: false},
+		{name: "WebP is ignored", requested: true, format: "webp", expectedApplied: false, expectedIgnored: true},
+		{name: "JPEG progressive", requested: true, format: "jpeg", expectedApplied: true, expectedIgnored: false},
+		{name: "PNG interlace", requested: true, format: "png", expectedApplied: true, expectedIgnored: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			applied, ignored := progressiveSettings(tt.requested, tt.format)
+			assert.Equal(t, tt.expectedApplied, applied)
+			assert.Equal(t, tt.expectedIgnored, ignored)
+		})
+	}
+}
+
+func TestSharpenSigma(t *testing.T) {
+	tests := []struct {
+		name     string
+		sigma    float64
+		scale    float64
+		expected float64
+	}{
+		{name: "Heavy downscale", sigma: 1.0, scale: 0.1, expected: 0.9},
+		{name: "Half size", sigma: 1.0, scale: 0.5, expected: 0.5},
+		{name: "Original size", sigma: 1.0, scale: 1.0, expected: 0},
+		{name: "Upscale", sigma: 1.0, scale: 2.0, expected: 0},
+		{name: "Disabled", sigma: 0, scale: 0.1, expected: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.InDelta(t, tt.expected, sharpenSigma(tt.sigma, tt.scale), 0.0001)
+		})
+	}
+}
+
+func TestAutoSharpen(t *testing.T) {
+	buckets := []helpers.SharpenBucket{
+		{MaxSize: 200, Sigma: 1.0, Amount: 3.0},
+		{MaxSize: 800, Sigma: 0.7, Amount: 2.0},
+		{MaxSize: 0, Sigma: 0.5, Amount: 1.0},
+	}
+	tests := []struct {
+		name           string
+		buckets        []helpers.SharpenBucket
+		level          string
+		width          int
+		height         int
+		expectedSigma  float64
+		expectedAmount float64
+	}{
+		{name: "Thumbnail", buckets: buckets, level: "medium", width: 150, height: 100, expectedSigma: 1.0, expectedAmount: 3.0},
+		{name: "Bucket bound is inclusive", buckets: buckets, level: "medium", width: 200, height: 133, expectedSigma: 1.0, expectedAmount: 3.0},
+		{name: "Portrait uses the longest side", buckets: buckets, level: "medium", width: 133, height: 500, expectedSigma: 0.7, expectedAmount: 2.0},
+		{name: "Large output", buckets: buckets, level: "medium", width: 1200, height: 800, expectedSigma: 0.5, expectedAmount: 1.0},
+		{name: "Low level", buckets: buckets, level: "low", width: 150, height: 100, expectedSigma: 1.0, expectedAmount: 1.5},
+		{name: "High level", buckets: buckets, level: "high", width: 1200, height: 800, expectedSigma: 0.5, expectedAmount: 1.5},
+		{name: "No catch-all bucket", buckets: buckets[:2], level: "medium", width: 1200, height: 800},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sigma, amount := autoSharpen(tt.buckets, tt.level, tt.width, tt.height)
+			assert.InDelta(t, tt.expectedSigma, sigma, 0.0001)
+			assert.InDelta(t, tt.expectedAmount, amount, 0.0001)
+		})
+	}
+}
+
+func TestOptimize_AutoSharpen(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	t.Setenv("MAX_WIDTH", "6000")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	testImageData := loadTestImage(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.WriteHeader(http.StatusOK)
+		w.Write(testImageData)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name           string
+		width          int
+		expectedSigma  float64
+		expectedAmount float64
+	}{
+		{name: "Small output", width: 150, expectedSigma: 1.0, expectedAmount: 3.0},
+		{name: "Medium output", width: 600, expectedSigma: 0.7, expectedAmount: 2.0},
+		{name: "Large output", width: 1600, expectedSigma: 0.5, expectedAmount: 1.0},
+		{name: "Upscale is not sharpened", width: 5000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := NewImageOptimizer().Optimize(helpers.ParamsOptimize{
+				Url:         server.URL,
+				Width:       tt.width,
+				Quality:     80,
+				AutoSharpen: "medium",
+			})
+			require.NoError(t, err)
+			require.Greater(t, len(result.Image), 0)
+			assert.InDelta(t, tt.expectedSigma, result.Sharpen, 0.0001)
+			assert.InDelta(t, tt.expectedAmount, result.SharpenAmount, 0.0001)
+		})
+	}
+}
+
+func TestOptimize_ThumbnailBundle(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	t.Setenv("MAX_WIDTH", "6000")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	testImageData := withExifOrientation(t, loadTestImage(t), 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.WriteHeader(http.StatusOK)
+		w.Write(testImageData)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name          string
+		width         int
+		expectedWidth int
+		sharpened     bool
+	}{
+		{name: "Downscale is sharpened", width: 500, expectedWidth: 500, sharpened: true},
+		{name: "Upscale is capped and not sharpened", width: 5000, expectedWidth: 2500, sharpened: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, err := helpers.ValidateParams(helpers.ParamsOptimize{
+				Url:       server.URL,
+				Width:     tt.width,
+				Quality:   30,
+				Thumbnail: true,
+			})
+			require.NoError(t, err)
+
+			result, err := NewImageOptimizer().Optimize(params)
+			require.NoError(t, err)
+			require.Greater(t, len(result.Image), 0)
+
+			assert.Equal(t, tt.expectedWidth, result.Width)
+			assert.Equal(t, 70, result.Encoder.Quality)
+			assert.True(t, result.Encoder.StripMetadata)
+			assert.Equal(t, tt.sharpened, result.Sharpen > 0)
+
+			image, err := vips.NewImageFromBuffer(result.Image, nil)
+			require.NoError(t, err)
+			defer image.Close()
+			assert.False(t, image.HasField("exif-data"), "metadata should be stripped")
+		})
+	}
+}
+
+func TestOptimize_CmykSource(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	// CMYK JPEG fixture made from the sRGB test image
+	fixture, err := vips.NewImageFromBuffer(loadTestImage(t), nil)
+	require.NoError(t, err)
+	defer fixture.Close()
+	require.NoError(t, fixture.Colourspace(vips.InterpretationCmyk, nil))
+	require.Equal(t, 4, fixture.Bands())
+	cmykJpeg, err := fixture.JpegsaveBuffer(&vips.JpegsaveBufferOptions{Q: 90})
+	require.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.WriteHeader(http.StatusOK)
+		w.Write(cmykJpeg)
+	}))
+	defer server.Close()
+
+	result, err := NewImageOptimizer().Optimize(helpers.ParamsOptimize{Url: server.URL, Width: 400, Quality: 80})
+	require.NoError(t, err)
+	require.Greater(t, len(result.Image), 0, "CMYK source should be optimized")
+	assert.Equal(t, "cmyk", result.ConvertedColorspace)
+	assert.Equal(t, 400, result.Width)
+
+	image, err := vips.NewImageFromBuffer(result.Image, nil)
+	require.NoError(t, err)
+	defer image.Close()
+	assert.Equal(t, vips.InterpretationSrgb, image.Interpretation())
+	assert.Equal(t, 3, image.Bands())
+}
+
+// BenchmarkOptimize_LargeSource reports the peak libvips memory for a large downscale,
+// run with -benchmem to compare against the Go side allocations
+func BenchmarkOptimize_LargeSource(b *testing.B) {
+	b.Setenv("SECRET_KEY", "test-imgop-key")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	largeImage, err := vips.NewBlack(8000, 6000, &vips.BlackOptions{Bands: 3})
+	require.NoError(b, err)
+	defer largeImage.Close()
+	largeJpeg, err := largeImage.JpegsaveBuffer(nil)
+	require.NoError(b, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.WriteHeader(http.StatusOK)
+		w.Write(largeJpeg)
+	}))
+	defer server.Close()
+
+	b.ReportAllocs()
+	for b.Loop() {
+		result, _ := NewImageOptimizer().Optimize(helpers.ParamsOptimize{Url: server.URL, Width: 800, Quality: 80})
+		require.True(b, result.SequentialAccess)
+	}
+
+	var stats vips.MemoryStats
+	vips.ReadVipsMemStats(&stats)
+	b.ReportMetric(float64(stats.MemHigh)/(1<<20), "vips-peak-MB")
+}
+
+func TestStreamDecode(t *testing.T) {
+	tests := []struct {
+		name          string
+		contentType   string
+		contentLength int64
+		params        helpers.ParamsOptimize
+		expected      bool
+	}{
+		{name: "Large tiff", contentType: "image/tiff", contentLength: 2048, params: helpers.ParamsOptimize{Width: 100}, expected: true},
+		{name: "Media type params", contentType: "Image/TIFF; charset=binary", contentLength: 2048, params: helpers.ParamsOptimize{Width: 100}, expected: true},
+		{name: "Small tiff", contentType: "image/tiff", contentLength: 1024, params: helpers.ParamsOptimize{Width: 100}, expected: false},
+		{name: "Unknown length", contentType: "image/tiff", contentLength: -1, params: helpers.ParamsOptimize{Width: 100}, expected: false},
+		{name: "Large jpeg", contentType: "image/jpeg", contentLength: 2048, params: helpers.ParamsOptimize{Width: 100}, expected: false},
+		{name: "Rotate needs random access", contentType: "image/tiff", contentLength: 2048, params: helpers.ParamsOptimize{Width: 100, Rotate: 90}, expected: false},
+		{name: "Trim needs random access", contentType: "image/tiff", contentLength: 2048, params: helpers.ParamsOptimize{Width: 100, Trim: true}, expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SECRET_KEY", "test-imgop-key")
+			t.Setenv("STREAM_DECODE_BYTES", "1024")
+			helpers.ResetAppEnvForTesting()
+			defer helpers.ResetAppEnvForTesting()
+
+			assert.Equal(t, tt.expected, streamDecode(tt.contentType, tt.contentLength, tt.params))
+		})
+	}
+}
+
+// newLargeTiffServer serves a synthetic uncompressed TIFF, large enough to be streamed
+// with a low STREAM_DECODE_BYTES
+func newLargeTiffServer(tb testing.TB, width int, height int) *httptest.Server {
+	tb.Helper()
+	largeImage, err := vips.NewBlack(width, height, &vips.BlackOptions{Bands: 3})
+	require.NoError(tb, err)
+	defer largeImage.Close()
+	largeTiff, err := largeImage.TiffsaveBuffer(nil)
+	require.NoError(tb, err)
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/tiff")
+		w.Header().Set("Content-Length", strconv.Itoa(len(largeTiff)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(largeTiff)
+	}))
+}
+
+func TestOptimize_StreamingTiff(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	t.Setenv("STREAM_DECODE_BYTES", "1048576")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	server := newLargeTiffServer(t, 4000, 3000)
+	defer server.Close()
+
+	result, err := NewImageOptimizer().Optimize(helpers.ParamsOptimize{Url: server.URL, Width: 400, Quality: 80})
+	require.NoError(t, err)
+	require.Greater(t, len(result.Image), 0)
+	assert.True(t, result.SequentialAccess)
+	assert.Equal(t, "tiff", result.SourceFormat)
+	assert.Equal(t, 400, result.Width)
+	assert.Equal(t, 300, result.Height)
+
+	// An upscale needs random access, which a streamed source can't give
+	result, err = NewImageOptimizer().Optimize(helpers.ParamsOptimize{Url: server.URL, Width: 5000, Quality: 80})
+	assert.Error(t, err)
+	assert.Empty(t, result.Image)
+}
+
+// BenchmarkOptimize_StreamingTiff compares the peak libvips memory of a streamed TIFF
+// downscale with BenchmarkOptimize_LargeSource, run with -benchmem
+func BenchmarkOptimize_StreamingTiff(b *testing.B) {
+	b.Setenv("SECRET_KEY", "test-imgop-key")
+	b.Setenv("STREAM_DECODE_BYTES", "1048576")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	server := newLargeTiffServer(b, 8000, 6000)
+	defer server.Close()
+
+	b.ReportAllocs()
+	for b.Loop() {
+		result, _ := NewImageOptimizer().Optimize(helpers.ParamsOptimize{Url: server.URL, Width: 800, Quality: 80})
+		require.True(b, result.SequentialAccess)
+	}
+
+	var stats vips.MemoryStats
+	vips.ReadVipsMemStats(&stats)
+	b.ReportMetric(float64(stats.MemHigh)/(1<<20), "vips-peak-MB")
+}
+
+// Rewrites testdata/golden from the current output, go test ./src/libs -run TestProcess_Golden -update
+var updateGolden = flag.Bool("update", false, "rewrite the golden files of TestProcess_Golden")
+
+// goldenOutput is the part of a Process result compared with its golden file. The encoded
+// bytes themselves change with the libvips version, so the output is decoded and its
+// format and size compared along with the decisions that produced it.
+type goldenOutput struct {
+	SourceHash       string          `json:"source_hash"`
+	OriginalWidth    int             `json:"original_width"`
+	OriginalHeight   int             `json:"original_height"`
+	Format           string          `json:"format"`
+	Width            int             `json:"width"`
+	Height           int             `json:"height"`
+	Scale            float64         `json:"scale"`
+	VerticalScale    float64         `json:"vertical_scale,omitempty"`
+	Sharpen          float64         `json:"sharpen"`
+	SequentialAccess bool            `json:"sequential_access"`
+	Encoder          EncoderSettings `json:"encoder"`
+}
+
+func TestProcess_Golden(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	tests := []struct {
+		name   string
+		params helpers.ParamsOptimize
+	}{
+		{name: "resize-width", params: helpers.ParamsOptimize{Width: 500, Quality: 75}},
+		{name: "square-crop-sharpen", params: helpers.ParamsOptimize{Width: 300, AspectRatio: 1, Sharpen: 1, Quality: 80, StripMetadata: true}},
+		{name: "fill-max", params: helpers.ParamsOptimize{Width: 400, Height: 400, Fit: "fill", Quality: 60, Optimization: "max"}},
+	}
+
+	source := loadTestImage(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := NewImageOptimizer().Process(context.Background(), source, tt.params)
+			require.NoError(t, err)
+
+			output, err := vips.NewImageFromBuffer(result.Image, nil)
+			require.NoError(t, err)
+			defer output.Close()
+
+			actual, err := json.MarshalIndent(goldenOutput{
+				SourceHash:       result.SourceHash,
+				OriginalWidth:    result.OriginalWidth,
+				OriginalHeight:   result.OriginalHeight,
+				Format:           string(output.Format()),
+				Width:            output.Width(),
+				Height:           output.Height(),
+				Scale:            result.Scale,
+				VerticalScale:    result.VerticalScale,
+				Sharpen:          result.Sharpen,
+				SequentialAccess: result.SequentialAccess,
+				Encoder:          result.Encoder,
+			}, "", "  ")
+			require.NoError(t, err)
+			actual = append(actual, '\n')
+
+			goldenPath := filepath.Join("testdata", "golden", tt.name+".json")
+			if *updateGolden {
+				require.NoError(t, os.WriteFile(goldenPath, actual, 0o644))
+			}
+			expected, err := os.ReadFile(goldenPath)
+			require.NoError(t, err, "run with -update to create the golden file")
+			assert.JSONEq(t, string(expected), string(actual))
+		})
+	}
+}
+
+func TestProcess_CanceledContext(t *testing.T) {
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := NewImageOptimizer().Process(ctx, []byte{0xFF, 0xD8, 0xFF, 0xE0}, helpers.ParamsOptimize{Width: 100})
+	assert.ErrorIs(t, err, context.Canceled)
+}
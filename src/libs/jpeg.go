@@ -0,0 +1,90 @@
+package libs
+
+import (
+	"imgop/src/helpers"
+
+	"github.com/cshum/vipsgen/vips"
+)
+
+// jpegEncoderSettings describes the f=jpeg output. The WebP presets, effort and alpha
+// quality have no JPEG counterpart.
+func jpegEncoderSettings(params helpers.ParamsOptimize) EncoderSettings {
+	return EncoderSettings{
+		Format:        "jpeg",
+		Quality:       params.Quality,
+		StripMetadata: params.StripMetadata,
+		KeepMetadata:  params.KeepMeta,
+		QuantTable:    params.QuantTable,
+	}
+}
+
+// encodeJpeg flattens the alpha left on the image, either opaque or with a bg to flatten
+// onto, and encodes the f=jpeg output
+func encodeJpeg(image *vips.Image, encoder EncoderSettings, background []float64) ([]byte, error) {
+	if image.HasAlpha() {
+		if err := image.Flatten(&vips.FlattenOptions{Background: background}); err != nil {
+			return nil, err
+		}
+	}
+	return image.JpegsaveBuffer(&vips.JpegsaveBufferOptions{
+		Q:              encoder.Quality,
+		OptimizeCoding: true,
+		Interlace:      encoder.Progressive,
+		Keep:           metadataKeep(encoder.StripMetadata, encoder.KeepMetadata),
+		QuantTable:     quantTableIndex(encoder.QuantTable),
+	})
+}
+
+// jpegOutputFormat returns the format f=jpeg is encoded as. JPEG has no alpha channel, so
+// an image with transparency and no bg to flatten onto is kept as WebP or fails the request,
+// as ALPHA_POLICY says. An image read sequentially can't be scanned without decoding it
+// twice, so its alpha counts as transparent.
+func jpegOutputFormat(image *vips.Image, background []float64, sequentialAccess bool) (string, error) {
+	if !image.HasAlpha() || background != nil {
+		return "jpeg", nil
+	}
+	transparent := true
+	if !sequentialAccess {
+		var err error
+		if transparent, err = hasTransparency(image); err != nil {
+			return "", err
+		}
+	}
+	if !transparent {
+		return "jpeg", nil
+	}
+	if helpers.GetAppEnv().ALPHA_POLICY == "error" {
+		return "", helpers.NewValidationError(helpers.ErrCodeTransparentSource, "f",
+			"the image has transparency that f=jpeg would flatten, set bg to pick the background or request webp or avif")
+	}
+	return "webp", nil
+}
+
+// needsAlphaScan reports whether jpegOutputFormat will read the alpha of the image, which
+// the sequential access of loadImage doesn't allow
+func needsAlphaScan(image *vips.Image, params helpers.ParamsOptimize) bool {
+	return params.Format == "jpeg" && !params.Email && params.Background == nil && image.HasAlpha()
+}
+
+// hasTransparency reports whether any pixel of the image is less than fully opaque. The
+// image itself is left untouched.
+func hasTransparency(image *vips.Image) (bool, error) {
+	alpha, err := image.Copy(nil)
+	if err != nil {
+		return false, err
+	}
+	defer alpha.Close()
+
+	if err := alpha.ExtractBand(alpha.Bands()-1, nil); err != nil {
+		return false, err
+	}
+	opaque := 255.0
+	if alpha.BandFormat() == vips.BandFormatUshort {
+		opaque = 65535
+	}
+	minAlpha, err := alpha.Min(nil)
+	if err != nil {
+		return false, err
+	}
+	return minAlpha < opaque, nil
+}
@@ -0,0 +1,140 @@
+package libs
+
+import (
+	"context"
+	"imgop/src/helpers"
+	"testing"
+
+	"github.com/cshum/vipsgen/vips"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJpegEncoderSettings(t *testing.T) {
+	tests := []struct {
+		name     string
+		params   helpers.ParamsOptimize
+		expected EncoderSettings
+	}{
+		{name: "Default", params: helpers.ParamsOptimize{Quality: 75},
+			expected: EncoderSettings{Format: "jpeg", Quality: 75}},
+		{name: "WebP options are ignored", params: helpers.ParamsOptimize{Quality: 75, Preset: "drawing", AlphaQuality: 50, Optimization: "max"},
+			expected: EncoderSettings{Format: "jpeg", Quality: 75}},
+		{name: "Quant table", params: helpers.ParamsOptimize{Quality: 75, QuantTable: "imagemagick"},
+			expected: EncoderSettings{Format: "jpeg", Quality: 75, QuantTable: "imagemagick"}},
+		{name: "Metadata", params: helpers.ParamsOptimize{Quality: 75, StripMetadata: true, KeepMeta: []string{"icc"}},
+			expected: EncoderSettings{Format: "jpeg", Quality: 75, StripMetadata: true, KeepMetadata: []string{"icc"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, jpegEncoderSettings(tt.params))
+		})
+	}
+}
+
+// newAlphaPng returns a grey PNG with an alpha channel of the given value everywhere
+func newAlphaPng(t *testing.T, alpha float64) []byte {
+	t.Helper()
+	image, err := vips.NewBlack(64, 64, &vips.BlackOptions{Bands: 4})
+	require.NoError(t, err)
+	defer image.Close()
+	require.NoError(t, image.Linear([]float64{1, 1, 1, 1}, []float64{100, 100, 100, alpha}, nil))
+	require.NoError(t, image.Cast(vips.BandFormatUchar, nil))
+	data, err := image.PngsaveBuffer(nil)
+	require.NoError(t, err)
+	return data
+}
+
+func TestProcess_JpegAlphaPolicy(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	tests := []struct {
+		name              string
+		policy            string
+		data              []byte
+		background        []float64
+		expectedFormat    string
+		expectedPreserved bool
+		expectedError     bool
+	}{
+		{name: "Preserve keeps the transparency as WebP", policy: "preserve", data: newAlphaPng(t, 0),
+			expectedFormat: "webp", expectedPreserved: true},
+		{name: "Error fails the request", policy: "error", data: newAlphaPng(t, 0), expectedError: true},
+		{name: "Preserve flattens onto bg", policy: "preserve", data: newAlphaPng(t, 0), background: []float64{255, 255, 255},
+			expectedFormat: "jpeg"},
+		{name: "Error flattens onto bg", policy: "error", data: newAlphaPng(t, 0), background: []float64{255, 255, 255},
+			expectedFormat: "jpeg"},
+		{name: "Partial transparency counts", policy: "error", data: newAlphaPng(t, 128), expectedError: true},
+		{name: "Opaque alpha is flattened silently", policy: "error", data: newAlphaPng(t, 255), expectedFormat: "jpeg"},
+		{name: "No alpha", policy: "error", data: newJpeg(t, 64, 64), expectedFormat: "jpeg"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SECRET_KEY", "test-imgop-key")
+			t.Setenv("ALPHA_POLICY", tt.policy)
+			helpers.ResetAppEnvForTesting()
+			defer helpers.ResetAppEnvForTesting()
+
+			result, err := NewImageOptimizer().Process(context.Background(), tt.data, helpers.ParamsOptimize{
+				Width:      32,
+				Quality:    75,
+				Format:     "jpeg",
+				Background: tt.background,
+			})
+			if tt.expectedError {
+				var validationErr *helpers.ValidationError
+				require.ErrorAs(t, err, &validationErr)
+				assert.Equal(t, helpers.ErrCodeTransparentSource, validationErr.Code)
+				assert.Equal(t, "f", validationErr.Field)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedFormat, result.Encoder.Format)
+			assert.Equal(t, tt.expectedPreserved, result.AlphaPreserved)
+
+			output, err := vips.NewImageFromBuffer(result.Image, nil)
+			require.NoError(t, err)
+			defer output.Close()
+			assert.Equal(t, tt.expectedPreserved, output.HasAlpha())
+			if tt.background != nil {
+				// The transparent source became the bg color, not black
+				pixel, err := output.Getpoint(16, 16, nil)
+				require.NoError(t, err)
+				assert.InDelta(t, 255, pixel[0], 4)
+			}
+		})
+	}
+}
+
+func TestHasTransparency(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	tests := []struct {
+		name     string
+		alpha    float64
+		expected bool
+	}{
+		{name: "Transparent", alpha: 0, expected: true},
+		{name: "Translucent", alpha: 254, expected: true},
+		{name: "Opaque", alpha: 255, expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			image, err := vips.NewImageFromBuffer(newAlphaPng(t, tt.alpha), nil)
+			require.NoError(t, err)
+			defer image.Close()
+
+			transparent, err := hasTransparency(image)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, transparent)
+			assert.True(t, image.HasAlpha(), "the image itself keeps its alpha")
+		})
+	}
+}
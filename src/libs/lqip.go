@@ -0,0 +1,46 @@
+package libs
+
+import (
+	"encoding/base64"
+
+	"github.com/cshum/vipsgen/vips"
+)
+
+// Longest side of the LQIP, the browser's upscale blurs it further
+const lqipSize = 8
+
+// LQIP encoder settings, quality barely matters at a few pixels
+const (
+	lqipBlurSigma = 1.0
+	lqipQuality   = 20
+)
+
+// encodeLqip encodes a blurred few-pixel copy of the output image as a WebP data URI,
+// small enough for a response header. The image itself is left untouched, but its pixels
+// are read again, so the source must not have been loaded with sequential access.
+func encodeLqip(image *vips.Image) (string, error) {
+	lqip, err := image.Copy(nil)
+	if err != nil {
+		return "", err
+	}
+	defer lqip.Close()
+
+	scale := float64(lqipSize) / float64(max(lqip.Width(), lqip.Height()))
+	if scale < 1.0 {
+		if err := lqip.Resize(scale, nil); err != nil {
+			return "", err
+		}
+	}
+	if err := lqip.Gaussblur(lqipBlurSigma, nil); err != nil {
+		return "", err
+	}
+
+	data, err := lqip.WebpsaveBuffer(&vips.WebpsaveBufferOptions{
+		Q:    lqipQuality,
+		Keep: metadataKeep(false, []string{}),
+	})
+	if err != nil {
+		return "", err
+	}
+	return "data:image/webp;base64," + base64.StdEncoding.EncodeToString(data), nil
+}
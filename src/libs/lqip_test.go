@@ -0,0 +1,61 @@
+package libs
+
+import (
+	"encoding/base64"
+	"imgop/src/helpers"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cshum/vipsgen/vips"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOptimize_Lqip(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	source := newJpeg(t, 1600, 800)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.WriteHeader(http.StatusOK)
+		w.Write(source)
+	}))
+	defer server.Close()
+
+	t.Run("Opt-in", func(t *testing.T) {
+		result, err := NewImageOptimizer().Optimize(helpers.ParamsOptimize{Url: server.URL, Width: 800, Quality: 80})
+		require.NoError(t, err)
+		require.Greater(t, len(result.Image), 0)
+		assert.Empty(t, result.Lqip)
+	})
+
+	t.Run("Tiny data URI", func(t *testing.T) {
+		result, err := NewImageOptimizer().Optimize(helpers.ParamsOptimize{Url: server.URL, Width: 800, Quality: 80, Lqip: true})
+		require.NoError(t, err)
+		require.Greater(t, len(result.Image), 0)
+		assert.Equal(t, 800, result.Width, "the output is unaffected")
+		assert.Equal(t, 400, result.Height)
+		assert.False(t, result.SequentialAccess)
+
+		encoded, ok := strings.CutPrefix(result.Lqip, "data:image/webp;base64,")
+		require.True(t, ok, "unexpected lqip: %s", result.Lqip)
+		assert.Less(t, len(result.Lqip), 512, "small enough for a header")
+
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		require.NoError(t, err)
+		lqip, err := vips.NewImageFromBuffer(data, nil)
+		require.NoError(t, err)
+		defer lqip.Close()
+		assert.Equal(t, vips.ImageTypeWebp, lqip.Format())
+		assert.Equal(t, lqipSize, lqip.Width())
+		assert.Equal(t, 4, lqip.Height())
+	})
+}
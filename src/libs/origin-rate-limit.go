@@ -0,0 +1,89 @@
+package libs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrOriginRateLimited is returned when a fetch can't start before the request deadline
+var ErrOriginRateLimited = errors.New("origin rate limit exceeded")
+
+// OriginRateLimiter throttles outbound fetches per origin host with a token bucket, so
+// a burst of requests for one expired source doesn't hammer its origin. Other hosts
+// have their own bucket and are unaffected.
+type OriginRateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	now     func() time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewOriginRateLimiter() *OriginRateLimiter {
+	return &OriginRateLimiter{buckets: map[string]*tokenBucket{}, now: time.Now}
+}
+
+// Wait reserves a fetch to the host at rate fetches per second, with bursts of up to
+// rate fetches (at least 1). It queues until the fetch is due, failing with
+// ErrOriginRateLimited right away when it wouldn't be due before the context deadline,
+// or once the context ends. A rate of 0 never waits.
+func (l *OriginRateLimiter) Wait(ctx context.Context, host string, rate float64) error {
+	if rate <= 0 {
+		return nil
+	}
+
+	delay := l.reserve(host, rate)
+	if delay <= 0 {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok && l.now().Add(delay).After(deadline) {
+		l.cancel(host)
+		return ErrOriginRateLimited
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.cancel(host)
+		return ErrOriginRateLimited
+	}
+}
+
+// reserve takes a token from the host bucket, returning how long until it is due
+func (l *OriginRateLimiter) reserve(host string, rate float64) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	burst := max(1, rate)
+	now := l.now()
+	bucket, ok := l.buckets[host]
+	if !ok {
+		bucket = &tokenBucket{tokens: burst, last: now}
+		l.buckets[host] = bucket
+	}
+	bucket.tokens = min(burst, bucket.tokens+now.Sub(bucket.last).Seconds()*rate)
+	bucket.last = now
+	bucket.tokens--
+
+	if bucket.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-bucket.tokens / rate * float64(time.Second))
+}
+
+// cancel returns the token of a fetch that gave up waiting
+func (l *OriginRateLimiter) cancel(host string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if bucket, ok := l.buckets[host]; ok {
+		bucket.tokens++
+	}
+}
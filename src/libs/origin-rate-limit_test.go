@@ -0,0 +1,113 @@
+package libs
+
+import (
+	"context"
+	"imgop/src/helpers"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestRateLimiter returns a limiter on a clock the test moves by hand
+func newTestRateLimiter() (*OriginRateLimiter, *time.Time) {
+	limiter := NewOriginRateLimiter()
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter.now = func() time.Time { return now }
+	return limiter, &now
+}
+
+func TestOriginRateLimiter_Unlimited(t *testing.T) {
+	limiter := NewOriginRateLimiter()
+	for i := 0; i < 100; i++ {
+		require.NoError(t, limiter.Wait(context.Background(), "origin.com", 0))
+	}
+}
+
+func TestOriginRateLimiter_Reserve(t *testing.T) {
+	limiter, now := newTestRateLimiter()
+
+	// A burst of up to the rate goes through at once
+	for i := 0; i < 2; i++ {
+		assert.Zero(t, limiter.reserve("origin.com", 2))
+	}
+	// Then fetches are spaced by 1/rate
+	assert.Equal(t, 500*time.Millisecond, limiter.reserve("origin.com", 2))
+	assert.Equal(t, time.Second, limiter.reserve("origin.com", 2))
+
+	// Other hosts are unaffected
+	assert.Zero(t, limiter.reserve("other.com", 2))
+
+	// Tokens refill with time
+	*now = now.Add(5 * time.Second)
+	assert.Zero(t, limiter.reserve("origin.com", 2))
+}
+
+func TestOriginRateLimiter_ShedsPastDeadline(t *testing.T) {
+	limiter := NewOriginRateLimiter()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	require.NoError(t, limiter.Wait(ctx, "origin.com", 1))
+	// The next token is due in a second, past the deadline
+	start := time.Now()
+	err := limiter.Wait(ctx, "origin.com", 1)
+	assert.ErrorIs(t, err, ErrOriginRateLimited)
+	assert.Less(t, time.Since(start), 50*time.Millisecond, "shed without waiting")
+
+	// The shed fetch gave its token back
+	limiter.mu.Lock()
+	assert.InDelta(t, 0, limiter.buckets["origin.com"].tokens, 0.2)
+	limiter.mu.Unlock()
+
+	// Another host still has its burst
+	require.NoError(t, limiter.Wait(ctx, "other.com", 1))
+}
+
+func TestOriginRateLimiter_QueuesWithinDeadline(t *testing.T) {
+	limiter := NewOriginRateLimiter()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	require.NoError(t, limiter.Wait(ctx, "origin.com", 20))
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		require.NoError(t, limiter.Wait(ctx, "origin.com", 20))
+	}
+	// The burst of 20 is used by the first 20 fetches, the 21st waits about 50ms
+	assert.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+}
+
+func TestSourceSize_OriginRateLimit(t *testing.T) {
+	newOrigin := func() *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Header().Set("Content-Length", "1234")
+			w.WriteHeader(http.StatusOK)
+		}))
+	}
+	busy := newOrigin()
+	defer busy.Close()
+	other := newOrigin()
+	defer other.Close()
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	t.Setenv("ORIGIN_RATE_LIMIT", "0.5")
+	t.Setenv("FETCH_TIMEOUT", "1")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	imgop := NewImageOptimizer()
+	_, err := imgop.SourceSize(helpers.ParamsOptimize{Url: busy.URL + "/a.jpg"})
+	require.NoError(t, err)
+
+	// The next fetch to the busy origin is due in 2s, past the 1s fetch timeout
+	_, err = imgop.SourceSize(helpers.ParamsOptimize{Url: busy.URL + "/b.jpg"})
+	assert.ErrorIs(t, err, ErrOriginRateLimited)
+
+	_, err = imgop.SourceSize(helpers.ParamsOptimize{Url: other.URL + "/a.jpg"})
+	assert.NoError(t, err, "other origins are unaffected")
+}
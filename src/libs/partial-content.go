@@ -0,0 +1,121 @@
+package libs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"imgop/src/helpers"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Upper bound on follow-up range requests for a single source
+const maxRangeRequests = 16
+
+// completePartialContent turns a 206 response into the full resource by requesting the
+// remaining ranges, returning a synthetic 200 response with the original headers.
+// The body is buffered, so the total size is checked against maxBytes (0 means unlimited) upfront.
+func completePartialContent(ctx context.Context, client *http.Client, imageUrl *url.URL, resp *http.Response, maxBytes int64) (*http.Response, error) {
+	start, _, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return nil, err
+	}
+	if start != 0 {
+		return nil, fmt.Errorf("partial content does not start at byte 0")
+	}
+	if maxBytes > 0 && total > maxBytes {
+		return nil, fmt.Errorf("source exceeds %d bytes", maxBytes)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, total))
+	if err != nil {
+		return nil, err
+	}
+
+	for requests := 0; int64(len(data)) < total; requests++ {
+		if requests >= maxRangeRequests {
+			return nil, fmt.Errorf("partial content incomplete after %d range requests", maxRangeRequests)
+		}
+		part, err := fetchRange(ctx, client, imageUrl, int64(len(data)), total)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, part...)
+	}
+
+	header := resp.Header.Clone()
+	header.Del("Content-Range")
+	header.Set("Content-Length", strconv.Itoa(len(data)))
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(data)),
+		ContentLength: int64(len(data)),
+	}, nil
+}
+
+// fetchRange requests the bytes from offset to the end of the resource, it must come back as a
+// 206 starting at offset and consistent with the known total
+func fetchRange(ctx context.Context, client *http.Client, imageUrl *url.URL, offset int64, total int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, imageUrl.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	applyOriginHeaders(req, helpers.GetAppEnv().ORIGIN_HEADERS)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("unexpected range status: %d", resp.StatusCode)
+	}
+	start, end, partTotal, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return nil, err
+	}
+	if start != offset || partTotal != total {
+		return nil, fmt.Errorf("unexpected content range: %s", resp.Header.Get("Content-Range"))
+	}
+
+	part, err := io.ReadAll(io.LimitReader(resp.Body, end-start+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(part) == 0 {
+		return nil, fmt.Errorf("empty range response")
+	}
+	return part, nil
+}
+
+// parseContentRange parses "bytes start-end/total", an unknown total (*) is not supported
+func parseContentRange(contentRange string) (int64, int64, int64, error) {
+	invalid := fmt.Errorf("invalid content range: %q", contentRange)
+
+	byteRange, found := strings.CutPrefix(strings.TrimSpace(contentRange), "bytes ")
+	if !found {
+		return 0, 0, 0, invalid
+	}
+	span, totalStr, found := strings.Cut(byteRange, "/")
+	if !found {
+		return 0, 0, 0, invalid
+	}
+	startStr, endStr, found := strings.Cut(span, "-")
+	if !found {
+		return 0, 0, 0, invalid
+	}
+
+	start, errStart := strconv.ParseInt(startStr, 10, 64)
+	end, errEnd := strconv.ParseInt(endStr, 10, 64)
+	total, errTotal := strconv.ParseInt(totalStr, 10, 64)
+	if errStart != nil || errEnd != nil || errTotal != nil || start < 0 || end < start || end >= total {
+		return 0, 0, 0, invalid
+	}
+	return start, end, total, nil
+}
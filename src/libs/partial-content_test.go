@@ -0,0 +1,186 @@
+package libs
+
+import (
+	"fmt"
+	"imgop/src/helpers"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		name          string
+		contentRange  string
+		expectedStart int64
+		expectedEnd   int64
+		expectedTotal int64
+		wantErr       bool
+	}{
+		{name: "Full", contentRange: "bytes 0-99/100", expectedStart: 0, expectedEnd: 99, expectedTotal: 100},
+		{name: "Middle", contentRange: "bytes 10-19/100", expectedStart: 10, expectedEnd: 19, expectedTotal: 100},
+		{name: "Unknown total", contentRange: "bytes 0-99/*", wantErr: true},
+		{name: "End past total", contentRange: "bytes 0-100/100", wantErr: true},
+		{name: "Reversed", contentRange: "bytes 20-10/100", wantErr: true},
+		{name: "Wrong unit", contentRange: "items 0-9/10", wantErr: true},
+		{name: "Empty", contentRange: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end, total, err := parseContentRange(tt.contentRange)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedStart, start)
+			assert.Equal(t, tt.expectedEnd, end)
+			assert.Equal(t, tt.expectedTotal, total)
+		})
+	}
+}
+
+// newChunkedServer serves content in chunks of chunkSize as 206 responses, honoring open ended ranges
+func newChunkedServer(content []byte, chunkSize int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := 0
+		if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+			start, _ = strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rangeHeader, "bytes="), "-"))
+		}
+		end := min(start+chunkSize, len(content)) - 1
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(content)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(content[start : end+1])
+	}))
+}
+
+func TestCompletePartialContent(t *testing.T) {
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	content := []byte(strings.Repeat("0123456789", 5))
+	server := newChunkedServer(content, 16)
+	defer server.Close()
+	imageUrl, _ := url.Parse(server.URL)
+
+	t.Run("Completes the remaining ranges", func(t *testing.T) {
+		resp, err := http.Get(server.URL)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		completed, err := completePartialContent(t.Context(), http.DefaultClient, imageUrl, resp, 0)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, completed.StatusCode)
+		assert.Equal(t, int64(len(content)), completed.ContentLength)
+		assert.Equal(t, "image/jpeg", completed.Header.Get("Content-Type"))
+		assert.Empty(t, completed.Header.Get("Content-Range"))
+
+		body := make([]byte, len(content)+1)
+		n, _ := completed.Body.Read(body)
+		assert.Equal(t, content, body[:n])
+	})
+
+	t.Run("Rejects totals above the limit", func(t *testing.T) {
+		resp, err := http.Get(server.URL)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		_, err = completePartialContent(t.Context(), http.DefaultClient, imageUrl, resp, 20)
+		assert.ErrorContains(t, err, "source exceeds 20 bytes")
+	})
+
+	t.Run("Rejects ranges not starting at 0", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+		req.Header.Set("Range", "bytes=10-")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		_, err = completePartialContent(t.Context(), http.DefaultClient, imageUrl, resp, 0)
+		assert.Error(t, err)
+	})
+}
+
+func TestOptimize_AcceptedStatuses(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		status   int
+		rejected bool
+	}{
+		{name: "203 rejected when only 200 is accepted", env: map[string]string{"ACCEPTED_STATUSES": "200"}, status: http.StatusNonAuthoritativeInfo, rejected: true},
+		{name: "206 rejected by policy", env: map[string]string{"PARTIAL_CONTENT": "reject"}, status: http.StatusPartialContent, rejected: true},
+		{name: "404 rejected", status: http.StatusNotFound, rejected: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				w.Header().Set("Content-Type", "image/jpeg")
+				w.Header().Set("Content-Range", "bytes 0-3/8")
+				w.WriteHeader(tt.status)
+				w.Write([]byte{0xFF, 0xD8, 0xFF, 0xE0})
+			}))
+			defer server.Close()
+
+			t.Setenv("SECRET_KEY", "test-imgop-key")
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			helpers.ResetAppEnvForTesting()
+			defer helpers.ResetAppEnvForTesting()
+
+			result, err := NewImageOptimizer().Optimize(helpers.ParamsOptimize{Url: server.URL})
+			assert.Error(t, err)
+			assert.Empty(t, result.Image)
+			assert.Equal(t, 1, requests, "no follow-up range requests")
+		})
+	}
+}
+
+func TestOptimize_NonStandardSuccessStatuses(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	testImageData := loadTestImage(t)
+
+	t.Run("203", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.WriteHeader(http.StatusNonAuthoritativeInfo)
+			w.Write(testImageData)
+		}))
+		defer server.Close()
+
+		result, err := NewImageOptimizer().Optimize(helpers.ParamsOptimize{Url: server.URL, Width: 300, Quality: 80})
+		require.NoError(t, err)
+		assert.Greater(t, len(result.Image), 0)
+		assert.Equal(t, len(testImageData), result.SourceBytes)
+	})
+
+	t.Run("206 completed", func(t *testing.T) {
+		server := newChunkedServer(testImageData, 64*1024)
+		defer server.Close()
+
+		result, err := NewImageOptimizer().Optimize(helpers.ParamsOptimize{Url: server.URL, Width: 300, Quality: 80})
+		require.NoError(t, err)
+		assert.Greater(t, len(result.Image), 0)
+		assert.Equal(t, len(testImageData), result.SourceBytes)
+	})
+}
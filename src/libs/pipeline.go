@@ -0,0 +1,50 @@
+package libs
+
+import (
+	"fmt"
+	"imgop/src/helpers"
+
+	"github.com/cshum/vipsgen/vips"
+)
+
+// pipelineResult sums up the geometry steps for the decision trace
+type pipelineResult struct {
+	Scale         float64 // Combined resize scale, horizontal for fit=fill
+	VerticalScale float64 // Vertical resize scale for fit=fill, 0 when the scale is uniform
+	EnlargeCapped bool    // A resize was capped at the image size because enlargement is disabled
+	Sharpen       float64 // Last sharpen sigma applied, 0 when not sharpened
+	SharpenAmount float64 // Sharpen amount (libvips m2) of auto_sharpen, 0 is the libvips default
+}
+
+// applyPipeline runs the explicit pipeline operations in order. Resizes honor enlarge=false
+// against the image size at that point, and sharpen sigmas are applied as given.
+func applyPipeline(image *vips.Image, params helpers.ParamsOptimize) (pipelineResult, error) {
+	result := pipelineResult{Scale: 1.0}
+	for i, op := range params.Pipeline {
+		var err error
+		switch op.Op {
+		case helpers.PipelineTrim:
+			err = trimBorders(image, params.TrimColor, int(op.Value))
+		case helpers.PipelineRotate:
+			err = rotateImage(image, op.Value, params.Background)
+		case helpers.PipelineCrop:
+			left, top, width, height := aspectCrop(image.Width(), image.Height(), op.Value)
+			err = image.ExtractArea(left, top, width, height)
+		case helpers.PipelineResize:
+			box := helpers.ParamsOptimize{Width: op.Width, Height: op.Height, WithoutEnlargement: params.WithoutEnlargement}
+			scale, enlargeCapped := computeScale(box, image.Width(), image.Height())
+			err = image.Resize(scale, nil)
+			result.Scale *= scale
+			result.EnlargeCapped = result.EnlargeCapped || enlargeCapped
+		case helpers.PipelineSharpen:
+			err = image.Sharpen(&vips.SharpenOptions{Sigma: op.Value})
+			result.Sharpen = op.Value
+		default:
+			err = fmt.Errorf("unknown operation")
+		}
+		if err != nil {
+			return pipelineResult{}, fmt.Errorf("pipeline step %d (%s) failed: %w", i+1, op.Op, err)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,74 @@
+package libs
+
+import (
+	"imgop/src/helpers"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cshum/vipsgen/vips"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOptimize_Pipeline(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	source, err := vips.NewBlack(800, 600, &vips.BlackOptions{Bands: 3})
+	require.NoError(t, err)
+	defer source.Close()
+	sourceJpeg, err := source.JpegsaveBuffer(nil)
+	require.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.WriteHeader(http.StatusOK)
+		w.Write(sourceJpeg)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name           string
+		pipeline       string
+		expectedWidth  int
+		expectedHeight int
+		expectedScale  float64
+		expectedCapped bool
+	}{
+		// The same two operations in a different order give a different size
+		{name: "Resize then rotate", pipeline: "resize:400,rotate:90", expectedWidth: 300, expectedHeight: 400, expectedScale: 0.5},
+		{name: "Rotate then resize", pipeline: "rotate:90,resize:400", expectedWidth: 400, expectedHeight: 533, expectedScale: 400.0 / 600},
+		{name: "Crop resize sharpen", pipeline: "crop:1:1,resize:100,sharpen:1", expectedWidth: 100, expectedHeight: 100, expectedScale: 100.0 / 600},
+		{name: "Two resizes", pipeline: "resize:400,resize:x150", expectedWidth: 200, expectedHeight: 150, expectedScale: 0.25},
+		{name: "Capped upscale", pipeline: "crop:1:1,resize:1000", expectedWidth: 600, expectedHeight: 600, expectedScale: 1.0, expectedCapped: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pipeline, err := helpers.ParsePipeline("pipeline", tt.pipeline)
+			require.NoError(t, err)
+
+			result, err := NewImageOptimizer().Optimize(helpers.ParamsOptimize{
+				Url:                server.URL,
+				Quality:            80,
+				Pipeline:           pipeline,
+				WithoutEnlargement: true,
+			})
+			require.NoError(t, err)
+			require.Greater(t, len(result.Image), 0)
+
+			assert.Equal(t, tt.expectedWidth, result.Width)
+			assert.Equal(t, tt.expectedHeight, result.Height)
+			assert.InDelta(t, tt.expectedScale, result.Scale, 0.0001)
+			assert.Equal(t, tt.expectedCapped, result.EnlargeCapped)
+			assert.Equal(t, pipeline, result.Pipeline)
+			assert.False(t, result.SequentialAccess)
+		})
+	}
+}
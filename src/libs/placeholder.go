@@ -0,0 +1,67 @@
+package libs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"imgop/src/helpers"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// cachedSource is a source kept in memory with the headers the optimizer reads
+type cachedSource struct {
+	data        []byte
+	contentType string
+}
+
+// placeholderResponse serves the placeholder as a synthetic origin response, fetching it
+// on first use. Only a successful fetch is cached, so a placeholder that failed is
+// retried by the next request instead of disabling the fallback until a cold start.
+func (imgop *ImageOptimizerHandler) placeholderResponse(ctx context.Context, method string, placeholderUrl *url.URL) (*http.Response, error) {
+	imgop.placeholderMu.Lock()
+	defer imgop.placeholderMu.Unlock()
+
+	if imgop.placeholder == nil {
+		placeholder, err := imgop.fetchPlaceholder(ctx, placeholderUrl)
+		if err != nil {
+			return nil, fmt.Errorf("placeholder fetch failed: %w", err)
+		}
+		imgop.placeholder = placeholder
+	}
+
+	body := io.NopCloser(bytes.NewReader(imgop.placeholder.data))
+	if method == http.MethodHead {
+		body = http.NoBody
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"Content-Type":   []string{imgop.placeholder.contentType},
+			"Content-Length": []string{strconv.Itoa(len(imgop.placeholder.data))},
+		},
+		Body:          body,
+		ContentLength: int64(len(imgop.placeholder.data)),
+	}, nil
+}
+
+// fetchPlaceholder downloads the placeholder with the same status and size limits as a source
+func (imgop *ImageOptimizerHandler) fetchPlaceholder(ctx context.Context, placeholderUrl *url.URL) (*cachedSource, error) {
+	appEnv := helpers.GetAppEnv()
+	resp, err := imgop.openOrigin(ctx, http.MethodGet, placeholderUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if !appEnv.IsAcceptedStatus(resp.StatusCode) || resp.StatusCode == http.StatusPartialContent {
+		return nil, fmt.Errorf("unexpected placeholder status: %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(&countingReader{reader: resp.Body, limit: appEnv.MaxDownloadBytesFor(placeholderUrl.Host)})
+	if err != nil {
+		return nil, err
+	}
+	return &cachedSource{data: data, contentType: resp.Header.Get("Content-Type")}, nil
+}
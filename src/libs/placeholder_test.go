@@ -0,0 +1,148 @@
+package libs
+
+import (
+	"context"
+	"imgop/src/helpers"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cshum/vipsgen/vips"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlaceholderResponse_CachesSuccessOnly(t *testing.T) {
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	var hits atomic.Int32
+	var failing atomic.Bool
+	failing.Store(true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("placeholder"))
+	}))
+	defer server.Close()
+
+	placeholderUrl, err := url.Parse(server.URL + "/placeholder.png")
+	require.NoError(t, err)
+	imgop := NewImageOptimizer()
+
+	_, err = imgop.placeholderResponse(context.Background(), http.MethodGet, placeholderUrl)
+	assert.ErrorContains(t, err, "placeholder fetch failed")
+
+	failing.Store(false)
+	for range 2 {
+		resp, err := imgop.placeholderResponse(context.Background(), http.MethodGet, placeholderUrl)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "placeholder", string(body))
+		assert.Equal(t, "image/png", resp.Header.Get("Content-Type"))
+		assert.Equal(t, int64(len("placeholder")), resp.ContentLength)
+	}
+	assert.Equal(t, int32(2), hits.Load(), "the failure is retried, the success is cached")
+}
+
+func TestOptimize_Placeholder(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	placeholderImage, err := vips.NewBlack(100, 50, &vips.BlackOptions{Bands: 3})
+	require.NoError(t, err)
+	defer placeholderImage.Close()
+	placeholderPng, err := placeholderImage.PngsaveBuffer(nil)
+	require.NoError(t, err)
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer origin.Close()
+
+	var placeholderHits atomic.Int32
+	placeholderServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		placeholderHits.Add(1)
+		if r.URL.Path == "/broken.png" {
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("not a png"))
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(placeholderPng)
+	}))
+	defer placeholderServer.Close()
+
+	t.Run("Origin failure serves the resized placeholder", func(t *testing.T) {
+		t.Setenv("SECRET_KEY", "test-imgop-key")
+		t.Setenv("PLACEHOLDER_URL", placeholderServer.URL+"/placeholder.png")
+		helpers.ResetAppEnvForTesting()
+		defer helpers.ResetAppEnvForTesting()
+		placeholderHits.Store(0)
+
+		imgop := NewImageOptimizer()
+		for range 2 {
+			result, err := imgop.Optimize(helpers.ParamsOptimize{Url: origin.URL + "/missing.jpg", Width: 40, Quality: 80})
+			require.NoError(t, err)
+			require.Greater(t, len(result.Image), 0)
+			assert.True(t, result.Fallback)
+			assert.Equal(t, 40, result.Width)
+			assert.Equal(t, 20, result.Height)
+		}
+		assert.Equal(t, int32(1), placeholderHits.Load(), "placeholder is fetched once")
+	})
+
+	t.Run("Working source ignores the placeholder", func(t *testing.T) {
+		t.Setenv("SECRET_KEY", "test-imgop-key")
+		t.Setenv("PLACEHOLDER_URL", placeholderServer.URL+"/placeholder.png")
+		helpers.ResetAppEnvForTesting()
+		defer helpers.ResetAppEnvForTesting()
+
+		result, err := NewImageOptimizer().Optimize(helpers.ParamsOptimize{Url: placeholderServer.URL + "/source.png", Width: 10, Quality: 80})
+		require.NoError(t, err)
+		require.Greater(t, len(result.Image), 0)
+		assert.False(t, result.Fallback)
+	})
+
+	t.Run("Redirect to a disallowed origin is refused, not replaced", func(t *testing.T) {
+		redirectServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, origin.URL+"/elsewhere.jpg", http.StatusFound)
+		}))
+		defer redirectServer.Close()
+
+		t.Setenv("SECRET_KEY", "test-imgop-key")
+		t.Setenv("PLACEHOLDER_URL", placeholderServer.URL+"/placeholder.png")
+		t.Setenv("ALLOWED_ORIGINS", strings.TrimPrefix(redirectServer.URL, "http://"))
+		t.Setenv("DEV_MODE", "false")
+		helpers.ResetAppEnvForTesting()
+		defer helpers.ResetAppEnvForTesting()
+
+		result, err := NewImageOptimizer().Optimize(helpers.ParamsOptimize{Url: redirectServer.URL + "/source.jpg", Width: 40, Quality: 80})
+		assert.ErrorIs(t, err, helpers.ErrOriginNotAllowed)
+		assert.Empty(t, result.Image)
+		assert.False(t, result.Fallback)
+	})
+
+	t.Run("Failing placeholder falls back to the empty result", func(t *testing.T) {
+		t.Setenv("SECRET_KEY", "test-imgop-key")
+		t.Setenv("PLACEHOLDER_URL", placeholderServer.URL+"/broken.png")
+		helpers.ResetAppEnvForTesting()
+		defer helpers.ResetAppEnvForTesting()
+
+		result, err := NewImageOptimizer().Optimize(helpers.ParamsOptimize{Url: origin.URL + "/missing.jpg", Width: 40, Quality: 80})
+		assert.Error(t, err)
+		assert.Empty(t, result.Image)
+		assert.False(t, result.Fallback)
+	})
+}
@@ -0,0 +1,29 @@
+package libs
+
+import (
+	"bytes"
+	"errors"
+)
+
+// ErrPolyglotSource is returned for a source carrying markup under REJECT_POLYGLOTS
+var ErrPolyglotSource = errors.New("source contains html or script markup")
+
+// Markup browsers may act on when they sniff a file as HTML or SVG, matched case-insensitively.
+// XMP metadata is XML too, but only uses the x: and rdf: namespaces, which aren't listed.
+var polyglotMarkers = [][]byte{
+	[]byte("<!doctype"), []byte("<html"), []byte("<head"), []byte("<body"), []byte("<script"),
+	[]byte("<iframe"), []byte("<object"), []byte("<embed"), []byte("<svg"), []byte("javascript:"),
+}
+
+// containsMarkup reports whether an image source also carries markup, like a polyglot
+// that has a valid image signature but embeds HTML in a comment or after the image data.
+// Re-encoding drops it, only sources returned untouched keep it.
+func containsMarkup(data []byte) bool {
+	lower := bytes.ToLower(data)
+	for _, marker := range polyglotMarkers {
+		if bytes.Contains(lower, marker) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package libs
+
+import (
+	"bytes"
+	"imgop/src/helpers"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withJpegComment inserts a COM segment right after the SOI marker
+func withJpegComment(jpeg []byte, comment string) []byte {
+	segment := []byte{0xFF, 0xFE, byte((len(comment) + 2) >> 8), byte(len(comment) + 2)}
+	return slices.Concat(jpeg[:2], segment, []byte(comment), jpeg[2:])
+}
+
+func TestContainsMarkup(t *testing.T) {
+	jpegHeader := []byte{0xFF, 0xD8, 0xFF, 0xE0, 0x00, 0x10, 0x4A, 0x46, 0x49, 0x46, 0x00, 0x01}
+	tests := []struct {
+		name     string
+		data     []byte
+		expected bool
+	}{
+		{name: "Plain image", data: jpegHeader, expected: false},
+		{name: "Script in a comment", data: withJpegComment(jpegHeader, "<script>alert(1)</script>"), expected: true},
+		{name: "Uppercase html after the image", data: append(slices.Clone(jpegHeader), "<HTML><BODY>"...), expected: true},
+		{name: "Javascript url", data: append(slices.Clone(jpegHeader), `<a href="JavaScript:alert(1)">`...), expected: true},
+		{name: "XMP metadata", data: withXmp(jpegHeader, `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF></rdf:RDF></x:xmpmeta>`), expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, containsMarkup(tt.data))
+		})
+	}
+}
+
+func TestOptimize_PolyglotPassthrough(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	polyglot := withJpegComment(newJpeg(t, 64, 48), "<html><script>alert(document.cookie)</script></html>")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.WriteHeader(http.StatusOK)
+		w.Write(polyglot)
+	}))
+	defer server.Close()
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	t.Setenv("PASSTHROUGH_FORMATS", "jpeg")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	result, err := NewImageOptimizer().Optimize(helpers.ParamsOptimize{Url: server.URL, Width: 64, Quality: 80})
+	require.NoError(t, err)
+	require.Greater(t, len(result.Image), 0)
+	assert.False(t, result.Passthrough, "the polyglot is not returned untouched")
+	assert.True(t, result.PolyglotReencoded)
+	assert.Equal(t, "webp", result.Encoder.Format)
+	assert.False(t, bytes.Contains(bytes.ToLower(result.Image), []byte("<script")), "re-encoding drops the markup")
+
+	t.Setenv("REJECT_POLYGLOTS", "true")
+	helpers.ResetAppEnvForTesting()
+	result, err = NewImageOptimizer().Optimize(helpers.ParamsOptimize{Url: server.URL, Width: 64, Quality: 80})
+	assert.Error(t, err)
+	assert.Empty(t, result.Image, "the polyglot is rejected")
+}
@@ -0,0 +1,80 @@
+package libs
+
+import (
+	"imgop/src/helpers"
+	"slices"
+
+	"github.com/cshum/vipsgen/vips"
+)
+
+// Content classes of a source, they pick the recommended preset and quality
+const (
+	ContentPhoto   = "photo"
+	ContentGraphic = "graphic"
+)
+
+// Recommended quality per content class, graphics show artifacts on flat areas and edges
+const (
+	photoQuality   = 80
+	graphicQuality = 90
+)
+
+// Source formats that are lossless, opaque sources in these are usually UI graphics or screenshots
+var losslessFormats = []string{"png", "gif", "svg"}
+
+// Recommendation is the suggested output for a source, found without encoding it
+type Recommendation struct {
+	Width        int             `json:"width"`
+	Height       int             `json:"height"`
+	SourceFormat string          `json:"source_format"`
+	HasAlpha     bool            `json:"has_alpha"`
+	Content      string          `json:"content"` // photo or graphic
+	Encoder      EncoderSettings `json:"encoder"`
+}
+
+// Recommend classifies the source from its header and returns the encoder settings
+// Optimize would pick for it, with a quality suited to the content
+func (imgop *ImageOptimizerHandler) Recommend(params helpers.ParamsOptimize) (Recommendation, error) {
+	var recommendation Recommendation
+	err := imgop.withSourceHeader(params, func(image *vips.Image, bytesRead int) {
+		recommendation = recommend(string(image.Format()), image.Width(), image.Height(), image.HasAlpha(), helpers.GetAppEnv().DEFAULT_EFFORT)
+		if image.Orientation() >= 5 {
+			// EXIF orientations 5-8 are displayed rotated by 90 degrees
+			recommendation.Width, recommendation.Height = recommendation.Height, recommendation.Width
+		}
+	})
+	return recommendation, err
+}
+
+// recommend builds the recommendation for a source with the given header fields, encoded
+// with the deployment default effort
+func recommend(sourceFormat string, width int, height int, hasAlpha bool, defaultEffort int) Recommendation {
+	content := classifyContent(sourceFormat, hasAlpha)
+	quality := photoQuality
+	if content == ContentGraphic {
+		quality = graphicQuality
+	}
+
+	encoder := webpEncoderSettings(helpers.ParamsOptimize{Quality: quality}, hasAlpha, defaultEffort)
+	if content == ContentGraphic {
+		encoder.Preset = "drawing"
+	}
+
+	return Recommendation{
+		Width:        width,
+		Height:       height,
+		SourceFormat: sourceFormat,
+		HasAlpha:     hasAlpha,
+		Content:      content,
+		Encoder:      encoder,
+	}
+}
+
+// classifyContent follows the encoder's alpha heuristic, and also treats opaque sources
+// in lossless formats as graphics
+func classifyContent(sourceFormat string, hasAlpha bool) string {
+	if hasAlpha || slices.Contains(losslessFormats, sourceFormat) {
+		return ContentGraphic
+	}
+	return ContentPhoto
+}
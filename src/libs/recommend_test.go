@@ -0,0 +1,90 @@
+package libs
+
+import (
+	"imgop/src/helpers"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cshum/vipsgen/vips"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecommend(t *testing.T) {
+	tests := []struct {
+		name            string
+		format          string
+		hasAlpha        bool
+		expectedContent string
+		expectedQuality int
+		expectedPreset  string
+		expectedAlphaQ  int
+	}{
+		{name: "Opaque jpeg is a photo", format: "jpeg", expectedContent: "photo", expectedQuality: 80, expectedPreset: "photo"},
+		{name: "Opaque webp is a photo", format: "webp", expectedContent: "photo", expectedQuality: 80, expectedPreset: "photo"},
+		{name: "Opaque png is a graphic", format: "png", expectedContent: "graphic", expectedQuality: 90, expectedPreset: "drawing"},
+		{name: "Alpha png is a graphic", format: "png", hasAlpha: true, expectedContent: "graphic", expectedQuality: 90, expectedPreset: "drawing", expectedAlphaQ: 100},
+		{name: "Alpha webp is a graphic", format: "webp", hasAlpha: true, expectedContent: "graphic", expectedQuality: 90, expectedPreset: "drawing", expectedAlphaQ: 100},
+		{name: "Svg is a graphic", format: "svg", expectedContent: "graphic", expectedQuality: 90, expectedPreset: "drawing"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recommendation := recommend(tt.format, 200, 100, tt.hasAlpha, 4)
+			assert.Equal(t, tt.expectedContent, recommendation.Content)
+			assert.Equal(t, "webp", recommendation.Encoder.Format)
+			assert.Equal(t, tt.expectedQuality, recommendation.Encoder.Quality)
+			assert.Equal(t, tt.expectedPreset, recommendation.Encoder.Preset)
+			assert.Equal(t, tt.expectedAlphaQ, recommendation.Encoder.AlphaQuality)
+			assert.Equal(t, 4, recommendation.Encoder.Effort)
+		})
+	}
+}
+
+func TestOptimizer_Recommend(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	graphic, err := vips.NewBlack(64, 32, &vips.BlackOptions{Bands: 4})
+	require.NoError(t, err)
+	defer graphic.Close()
+	graphicPng, err := graphic.PngsaveBuffer(nil)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name            string
+		data            []byte
+		contentType     string
+		expectedWidth   int
+		expectedHeight  int
+		expectedContent string
+		expectedAlpha   bool
+	}{
+		{name: "Photo", data: loadTestImage(t), contentType: "image/jpeg", expectedWidth: 2500, expectedHeight: 1667, expectedContent: "photo"},
+		{name: "Graphic", data: graphicPng, contentType: "image/png", expectedWidth: 64, expectedHeight: 32, expectedContent: "graphic", expectedAlpha: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.WriteHeader(http.StatusOK)
+				w.Write(tt.data)
+			}))
+			defer server.Close()
+
+			recommendation, err := NewImageOptimizer().Recommend(helpers.ParamsOptimize{Url: server.URL})
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedWidth, recommendation.Width)
+			assert.Equal(t, tt.expectedHeight, recommendation.Height)
+			assert.Equal(t, tt.expectedContent, recommendation.Content)
+			assert.Equal(t, tt.expectedAlpha, recommendation.HasAlpha)
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package libs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"imgop/src/helpers"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/cshum/vipsgen/vips"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stubS3 serves objects from memory, keyed by bucket/key
+type stubS3 struct {
+	objects     map[string][]byte
+	contentType string
+	requests    []string
+	puts        []*s3.PutObjectInput
+	putErr      error // Fails every PutObject when set
+}
+
+func (s *stubS3) object(bucket *string, key *string) ([]byte, error) {
+	path := aws.ToString(bucket) + "/" + aws.ToString(key)
+	s.requests = append(s.requests, path)
+	data, ok := s.objects[path]
+	if !ok {
+		return nil, fmt.Errorf("NoSuchKey: %s", path)
+	}
+	return data, nil
+}
+
+func (s *stubS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	data, err := s.object(params.Bucket, params.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &s3.GetObjectOutput{
+		Body:          io.NopCloser(bytes.NewReader(data)),
+		ContentType:   aws.String(s.contentType),
+		ContentLength: aws.Int64(int64(len(data))),
+		ETag:          aws.String(`"abc"`),
+		LastModified:  aws.Time(time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)),
+	}, nil
+}
+
+func (s *stubS3) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	data, err := s.object(params.Bucket, params.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &s3.HeadObjectOutput{
+		ContentType:   aws.String(s.contentType),
+		ContentLength: aws.Int64(int64(len(data))),
+	}, nil
+}
+
+func (s *stubS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	s.puts = append(s.puts, params)
+	if s.putErr != nil {
+		return nil, s.putErr
+	}
+	data, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	s.objects[aws.ToString(params.Bucket)+"/"+aws.ToString(params.Key)] = data
+	return &s3.PutObjectOutput{}, nil
+}
+
+// newS3StubOptimizer returns an optimizer reading s3:// sources from the stub
+func newS3StubOptimizer(stub *stubS3) *ImageOptimizerHandler {
+	imgop := NewImageOptimizer()
+	imgop.s3Once.Do(func() {
+		imgop.s3 = stub
+	})
+	return imgop
+}
+
+func TestS3ObjectResponse(t *testing.T) {
+	jpegHeader := []byte{0xFF, 0xD8, 0xFF, 0xE0, 0x00, 0x10, 0x4A, 0x46, 0x49, 0x46, 0x00, 0x01}
+	stub := &stubS3{
+		objects:     map[string][]byte{"private-assets/photos/a.jpg": jpegHeader},
+		contentType: "image/jpeg",
+	}
+
+	tests := []struct {
+		name          string
+		method        string
+		s3Url         string
+		expectedBody  []byte
+		errorContains string
+	}{
+		{name: "Get", method: http.MethodGet, s3Url: "s3://private-assets/photos/a.jpg", expectedBody: jpegHeader},
+		{name: "Head", method: http.MethodHead, s3Url: "s3://private-assets/photos/a.jpg", expectedBody: []byte{}},
+		{name: "Missing object", method: http.MethodGet, s3Url: "s3://private-assets/missing.jpg", errorContains: "NoSuchKey"},
+		{name: "Missing key", method: http.MethodGet, s3Url: "s3://private-assets/", errorContains: "expected s3://bucket/key"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s3Url, err := url.Parse(tt.s3Url)
+			require.NoError(t, err)
+
+			resp, err := s3ObjectResponse(context.Background(), stub, tt.method, s3Url)
+			if tt.errorContains != "" {
+				assert.ErrorContains(t, err, tt.errorContains)
+				return
+			}
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "image/jpeg", resp.Header.Get("Content-Type"))
+			assert.Equal(t, int64(len(jpegHeader)), resp.ContentLength)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedBody, body)
+		})
+	}
+}
+
+func TestS3Header(t *testing.T) {
+	header := s3Header(aws.String("image/png"), aws.Int64(42), aws.String("max-age=60"), aws.String(`"abc"`),
+		aws.Time(time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)))
+	assert.Equal(t, "image/png", header.Get("Content-Type"))
+	assert.Equal(t, "42", header.Get("Content-Length"))
+	assert.Equal(t, "max-age=60", header.Get("Cache-Control"))
+	assert.Equal(t, `"abc"`, header.Get("ETag"))
+	assert.Equal(t, "Fri, 02 Jan 2026 03:04:05 GMT", header.Get("Last-Modified"))
+
+	assert.Empty(t, s3Header(nil, nil, nil, nil, nil))
+	assert.Equal(t, int64(-1), s3ContentLength(nil))
+}
+
+func TestSourceSize_S3(t *testing.T) {
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	t.Setenv("ALLOWED_BUCKETS", "private-assets")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	stub := &stubS3{
+		objects:     map[string][]byte{"private-assets/a.jpg": make([]byte, 1234)},
+		contentType: "image/jpeg",
+	}
+	size, err := newS3StubOptimizer(stub).SourceSize(helpers.ParamsOptimize{Url: "s3://private-assets/a.jpg"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1234), size)
+}
+
+func TestOptimize_S3(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	t.Setenv("ALLOWED_BUCKETS", "private-assets")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	smallImage, err := vips.NewBlack(40, 20, &vips.BlackOptions{Bands: 3})
+	require.NoError(t, err)
+	defer smallImage.Close()
+	smallJpeg, err := smallImage.JpegsaveBuffer(nil)
+	require.NoError(t, err)
+
+	stub := &stubS3{
+		objects:     map[string][]byte{"private-assets/photos/a.jpg": smallJpeg},
+		contentType: "image/jpeg",
+	}
+	result, err := newS3StubOptimizer(stub).Optimize(helpers.ParamsOptimize{
+		Url:     "s3://private-assets/photos/a.jpg",
+		Width:   20,
+		Quality: 80,
+	})
+	require.NoError(t, err)
+	require.Greater(t, len(result.Image), 0)
+	assert.Equal(t, []string{"private-assets/photos/a.jpg"}, stub.requests)
+	assert.Equal(t, len(smallJpeg), result.SourceBytes)
+	assert.Equal(t, "jpeg", result.SourceFormat)
+	assert.Equal(t, 20, result.Width)
+	assert.Equal(t, 10, result.Height)
+}
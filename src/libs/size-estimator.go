@@ -0,0 +1,108 @@
+package libs
+
+import (
+	"imgop/src/helpers"
+	"math"
+)
+
+type bppPoint struct {
+	quality int
+	bpp     float64
+}
+
+// sizeCalibration is the bits per pixel of an output format by quality, plus the bytes of
+// its container and headers
+type sizeCalibration struct {
+	overheadBytes int
+	points        []bppPoint
+}
+
+// sizeCalibrations map each output format's quality to approximate bits per pixel for
+// typical photos with the default encoder settings (WebP photo preset at effort 4, AVIF at
+// effort 4, baseline JPEG) on mid-size outputs. Points are sorted by quality, recalibrate
+// with TestEstimateOutputBytes_AgainstEncodes when the encoder defaults change.
+var sizeCalibrations = map[string]sizeCalibration{
+	"webp": {overheadBytes: 200, points: []bppPoint{
+		{quality: 1, bpp: 0.08},
+		{quality: 25, bpp: 0.25},
+		{quality: 50, bpp: 0.40},
+		{quality: 75, bpp: 0.62},
+		{quality: 85, bpp: 0.85},
+		{quality: 95, bpp: 1.60},
+		{quality: 100, bpp: 2.60},
+	}},
+	// AV1 needs about two thirds of the WebP bits at the same quality, more of the header
+	// is the HEIF item and property boxes
+	"avif": {overheadBytes: 400, points: []bppPoint{
+		{quality: 1, bpp: 0.04},
+		{quality: 25, bpp: 0.15},
+		{quality: 50, bpp: 0.26},
+		{quality: 75, bpp: 0.42},
+		{quality: 85, bpp: 0.60},
+		{quality: 95, bpp: 1.10},
+		{quality: 100, bpp: 2.00},
+	}},
+	// The quantization and Huffman tables make up most of the JPEG header
+	"jpeg": {overheadBytes: 600, points: []bppPoint{
+		{quality: 1, bpp: 0.15},
+		{quality: 25, bpp: 0.50},
+		{quality: 50, bpp: 0.75},
+		{quality: 75, bpp: 1.10},
+		{quality: 85, bpp: 1.50},
+		{quality: 95, bpp: 2.60},
+		{quality: 100, bpp: 4.50},
+	}},
+}
+
+// Encoder default used when no quality is requested
+const defaultWebpQuality = 75
+
+// EstimateOutputBytes predicts the encoded size for the requested dimensions, quality and
+// format without fetching or encoding anything. A missing dimension is assumed equal to the
+// given one, so pass both for a tighter estimate. An empty format is WebP, like the output,
+// and email=1 is always JPEG. Returns 0 when no dimension is given.
+func EstimateOutputBytes(params helpers.ParamsOptimize) int {
+	width, height := params.Width, params.Height
+	if width == 0 {
+		width = height
+	}
+	if height == 0 {
+		height = width
+	}
+	if width <= 0 || height <= 0 {
+		return 0
+	}
+
+	quality := params.Quality
+	if quality <= 0 {
+		quality = defaultWebpQuality
+	}
+
+	format := params.Format
+	if params.Email {
+		format = "jpeg"
+	}
+	calibration, ok := sizeCalibrations[format]
+	if !ok {
+		calibration = sizeCalibrations["webp"]
+	}
+
+	pixels := float64(width * height)
+	return calibration.overheadBytes + int(math.Round(pixels*bitsPerPixel(calibration.points, quality)/8))
+}
+
+// bitsPerPixel interpolates the calibration points linearly between the surrounding qualities
+func bitsPerPixel(points []bppPoint, quality int) float64 {
+	if quality <= points[0].quality {
+		return points[0].bpp
+	}
+	for i := 1; i < len(points); i++ {
+		upper := points[i]
+		if quality <= upper.quality {
+			lower := points[i-1]
+			ratio := float64(quality-lower.quality) / float64(upper.quality-lower.quality)
+			return lower.bpp + ratio*(upper.bpp-lower.bpp)
+		}
+	}
+	return points[len(points)-1].bpp
+}
@@ -0,0 +1,116 @@
+package libs
+
+import (
+	"imgop/src/helpers"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBitsPerPixel(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   string
+		quality  int
+		expected float64
+	}{
+		{name: "Calibrated point", format: "webp", quality: 75, expected: 0.62},
+		{name: "Between points", format: "webp", quality: 80, expected: 0.735},
+		{name: "Lowest", format: "webp", quality: 1, expected: 0.08},
+		{name: "Highest", format: "webp", quality: 100, expected: 2.60},
+		{name: "Above range", format: "webp", quality: 150, expected: 2.60},
+		{name: "AVIF", format: "avif", quality: 80, expected: 0.51},
+		{name: "JPEG", format: "jpeg", quality: 80, expected: 1.30},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.InDelta(t, tt.expected, bitsPerPixel(sizeCalibrations[tt.format].points, tt.quality), 0.0001)
+		})
+	}
+}
+
+func TestEstimateOutputBytes(t *testing.T) {
+	assert.Equal(t, 0, EstimateOutputBytes(helpers.ParamsOptimize{}), "no dimensions")
+
+	// 100x100 at the default quality: 200 + 10000 * 0.62 / 8
+	assert.Equal(t, 975, EstimateOutputBytes(helpers.ParamsOptimize{Width: 100, Height: 100}))
+	assert.Equal(t, 975, EstimateOutputBytes(helpers.ParamsOptimize{Width: 100}), "missing dimension is square")
+
+	previous := 0
+	for _, quality := range []int{10, 40, 70, 90, 100} {
+		estimate := EstimateOutputBytes(helpers.ParamsOptimize{Width: 800, Height: 600, Quality: quality})
+		assert.Greater(t, estimate, previous, "estimate grows with quality")
+		previous = estimate
+	}
+	assert.Greater(t,
+		EstimateOutputBytes(helpers.ParamsOptimize{Width: 1600, Height: 1200, Quality: 80}),
+		EstimateOutputBytes(helpers.ParamsOptimize{Width: 800, Height: 600, Quality: 80}),
+		"estimate grows with dimensions",
+	)
+
+	// 100x100 at the default quality: 400 + 10000 * 0.42 / 8 and 600 + 10000 * 1.10 / 8
+	assert.Equal(t, 925, EstimateOutputBytes(helpers.ParamsOptimize{Width: 100, Height: 100, Format: "avif"}))
+	assert.Equal(t, 1975, EstimateOutputBytes(helpers.ParamsOptimize{Width: 100, Height: 100, Format: "jpeg"}))
+	assert.Equal(t, 975, EstimateOutputBytes(helpers.ParamsOptimize{Width: 100, Height: 100, Format: "webp"}), "explicit webp matches the default")
+	assert.Equal(t, 1975, EstimateOutputBytes(helpers.ParamsOptimize{Width: 100, Height: 100, Format: "webp", Email: true}), "email is jpeg")
+
+	webp := EstimateOutputBytes(helpers.ParamsOptimize{Width: 800, Height: 600, Quality: 80})
+	assert.Less(t, EstimateOutputBytes(helpers.ParamsOptimize{Width: 800, Height: 600, Quality: 80, Format: "avif"}), webp)
+	assert.Greater(t, EstimateOutputBytes(helpers.ParamsOptimize{Width: 800, Height: 600, Quality: 80, Format: "jpeg"}), webp)
+}
+
+func TestEstimateOutputBytes_AgainstEncodes(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	testImageData := loadTestImage(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.WriteHeader(http.StatusOK)
+		w.Write(testImageData)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		format  string
+		width   int
+		quality int
+	}{
+		{format: "", width: 400, quality: 50},
+		{format: "", width: 800, quality: 75},
+		{format: "", width: 800, quality: 90},
+		{format: "", width: 1200, quality: 80},
+		{format: "avif", width: 400, quality: 50},
+		{format: "avif", width: 800, quality: 75},
+		{format: "avif", width: 1200, quality: 80},
+		{format: "jpeg", width: 400, quality: 50},
+		{format: "jpeg", width: 800, quality: 75},
+		{format: "jpeg", width: 800, quality: 90},
+		{format: "jpeg", width: 1200, quality: 80},
+	}
+
+	for _, tt := range tests {
+		params := helpers.ParamsOptimize{Url: server.URL, Width: tt.width, Quality: tt.quality, Format: tt.format}
+		if !EncoderAvailable(tt.format) {
+			t.Logf("f=%s can't be encoded by this libvips build, not calibrated", tt.format)
+			continue
+		}
+		result, err := NewImageOptimizer().Optimize(params)
+		require.NoError(t, err)
+		require.Greater(t, len(result.Image), 0)
+
+		params.Height = result.Height
+		estimate := EstimateOutputBytes(params)
+		ratio := float64(estimate) / float64(len(result.Image))
+		assert.InDelta(t, 1.0, ratio, 0.5, "f=%s w=%d q=%d estimated %d, encoded %d", tt.format, tt.width, tt.quality, estimate, len(result.Image))
+	}
+}
@@ -0,0 +1,89 @@
+package libs
+
+import (
+	"context"
+	"imgop/src/helpers"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/cshum/vipsgen/vips"
+)
+
+// SourceDimensions is the intrinsic size of a source, as displayed after EXIF orientation
+type SourceDimensions struct {
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Format    string `json:"format"`
+	BytesRead int    `json:"bytes_read"` // How much of the source was read to find the size
+}
+
+// SourceDimensions reads the source dimensions from its header. The body is streamed into
+// the loader, which stops reading once the header is parsed, so most of a large source
+// is never downloaded or decoded. SVGs are sanitized and rasterized like in Optimize.
+func (imgop *ImageOptimizerHandler) SourceDimensions(params helpers.ParamsOptimize) (SourceDimensions, error) {
+	var dimensions SourceDimensions
+	err := imgop.withSourceHeader(params, func(image *vips.Image, bytesRead int) {
+		dimensions = SourceDimensions{
+			Width:     image.Width(),
+			Height:    image.Height(),
+			Format:    string(image.Format()),
+			BytesRead: bytesRead,
+		}
+		if image.Orientation() >= 5 {
+			// EXIF orientations 5-8 are displayed rotated by 90 degrees
+			dimensions.Width, dimensions.Height = dimensions.Height, dimensions.Width
+		}
+	})
+	return dimensions, err
+}
+
+// withSourceHeader opens the source with sequential access and passes the image to read,
+// along with how many bytes it took, before closing it. Only header fields are cheap to
+// read, touching the pixels would decode the whole source.
+func (imgop *ImageOptimizerHandler) withSourceHeader(params helpers.ParamsOptimize, read func(image *vips.Image, bytesRead int)) error {
+	appEnv := helpers.GetAppEnv()
+	imageUrl, err := url.Parse(params.Url)
+	if err != nil {
+		return err
+	}
+
+	timeout := time.Duration(appEnv.FetchTimeoutFor(imageUrl.Host)) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	resp, err := imgop.openSource(ctx, http.MethodGet, imageUrl)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if !appEnv.IsAcceptedStatus(resp.StatusCode) {
+		return originStatusError(resp.StatusCode)
+	}
+
+	validatedBody, err := validateImageFile(resp)
+	if err != nil {
+		return err
+	}
+	countedBody := &countingReader{reader: validatedBody, limit: appEnv.MaxDownloadBytesFor(imageUrl.Host)}
+
+	var image *vips.Image
+	if isSvgContentType(resp.Header.Get("Content-Type")) {
+		image, err = loadSvg(countedBody, params.Density)
+	} else {
+		source := vips.NewSource(countedBody)
+		defer source.Close()
+		image, err = vips.NewImageFromSource(source, &vips.LoadOptions{Access: vips.AccessSequential})
+		if err != nil {
+			err = decodeError(err)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+
+	read(image, countedBody.count)
+	return nil
+}
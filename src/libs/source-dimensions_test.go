@@ -0,0 +1,70 @@
+package libs
+
+import (
+	"imgop/src/helpers"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSourceDimensions(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	// test-image.jpg is landscape (2500x1667) with orientation 1
+	testImageData := loadTestImage(t)
+
+	tests := []struct {
+		name           string
+		orientation    int
+		expectedWidth  int
+		expectedHeight int
+	}{
+		{name: "Upright", orientation: 1, expectedWidth: 2500, expectedHeight: 1667},
+		{name: "Upside down", orientation: 3, expectedWidth: 2500, expectedHeight: 1667},
+		{name: "EXIF rotated 90 CW", orientation: 6, expectedWidth: 1667, expectedHeight: 2500},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fixture := withExifOrientation(t, testImageData, tt.orientation)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "image/jpeg")
+				w.WriteHeader(http.StatusOK)
+				w.Write(fixture)
+			}))
+			defer server.Close()
+
+			dimensions, err := NewImageOptimizer().SourceDimensions(helpers.ParamsOptimize{Url: server.URL})
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.expectedWidth, dimensions.Width)
+			assert.Equal(t, tt.expectedHeight, dimensions.Height)
+			assert.Equal(t, "jpeg", dimensions.Format)
+			// Only the header was read, not the whole source
+			assert.Less(t, dimensions.BytesRead, len(fixture)/2)
+		})
+	}
+}
+
+func TestSourceDimensions_OriginError(t *testing.T) {
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	_, err := NewImageOptimizer().SourceDimensions(helpers.ParamsOptimize{Url: server.URL})
+	assert.ErrorContains(t, err, "unexpected origin status: 404")
+}
@@ -0,0 +1,288 @@
+package libs
+
+import (
+	"fmt"
+	"imgop/src/helpers"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cshum/vipsgen/vips"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsSvgContentType(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected bool
+	}{
+		{name: "svg", content: "image/svg+xml", expected: true},
+		{name: "svg with charset", content: "image/svg+xml; charset=utf-8", expected: true},
+		{name: "uppercase", content: "IMAGE/SVG+XML", expected: true},
+		{name: "png", content: "image/png", expected: false},
+		{name: "plain xml", content: "text/xml", expected: false},
+		{name: "empty", content: "", expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, isSvgContentType(tt.content))
+		})
+	}
+}
+
+func TestIsSvgSignature(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		expected bool
+	}{
+		{name: "svg root", data: []byte(`<svg xmlns="`), expected: true},
+		{name: "xml declaration", data: []byte(`<?xml versio`), expected: true},
+		{name: "leading whitespace", data: []byte("\n  <svg xmln"), expected: true},
+		{name: "utf-8 bom", data: []byte("\xEF\xBB\xBF<svg xmln"), expected: true},
+		{name: "html", data: []byte(`<html><body`), expected: false},
+		{name: "jpeg", data: []byte{0xFF, 0xD8, 0xFF, 0xE0}, expected: false},
+		{name: "empty", data: []byte{}, expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, isSvgSignature(tt.data))
+		})
+	}
+}
+
+func TestValidateImageFile_Svg(t *testing.T) {
+	tests := []struct {
+		name          string
+		contentType   string
+		bodyData      []byte
+		expectedError bool
+	}{
+		{
+			name:          "svg declared as svg",
+			contentType:   "image/svg+xml",
+			bodyData:      []byte(`<svg xmlns="http://www.w3.org/2000/svg" width="10" height="10"></svg>`),
+			expectedError: false,
+		},
+		{
+			name:          "svg declared as png",
+			contentType:   "image/png",
+			bodyData:      []byte(`<svg xmlns="http://www.w3.org/2000/svg" width="10" height="10"></svg>`),
+			expectedError: true,
+		},
+		{
+			name:          "html declared as svg",
+			contentType:   "image/svg+xml",
+			bodyData:      []byte(`<html><body>hello</body></html>`),
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Content-Type": []string{tt.contentType}},
+				Body:       io.NopCloser(strings.NewReader(string(tt.bodyData))),
+			}
+
+			validatedBody, err := validateImageFile(resp)
+			if tt.expectedError {
+				assert.Error(t, err)
+				assert.Nil(t, validatedBody)
+				return
+			}
+
+			require.NoError(t, err)
+			readData, err := io.ReadAll(validatedBody)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.bodyData, readData)
+		})
+	}
+}
+
+func TestSanitizeSvg(t *testing.T) {
+	tests := []struct {
+		name        string
+		svg         string
+		contains    []string
+		notContains []string
+	}{
+		{
+			name:        "script element",
+			svg:         `<svg><script>alert(1)</script><rect width="1" height="1"/></svg>`,
+			contains:    []string{`<rect width="1" height="1"/>`},
+			notContains: []string{"<script", "alert(1)"},
+		},
+		{
+			name:        "self closing script",
+			svg:         `<svg><script href="https://evil.com/x.js"/><rect/></svg>`,
+			contains:    []string{"<rect/>"},
+			notContains: []string{"<script", "evil.com"},
+		},
+		{
+			name:        "event handler",
+			svg:         `<svg onload="alert(1)"><rect onclick='alert(2)'/></svg>`,
+			contains:    []string{"<svg>", "<rect/>"},
+			notContains: []string{"onload", "onclick"},
+		},
+		{
+			name:        "external entity",
+			svg:         `<?xml version="1.0"?><!DOCTYPE svg [<!ENTITY xxe SYSTEM "file:///etc/passwd">]><svg>&xxe;</svg>`,
+			contains:    []string{"<svg>"},
+			notContains: []string{"<!DOCTYPE", "<!ENTITY", "/etc/passwd"},
+		},
+		{
+			name:        "external image href",
+			svg:         `<svg><image xlink:href="https://evil.com/a.png"/><image href='http://evil.com/b.png'/></svg>`,
+			contains:    []string{`xlink:href=""`, `href=""`},
+			notContains: []string{"evil.com"},
+		},
+		{
+			name:     "internal references are kept",
+			svg:      `<svg><use href="#shape"/><image href="data:image/png;base64,AAAA"/></svg>`,
+			contains: []string{`href="#shape"`, `href="data:image/png;base64,AAAA"`},
+		},
+		{
+			name:        "external css url and import",
+			svg:         `<svg><style>@import url("https://evil.com/a.css"); rect { fill: url(#grad); background: url(https://evil.com/bg.png) }</style></svg>`,
+			contains:    []string{"url(#grad)"},
+			notContains: []string{"evil.com", "@import"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := string(sanitizeSvg([]byte(tt.svg)))
+			for _, expected := range tt.contains {
+				assert.Contains(t, result, expected)
+			}
+			for _, unexpected := range tt.notContains {
+				assert.NotContains(t, result, unexpected)
+			}
+		})
+	}
+}
+
+func TestRasterizeSvg_ExternalImage(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	var externalHits atomic.Int32
+	externalServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		externalHits.Add(1)
+		w.Header().Set("Content-Type", "image/png")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer externalServer.Close()
+
+	// Unsanitized, so only the loader stands between the markup and the network
+	svg := `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" width="100" height="50">` +
+		`<rect width="100" height="50" fill="red"/>` +
+		`<image href="` + externalServer.URL + `/a.png" width="10" height="10"/>` +
+		`<image xlink:href="` + externalServer.URL + `/b.png" width="10" height="10"/>` +
+		`<image href="file:///etc/passwd" width="10" height="10"/>` +
+		`</svg>`
+	image, err := rasterizeSvg([]byte(svg), 0)
+	if err == nil {
+		defer image.Close()
+		_, err = image.PngsaveBuffer(nil)
+		assert.NoError(t, err, "the external images are skipped, the rest renders")
+	}
+	assert.Equal(t, int32(0), externalHits.Load(), "external references must not be fetched")
+}
+
+func TestRasterizeSvg_EntityExpansion(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	// Billion laughs: 10 levels of 10 references expand to 10^9 "lol"s
+	var doctype strings.Builder
+	doctype.WriteString(`<!DOCTYPE svg [<!ENTITY lol0 "lol">`)
+	for level := 1; level < 10; level++ {
+		fmt.Fprintf(&doctype, `<!ENTITY lol%d "%s">`, level, strings.Repeat(fmt.Sprintf("&lol%d;", level-1), 10))
+	}
+	doctype.WriteString(`]>`)
+	svg := `<?xml version="1.0"?>` + doctype.String() +
+		`<svg xmlns="http://www.w3.org/2000/svg" width="100" height="50"><text y="20">&lol9;</text></svg>`
+
+	done := make(chan error, 1)
+	go func() {
+		image, err := rasterizeSvg([]byte(svg), 0)
+		if err == nil {
+			_, err = image.PngsaveBuffer(nil)
+			image.Close()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		// librsvg either refuses the document or renders it without expanding the entities
+		if err != nil {
+			assert.ErrorIs(t, err, helpers.ErrUnsupportedMedia)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the entities were expanded")
+	}
+}
+
+func TestOptimize_SvgExternalReference(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	os.Setenv("SECRET_KEY", "test-imgop-key")
+	defer func() {
+		os.Unsetenv("SECRET_KEY")
+		helpers.ResetAppEnvForTesting()
+	}()
+	helpers.ResetAppEnvForTesting()
+
+	// External server records any fetch triggered while rasterizing
+	var externalHits atomic.Int32
+	externalServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		externalHits.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer externalServer.Close()
+
+	svg := `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" width="100" height="50">` +
+		`<rect width="100" height="50" fill="red"/>` +
+		`<image xlink:href="` + externalServer.URL + `/pixel.png" width="10" height="10"/>` +
+		`<style>rect { fill: url(` + externalServer.URL + `/fill.svg) }</style>` +
+		`</svg>`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(svg))
+	}))
+	defer server.Close()
+
+	result, err := NewImageOptimizer().Optimize(helpers.ParamsOptimize{
+		Url:     server.URL,
+		Quality: 80,
+		Density: 144,
+	})
+	require.NoError(t, err)
+	require.Greater(t, len(result.Image), 0, "svg should be rasterized")
+	assert.Equal(t, int32(0), externalHits.Load(), "external references must not be fetched")
+
+	image, err := vips.NewImageFromBuffer(result.Image, nil)
+	require.NoError(t, err)
+	defer image.Close()
+
+	// 144 DPI doubles the 72 DPI intrinsic size
+	assert.Equal(t, 200, image.Width())
+	assert.Equal(t, 100, image.Height())
+}
@@ -0,0 +1,106 @@
+package libs
+
+import (
+	"fmt"
+	"imgop/src/helpers"
+	"math"
+
+	"github.com/cshum/vipsgen/vips"
+)
+
+// Longest side of the cheap downscale the dominant color is computed from
+const swatchSampleSize = 32
+
+// findDominantColor returns the dominant RGB color of the image. It works on a tiny
+// downscale, so it modifies the image in place and the caller should discard it.
+func findDominantColor(image *vips.Image) ([]float64, error) {
+	if image.HasAlpha() {
+		if err := image.Flatten(&vips.FlattenOptions{Background: []float64{255, 255, 255}}); err != nil {
+			return nil, err
+		}
+	}
+	if err := image.Colourspace(vips.InterpretationSrgb, nil); err != nil {
+		return nil, err
+	}
+	if err := image.Cast(vips.BandFormatUchar, nil); err != nil {
+		return nil, err
+	}
+
+	scale := float64(swatchSampleSize) / float64(max(image.Width(), image.Height()))
+	if scale < 1.0 {
+		if err := image.Resize(scale, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	pixels, err := image.RawsaveBuffer(nil)
+	if err != nil {
+		return nil, err
+	}
+	return dominantColor(pixels, image.Bands()), nil
+}
+
+// dominantColor buckets the pixels by their top 4 bits per channel and averages the
+// pixels of the most populated bucket, so a large flat area wins over a blend of details
+func dominantColor(pixels []byte, bands int) []float64 {
+	if bands < 3 || len(pixels) < bands {
+		return []float64{0, 0, 0}
+	}
+
+	counts := map[int]int{}
+	sums := map[int][3]int{}
+	best := -1
+	for i := 0; i+bands <= len(pixels); i += bands {
+		r, g, b := pixels[i], pixels[i+1], pixels[i+2]
+		bucket := int(r>>4)<<8 | int(g>>4)<<4 | int(b>>4)
+		counts[bucket]++
+		sum := sums[bucket]
+		sums[bucket] = [3]int{sum[0] + int(r), sum[1] + int(g), sum[2] + int(b)}
+		if best == -1 || counts[bucket] > counts[best] {
+			best = bucket
+		}
+	}
+
+	count := float64(counts[best])
+	sum := sums[best]
+	return []float64{
+		math.Round(float64(sum[0]) / count),
+		math.Round(float64(sum[1]) / count),
+		math.Round(float64(sum[2]) / count),
+	}
+}
+
+// newSwatch creates a solid image of the color
+func newSwatch(width int, height int, color []float64) (*vips.Image, error) {
+	swatch, err := vips.NewBlack(width, height, &vips.BlackOptions{Bands: 3})
+	if err != nil {
+		return nil, err
+	}
+	if err := swatch.Linear([]float64{1, 1, 1}, color, nil); err != nil {
+		swatch.Close()
+		return nil, err
+	}
+	if err := swatch.Cast(vips.BandFormatUchar, nil); err != nil {
+		swatch.Close()
+		return nil, err
+	}
+	return swatch, nil
+}
+
+// swatchSize defaults to 1x1, a single dimension gives a square
+func swatchSize(params helpers.ParamsOptimize) (int, int) {
+	switch {
+	case params.Width > 0 && params.Height > 0:
+		return params.Width, params.Height
+	case params.Width > 0:
+		return params.Width, params.Width
+	case params.Height > 0:
+		return params.Height, params.Height
+	}
+	return 1, 1
+}
+
+// hexColor formats an RGB color as #rrggbb
+func hexColor(color []float64) string {
+	return fmt.Sprintf("#%02x%02x%02x", uint8(color[0]), uint8(color[1]), uint8(color[2]))
+}
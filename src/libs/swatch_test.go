@@ -0,0 +1,145 @@
+package libs
+
+import (
+	"imgop/src/helpers"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cshum/vipsgen/vips"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDominantColor(t *testing.T) {
+	tests := []struct {
+		name     string
+		pixels   []byte
+		bands    int
+		expected []float64
+	}{
+		{
+			name:     "Single color",
+			pixels:   []byte{200, 10, 10, 200, 10, 10},
+			bands:    3,
+			expected: []float64{200, 10, 10},
+		},
+		{
+			name:     "Majority wins over a brighter minority",
+			pixels:   []byte{10, 20, 200, 12, 22, 202, 255, 255, 255},
+			bands:    3,
+			expected: []float64{11, 21, 201},
+		},
+		{
+			name:     "Extra bands are ignored",
+			pixels:   []byte{0, 128, 0, 255, 0, 128, 0, 255},
+			bands:    4,
+			expected: []float64{0, 128, 0},
+		},
+		{
+			name:     "Empty",
+			pixels:   []byte{},
+			bands:    3,
+			expected: []float64{0, 0, 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, dominantColor(tt.pixels, tt.bands))
+		})
+	}
+}
+
+func TestSwatchSize(t *testing.T) {
+	tests := []struct {
+		name           string
+		params         helpers.ParamsOptimize
+		expectedWidth  int
+		expectedHeight int
+	}{
+		{name: "Default", params: helpers.ParamsOptimize{}, expectedWidth: 1, expectedHeight: 1},
+		{name: "Width only", params: helpers.ParamsOptimize{Width: 16}, expectedWidth: 16, expectedHeight: 16},
+		{name: "Height only", params: helpers.ParamsOptimize{Height: 8}, expectedWidth: 8, expectedHeight: 8},
+		{name: "Both", params: helpers.ParamsOptimize{Width: 40, Height: 20}, expectedWidth: 40, expectedHeight: 20},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			width, height := swatchSize(tt.params)
+			assert.Equal(t, tt.expectedWidth, width)
+			assert.Equal(t, tt.expectedHeight, height)
+		})
+	}
+}
+
+func TestHexColor(t *testing.T) {
+	assert.Equal(t, "#ff0a00", hexColor([]float64{255, 10, 0}))
+	assert.Equal(t, "#000000", hexColor([]float64{0, 0, 0}))
+}
+
+func TestOptimize_Swatch(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	// Mostly red 300x200 image with a thin white border
+	source, err := newSwatch(280, 180, []float64{200, 30, 30})
+	require.NoError(t, err)
+	defer source.Close()
+	require.NoError(t, source.Embed(10, 10, 300, 200, &vips.EmbedOptions{
+		Extend:     vips.ExtendBackground,
+		Background: []float64{255, 255, 255},
+	}))
+	sourcePng, err := source.PngsaveBuffer(nil)
+	require.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.WriteHeader(http.StatusOK)
+		w.Write(sourcePng)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name           string
+		width          int
+		height         int
+		expectedWidth  int
+		expectedHeight int
+	}{
+		{name: "Default 1x1", expectedWidth: 1, expectedHeight: 1},
+		{name: "Sized", width: 20, height: 10, expectedWidth: 20, expectedHeight: 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := NewImageOptimizer().Optimize(helpers.ParamsOptimize{
+				Url:     server.URL,
+				Width:   tt.width,
+				Height:  tt.height,
+				Quality: 100,
+				Swatch:  true,
+			})
+			require.NoError(t, err)
+			require.Greater(t, len(result.Image), 0)
+
+			assert.Equal(t, "#c81e1e", result.DominantColor)
+			assert.Equal(t, tt.expectedWidth, result.Width)
+			assert.Equal(t, tt.expectedHeight, result.Height)
+
+			image, err := vips.NewImageFromBuffer(result.Image, nil)
+			require.NoError(t, err)
+			defer image.Close()
+			pixel, err := image.Getpoint(0, 0, nil)
+			require.NoError(t, err)
+			assert.InDelta(t, 200, pixel[0], 10)
+			assert.InDelta(t, 30, pixel[1], 10)
+			assert.InDelta(t, 30, pixel[2], 10)
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package libs
+
+import (
+	"context"
+	"imgop/src/helpers"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// validateSourceBytes is how much of the source is requested to validate it, far more than
+// the content-type and signature checks need
+const validateSourceBytes = 4096
+
+// SourceValidation is whether a source looks like an image we can optimize
+type SourceValidation struct {
+	Valid     bool   `json:"valid"`
+	Format    string `json:"format,omitempty"` // Format by file signature, set when valid
+	Error     string `json:"error,omitempty"`  // Why the source was rejected, set when invalid
+	BytesRead int    `json:"bytes_read"`       // How much of the source was read to validate it
+}
+
+// sourceRangeKey carries the number of leading bytes to request from an origin
+type sourceRangeKey struct{}
+
+// withSourceRange asks fetchSource to request only the first length bytes of the source,
+// origins that don't support ranges still send everything
+func withSourceRange(ctx context.Context, length int64) context.Context {
+	return context.WithValue(ctx, sourceRangeKey{}, length)
+}
+
+// ValidateSource runs the content-type and signature checks of Optimize on the first bytes
+// of the source, without downloading or decoding the rest. A source that fails the checks
+// is reported as invalid, only fetch failures are returned as errors.
+func (imgop *ImageOptimizerHandler) ValidateSource(params helpers.ParamsOptimize) (SourceValidation, error) {
+	appEnv := helpers.GetAppEnv()
+	imageUrl, err := url.Parse(params.Url)
+	if err != nil {
+		return SourceValidation{}, err
+	}
+
+	timeout := time.Duration(appEnv.FetchTimeoutFor(imageUrl.Host)) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	resp, err := imgop.openSource(withSourceRange(ctx, validateSourceBytes), http.MethodGet, imageUrl)
+	if err != nil {
+		return SourceValidation{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent && !appEnv.IsAcceptedStatus(resp.StatusCode) {
+		return SourceValidation{}, originStatusError(resp.StatusCode)
+	}
+
+	// Closing the body drops whatever an origin ignoring the range still has to send
+	resp.Body = io.NopCloser(io.LimitReader(resp.Body, validateSourceBytes))
+	validatedBody, err := validateImageFile(resp)
+	if err != nil {
+		return SourceValidation{Error: err.Error()}, nil
+	}
+	prefix, err := io.ReadAll(validatedBody)
+	if err != nil {
+		return SourceValidation{}, sourceUnavailable(err)
+	}
+
+	format := sourceSignatureFormat(prefix)
+	if format == "" {
+		// Only declared SVGs pass the signature check without a binary signature
+		format = "svg"
+	}
+	return SourceValidation{Valid: true, Format: format, BytesRead: len(prefix)}, nil
+}
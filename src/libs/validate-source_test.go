@@ -0,0 +1,100 @@
+package libs
+
+import (
+	"bytes"
+	"imgop/src/helpers"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSourceSignatureFormat(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		expected string
+	}{
+		{name: "Jpeg", data: []byte{0xFF, 0xD8, 0xFF, 0xE0}, expected: "jpeg"},
+		{name: "Png", data: []byte{0x89, 0x50, 0x4E, 0x47}, expected: "png"},
+		{name: "Gif", data: []byte("GIF89a"), expected: "gif"},
+		{name: "Webp", data: []byte("RIFF\x00\x00\x00\x00WEBP"), expected: "webp"},
+		{name: "Bmp", data: []byte("BM\x00\x00"), expected: "bmp"},
+		{name: "Tiff", data: []byte{0x49, 0x49, 0x2A, 0x00}, expected: "tiff"},
+		{name: "Heif", data: []byte("\x00\x00\x00\x18ftypheic"), expected: "heif"},
+		{name: "Html", data: []byte("<!doctype html>"), expected: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, sourceSignatureFormat(tt.data))
+		})
+	}
+}
+
+func TestValidateSource(t *testing.T) {
+	jpegBody := append([]byte{0xFF, 0xD8, 0xFF, 0xE0, 0x00, 0x10, 0x4A, 0x46, 0x49, 0x46, 0x00, 0x01}, make([]byte, 1<<20)...)
+	svgBody := []byte(`<svg xmlns="http://www.w3.org/2000/svg" width="10" height="10"></svg>`)
+
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		switch r.URL.Path {
+		case "/photo.jpg":
+			w.Header().Set("Content-Type", "image/jpeg")
+			http.ServeContent(w, r, "photo.jpg", time.Time{}, bytes.NewReader(jpegBody))
+		case "/no-range.jpg":
+			// Ignores the range and sends the whole image
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Write(jpegBody)
+		case "/logo.svg":
+			w.Header().Set("Content-Type", "image/svg+xml")
+			w.Write(svgBody)
+		case "/page.html":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<!doctype html><html></html>"))
+		case "/disguised.jpg":
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Write([]byte("<!doctype html><html></html>"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	tests := []struct {
+		name          string
+		path          string
+		expected      SourceValidation
+		errorContains string
+	}{
+		{name: "Jpeg", path: "/photo.jpg", expected: SourceValidation{Valid: true, Format: "jpeg", BytesRead: validateSourceBytes}},
+		{name: "Origin ignoring the range", path: "/no-range.jpg", expected: SourceValidation{Valid: true, Format: "jpeg", BytesRead: validateSourceBytes}},
+		{name: "Svg", path: "/logo.svg", expected: SourceValidation{Valid: true, Format: "svg", BytesRead: len(svgBody)}},
+		{name: "Html page", path: "/page.html", expected: SourceValidation{Error: "origin returned non-image content: invalid content type: text/html"}},
+		{name: "Html declared as jpeg", path: "/disguised.jpg", expected: SourceValidation{Error: "origin returned non-image content: invalid image file signature"}},
+		{name: "Missing source", path: "/missing.jpg", errorContains: "unexpected origin status: 404"},
+	}
+
+	imgop := NewImageOptimizer()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ranges = nil
+			validation, err := imgop.ValidateSource(helpers.ParamsOptimize{Url: server.URL + tt.path})
+			if tt.errorContains != "" {
+				assert.ErrorContains(t, err, tt.errorContains)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, validation)
+			assert.Equal(t, []string{"bytes=0-4095"}, ranges)
+		})
+	}
+}
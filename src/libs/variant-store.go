@@ -0,0 +1,85 @@
+package libs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"imgop/src/helpers"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// ErrVariantNotRendered is returned when the source couldn't be optimized, nothing is stored
+var ErrVariantNotRendered = errors.New("variant could not be rendered")
+
+// Deadline of the S3 calls storing a variant, the render itself isn't bounded by it
+const variantStoreTimeout = 10 * time.Second
+
+// StoredVariant is an optimized variant written to VARIANTS_BUCKET
+type StoredVariant struct {
+	Url         string `json:"url"`
+	Bucket      string `json:"bucket"`
+	Key         string `json:"key"`
+	ContentType string `json:"content_type"`
+	Bytes       int64  `json:"bytes"`
+	Created     bool   `json:"created"` // False when the variant was already stored
+}
+
+// StoreVariant renders the variant and writes it to VARIANTS_BUCKET under its param hash,
+// so a CDN in front of the bucket serves it from then on. A variant already stored under
+// the key is returned without rendering it again, unless NoCache asks for a fresh render
+// replacing it. Placeholder fallbacks are never stored.
+func (imgop *ImageOptimizerHandler) StoreVariant(params helpers.ParamsOptimize) (StoredVariant, error) {
+	appEnv := helpers.GetAppEnv()
+	client, err := imgop.s3Client()
+	if err != nil {
+		return StoredVariant{}, err
+	}
+
+	variant := StoredVariant{
+		Bucket: appEnv.VARIANTS_BUCKET,
+		Key:    helpers.VariantKey(params, appEnv.VARIANTS_PREFIX),
+	}
+	variant.Url = appEnv.VARIANTS_BASE_URL + "/" + variant.Key
+
+	if !params.NoCache {
+		ctx, cancel := context.WithTimeout(context.Background(), variantStoreTimeout)
+		defer cancel()
+		head, err := client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(variant.Bucket), Key: aws.String(variant.Key)})
+		if err == nil {
+			variant.ContentType = aws.ToString(head.ContentType)
+			variant.Bytes = aws.ToInt64(head.ContentLength)
+			return variant, nil
+		}
+	}
+
+	result, err := imgop.Optimize(params)
+	if err != nil {
+		return StoredVariant{}, fmt.Errorf("%w: %w", ErrVariantNotRendered, err)
+	}
+	if result.Fallback {
+		return StoredVariant{}, ErrVariantNotRendered
+	}
+
+	variant.ContentType = helpers.ContentType(result.Encoder.Format)
+	variant.Bytes = int64(len(result.Image))
+	// The render may have used up the first deadline
+	putCtx, putCancel := context.WithTimeout(context.Background(), variantStoreTimeout)
+	defer putCancel()
+	_, err = client.PutObject(putCtx, &s3.PutObjectInput{
+		Bucket:        aws.String(variant.Bucket),
+		Key:           aws.String(variant.Key),
+		Body:          bytes.NewReader(result.Image),
+		ContentType:   aws.String(variant.ContentType),
+		ContentLength: aws.Int64(variant.Bytes),
+		CacheControl:  aws.String(helpers.CacheControl(31536000)),
+	})
+	if err != nil {
+		return StoredVariant{}, fmt.Errorf("failed to store variant: %w", err)
+	}
+	variant.Created = true
+	return variant, nil
+}
@@ -0,0 +1,115 @@
+package libs
+
+import (
+	"errors"
+	"imgop/src/helpers"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/cshum/vipsgen/vips"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreVariant(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	t.Setenv("SECRET_KEY", "test-imgop-key")
+	t.Setenv("ALLOWED_BUCKETS", "private-assets")
+	t.Setenv("VARIANTS_BUCKET", "variants")
+	t.Setenv("VARIANTS_PREFIX", "v/")
+	t.Setenv("VARIANTS_BASE_URL", "https://cdn.example.com/")
+	helpers.ResetAppEnvForTesting()
+	defer helpers.ResetAppEnvForTesting()
+
+	source, err := vips.NewBlack(40, 20, &vips.BlackOptions{Bands: 3})
+	require.NoError(t, err)
+	defer source.Close()
+	sourceJpeg, err := source.JpegsaveBuffer(nil)
+	require.NoError(t, err)
+
+	params := helpers.ParamsOptimize{Url: "s3://private-assets/a.jpg", Width: 20, Quality: 80}
+	key := helpers.VariantKey(params, "v/")
+
+	t.Run("Renders and stores the variant", func(t *testing.T) {
+		stub := &stubS3{objects: map[string][]byte{"private-assets/a.jpg": sourceJpeg}, contentType: "image/jpeg"}
+		variant, err := newS3StubOptimizer(stub).StoreVariant(params)
+		require.NoError(t, err)
+
+		assert.True(t, variant.Created)
+		assert.Equal(t, "https://cdn.example.com/"+key, variant.Url)
+		assert.Equal(t, "variants", variant.Bucket)
+		assert.Equal(t, key, variant.Key)
+		assert.Equal(t, "image/webp", variant.ContentType)
+
+		require.Len(t, stub.puts, 1)
+		assert.Equal(t, "image/webp", aws.ToString(stub.puts[0].ContentType))
+		stored := stub.objects["variants/"+key]
+		require.NotEmpty(t, stored)
+		assert.Equal(t, int64(len(stored)), variant.Bytes)
+		assert.Equal(t, "WEBP", string(stored[8:12]))
+
+		image, err := vips.NewImageFromBuffer(stored, nil)
+		require.NoError(t, err)
+		defer image.Close()
+		assert.Equal(t, 20, image.Width())
+		assert.Equal(t, 10, image.Height())
+	})
+
+	t.Run("Stored variant is not rendered again", func(t *testing.T) {
+		stub := &stubS3{objects: map[string][]byte{"variants/" + key: []byte("stored")}, contentType: "image/webp"}
+		variant, err := newS3StubOptimizer(stub).StoreVariant(params)
+		require.NoError(t, err)
+
+		assert.False(t, variant.Created)
+		assert.Equal(t, "https://cdn.example.com/"+key, variant.Url)
+		assert.Equal(t, int64(6), variant.Bytes)
+		assert.Equal(t, []string{"variants/" + key}, stub.requests, "the source is never read")
+		assert.Empty(t, stub.puts)
+	})
+
+	t.Run("NoCache renders over the stored variant", func(t *testing.T) {
+		stub := &stubS3{objects: map[string][]byte{
+			"private-assets/a.jpg": sourceJpeg,
+			"variants/" + key:      []byte("stale"),
+		}, contentType: "image/jpeg"}
+		imgop := newS3StubOptimizer(stub)
+		fresh := params
+		fresh.NoCache = true
+
+		variant, err := imgop.StoreVariant(fresh)
+		require.NoError(t, err)
+		assert.True(t, variant.Created)
+		assert.Equal(t, key, variant.Key, "the fresh render replaces the same variant")
+		assert.NotContains(t, stub.requests, "variants/"+key, "the stored variant is never read")
+		require.Len(t, stub.puts, 1)
+		assert.Equal(t, "WEBP", string(stub.objects["variants/"+key][8:12]))
+
+		// The bypass only lasts for the request, the next store hits the fresh variant
+		stub.requests = nil
+		variant, err = imgop.StoreVariant(params)
+		require.NoError(t, err)
+		assert.False(t, variant.Created)
+		assert.Equal(t, []string{"variants/" + key}, stub.requests)
+		assert.Len(t, stub.puts, 1)
+	})
+
+	t.Run("Write failure", func(t *testing.T) {
+		stub := &stubS3{
+			objects:     map[string][]byte{"private-assets/a.jpg": sourceJpeg},
+			contentType: "image/jpeg",
+			putErr:      errors.New("AccessDenied"),
+		}
+		_, err := newS3StubOptimizer(stub).StoreVariant(params)
+		assert.ErrorContains(t, err, "failed to store variant: AccessDenied")
+	})
+
+	t.Run("Source that can't be rendered stores nothing", func(t *testing.T) {
+		stub := &stubS3{objects: map[string][]byte{}, contentType: "image/jpeg"}
+		_, err := newS3StubOptimizer(stub).StoreVariant(params)
+		assert.ErrorIs(t, err, ErrVariantNotRendered)
+		assert.Empty(t, stub.puts)
+	})
+}
@@ -0,0 +1,85 @@
+package libs
+
+import (
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/cshum/vipsgen/vips"
+)
+
+// Cap on the warnings kept per request, a broken source can emit one per scanline
+const maxVipsWarnings = 20
+
+// warningCollector gathers the libvips warnings emitted while a request is optimized.
+// A Lambda instance handles one request at a time, so warnings are attributed to the
+// request that is in flight.
+type warningCollector struct {
+	mu        sync.Mutex
+	url       string
+	requestID string
+	active    bool
+	warnings  []string
+}
+
+var vipsWarnings = &warningCollector{}
+
+// CaptureVipsWarnings routes libvips warnings (and worse) into the structured log and the
+// collector, libvips otherwise prints them to stderr where they are easy to miss
+func CaptureVipsWarnings() {
+	vips.SetLogging(handleVipsLog, vips.LogLevelWarning)
+}
+
+func handleVipsLog(domain string, level vips.LogLevel, message string) {
+	message = strings.TrimSpace(message)
+	url := vipsWarnings.add(message)
+	if len(url) > 200 {
+		// data: URLs carry the whole image
+		url = url[:200] + "..."
+	}
+	slog.Warn("libvips warning", "domain", domain, "level", int(level), "message", message, "url", url,
+		"request_id", vipsWarnings.currentRequestID())
+}
+
+// begin starts collecting warnings for the source url, dropping anything left over
+func (c *warningCollector) begin(url string, requestID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.url = url
+	c.requestID = requestID
+	c.active = true
+	c.warnings = nil
+}
+
+// add records the warning for the request in flight and returns its url
+func (c *warningCollector) add(message string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.active {
+		return ""
+	}
+	if len(c.warnings) < maxVipsWarnings && !slices.Contains(c.warnings, message) {
+		c.warnings = append(c.warnings, message)
+	}
+	return c.url
+}
+
+// currentRequestID returns the ID of the request in flight, empty outside of one
+func (c *warningCollector) currentRequestID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.requestID
+}
+
+// end stops collecting and returns the warnings, calling it again returns nothing
+func (c *warningCollector) end() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	warnings := c.warnings
+	c.url = ""
+	c.requestID = ""
+	c.active = false
+	c.warnings = nil
+	return warnings
+}
@@ -0,0 +1,43 @@
+package libs
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWarningCollector(t *testing.T) {
+	c := &warningCollector{}
+
+	// Nothing is recorded outside a request
+	assert.Empty(t, c.add("stray"))
+
+	c.begin("https://example.com/a.jpg", "req-1")
+	assert.Equal(t, "https://example.com/a.jpg", c.add("premature end of JPEG file"))
+	assert.Equal(t, "req-1", c.currentRequestID())
+	c.add("premature end of JPEG file")
+	c.add("ignoring unknown chunk")
+	assert.Equal(t, []string{"premature end of JPEG file", "ignoring unknown chunk"}, c.end())
+	assert.Empty(t, c.currentRequestID(), "the ID ends with the request")
+
+	// A second end, e.g. the deferred one, returns nothing
+	assert.Empty(t, c.end())
+}
+
+func TestWarningCollector_Capped(t *testing.T) {
+	c := &warningCollector{}
+	c.begin("https://example.com/a.jpg", "req-1")
+	for i := 0; i < maxVipsWarnings*2; i++ {
+		c.add(fmt.Sprintf("warning %d", i))
+	}
+	assert.Len(t, c.end(), maxVipsWarnings)
+}
+
+func TestWarningCollector_BeginDropsLeftovers(t *testing.T) {
+	c := &warningCollector{}
+	c.begin("https://example.com/a.jpg", "req-1")
+	c.add("from the previous request")
+	c.begin("https://example.com/b.jpg", "req-2")
+	assert.Empty(t, c.end())
+}
@@ -3,9 +3,16 @@ package main
 import (
 	"context"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"maps"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 
 	"imgop/src/helpers"
 	libs "imgop/src/libs"
@@ -22,12 +29,26 @@ type ImageRequest struct {
 }
 
 var optimizer *libs.ImageOptimizerHandler
+var admission *libs.AdmissionControl
 
 func init() {
 	optimizer = libs.NewImageOptimizer()
+	libs.CaptureVipsWarnings()
 }
 
+// handler echoes the request ID on every response, including errors, so a response can
+// be matched with its log lines
 func handler(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	requestID := helpers.RequestID(helpers.GetHeaders(req.Headers))
+	response, err := handle(ctx, req, requestID)
+	if response.Headers == nil {
+		response.Headers = map[string]string{}
+	}
+	response.Headers[helpers.RequestIDHeader] = requestID
+	return response, err
+}
+
+func handle(ctx context.Context, req events.APIGatewayProxyRequest, requestID string) (events.APIGatewayProxyResponse, error) {
 	// Check authentication
 	appEnv := helpers.GetAppEnv()
 	reqHeaders := helpers.GetHeaders(req.Headers)
@@ -37,17 +58,172 @@ func handler(ctx context.Context, req events.APIGatewayProxyRequest) (events.API
 	}
 
 	qParams := req.QueryStringParameters
-	width, err1 := helpers.ParseParams[int](qParams, "w")
-	height, err2 := helpers.ParseParams[int](qParams, "h")
-	quality, _ := helpers.ParseParams[int](qParams, "q")
+	if appEnv.STRICT_PARAMS {
+		// Typos like widht=800 would otherwise be silently ignored
+		if unknown := helpers.UnknownParams(qParams); len(unknown) > 0 {
+			errUnknown := helpers.NewValidationError(helpers.ErrCodeUnknownParameter, strings.Join(unknown, ","), "unknown parameters: %s", strings.Join(unknown, ", "))
+			return helpers.ErrResponse(errUnknown, http.StatusUnprocessableEntity)
+		}
+	}
+	// Seed stores a batch of variants listed in the body, the query only switches it on
+	if seed, _ := helpers.ParseParams[int](qParams, "seed"); seed == 1 {
+		return seedResponse(ctx, req, requestID)
+	}
+	// All optional, 0 keeps the source size of that axis and the quality is DEFAULT_QUALITY
+	width, errWidth := helpers.ParseParams[int](qParams, "w")
+	if _, ok := qParams["w"]; ok && errWidth != nil {
+		return helpers.ErrResponse(errWidth, http.StatusUnprocessableEntity)
+	}
+	height, errHeight := helpers.ParseParams[int](qParams, "h")
+	if _, ok := qParams["h"]; ok && errHeight != nil {
+		return helpers.ErrResponse(errHeight, http.StatusUnprocessableEntity)
+	}
+	quality, errQuality := helpers.ParseParams[int](qParams, "q")
+	if _, ok := qParams["q"]; ok && errQuality != nil {
+		return helpers.ErrResponse(errQuality, http.StatusUnprocessableEntity)
+	}
+
+	dpr, errDpr := helpers.ParseParams[float64](qParams, "dpr")
+	if _, ok := qParams["dpr"]; ok && errDpr != nil {
+		return helpers.ErrResponse(errDpr, http.StatusUnprocessableEntity)
+	}
+
+	rotate, errRotate := helpers.ParseParams[float64](qParams, "rotate")
+	if _, ok := qParams["rotate"]; ok && errRotate != nil {
+		return helpers.ErrResponse(errRotate, http.StatusUnprocessableEntity)
+	}
+	orient, _ := helpers.ParseParams[string](qParams, "orient")
+
+	density, errDensity := helpers.ParseParams[int](qParams, "density")
+	if _, ok := qParams["density"]; ok && errDensity != nil {
+		return helpers.ErrResponse(errDensity, http.StatusUnprocessableEntity)
+	}
+
+	alphaQuality, errAlphaQuality := helpers.ParseParams[int](qParams, "aq")
+	if _, ok := qParams["aq"]; ok && errAlphaQuality != nil {
+		return helpers.ErrResponse(errAlphaQuality, http.StatusUnprocessableEntity)
+	}
+	preset, _ := helpers.ParseParams[string](qParams, "preset")
+	optimization, _ := helpers.ParseParams[string](qParams, "optimize")
+	fit, _ := helpers.ParseParams[string](qParams, "fit")
+	undersize, _ := helpers.ParseParams[string](qParams, "undersize")
+	gravity, _ := helpers.ParseParams[string](qParams, "gravity")
+
+	enlarge, errEnlarge := helpers.ParseParams[bool](qParams, "enlarge")
+	if _, ok := qParams["enlarge"]; ok && errEnlarge != nil {
+		return helpers.ErrResponse(errEnlarge, http.StatusUnprocessableEntity)
+	}
+	// Upscaling only blurs and bloats the output, the source size is the cap unless enlarge=true
+	withoutEnlargement := errEnlarge != nil || !enlarge
+
+	trim, errTrim := helpers.ParseParams[bool](qParams, "trim")
+	if _, ok := qParams["trim"]; ok && errTrim != nil {
+		return helpers.ErrResponse(errTrim, http.StatusUnprocessableEntity)
+	}
+	trimThreshold, errTrimThreshold := helpers.ParseParams[int](qParams, "trimthreshold")
+	if _, ok := qParams["trimthreshold"]; ok && errTrimThreshold != nil {
+		return helpers.ErrResponse(errTrimThreshold, http.StatusUnprocessableEntity)
+	}
+	var background []float64
+	if backgroundParam, ok := qParams["bg"]; ok {
+		color, errBackground := helpers.ParseColor("bg", backgroundParam)
+		if errBackground != nil {
+			return helpers.ErrResponse(errBackground, http.StatusUnprocessableEntity)
+		}
+		background = color
+	}
+
+	var trimColor []float64
+	if trimColorParam, ok := qParams["trimcolor"]; ok {
+		color, errTrimColor := helpers.ParseColor("trimcolor", trimColorParam)
+		if errTrimColor != nil {
+			return helpers.ErrResponse(errTrimColor, http.StatusUnprocessableEntity)
+		}
+		trimColor = color
+	}
+
+	var aspectRatio float64
+	if aspectRatioParam, ok := qParams["ar"]; ok {
+		ratio, errAspectRatio := helpers.ParseAspectRatio("ar", aspectRatioParam)
+		if errAspectRatio != nil {
+			return helpers.ErrResponse(errAspectRatio, http.StatusUnprocessableEntity)
+		}
+		aspectRatio = ratio
+	}
 
-	if width+height == 0 {
-		if err1 != nil {
-			return helpers.ErrResponse(err1, http.StatusUnprocessableEntity)
+	var pipeline []helpers.PipelineOp
+	if pipelineParam, ok := qParams["pipeline"]; ok {
+		ops, errPipeline := helpers.ParsePipeline("pipeline", pipelineParam)
+		if errPipeline != nil {
+			return helpers.ErrResponse(errPipeline, http.StatusUnprocessableEntity)
 		}
-		if err2 != nil {
-			return helpers.ErrResponse(err2, http.StatusUnprocessableEntity)
+		pipeline = ops
+	}
+
+	var keepMeta []string
+	if keepMetaParam, ok := qParams["keep_meta"]; ok {
+		namespaces, errKeepMeta := helpers.ParseKeepMeta("keep_meta", keepMetaParam)
+		if errKeepMeta != nil {
+			return helpers.ErrResponse(errKeepMeta, http.StatusUnprocessableEntity)
 		}
+		keepMeta = namespaces
+	}
+
+	keepMetadata, errKeepMetadata := helpers.ParseParams[bool](qParams, "keep_metadata")
+	if _, ok := qParams["keep_metadata"]; ok && errKeepMetadata != nil {
+		return helpers.ErrResponse(errKeepMetadata, http.StatusUnprocessableEntity)
+	}
+	// EXIF can leak GPS coordinates and only adds bytes once the pixels are upright, it is
+	// stripped unless asked for or orient=preserve needs the orientation tag downstream
+	stripMetadata := !keepMetadata && orient != "preserve"
+
+	progressive, errProgressive := helpers.ParseParams[bool](qParams, "progressive")
+	if _, ok := qParams["progressive"]; ok && errProgressive != nil {
+		return helpers.ErrResponse(errProgressive, http.StatusUnprocessableEntity)
+	}
+
+	thumbnail, errThumbnail := helpers.ParseParams[bool](qParams, "thumbnail")
+	if _, ok := qParams["thumbnail"]; ok && errThumbnail != nil {
+		return helpers.ErrResponse(errThumbnail, http.StatusUnprocessableEntity)
+	}
+
+	swatch, _ := helpers.ParseParams[int](qParams, "swatch")
+	useEmbeddedThumb, _ := helpers.ParseParams[int](qParams, "use_embedded_thumb")
+	lqip, _ := helpers.ParseParams[int](qParams, "lqip")
+	email, _ := helpers.ParseParams[int](qParams, "email")
+	quantTable, _ := helpers.ParseParams[string](qParams, "qtable")
+	autoSharpen, _ := helpers.ParseParams[string](qParams, "auto_sharpen")
+	sourceFormat, _ := helpers.ParseParams[string](qParams, "src_fmt")
+	format, _ := helpers.ParseParams[string](qParams, "f")
+	// An explicit f wins, a list is a preference chain resolved against the Accept header,
+	// otherwise the format is the best one the client accepts. f=auto negotiates as well,
+	// then lets the optimizer pick lossless WebP for graphics.
+	contentAware := strings.EqualFold(format, "auto")
+	negotiated := format == "" || contentAware || strings.Contains(format, ",")
+	if format == "" || contentAware {
+		format = helpers.NegotiateFormat(reqHeaders["accept"], appEnv.OUTPUT_FORMATS)
+	} else if negotiated {
+		chain, errChain := helpers.ParseFormatChain(format)
+		if errChain != nil {
+			return helpers.ErrResponse(errChain, http.StatusUnprocessableEntity)
+		}
+		format = helpers.ResolveFormatChain(chain, reqHeaders["accept"], appEnv.OUTPUT_FORMATS)
+	}
+	size, _ := helpers.ParseParams[int](qParams, "size")
+	recommend, _ := helpers.ParseParams[int](qParams, "recommend")
+	validate, _ := helpers.ParseParams[int](qParams, "validate")
+	previewCrop, _ := helpers.ParseParams[int](qParams, "preview_crop")
+	store, _ := helpers.ParseParams[int](qParams, "store")
+	noCache, _ := helpers.ParseParams[int](qParams, "nocache")
+
+	debug, _ := helpers.ParseParams[int](qParams, "debug")
+	// Introspection modes don't exist unless the deployment enables them, and the optimizer
+	// trace only exists for trusted callers on top
+	if helpers.RequestedDebugMode(qParams) != "" && !appEnv.ENABLE_DEBUG_MODES {
+		return helpers.ErrResponse(fmt.Errorf("not found"), http.StatusNotFound)
+	}
+	if debug == 1 && !helpers.IsTrustedRequest(reqHeaders) {
+		return helpers.ErrResponse(fmt.Errorf("not found"), http.StatusNotFound)
 	}
 
 	urlParams, err4 := helpers.ParseParams[string](qParams, "url")
@@ -56,11 +232,11 @@ func handler(ctx context.Context, req events.APIGatewayProxyRequest) (events.API
 	}
 	urlParams, err5 := url.QueryUnescape(urlParams)
 	if err5 != nil {
-		return helpers.ErrResponse(err5, http.StatusUnprocessableEntity)
+		return helpers.ErrResponse(helpers.NewValidationError(helpers.ErrCodeInvalidUrl, "url", "%s", err5.Error()), http.StatusUnprocessableEntity)
 	}
-	isValidUrl := helpers.IsAllowedOrigin(urlParams)
+	isValidUrl := helpers.IsDataUrl(urlParams) || helpers.IsAllowedOrigin(urlParams) || helpers.IsAllowedBucket(urlParams)
 	if !isValidUrl {
-		return helpers.ErrResponse(fmt.Errorf("invalid url allowed origin"), http.StatusUnprocessableEntity)
+		return helpers.ErrResponse(helpers.NewValidationError(helpers.ErrCodeInvalidUrl, "url", "invalid url allowed origin"), http.StatusUnprocessableEntity)
 	}
 
 	imageParams := helpers.ParamsOptimize{
@@ -68,26 +244,412 @@ func handler(ctx context.Context, req events.APIGatewayProxyRequest) (events.API
 		Width:   width,
 		Height:  height,
 		Quality: quality,
+		Rotate:  rotate,
+		Orient:  orient,
+		Density: density,
+		Dpr:     dpr,
+
+		Format:       strings.ToLower(format),
+		ContentAware: contentAware,
+		Preset:       preset,
+		AlphaQuality: alphaQuality,
+		Optimization: optimization,
+
+		WithoutEnlargement: withoutEnlargement,
+		Fit:                fit,
+		Undersize:          undersize,
+		Gravity:            strings.ToLower(gravity),
+		Progressive:        progressive,
+
+		Trim:          trim,
+		TrimColor:     trimColor,
+		TrimThreshold: trimThreshold,
+
+		AspectRatio: aspectRatio,
+		Pipeline:    pipeline,
+
+		QuantTable: quantTable,
+
+		AutoSharpen:  autoSharpen,
+		SourceFormat: strings.ToLower(sourceFormat),
+		NoCache:      noCache == 1,
+
+		StripMetadata: stripMetadata,
+
+		UseEmbeddedThumb: useEmbeddedThumb == 1,
+		KeepMeta:         keepMeta,
+		Lqip:             lqip == 1,
+
+		Background: background,
+		Thumbnail:  thumbnail,
+		Swatch:     swatch == 1,
+		Email:      email == 1,
+		Trusted:    helpers.IsTrustedRequest(reqHeaders),
+		RequestID:  requestID,
 	}
 
+	if errPresent := helpers.ValidatePresentParams(qParams, imageParams); errPresent != nil {
+		return helpers.ErrResponse(errPresent, http.StatusUnprocessableEntity)
+	}
 	imageParams, errImg := helpers.ValidateParams(imageParams)
 	if errImg != nil {
 		return helpers.ErrResponse(errImg, http.StatusUnprocessableEntity)
 	}
 
-	imageBytes := optimizer.Optimize(imageParams)
-	cacheTime := "31536000" // 1 year cache
+	// Variants are only stored where the deployment configured a bucket
+	if store == 1 && appEnv.VARIANTS_BUCKET == "" {
+		return helpers.ErrResponse(helpers.NewValidationError(helpers.ErrCodeInvalidParameter, "store", "store requires VARIANTS_BUCKET"), http.StatusUnprocessableEntity)
+	}
+
+	// WebP unless f asks for another format
+	outputFormat := "webp"
+	if imageParams.Format != "" && libs.EncoderAvailable(imageParams.Format) {
+		// A format this libvips build can't encode falls back to WebP, HEAD must agree with GET
+		outputFormat = imageParams.Format
+	}
+	headers := map[string]string{
+		"Content-Type":  helpers.ContentType(outputFormat),
+		"Cache-Control": helpers.CacheControl(31536000), // 1 year cache
+	}
+
+	if negotiated {
+		// Caches must key the response on Accept, or serve AVIF to clients that can't decode it
+		headers["Vary"] = "Accept"
+	}
+
+	if imageParams.Email {
+		// Known before encoding, so HEAD responses agree with the image
+		headers["Content-Type"] = helpers.ContentType("jpeg")
+	}
+
+	if imageParams.QualityCapped {
+		// Tell the client it got less than it asked for
+		headers["X-Quality-Capped"] = strconv.Itoa(imageParams.Quality)
+	}
+
+	// Size only reads the source header, skip the decode and encode
+	if size == 1 {
+		return sizeResponse(imageParams, headers["Cache-Control"])
+	}
+
+	// Recommend only reads the source header as well
+	if recommend == 1 {
+		return recommendResponse(imageParams, headers["Cache-Control"])
+	}
+
+	// The crop preview only reads the source header as well
+	if previewCrop == 1 {
+		if errPreview := helpers.ValidatePreviewCrop(imageParams); errPreview != nil {
+			return helpers.ErrResponse(errPreview, http.StatusUnprocessableEntity)
+		}
+		return previewCropResponse(imageParams, headers["Cache-Control"])
+	}
+
+	// Validate only reads the first bytes of the source
+	if validate == 1 {
+		return validateResponse(imageParams)
+	}
+
+	// HEAD only reports headers, skip the download and encode
+	if req.HTTPMethod == http.MethodHead {
+		return headResponse(imageParams, headers)
+	}
+
+	release, errAdmission := admission.Acquire(ctx)
+	if errAdmission != nil {
+		response, _ := helpers.ErrResponse(errAdmission, http.StatusServiceUnavailable)
+		response.Headers["Retry-After"] = "1"
+		return response, nil
+	}
+	// Store writes the variant to S3 and returns where, instead of the image
+	if store == 1 {
+		variant, errStore := optimizer.StoreVariant(imageParams)
+		release()
+		return storeResponse(variant, errStore, requestID)
+	}
+	result, errOptimize := optimizer.Optimize(imageParams)
+	release()
+	if errOptimize != nil {
+		return sourceErrResponse(errOptimize, requestID)
+	}
+
+	// Debug returns the optimizer decisions instead of the image
+	if debug == 1 {
+		response, err := helpers.JSONResponse(result, http.StatusOK)
+		if len(result.Warnings) > 0 {
+			response.Headers["X-Image-Warnings"] = helpers.HeaderValue(strings.Join(result.Warnings, "; "), 1024)
+		}
+		return response, err
+	}
+	if result.Fallback {
+		// Placeholder for a source that couldn't be optimized, cache it briefly so a fixed origin recovers quickly
+		headers["Cache-Control"] = helpers.CacheControl(appEnv.FALLBACK_CACHE_TTL)
+		headers["X-Image-Fallback"] = "placeholder"
+	}
+	if result.ProgressiveIgnored {
+		// Not an error, the image is still usable, just not progressive
+		headers["X-Progressive-Ignored"] = result.Encoder.Format
+	}
+	if result.FormatFallback != "" {
+		headers["X-Format-Fallback"] = result.FormatFallback
+	}
+	if result.Passthrough {
+		headers["X-Image-Passthrough"] = result.SourceFormat
+	}
+	if result.DominantColor != "" {
+		headers["X-Dominant-Color"] = result.DominantColor
+	}
+	if result.Lqip != "" {
+		headers["X-LQIP"] = result.Lqip
+	}
+	// The placeholder hash doesn't identify the requested image, so it gets no validator
+	if result.SourceHash != "" && !result.Fallback {
+		etag := helpers.ETag(imageParams, result.SourceHash)
+		headers["ETag"] = etag
+		if ifNoneMatch, ok := reqHeaders["if-none-match"]; ok && helpers.MatchesETag(ifNoneMatch, etag) {
+			// Client (or CDN) copy is still current, skip the body
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusNotModified,
+				Headers:    headers,
+			}, nil
+		}
+	}
+	if result.Encoder.Format != "" {
+		// Always report the format that was actually encoded
+		headers["Content-Type"] = helpers.ContentType(result.Encoder.Format)
+		headers["X-Output-Format"] = result.Encoder.Format
+	}
+	maps.Copy(headers, helpers.SizeHeaders(result.SourceBytes, len(result.Image)))
+	for name, value := range result.ForwardedHeaders {
+		// Our own headers always win over forwarded ones
+		if _, exists := headers[name]; !exists {
+			headers[name] = value
+		}
+	}
+	if result.AspectDistorted {
+		// Not an error, but fill squashed the image more than the threshold allows
+		headers["X-Aspect-Distorted"] = strconv.FormatFloat(result.AspectDistortion, 'f', 2, 64)
+	}
+	if result.EnlargeCapped {
+		// Requested size was above the source, tell the client why it got less
+		headers["X-Max-Source-Size"] = fmt.Sprintf("%dx%d", result.OriginalWidth, result.OriginalHeight)
+	}
+	requestedDpr := dpr
+	if requestedDpr == 0 && appEnv.DEFAULT_DPR != 1 {
+		// The deployment default is capped like a requested dpr
+		requestedDpr = appEnv.DEFAULT_DPR
+	}
+	if requestedDpr != 0 && !result.Fallback && !result.Passthrough {
+		// MAX_WIDTH/MAX_HEIGHT or the source size capped the dpr, tell the client what it got instead
+		if effectiveDpr, capped := helpers.EffectiveDpr(requestedDpr, imageParams.Fit, width, height, result.Width, result.Height); capped {
+			headers["X-Effective-DPR"] = strconv.FormatFloat(effectiveDpr, 'f', 2, 64)
+		}
+	}
+
 	return events.APIGatewayProxyResponse{
 		StatusCode:      http.StatusOK,
-		Body:            base64.StdEncoding.EncodeToString(imageBytes),
+		Body:            base64.StdEncoding.EncodeToString(result.Image),
 		IsBase64Encoded: true,
-		Headers: map[string]string{
-			"Content-Type":  "image/webp",
-			"Cache-Control": "public, max-age=" + cacheTime + ", s-maxage=" + cacheTime, // 1 year cache
-		},
+		Headers:         headers,
+	}, nil
+}
+
+// sourceErrorStatus is the status of a failed source read, 422 for params the image turned
+// out not to allow, 403 for an origin outside the allowlist, 504 when the origin didn't answer
+// in time, 415 for a source libvips can't decode, 502 for everything else the origin got wrong
+// and 500 when we failed on our side
+func sourceErrorStatus(err error) int {
+	var validationErr *helpers.ValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, helpers.ErrOriginNotAllowed):
+		return http.StatusForbidden
+	case libs.IsTimeout(err):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, helpers.ErrUnsupportedMedia):
+		return http.StatusUnsupportedMediaType
+	case libs.IsSourceError(err):
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+// sourceErrResponse answers a failed source read, cached briefly so a fixed origin recovers
+// quickly. Our own failures are left uncached and only described in the log.
+func sourceErrResponse(err error, requestID string) (events.APIGatewayProxyResponse, error) {
+	statusCode := sourceErrorStatus(err)
+	response, _ := helpers.ErrResponse(err, statusCode)
+	if statusCode == http.StatusInternalServerError {
+		slog.Error("request failed", "error", err.Error(), "request_id", requestID)
+		return response, nil
+	}
+	response.Headers["Cache-Control"] = helpers.CacheControl(helpers.GetAppEnv().FALLBACK_CACHE_TTL)
+	return response, nil
+}
+
+func sizeResponse(imageParams helpers.ParamsOptimize, cacheControl string) (events.APIGatewayProxyResponse, error) {
+	dimensions, err := optimizer.SourceDimensions(imageParams)
+	if err != nil {
+		return sourceErrResponse(err, imageParams.RequestID)
+	}
+
+	response, err := helpers.JSONResponse(dimensions, http.StatusOK)
+	if response.StatusCode == http.StatusOK {
+		// Dimensions are as stable as the image they describe
+		response.Headers["Cache-Control"] = cacheControl
+	}
+	return response, err
+}
+
+func recommendResponse(imageParams helpers.ParamsOptimize, cacheControl string) (events.APIGatewayProxyResponse, error) {
+	recommendation, err := optimizer.Recommend(imageParams)
+	if err != nil {
+		return sourceErrResponse(err, imageParams.RequestID)
+	}
+
+	response, err := helpers.JSONResponse(recommendation, http.StatusOK)
+	if response.StatusCode == http.StatusOK {
+		// Derived from the image header only, as stable as the image
+		response.Headers["Cache-Control"] = cacheControl
+	}
+	return response, err
+}
+
+func previewCropResponse(imageParams helpers.ParamsOptimize, cacheControl string) (events.APIGatewayProxyResponse, error) {
+	preview, err := optimizer.PreviewCrop(imageParams)
+	if err != nil {
+		return sourceErrResponse(err, imageParams.RequestID)
+	}
+
+	response, err := helpers.JSONResponse(preview, http.StatusOK)
+	if response.StatusCode == http.StatusOK {
+		// Derived from the image header and the params, as stable as the image
+		response.Headers["Cache-Control"] = cacheControl
+	}
+	return response, err
+}
+
+func storeResponse(variant libs.StoredVariant, err error, requestID string) (events.APIGatewayProxyResponse, error) {
+	if err != nil {
+		return sourceErrResponse(err, requestID)
+	}
+
+	statusCode := http.StatusOK
+	if variant.Created {
+		statusCode = http.StatusCreated
+	}
+	response, err := helpers.JSONResponse(variant, statusCode)
+	if response.StatusCode == statusCode {
+		response.Headers["Location"] = variant.Url
+	}
+	return response, err
+}
+
+// seedOutcome is the store=1 response of one seed item, the stored variant or the error
+type seedOutcome struct {
+	Params map[string]string `json:"params"`
+	Status int               `json:"status"`
+	Result json.RawMessage   `json:"result"`
+}
+
+type seedSummary struct {
+	Seeded int           `json:"seeded"`
+	Failed int           `json:"failed"`
+	Items  []seedOutcome `json:"items"`
+}
+
+// seedResponse stores each item of the body as a store=1 request with the caller's headers,
+// SEED_CONCURRENCY at a time, so the variants are warm before traffic arrives. Stored
+// variants aren't rendered again, a batch can be retried as a whole.
+func seedResponse(ctx context.Context, req events.APIGatewayProxyRequest, requestID string) (events.APIGatewayProxyResponse, error) {
+	appEnv := helpers.GetAppEnv()
+	if !helpers.IsTrustedRequest(helpers.GetHeaders(req.Headers)) {
+		return helpers.ErrResponse(fmt.Errorf("not found"), http.StatusNotFound)
+	}
+	if appEnv.VARIANTS_BUCKET == "" {
+		return helpers.ErrResponse(helpers.NewValidationError(helpers.ErrCodeInvalidParameter, "seed", "seed requires VARIANTS_BUCKET"), http.StatusUnprocessableEntity)
+	}
+
+	body := req.Body
+	if req.IsBase64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(body)
+		if err != nil {
+			return helpers.ErrResponse(helpers.NewValidationError(helpers.ErrCodeInvalidSeed, "seed", "seed body is not valid base64"), http.StatusUnprocessableEntity)
+		}
+		body = string(decoded)
+	}
+	items, err := helpers.ParseSeedItems(body, appEnv.SEED_MAX_ITEMS)
+	if err != nil {
+		return helpers.ErrResponse(err, http.StatusUnprocessableEntity)
+	}
+
+	outcomes := make([]seedOutcome, len(items))
+	slots := make(chan struct{}, appEnv.SEED_CONCURRENCY)
+	var wg sync.WaitGroup
+	for i, item := range items {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			params := maps.Clone(item)
+			params["store"] = "1"
+			response, _ := handle(ctx, events.APIGatewayProxyRequest{
+				HTTPMethod:            http.MethodGet,
+				Headers:               req.Headers,
+				QueryStringParameters: params,
+			}, requestID)
+			outcomes[i] = seedOutcome{Params: item, Status: response.StatusCode}
+			if json.Valid([]byte(response.Body)) {
+				outcomes[i].Result = json.RawMessage(response.Body)
+			}
+		}()
+	}
+	wg.Wait()
+
+	summary := seedSummary{Items: outcomes}
+	for _, outcome := range outcomes {
+		if outcome.Status == http.StatusOK || outcome.Status == http.StatusCreated {
+			summary.Seeded++
+		} else {
+			summary.Failed++
+		}
+	}
+	return helpers.JSONResponse(summary, http.StatusOK)
+}
+
+func validateResponse(imageParams helpers.ParamsOptimize) (events.APIGatewayProxyResponse, error) {
+	validation, err := optimizer.ValidateSource(imageParams)
+	if err != nil {
+		return sourceErrResponse(err, imageParams.RequestID)
+	}
+
+	// Left uncached, the origin may fix or replace the source at any time
+	return helpers.JSONResponse(validation, http.StatusOK)
+}
+
+func headResponse(imageParams helpers.ParamsOptimize, headers map[string]string) (events.APIGatewayProxyResponse, error) {
+	sourceBytes, err := optimizer.SourceSize(imageParams)
+	if err != nil {
+		response, _ := sourceErrResponse(err, imageParams.RequestID)
+		response.Body = ""
+		return response, nil
+	}
+	if sourceBytes >= 0 {
+		headers["X-Source-Bytes"] = strconv.FormatInt(sourceBytes, 10)
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Headers:    headers,
 	}, nil
 }
 
+// main reads the env, not init, so the handler tests can set it up before the first request
 func main() {
+	appEnv := helpers.GetAppEnv()
+	admission = libs.NewAdmissionControl(appEnv.MAX_CONCURRENCY, appEnv.MAX_QUEUE)
 	lambda.Start(handler)
 }
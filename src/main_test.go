@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"imgop/src/helpers"
+	libs "imgop/src/libs"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/cshum/vipsgen/vips"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testSecretKey = "test-imgop-key"
+const testTrustedKey = "test-trusted-key"
+
+// TestMain runs the handler with DEV_MODE, the httptest origins listen on random local
+// ports that can't be allowlisted up front
+func TestMain(m *testing.M) {
+	os.Setenv("SECRET_KEY", testSecretKey)
+	os.Setenv("TRUSTED_KEY", testTrustedKey)
+	os.Setenv("DEV_MODE", "true")
+	os.Exit(m.Run())
+}
+
+// setupHandler rereads the env set by the test and gives the handler a fresh optimizer,
+// as a cold start would
+func setupHandler(t *testing.T) {
+	t.Helper()
+	helpers.ResetAppEnvForTesting()
+	t.Cleanup(helpers.ResetAppEnvForTesting)
+	optimizer = libs.NewImageOptimizer()
+	admission = libs.NewAdmissionControl(0, 0)
+}
+
+// imageOrigin serves a JPEG and records the methods it was requested with
+type imageOrigin struct {
+	*httptest.Server
+	image   []byte
+	mu      sync.Mutex
+	methods []string
+}
+
+func (o *imageOrigin) requestMethods() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]string{}, o.methods...)
+}
+
+func newImageOrigin(t *testing.T, width int, height int) *imageOrigin {
+	t.Helper()
+	image, err := vips.NewBlack(width, height, &vips.BlackOptions{Bands: 3})
+	require.NoError(t, err)
+	defer image.Close()
+	jpeg, err := image.JpegsaveBuffer(nil)
+	require.NoError(t, err)
+
+	origin := &imageOrigin{image: jpeg}
+	origin.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin.mu.Lock()
+		origin.methods = append(origin.methods, r.Method)
+		origin.mu.Unlock()
+		w.Header().Set("Content-Type", "image/jpeg")
+		http.ServeContent(w, r, "image.jpg", time.Time{}, bytes.NewReader(jpeg))
+	}))
+	t.Cleanup(origin.Close)
+	return origin
+}
+
+// newRequest returns an authenticated GET with the query params, headers are added to the key
+func newRequest(params map[string]string, headers map[string]string) events.APIGatewayProxyRequest {
+	reqHeaders := map[string]string{"imgop-key": testSecretKey}
+	for name, value := range headers {
+		reqHeaders[name] = value
+	}
+	return events.APIGatewayProxyRequest{
+		HTTPMethod:            http.MethodGet,
+		Headers:               reqHeaders,
+		QueryStringParameters: params,
+	}
+}
+
+func TestHandler_DebugModes(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	origin := newImageOrigin(t, 400, 200)
+
+	trusted := map[string]string{"imgop-trusted-key": testTrustedKey}
+	tests := []struct {
+		name    string
+		params  map[string]string
+		headers map[string]string
+	}{
+		{name: "Debug", params: map[string]string{"debug": "1"}, headers: trusted},
+		{name: "Size", params: map[string]string{"size": "1"}},
+		{name: "Recommend", params: map[string]string{"recommend": "1"}},
+		{name: "Validate", params: map[string]string{"validate": "1"}},
+		{name: "Preview crop", params: map[string]string{"preview_crop": "1", "w": "100", "h": "100", "fit": "cover"}},
+	}
+
+	for _, tt := range tests {
+		params := map[string]string{"url": origin.URL}
+		for name, value := range tt.params {
+			params[name] = value
+		}
+
+		t.Run(tt.name+" is not found when off", func(t *testing.T) {
+			setupHandler(t)
+			response, err := handler(context.Background(), newRequest(params, tt.headers))
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusNotFound, response.StatusCode)
+			assert.NotContains(t, response.Body, "width", "nothing about the source leaks")
+		})
+
+		t.Run(tt.name+" works when on", func(t *testing.T) {
+			t.Setenv("ENABLE_DEBUG_MODES", "true")
+			setupHandler(t)
+			response, err := handler(context.Background(), newRequest(params, tt.headers))
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, response.StatusCode)
+			assert.Equal(t, "application/json", response.Headers["Content-Type"])
+			assert.True(t, json.Valid([]byte(response.Body)))
+		})
+	}
+
+	for _, mode := range []string{"info", "diag"} {
+		t.Run("Reserved "+mode+" is not found when off", func(t *testing.T) {
+			setupHandler(t)
+			response, err := handler(context.Background(), newRequest(map[string]string{"url": origin.URL, mode: "1"}, nil))
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusNotFound, response.StatusCode)
+		})
+	}
+}
+
+func TestHandler_DebugTrustedOnly(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	origin := newImageOrigin(t, 400, 200)
+	params := map[string]string{"url": origin.URL, "w": "100", "debug": "1"}
+
+	tests := []struct {
+		name           string
+		trustedKey     string
+		headers        map[string]string
+		expectedStatus int
+	}{
+		{name: "Trusted", trustedKey: testTrustedKey, headers: map[string]string{"imgop-trusted-key": testTrustedKey},
+			expectedStatus: http.StatusOK},
+		{name: "Anonymous", trustedKey: testTrustedKey, expectedStatus: http.StatusNotFound},
+		{name: "Wrong trusted key", trustedKey: testTrustedKey, headers: map[string]string{"imgop-trusted-key": "guess"},
+			expectedStatus: http.StatusNotFound},
+		{name: "No TRUSTED_KEY configured", headers: map[string]string{"imgop-trusted-key": ""},
+			expectedStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ENABLE_DEBUG_MODES", "true")
+			t.Setenv("TRUSTED_KEY", tt.trustedKey)
+			setupHandler(t)
+
+			response, err := handler(context.Background(), newRequest(params, tt.headers))
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedStatus, response.StatusCode)
+			if tt.expectedStatus != http.StatusOK {
+				assert.NotContains(t, response.Body, "encoder", "no trace for untrusted callers")
+				return
+			}
+			var trace libs.OptimizeResult
+			require.NoError(t, json.Unmarshal([]byte(response.Body), &trace))
+			assert.Equal(t, 100, trace.Width)
+			assert.Equal(t, "jpeg", trace.SourceFormat)
+			assert.NotContains(t, response.Body, testSecretKey)
+			assert.NotContains(t, response.Body, testTrustedKey)
+		})
+	}
+}
+
+// newFailingOrigin answers every request with the status
+func newFailingOrigin(t *testing.T, status int) *httptest.Server {
+	t.Helper()
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(origin.Close)
+	return origin
+}
+
+func TestHandler_ETag(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	setupHandler(t)
+	origin := newImageOrigin(t, 400, 200)
+	params := map[string]string{"url": origin.URL, "w": "100"}
+
+	response, err := handler(context.Background(), newRequest(params, nil))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	etag := response.Headers["ETag"]
+	require.NotEmpty(t, etag)
+	assert.Regexp(t, `^"[0-9a-f]{32}"$`, etag, "a strong validator")
+
+	t.Run("Stable across identical requests", func(t *testing.T) {
+		again, err := handler(context.Background(), newRequest(params, nil))
+		require.NoError(t, err)
+		assert.Equal(t, etag, again.Headers["ETag"])
+	})
+
+	t.Run("Changes with the params", func(t *testing.T) {
+		other, err := handler(context.Background(), newRequest(map[string]string{"url": origin.URL, "w": "120"}, nil))
+		require.NoError(t, err)
+		assert.NotEmpty(t, other.Headers["ETag"])
+		assert.NotEqual(t, etag, other.Headers["ETag"])
+	})
+
+	t.Run("Matching If-None-Match is 304 without a body", func(t *testing.T) {
+		notModified, err := handler(context.Background(), newRequest(params, map[string]string{"If-None-Match": etag}))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusNotModified, notModified.StatusCode)
+		assert.Empty(t, notModified.Body)
+		assert.False(t, notModified.IsBase64Encoded)
+		assert.Equal(t, etag, notModified.Headers["ETag"])
+		assert.Equal(t, response.Headers["Cache-Control"], notModified.Headers["Cache-Control"])
+	})
+
+	t.Run("Weak match is 304 too", func(t *testing.T) {
+		notModified, err := handler(context.Background(), newRequest(params, map[string]string{"If-None-Match": `"other", W/` + etag}))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusNotModified, notModified.StatusCode)
+	})
+
+	t.Run("Stale If-None-Match gets the image", func(t *testing.T) {
+		stale, err := handler(context.Background(), newRequest(params, map[string]string{"If-None-Match": `"stale"`}))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, stale.StatusCode)
+		assert.NotEmpty(t, stale.Body)
+	})
+
+	t.Run("Fallback has no validator", func(t *testing.T) {
+		placeholder := newImageOrigin(t, 50, 50)
+		t.Setenv("PLACEHOLDER_URL", placeholder.URL)
+		setupHandler(t)
+		failing := newFailingOrigin(t, http.StatusNotFound)
+
+		fallback, err := handler(context.Background(), newRequest(map[string]string{"url": failing.URL, "w": "100"},
+			map[string]string{"If-None-Match": "*"}))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, fallback.StatusCode, "a wildcard never matches a response without a validator")
+		assert.Equal(t, "placeholder", fallback.Headers["X-Image-Fallback"])
+		assert.NotContains(t, fallback.Headers, "ETag")
+		assert.NotEmpty(t, fallback.Body)
+	})
+}
+
+func TestHandler_Head(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	setupHandler(t)
+	origin := newImageOrigin(t, 400, 200)
+	request := newRequest(map[string]string{"url": origin.URL, "w": "100", "f": "jpeg"}, nil)
+	request.HTTPMethod = http.MethodHead
+
+	response, err := handler(context.Background(), request)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Empty(t, response.Body)
+	assert.False(t, response.IsBase64Encoded)
+	assert.Equal(t, "image/jpeg", response.Headers["Content-Type"])
+	assert.Equal(t, helpers.CacheControl(31536000), response.Headers["Cache-Control"])
+	assert.Equal(t, strconv.Itoa(len(origin.image)), response.Headers["X-Source-Bytes"])
+	assert.Equal(t, []string{http.MethodHead}, origin.requestMethods(), "the source is never downloaded")
+
+	t.Run("Failed source has no body either", func(t *testing.T) {
+		failing := newFailingOrigin(t, http.StatusNotFound)
+		request := newRequest(map[string]string{"url": failing.URL}, nil)
+		request.HTTPMethod = http.MethodHead
+
+		response, err := handler(context.Background(), request)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadGateway, response.StatusCode)
+		assert.Empty(t, response.Body)
+	})
+}
+
+func TestHandler_FallbackCacheHeaders(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	placeholder := newImageOrigin(t, 50, 50)
+	failing := newFailingOrigin(t, http.StatusNotFound)
+
+	tests := []struct {
+		name                 string
+		ttl                  string
+		placeholderUrl       string
+		expectedStatus       int
+		expectedCacheControl string
+		expectedFallback     string
+	}{
+		{name: "Placeholder", ttl: "45", placeholderUrl: placeholder.URL, expectedStatus: http.StatusOK,
+			expectedCacheControl: "public, max-age=45, s-maxage=45", expectedFallback: "placeholder"},
+		{name: "Default TTL", placeholderUrl: placeholder.URL, expectedStatus: http.StatusOK,
+			expectedCacheControl: "public, max-age=30, s-maxage=30", expectedFallback: "placeholder"},
+		{name: "Placeholder uncached", ttl: "0", placeholderUrl: placeholder.URL, expectedStatus: http.StatusOK,
+			expectedCacheControl: "no-store", expectedFallback: "placeholder"},
+		{name: "Error without placeholder", ttl: "45", expectedStatus: http.StatusBadGateway,
+			expectedCacheControl: "public, max-age=45, s-maxage=45"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("FALLBACK_CACHE_TTL", tt.ttl)
+			t.Setenv("PLACEHOLDER_URL", tt.placeholderUrl)
+			setupHandler(t)
+
+			response, err := handler(context.Background(), newRequest(map[string]string{"url": failing.URL, "w": "100"}, nil))
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedStatus, response.StatusCode)
+			assert.Equal(t, tt.expectedCacheControl, response.Headers["Cache-Control"])
+			assert.Equal(t, tt.expectedFallback, response.Headers["X-Image-Fallback"])
+		})
+	}
+}
+
+func TestHandler_AvifFallback(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	t.Setenv("OUTPUT_FORMATS", "webp,avif,jpeg")
+	setupHandler(t)
+	defer libs.SetAvifSupportedForTesting(false)()
+	origin := newImageOrigin(t, 400, 200)
+
+	response, err := handler(context.Background(), newRequest(map[string]string{"url": origin.URL, "w": "100", "f": "avif"}, nil))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "image/webp", response.Headers["Content-Type"])
+	assert.Equal(t, "webp", response.Headers["X-Output-Format"])
+	assert.Equal(t, "avif", response.Headers["X-Format-Fallback"])
+
+	require.True(t, response.IsBase64Encoded)
+	body, err := base64.StdEncoding.DecodeString(response.Body)
+	require.NoError(t, err)
+	output, err := vips.NewImageFromBuffer(body, nil)
+	require.NoError(t, err)
+	defer output.Close()
+	assert.Equal(t, vips.ImageTypeWebp, output.Format())
+
+	t.Run("HEAD reports the fallback format", func(t *testing.T) {
+		request := newRequest(map[string]string{"url": origin.URL, "w": "100", "f": "avif"}, nil)
+		request.HTTPMethod = http.MethodHead
+
+		response, err := handler(context.Background(), request)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+		assert.Equal(t, "image/webp", response.Headers["Content-Type"])
+	})
+}
+
+func TestHandler_Seed(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping integration test in short mode")
+	}
+
+	t.Setenv("VARIANTS_BUCKET", "test-variants")
+	t.Setenv("SEED_MAX_ITEMS", "2")
+	setupHandler(t)
+	trusted := map[string]string{"imgop-trusted-key": testTrustedKey}
+	seedRequest := func(body string, headers map[string]string) events.APIGatewayProxyRequest {
+		request := newRequest(map[string]string{"seed": "1"}, headers)
+		request.HTTPMethod = http.MethodPost
+		request.Body = body
+		return request
+	}
+
+	t.Run("Untrusted is not found", func(t *testing.T) {
+		response, err := handler(context.Background(), seedRequest(`{"items":[{"url":"https://test.com/a.jpg"}]}`, nil))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusNotFound, response.StatusCode)
+	})
+
+	t.Run("Batch over SEED_MAX_ITEMS", func(t *testing.T) {
+		response, err := handler(context.Background(), seedRequest(`{"items":[{"url":"a"},{"url":"b"},{"url":"c"}]}`, trusted))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusUnprocessableEntity, response.StatusCode)
+		assert.Contains(t, response.Body, helpers.ErrCodeInvalidSeed)
+	})
+
+	t.Run("Outcome per item", func(t *testing.T) {
+		body := base64.StdEncoding.EncodeToString([]byte(`{"items":[{"url":"https://test.com/a.jpg","w":"wide"},{"w":"400"}]}`))
+		request := seedRequest(body, trusted)
+		request.IsBase64Encoded = true
+
+		response, err := handler(context.Background(), request)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, response.StatusCode)
+
+		var summary seedSummary
+		require.NoError(t, json.Unmarshal([]byte(response.Body), &summary))
+		assert.Equal(t, 0, summary.Seeded)
+		assert.Equal(t, 2, summary.Failed)
+		require.Len(t, summary.Items, 2)
+		assert.Equal(t, map[string]string{"url": "https://test.com/a.jpg", "w": "wide"}, summary.Items[0].Params, "in request order, without the store param")
+		for _, item := range summary.Items {
+			assert.Equal(t, http.StatusUnprocessableEntity, item.Status)
+			var errBody helpers.ErrorResponse
+			require.NoError(t, json.Unmarshal(item.Result, &errBody))
+			assert.NotEmpty(t, errBody.Error.Code)
+		}
+	})
+
+	t.Run("Requires VARIANTS_BUCKET", func(t *testing.T) {
+		t.Setenv("VARIANTS_BUCKET", "")
+		helpers.ResetAppEnvForTesting()
+
+		response, err := handler(context.Background(), seedRequest(`{"items":[{"url":"https://test.com/a.jpg"}]}`, trusted))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusUnprocessableEntity, response.StatusCode)
+	})
+}